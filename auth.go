@@ -0,0 +1,68 @@
+// Copyright 2018 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// authorize tells whether r carries the credentials required by the
+// configuration, answering 401 if it doesn't. Must be called with the lock
+// held.
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request) bool {
+	auth := s.cfg.Web.Auth
+	if auth == nil {
+		return true
+	}
+
+	if auth.Token != "" {
+		header := r.Header.Get("Authorization")
+		if strings.HasPrefix(header, "Bearer ") && secureCompare(header[len("Bearer "):], string(auth.Token)) {
+			return true
+		}
+	}
+	if auth.Username != "" {
+		username, password, ok := r.BasicAuth()
+		// Compare both to not tell which one is wrong through timing.
+		validUsername := secureCompare(username, auth.Username)
+		validPassword := secureCompare(password, string(auth.Password))
+		if ok && validUsername && validPassword {
+			return true
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="graphite-remote-adapter"`)
+	}
+
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	return false
+}
+
+// secureCompare compares a and b in constant time.
+func secureCompare(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// withMetricsAuth protects the telemetry handler h if the configuration
+// asks for it.
+func (s *Server) withMetricsAuth(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.lock.RLock()
+		authorized := s.cfg.Web.Auth == nil || !s.cfg.Web.Auth.ProtectMetrics || s.authorize(w, r)
+		s.lock.RUnlock()
+		if authorized {
+			h.ServeHTTP(w, r)
+		}
+	})
+}
@@ -0,0 +1,123 @@
+// Copyright 2018 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/criteo/graphite-remote-adapter/client"
+	"github.com/criteo/graphite-remote-adapter/config"
+)
+
+func authServer(t *testing.T, auth string) *Server {
+	cfg := &config.Config{}
+	require.NoError(t, yaml.Unmarshal([]byte(auth), cfg))
+	return &Server{
+		cfg:     cfg,
+		writers: []client.Writer{&fakeStorage{}},
+	}
+}
+
+func TestWriteAuth(t *testing.T) {
+	server := authServer(t, `
+web:
+  auth:
+    username: prometheus
+    password: s3cret
+    token: t0ken
+`)
+
+	tests := []struct {
+		name     string
+		setAuth  func(r *http.Request)
+		expected int
+	}{
+		{"no credentials", func(r *http.Request) {}, http.StatusUnauthorized},
+		{"basic auth", func(r *http.Request) { r.SetBasicAuth("prometheus", "s3cret") }, http.StatusOK},
+		{"wrong password", func(r *http.Request) { r.SetBasicAuth("prometheus", "wrong") }, http.StatusUnauthorized},
+		{"wrong username", func(r *http.Request) { r.SetBasicAuth("grafana", "s3cret") }, http.StatusUnauthorized},
+		{"bearer token", func(r *http.Request) { r.Header.Set("Authorization", "Bearer t0ken") }, http.StatusOK},
+		{"wrong token", func(r *http.Request) { r.Header.Set("Authorization", "Bearer wrong") }, http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		r := writeRequest(t)
+		test.setAuth(r)
+		w := httptest.NewRecorder()
+		server.Write(log.NewNopLogger(), w, r)
+		require.Equal(t, test.expected, w.Code, test.name)
+		if test.expected == http.StatusUnauthorized {
+			require.Contains(t, w.Header().Get("WWW-Authenticate"), "Basic", test.name)
+		}
+	}
+}
+
+func TestWriteNoAuth(t *testing.T) {
+	server := &Server{
+		cfg:     &config.DefaultConfig,
+		writers: []client.Writer{&fakeStorage{}},
+	}
+	w := httptest.NewRecorder()
+	server.Write(log.NewNopLogger(), w, writeRequest(t))
+	require.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestMetricsAuth(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	server := authServer(t, `
+web:
+  auth:
+    token: t0ken
+`)
+	w := httptest.NewRecorder()
+	server.withMetricsAuth(handler).ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	server = authServer(t, `
+web:
+  auth:
+    token: t0ken
+    protect_metrics: true
+`)
+	w = httptest.NewRecorder()
+	server.withMetricsAuth(handler).ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestStatusAuth(t *testing.T) {
+	server := authServer(t, `
+web:
+  auth:
+    username: prometheus
+    password: s3cret
+`)
+
+	w := httptest.NewRecorder()
+	server.Status(w, httptest.NewRequest("GET", "/", nil))
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.SetBasicAuth("prometheus", "s3cret")
+	w = httptest.NewRecorder()
+	server.Status(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Contains(t, w.Body.String(), "&lt;secret&gt;")
+	require.NotContains(t, w.Body.String(), "s3cret")
+}
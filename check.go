@@ -0,0 +1,82 @@
+// Copyright 2018 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v2"
+
+	"github.com/criteo/graphite-remote-adapter/client/graphite"
+	"github.com/criteo/graphite-remote-adapter/config"
+)
+
+// checkConfig loads the configuration, compiling the rules, and prints the
+// paths of the sample metrics if any.
+func checkConfig(cliCfg *config.Config, logger log.Logger, w io.Writer) error {
+	source := "file " + cliCfg.ConfigFile
+	switch {
+	case cliCfg.ConfigFile == "" && cliCfg.ConfigDir == "":
+		return fmt.Errorf("check-config requires --config.file or --config.dir")
+	case cliCfg.ConfigFile == "":
+		source = "directory " + cliCfg.ConfigDir
+	case cliCfg.ConfigDir != "":
+		source += " with directory " + cliCfg.ConfigDir
+	}
+	cfg, err := loadConfig(cliCfg, logger)
+	if err != nil {
+		return fmt.Errorf("invalid config %s: %s", source, err)
+	}
+	fmt.Fprintf(w, "Config %s is valid\n", source)
+	for _, warning := range cfg.Graphite.Write.Lint() {
+		fmt.Fprintf(w, "warning: %s\n", warning)
+	}
+
+	if cliCfg.CheckSamplesFile == "" {
+		return nil
+	}
+	content, err := ioutil.ReadFile(cliCfg.CheckSamplesFile)
+	if err != nil {
+		return err
+	}
+	var samples []model.Metric
+	if err := yaml.Unmarshal(content, &samples); err != nil {
+		return fmt.Errorf("invalid samples file %s: %s", cliCfg.CheckSamplesFile, err)
+	}
+
+	failed := 0
+	for _, m := range samples {
+		fmt.Fprintln(w, m)
+		paths, err := graphite.CheckPaths(cfg, m)
+		if err != nil {
+			fmt.Fprintf(w, "  error: %s\n", err)
+			failed++
+			continue
+		}
+		if len(paths) == 0 {
+			fmt.Fprintln(w, "  dropped")
+		}
+		for _, path := range paths {
+			fmt.Fprintf(w, "  %s\n", path)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d samples failed", failed, len(samples))
+	}
+	return nil
+}
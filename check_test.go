@@ -0,0 +1,131 @@
+// Copyright 2018 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+
+	"github.com/criteo/graphite-remote-adapter/config"
+)
+
+const checkSamples = `
+- __name__: test
+  owner: team-X
+- __name__: test
+  owner: team-Y
+- __name__: test
+  owner: team-Z
+`
+
+func tempFile(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "check")
+	require.NoError(t, err)
+	defer f.Close()
+	_, err = f.WriteString(content)
+	require.NoError(t, err)
+	return f.Name()
+}
+
+func TestCheckConfig(t *testing.T) {
+	cfgFile := tempFile(t, `
+graphite:
+  default_prefix: prefix.
+  write:
+    rules:
+    - match:
+        owner: team-X
+      template: 'teams.{{.labels.owner}}'
+      continue: false
+    - match:
+        owner: team-Z
+      action: drop
+`)
+	defer os.Remove(cfgFile)
+	samplesFile := tempFile(t, checkSamples)
+	defer os.Remove(samplesFile)
+
+	var out bytes.Buffer
+	cliCfg := &config.Config{ConfigFile: cfgFile, CheckSamplesFile: samplesFile}
+	require.NoError(t, checkConfig(cliCfg, log.NewNopLogger(), &out))
+	require.Equal(t, "Config file "+cfgFile+" is valid\n"+
+		"test{owner=\"team-X\"}\n  teams.team-X\n"+
+		"test{owner=\"team-Y\"}\n  prefix.test.owner.team-Y\n"+
+		"test{owner=\"team-Z\"}\n  dropped\n", out.String())
+}
+
+func TestCheckConfigBrokenTemplate(t *testing.T) {
+	cfgFile := tempFile(t, `
+graphite:
+  write:
+    rules:
+    - match:
+        owner: team-X
+      template: 'teams.{{.labels.owner'
+`)
+	defer os.Remove(cfgFile)
+
+	var out bytes.Buffer
+	cliCfg := &config.Config{ConfigFile: cfgFile}
+	require.Error(t, checkConfig(cliCfg, log.NewNopLogger(), &out))
+	require.Empty(t, out.String())
+}
+
+func TestCheckConfigFailingTemplate(t *testing.T) {
+	// Compiles fine but can't be executed: owner is a string.
+	cfgFile := tempFile(t, `
+graphite:
+  write:
+    rules:
+    - match:
+        owner: team-X
+      template: 'teams.{{.labels.owner.name}}'
+`)
+	defer os.Remove(cfgFile)
+	samplesFile := tempFile(t, checkSamples)
+	defer os.Remove(samplesFile)
+
+	var out bytes.Buffer
+	cliCfg := &config.Config{ConfigFile: cfgFile, CheckSamplesFile: samplesFile}
+	err := checkConfig(cliCfg, log.NewNopLogger(), &out)
+	require.EqualError(t, err, "1 of 3 samples failed")
+	require.Contains(t, out.String(), "error: error executing template")
+}
+
+func TestCheckConfigWarnings(t *testing.T) {
+	cfgFile := tempFile(t, `
+graphite:
+  write:
+    rules:
+    - match:
+        owner: team-X
+      continue: false
+    - match:
+        owner: team-X
+        env: prod
+      template: 'teams.{{.labels.owner}}'
+`)
+	defer os.Remove(cfgFile)
+
+	var out bytes.Buffer
+	cliCfg := &config.Config{ConfigFile: cfgFile}
+	require.NoError(t, checkConfig(cliCfg, log.NewNopLogger(), &out))
+	require.Equal(t, "Config file "+cfgFile+" is valid\n"+
+		"warning: rule 1 is unreachable: rule 0 matches all its metrics and doesn't continue\n", out.String())
+}
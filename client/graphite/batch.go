@@ -0,0 +1,170 @@
+// Copyright 2018 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphite
+
+import (
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// batcher coalesces the points of successive writes into batches of size
+// points. Partial batches are flushed every flush interval.
+//
+// The points of a write are acknowledged once it returns without error. When
+// a batch fails, those of the failing write are dropped for Prometheus to
+// retry them and those already acknowledged are kept for the next batch.
+type batcher struct {
+	lock    sync.Mutex
+	size    int
+	pending []pendingPoint
+	flush   func([]dataPoint) error
+	logger  log.Logger
+
+	quit chan struct{}
+	done chan struct{}
+}
+
+// pendingPoint is a point waiting in the batcher, along with the write which
+// added it.
+type pendingPoint struct {
+	point dataPoint
+	write *batchWrite
+}
+
+// batchWrite identifies a call to add. It isn't empty so that each has its
+// own address.
+type batchWrite struct {
+	_ byte
+}
+
+func newBatcher(size int, interval time.Duration, flush func([]dataPoint) error, logger log.Logger) *batcher {
+	b := &batcher{
+		size:   size,
+		flush:  flush,
+		logger: logger,
+		quit:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go b.loop(interval)
+	return b
+}
+
+// add queues points, flushing the full batches. It returns the first error
+// met while flushing, the points of the write then being dropped.
+func (b *batcher) add(points []dataPoint) error {
+	write := &batchWrite{}
+	b.lock.Lock()
+	for _, p := range points {
+		b.pending = append(b.pending, pendingPoint{point: p, write: write})
+	}
+	var batches [][]pendingPoint
+	for len(b.pending) >= b.size {
+		batches = append(batches, b.pending[:b.size:b.size])
+		b.pending = b.pending[b.size:]
+	}
+	b.lock.Unlock()
+
+	// Carbon may be slow, don't hold the other writes meanwhile.
+	var err error
+	var failed []pendingPoint
+	for _, batch := range batches {
+		if flushErr := b.flushBatch(batch, "size"); flushErr != nil {
+			if err == nil {
+				err = flushErr
+			}
+			failed = append(failed, batch...)
+		}
+	}
+	if err != nil {
+		b.requeue(failed, write)
+	}
+	return err
+}
+
+// flushPending flushes the partial batch, if any, for the given reason.
+func (b *batcher) flushPending(reason string) error {
+	b.lock.Lock()
+	batch := b.pending
+	b.pending = nil
+	b.lock.Unlock()
+
+	if len(batch) == 0 {
+		return nil
+	}
+	err := b.flushBatch(batch, reason)
+	if err != nil {
+		b.requeue(batch, nil)
+	}
+	return err
+}
+
+// requeue puts back the points of a failed batch in front of the pending
+// ones, except those of the failing write which are dropped altogether.
+func (b *batcher) requeue(failed []pendingPoint, failing *batchWrite) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	kept := make([]pendingPoint, 0, len(failed)+len(b.pending))
+	for _, p := range failed {
+		if p.write != failing {
+			kept = append(kept, p)
+		}
+	}
+	for _, p := range b.pending {
+		if p.write != failing {
+			kept = append(kept, p)
+		}
+	}
+	b.pending = kept
+}
+
+// flushBatch flushes points, accounting for the flush and its reason.
+func (b *batcher) flushBatch(batch []pendingPoint, reason string) error {
+	points := make([]dataPoint, len(batch))
+	for i, p := range batch {
+		points[i] = p.point
+	}
+	batchFlushes.WithLabelValues(reason).Inc()
+	batchFlushPoints.Observe(float64(len(points)))
+	return b.flush(points)
+}
+
+func (b *batcher) loop(interval time.Duration) {
+	defer close(b.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := b.flushPending("interval"); err != nil {
+				level.Warn(b.logger).Log("err", err, "msg", "Error flushing partial batch")
+			}
+		case <-b.quit:
+			return
+		}
+	}
+}
+
+// stop stops the periodic flushes and flushes the partial batch.
+func (b *batcher) stop() {
+	close(b.quit)
+	<-b.done
+	if err := b.flushPending("shutdown"); err != nil {
+		level.Warn(b.logger).Log("err", err, "msg", "Error flushing partial batch")
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright 2018 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphite
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+)
+
+// recordFlushes returns a flush func recording the batches.
+func recordFlushes() (func([]dataPoint) error, func() [][]dataPoint) {
+	var lock sync.Mutex
+	var batches [][]dataPoint
+	flush := func(points []dataPoint) error {
+		lock.Lock()
+		defer lock.Unlock()
+		batches = append(batches, append([]dataPoint{}, points...))
+		return nil
+	}
+	flushed := func() [][]dataPoint {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([][]dataPoint{}, batches...)
+	}
+	return flush, flushed
+}
+
+func TestBatcherFlushesFullBatches(t *testing.T) {
+	flush, flushed := recordFlushes()
+	b := newBatcher(3, time.Hour, flush, log.NewNopLogger())
+	defer b.stop()
+
+	points := []dataPoint{{path: "a"}, {path: "b"}, {path: "c"}, {path: "d"}, {path: "e"}, {path: "f"}, {path: "g"}}
+	require.NoError(t, b.add(points[:2]))
+	require.Empty(t, flushed())
+
+	require.NoError(t, b.add(points[2:]))
+	require.Equal(t, [][]dataPoint{points[:3], points[3:6]}, flushed())
+}
+
+func TestBatcherFlushesPartialBatchesOnInterval(t *testing.T) {
+	flush, flushed := recordFlushes()
+	b := newBatcher(100, 50*time.Millisecond, flush, log.NewNopLogger())
+	defer b.stop()
+
+	points := []dataPoint{{path: "a"}, {path: "b"}}
+	require.NoError(t, b.add(points))
+	require.Empty(t, flushed())
+
+	deadline := time.Now().Add(time.Second)
+	for len(flushed()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Equal(t, [][]dataPoint{points}, flushed())
+}
+
+func TestBatcherFlushesOnStop(t *testing.T) {
+	flush, flushed := recordFlushes()
+	b := newBatcher(100, time.Hour, flush, log.NewNopLogger())
+
+	points := []dataPoint{{path: "a"}}
+	require.NoError(t, b.add(points))
+	b.stop()
+	require.Equal(t, [][]dataPoint{points}, flushed())
+}
+
+func TestBatcherFlushMetrics(t *testing.T) {
+	histogram := func() (uint64, float64) {
+		var m dto.Metric
+		require.NoError(t, batchFlushPoints.Write(&m))
+		return m.GetHistogram().GetSampleCount(), m.GetHistogram().GetSampleSum()
+	}
+	count, sum := histogram()
+	sizeFlushes := counterValue(t, batchFlushes.WithLabelValues("size"))
+	shutdownFlushes := counterValue(t, batchFlushes.WithLabelValues("shutdown"))
+
+	flush, _ := recordFlushes()
+	b := newBatcher(3, time.Hour, flush, log.NewNopLogger())
+	require.NoError(t, b.add([]dataPoint{{path: "a"}, {path: "b"}, {path: "c"}, {path: "d"}, {path: "e"}}))
+	b.stop()
+
+	newCount, newSum := histogram()
+	require.Equal(t, count+2, newCount)
+	require.Equal(t, sum+5, newSum)
+	require.Equal(t, sizeFlushes+1, counterValue(t, batchFlushes.WithLabelValues("size")))
+	require.Equal(t, shutdownFlushes+1, counterValue(t, batchFlushes.WithLabelValues("shutdown")))
+}
+
+func TestBatcherKeepsAcknowledgedPointsOnFailure(t *testing.T) {
+	var lock sync.Mutex
+	var batches [][]dataPoint
+	errDown := errors.New("carbon is down")
+	fail := true
+	flush := func(points []dataPoint) error {
+		lock.Lock()
+		defer lock.Unlock()
+		if fail {
+			return errDown
+		}
+		batches = append(batches, append([]dataPoint{}, points...))
+		return nil
+	}
+	b := newBatcher(3, time.Hour, flush, log.NewNopLogger())
+	defer b.stop()
+
+	// a and b are acknowledged, the write of c, d, e and f fails: they are
+	// dropped for Prometheus to retry them.
+	require.NoError(t, b.add([]dataPoint{{path: "a"}, {path: "b"}}))
+	require.Equal(t, errDown, b.add([]dataPoint{{path: "c"}, {path: "d"}, {path: "e"}, {path: "f"}}))
+
+	lock.Lock()
+	fail = false
+	lock.Unlock()
+	require.NoError(t, b.add([]dataPoint{{path: "c"}, {path: "d"}, {path: "e"}, {path: "f"}}))
+	require.Equal(t, [][]dataPoint{
+		{{path: "a"}, {path: "b"}, {path: "c"}},
+		{{path: "d"}, {path: "e"}, {path: "f"}},
+	}, batches)
+}
+
+func TestBatcherFlushesOutsideTheLock(t *testing.T) {
+	release := make(chan struct{})
+	flushing := make(chan struct{}, 1)
+	flush := func(points []dataPoint) error {
+		flushing <- struct{}{}
+		<-release
+		return nil
+	}
+	b := newBatcher(1, time.Hour, flush, log.NewNopLogger())
+
+	go b.add([]dataPoint{{path: "a"}})
+	<-flushing
+	// Another write isn't blocked by the slow flush.
+	b.lock.Lock()
+	b.lock.Unlock()
+	close(release)
+	b.stop()
+}
@@ -0,0 +1,203 @@
+// Copyright 2018 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphite
+
+import (
+	"crypto/tls"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/prometheus/config"
+	"github.com/prometheus/prometheus/util/httputil"
+)
+
+// make it mockable in tests
+var dialCarbon = net.DialTimeout
+
+// destination is a carbon server the points are sent to.
+type destination struct {
+	address string
+	// instance names the destination on the consistent hash ring.
+	instance string
+	pool     *carbonPool
+	spool    *spool
+}
+
+// splitInstance splits the optional carbon instance name off address, written
+// host:port:instance as in the carbon-relay destinations. The instance
+// defaults to the address.
+func splitInstance(address string) (string, string) {
+	i := strings.LastIndex(address, ":")
+	if i < 0 || !strings.Contains(address[:i], ":") {
+		return address, address
+	}
+	if _, err := strconv.Atoi(address[i+1:]); err == nil {
+		// An IPv6 address.
+		return address, address
+	}
+	return address[:i], address[i+1:]
+}
+
+// carbonConn is a slot of the carbon connection pool. The connection to
+// address is established lazily and dropped on error.
+type carbonConn struct {
+	address       string
+	conn          net.Conn
+	lastReconnect time.Time
+}
+
+// carbonPool holds a fixed number of connections to a carbon server. A writer
+// takes a connection for the duration of a batch and puts it back afterwards.
+type carbonPool struct {
+	size  int
+	conns chan *carbonConn
+}
+
+func newCarbonPool(address string, size int) *carbonPool {
+	p := &carbonPool{
+		size:  size,
+		conns: make(chan *carbonConn, size),
+	}
+	for i := 0; i < size; i++ {
+		p.conns <- &carbonConn{address: address}
+	}
+	carbonPoolSize.Set(float64(size))
+	return p
+}
+
+// get blocks until a connection is available.
+func (p *carbonPool) get() *carbonConn {
+	cc := <-p.conns
+	carbonPoolInUse.Inc()
+	return cc
+}
+
+func (p *carbonPool) put(cc *carbonConn) {
+	carbonPoolInUse.Dec()
+	p.conns <- cc
+}
+
+// close waits for all connections to be put back and closes them.
+func (p *carbonPool) close() {
+	for i := 0; i < p.size; i++ {
+		cc := <-p.conns
+		if cc.conn != nil {
+			cc.conn.Close()
+		}
+		cc.conn = nil
+	}
+}
+
+func (c *Client) connectToCarbon(cc *carbonConn) (net.Conn, error) {
+	if cc.conn != nil {
+		if time.Since(cc.lastReconnect) < c.cfg.Write.CarbonReconnectInterval {
+			// Last reconnect is not too long ago, re-use the connection.
+			return cc.conn, nil
+		}
+		level.Debug(c.logger).Log(
+			"last", cc.lastReconnect,
+			"msg", "Reinitializing the connection to carbon")
+		c.disconnectFromCarbon(cc)
+	}
+
+	level.Debug(c.logger).Log(
+		"transport", c.cfg.Write.CarbonTransport,
+		"address", cc.address,
+		"timeout", c.cfg.Write.DialTimeout,
+		"msg", "Connecting to carbon")
+	if !cc.lastReconnect.IsZero() {
+		// Only connections replacing a previous one are reconnects.
+		carbonReconnects.Inc()
+	}
+	conn, err := c.dial(cc.address)
+	if err != nil {
+		cc.conn = nil
+	} else {
+		cc.lastReconnect = time.Now()
+		cc.conn = conn
+	}
+
+	return cc.conn, err
+}
+
+// dial opens a new connection to the carbon server at address, performing the
+// TLS and websocket handshakes when needed.
+func (c *Client) dial(address string) (net.Conn, error) {
+	network := c.cfg.Write.CarbonTransport
+	tlsConfig := c.cfg.Write.TLS
+
+	var wsURL *url.URL
+	if network == "websocket" {
+		u, err := url.Parse(address)
+		if err != nil {
+			return nil, err
+		}
+		wsURL = u
+		network, address = "tcp", urlAddress(u)
+		if u.Scheme == "wss" && tlsConfig == nil {
+			tlsConfig = &config.TLSConfig{}
+		}
+	}
+
+	conn, err := dialCarbon(network, address, c.cfg.Write.DialTimeout)
+	if err == nil && tlsConfig != nil {
+		conn, err = c.tlsHandshake(conn, address, tlsConfig)
+	}
+	if err == nil && wsURL != nil {
+		wsConn, wsErr := websocketHandshake(conn, wsURL, c.cfg.Write.DialTimeout)
+		if wsErr != nil {
+			conn.Close()
+		}
+		conn, err = wsConn, wsErr
+	}
+	return conn, err
+}
+
+// tlsHandshake wraps conn in a TLS client connection and performs the
+// handshake, so that certificate errors are reported when connecting.
+func (c *Client) tlsHandshake(conn net.Conn, address string, cfg *config.TLSConfig) (net.Conn, error) {
+	tlsConfig, err := httputil.NewTLSConfig(*cfg)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if tlsConfig.ServerName == "" {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		tlsConfig.ServerName = host
+	}
+
+	tlsConn := tls.Client(conn, tlsConfig)
+	tlsConn.SetDeadline(time.Now().Add(c.cfg.Write.DialTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+func (c *Client) disconnectFromCarbon(cc *carbonConn) {
+	if cc.conn != nil {
+		cc.conn.Close()
+	}
+	cc.conn = nil
+}
@@ -0,0 +1,309 @@
+// Copyright 2018 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphite
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+
+	"github.com/criteo/graphite-remote-adapter/client/graphite/config"
+)
+
+// fakeCarbon is a tcp listener recording the connections and lines it receives.
+type fakeCarbon struct {
+	listener net.Listener
+
+	lock  sync.Mutex
+	conns int
+	lines []string
+}
+
+func newFakeCarbon(t *testing.T) *fakeCarbon {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	f := &fakeCarbon{listener: l}
+	go f.serve()
+	return f
+}
+
+func (f *fakeCarbon) serve() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		f.lock.Lock()
+		f.conns++
+		f.lock.Unlock()
+		go func(conn net.Conn) {
+			defer conn.Close()
+			scanner := bufio.NewScanner(conn)
+			for scanner.Scan() {
+				f.lock.Lock()
+				f.lines = append(f.lines, scanner.Text())
+				f.lock.Unlock()
+			}
+		}(conn)
+	}
+}
+
+func (f *fakeCarbon) address() string {
+	return f.listener.Addr().String()
+}
+
+func (f *fakeCarbon) close() {
+	f.listener.Close()
+}
+
+func (f *fakeCarbon) accepted() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.conns
+}
+
+func (f *fakeCarbon) received() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]string{}, f.lines...)
+}
+
+// waitFor polls cond until it's true or fails the test after a second.
+func waitFor(t *testing.T, cond func() bool) {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); {
+		if cond() {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("condition not met before deadline")
+}
+
+func newTestCarbonClient(address string, poolSize int) *Client {
+	return &Client{
+		logger: log.NewNopLogger(),
+		cfg: &config.Config{
+			Write: config.WriteConfig{
+				CarbonAddress:           config.CarbonAddresses{address},
+				CarbonTransport:         "tcp",
+				CarbonProtocol:          "plaintext",
+				CarbonReconnectInterval: time.Hour,
+				DialTimeout:             time.Second,
+				WriteTimeout:            time.Second,
+			},
+		},
+		format:         FormatCarbon,
+		ignoredSamples: prometheus.NewCounter(prometheus.CounterOpts{Name: "ignored"}),
+		destinations: []*destination{
+			{address: address, pool: newCarbonPool(address, poolSize)},
+		},
+	}
+}
+
+var testSamples = model.Samples{
+	{Metric: model.Metric{model.MetricNameLabel: "test"}, Value: 1, Timestamp: 1000},
+}
+
+func TestCarbonPoolFanOut(t *testing.T) {
+	carbon := newFakeCarbon(t)
+	defer carbon.close()
+	c := newTestCarbonClient(carbon.address(), 3)
+	defer c.Shutdown()
+
+	// Concurrent writers each hold their own connection.
+	conns := make([]*carbonConn, 3)
+	for i := range conns {
+		conns[i] = c.destinations[0].pool.get()
+		_, err := c.connectToCarbon(conns[i])
+		require.NoError(t, err)
+	}
+	for _, cc := range conns {
+		c.destinations[0].pool.put(cc)
+	}
+	waitFor(t, func() bool { return carbon.accepted() == 3 })
+
+	// Further writes re-use the pooled connections.
+	r, _ := http.NewRequest("POST", "http://fakeHost:6666", nil)
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		go func() {
+			errs <- c.Write(testSamples, r)
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		require.NoError(t, <-errs)
+	}
+	waitFor(t, func() bool { return len(carbon.received()) == 10 })
+	require.Equal(t, 3, carbon.accepted())
+}
+
+func TestCarbonPoolEvictsBrokenConnection(t *testing.T) {
+	carbon := newFakeCarbon(t)
+	defer carbon.close()
+	c := newTestCarbonClient(carbon.address(), 3)
+	defer c.Shutdown()
+
+	reconnects := counterValue(t, carbonReconnects)
+	conns := make([]*carbonConn, 3)
+	for i := range conns {
+		conns[i] = c.destinations[0].pool.get()
+		_, err := c.connectToCarbon(conns[i])
+		require.NoError(t, err)
+	}
+	// The first connections aren't reconnects.
+	require.Equal(t, reconnects, counterValue(t, carbonReconnects))
+	// Break the first connection, it's the next one to be picked.
+	broken, remote := net.Pipe()
+	remote.Close()
+	healthy := []net.Conn{conns[1].conn, conns[2].conn}
+	conns[0].conn = broken
+	for _, cc := range conns {
+		c.destinations[0].pool.put(cc)
+	}
+
+	r, _ := http.NewRequest("POST", "http://fakeHost:6666", nil)
+	require.Error(t, c.Write(testSamples, r))
+	require.Nil(t, conns[0].conn)
+	require.Equal(t, healthy, []net.Conn{conns[1].conn, conns[2].conn})
+
+	// Healthy connections are still used, the broken one is replaced lazily.
+	require.NoError(t, c.Write(testSamples, r))
+	require.NoError(t, c.Write(testSamples, r))
+	require.Equal(t, 3, carbon.accepted())
+	require.NoError(t, c.Write(testSamples, r))
+	waitFor(t, func() bool { return carbon.accepted() == 4 })
+	require.Equal(t, reconnects+1, counterValue(t, carbonReconnects))
+}
+
+// newTestFanOutClient returns a client writing to all the given addresses.
+func newTestFanOutClient(policy string, addresses ...string) *Client {
+	c := newTestCarbonClient(addresses[0], 1)
+	c.cfg.Write.CarbonAddress = addresses
+	c.cfg.Write.FanoutPolicy = policy
+	c.destinations = nil
+	for _, address := range addresses {
+		c.destinations = append(c.destinations, &destination{address: address, pool: newCarbonPool(address, 1)})
+	}
+	return c
+}
+
+func TestWriteFanOut(t *testing.T) {
+	primary, analytics := newFakeCarbon(t), newFakeCarbon(t)
+	defer primary.close()
+	defer analytics.close()
+
+	c := newTestFanOutClient("all_must_succeed", primary.address(), analytics.address())
+	defer c.Shutdown()
+
+	r, _ := http.NewRequest("POST", "/write", nil)
+	require.NoError(t, c.Write(testSamples, r))
+	waitFor(t, func() bool { return len(primary.received()) == 1 && len(analytics.received()) == 1 })
+	require.Equal(t, []string{"test 1.000000 1.000000"}, primary.received())
+	require.Equal(t, []string{"test 1.000000 1.000000"}, analytics.received())
+	require.Equal(t, float64(1), counterValue(t, destinationWrites.WithLabelValues(primary.address(), "success")))
+	require.Equal(t, float64(1), counterValue(t, destinationWrites.WithLabelValues(analytics.address(), "success")))
+}
+
+func TestWriteRoutedByRule(t *testing.T) {
+	a, b := newFakeCarbon(t), newFakeCarbon(t)
+	defer a.close()
+	defer b.close()
+
+	cfg := loadTestConfig(fmt.Sprintf(`
+write:
+  carbon_address: ['%s', '%s']
+  destinations:
+    cluster-a: '%s'
+    cluster-b: '%s'
+  default_destination: cluster-b
+  rules:
+  - match:
+      owner: team-X
+    template: 'teams.x.{{.labels.__name__}}'
+    destination: cluster-a
+    continue: false`, a.address(), b.address(), a.address(), b.address()))
+	require.NotNil(t, cfg)
+
+	c := newTestFanOutClient("all_must_succeed", a.address(), b.address())
+	c.cfg.Write.Destinations = cfg.Write.Destinations
+	c.cfg.Write.DefaultDestination = cfg.Write.DefaultDestination
+	c.cfg.Write.Rules = cfg.Write.Rules
+	c.ruleRoutes = map[string]int{"cluster-a": 0, "cluster-b": 1}
+	defer c.Shutdown()
+
+	samples := model.Samples{
+		{Metric: model.Metric{model.MetricNameLabel: "test", "owner": "team-X"}, Value: 1, Timestamp: 1000},
+		{Metric: model.Metric{model.MetricNameLabel: "test", "owner": "team-Y"}, Value: 2, Timestamp: 1000},
+	}
+	r, _ := http.NewRequest("POST", "/write", nil)
+	require.NoError(t, c.Write(samples, r))
+	waitFor(t, func() bool { return len(a.received()) == 1 && len(b.received()) == 1 })
+	require.Equal(t, []string{"teams.x.test 1.000000 1.000000"}, a.received())
+	require.Equal(t, []string{"test.owner.team-Y 2.000000 1.000000"}, b.received())
+}
+
+func TestWriteShadow(t *testing.T) {
+	primary, shadow, down := newFakeCarbon(t), newFakeCarbon(t), newFakeCarbon(t)
+	defer primary.close()
+	defer shadow.close()
+	down.close()
+
+	c := newTestCarbonClient(primary.address(), 1)
+	for _, address := range []string{shadow.address(), down.address()} {
+		c.shadows = append(c.shadows, &destination{address: address, pool: newCarbonPool(address, 1)})
+	}
+	defer c.Shutdown()
+
+	// The shadow which is down doesn't fail the write.
+	r, _ := http.NewRequest("POST", "/write", nil)
+	require.NoError(t, c.Write(testSamples, r))
+	waitFor(t, func() bool { return len(primary.received()) == 1 && len(shadow.received()) == 1 })
+	require.Equal(t, []string{"test 1.000000 1.000000"}, shadow.received())
+	require.Equal(t, float64(1), counterValue(t, shadowWrites.WithLabelValues(shadow.address(), "success")))
+	require.Equal(t, float64(1), counterValue(t, shadowWrites.WithLabelValues(down.address(), "failure")))
+	require.Equal(t, float64(0), counterValue(t, destinationWrites.WithLabelValues(down.address(), "failure")))
+}
+
+func TestWriteFanOutPolicy(t *testing.T) {
+	up, down := newFakeCarbon(t), newFakeCarbon(t)
+	defer up.close()
+	down.close()
+
+	r, _ := http.NewRequest("POST", "/write", nil)
+	c := newTestFanOutClient("all_must_succeed", up.address(), down.address())
+	require.Error(t, c.Write(testSamples, r))
+	c.Shutdown()
+	waitFor(t, func() bool { return len(up.received()) == 1 })
+	require.Equal(t, float64(1), counterValue(t, destinationWrites.WithLabelValues(down.address(), "failure")))
+
+	c = newTestFanOutClient("any", up.address(), down.address())
+	require.NoError(t, c.Write(testSamples, r))
+	c.Shutdown()
+	waitFor(t, func() bool { return len(up.received()) == 2 })
+	require.Equal(t, float64(2), counterValue(t, destinationWrites.WithLabelValues(down.address(), "failure")))
+
+	// All of them failing fails the write whatever the policy.
+	c = newTestFanOutClient("any", down.address(), down.address())
+	require.Error(t, c.Write(testSamples, r))
+	c.Shutdown()
+}
@@ -0,0 +1,100 @@
+// Copyright 2018 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphite
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	promconfig "github.com/prometheus/prometheus/config"
+)
+
+// newFakeTLSCarbon starts a fakeCarbon behind TLS with a self-signed
+// certificate, and returns the path of the PEM encoded certificate.
+func newFakeTLSCarbon(t *testing.T) (*fakeCarbon, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "carbon"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	f, err := ioutil.TempFile("", "carbon-ca")
+	require.NoError(t, err)
+	require.NoError(t, pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	f.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	carbon := &fakeCarbon{listener: tls.NewListener(l, &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	})}
+	go carbon.serve()
+	return carbon, f.Name()
+}
+
+func TestWriteOverTLS(t *testing.T) {
+	carbon, caFile := newFakeTLSCarbon(t)
+	defer carbon.close()
+	defer os.Remove(caFile)
+
+	c := newTestCarbonClient(carbon.address(), 1)
+	c.cfg.Write.TLS = &promconfig.TLSConfig{CAFile: caFile}
+	defer c.Shutdown()
+
+	r, _ := http.NewRequest("POST", "http://fakeHost:6666", nil)
+	require.NoError(t, c.Write(testSamples, r))
+	waitFor(t, func() bool { return len(carbon.received()) == len(testSamples) })
+	require.Equal(t, "test 1.000000 1.000000", carbon.received()[0])
+}
+
+func TestWriteOverTLSUnknownAuthority(t *testing.T) {
+	carbon, caFile := newFakeTLSCarbon(t)
+	defer carbon.close()
+	defer os.Remove(caFile)
+
+	// The self-signed certificate isn't trusted without its CA.
+	c := newTestCarbonClient(carbon.address(), 1)
+	c.cfg.Write.TLS = &promconfig.TLSConfig{}
+	defer c.Shutdown()
+
+	r, _ := http.NewRequest("POST", "http://fakeHost:6666", nil)
+	err := c.Write(testSamples, r)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "certificate")
+	require.Empty(t, carbon.received())
+}
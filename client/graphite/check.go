@@ -0,0 +1,44 @@
+// Copyright 2018 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphite
+
+import (
+	"fmt"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/criteo/graphite-remote-adapter/config"
+)
+
+// CheckPaths returns the paths the write rules of cfg generate for metric,
+// failing if a template can't be executed.
+func CheckPaths(cfg *config.Config, metric model.Metric) ([]string, error) {
+	paths, _, err := ExplainPaths(cfg, metric)
+	return paths, err
+}
+
+// ExplainPaths returns the paths the write rules of cfg generate for metric
+// and the indexes of the rules it matched, failing if a template can't be
+// executed.
+func ExplainPaths(cfg *config.Config, metric model.Metric) ([]string, []int, error) {
+	if metric = relabelMetric(metric, &cfg.Graphite.Write); metric == nil {
+		return nil, nil, nil
+	}
+	format := formatFromConfig(&cfg.Graphite)
+	paths, rules, err := computePaths(metric, nil, format, cfg.Graphite.DefaultPrefix, &cfg.Graphite.Write)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error executing template for %s: %s", metric, err)
+	}
+	return paths, rules, nil
+}
@@ -18,6 +18,7 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"path/filepath"
 	"sync"
 	"time"
 
@@ -25,39 +26,52 @@ import (
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
+	"golang.org/x/time/rate"
 
 	graphiteCfg "github.com/criteo/graphite-remote-adapter/client/graphite/config"
 	"github.com/criteo/graphite-remote-adapter/config"
 )
 
 const (
-	expandEndpoint  = "/metrics/expand"
-	renderEndpoint  = "/render/"
-	maxFetchWorkers = 10
+	expandEndpoint = "/metrics/expand"
+	renderEndpoint = "/render/"
 )
 
 // Client allows sending batches of Prometheus samples to Graphite.
 type Client struct {
 	lock           sync.RWMutex
 	cfg            *graphiteCfg.Config
-	writeTimeout   time.Duration
 	readTimeout    time.Duration
 	readDelay      time.Duration
 	ignoredSamples prometheus.Counter
 	format         Format
-
-	carbonCon               net.Conn
-	carbonLastReconnectTime time.Time
-	carbonConLock           sync.Mutex
+	destinations   []*destination
+	shadows        []*destination
+	ring           *hashRing
+	ruleRoutes     map[string]int
+	readCache      *readCache
+	metadataCache  *readCache
+	batcher        *batcher
+	heartbeat      *heartbeat
+	dedup          *dedupSet
+	deltas         *deltaTracker
+	limiter        *rate.Limiter
+	dryRunLogger   *sampledLogger
+	httpClient     *http.Client
+	ingestClient   *http.Client
+	quit           chan struct{}
+	done           chan struct{}
+	shutdown       sync.Once
 
 	logger log.Logger
 }
 
 // NewClient returns a new Client.
 func NewClient(cfg *config.Config, logger log.Logger) *Client {
-	if cfg.Graphite.Write.CarbonAddress == "" && cfg.Graphite.Read.URL == "" {
+	if len(cfg.Graphite.Write.CarbonAddress) == 0 && cfg.Graphite.Read.URL == "" {
 		return nil
 	}
+	// Paths cached by a previous client may come from other rules.
 	if cfg.Graphite.Write.EnablePathsCache {
 		initPathsCache(cfg.Graphite.Write.PathsCacheTTL,
 			cfg.Graphite.Write.PathsCachePurgeInterval)
@@ -65,25 +79,20 @@ func NewClient(cfg *config.Config, logger log.Logger) *Client {
 			"PathsCacheTTL", cfg.Graphite.Write.PathsCacheTTL,
 			"PathsCachePurgeInterval", cfg.Graphite.Write.PathsCachePurgeInterval,
 			"msg", "Paths cache initialized")
+	} else {
+		pathsCacheEnabled = false
 	}
 
-	// Which format are we using to write points?
-	format := FormatCarbon
-	if cfg.Graphite.EnableTags {
-		if cfg.Graphite.UseOpenMetricsFormat {
-			format = FormatCarbonOpenMetrics
-		} else {
-			format = FormatCarbonTags
-		}
-	}
+	unmatchedLogger = newSampledLogger(logger, cfg.Graphite.Write.LogSampleUnmatched)
+
+	format := formatFromConfig(&cfg.Graphite)
 
-	return &Client{
-		logger:       logger,
-		cfg:          &cfg.Graphite,
-		writeTimeout: cfg.Write.Timeout,
-		format:       format,
-		readTimeout:  cfg.Read.Timeout,
-		readDelay:    cfg.Read.Delay,
+	c := &Client{
+		logger:      logger,
+		cfg:         &cfg.Graphite,
+		format:      format,
+		readTimeout: cfg.Read.Timeout,
+		readDelay:   cfg.Read.Delay,
 		ignoredSamples: prometheus.NewCounter(
 			prometheus.CounterOpts{
 				Namespace: "remote_adapter_graphite",
@@ -91,17 +100,187 @@ func NewClient(cfg *config.Config, logger log.Logger) *Client {
 				Help:      "The total number of samples not sent to Graphite due to unsupported float values (Inf, -Inf, NaN).",
 			},
 		),
-		carbonCon:               nil,
-		carbonLastReconnectTime: time.Time{},
-		carbonConLock:           sync.Mutex{},
+		httpClient: newHTTPClient(&cfg.Graphite.Read),
+	}
+	if cfg.Graphite.Write.CarbonTransport == "http" {
+		c.ingestClient = newIngestHTTPClient(&cfg.Graphite.Write)
+	}
+
+	consistentHash := cfg.Graphite.Write.Routing == "consistent_hash"
+	var instances []string
+	for _, address := range cfg.Graphite.Write.CarbonAddress {
+		instance := address
+		if consistentHash {
+			address, instance = splitInstance(address)
+		}
+		c.destinations = append(c.destinations, &destination{
+			address:  address,
+			instance: instance,
+			pool:     newCarbonPool(address, cfg.Graphite.Write.CarbonPoolSize),
+		})
+		instances = append(instances, instance)
+	}
+	if consistentHash {
+		c.ring = newHashRing(instances)
+	}
+	if len(cfg.Graphite.Write.Destinations) > 0 {
+		c.ruleRoutes = make(map[string]int, len(cfg.Graphite.Write.Destinations))
+		for name, address := range cfg.Graphite.Write.Destinations {
+			for i, d := range c.destinations {
+				if d.address == address {
+					c.ruleRoutes[name] = i
+					break
+				}
+			}
+		}
+	}
+	for _, address := range cfg.Graphite.Write.Shadow {
+		c.shadows = append(c.shadows, &destination{
+			address: address,
+			pool:    newCarbonPool(address, cfg.Graphite.Write.CarbonPoolSize),
+		})
+	}
+
+	if cfg.Graphite.Read.CacheTTL > 0 {
+		c.readCache = newReadCache(cfg.Graphite.Read.CacheTTL, cfg.Graphite.Read.CacheSize)
+	}
+	if cfg.Graphite.Read.MetadataCacheTTL > 0 {
+		c.metadataCache = newReadCache(cfg.Graphite.Read.MetadataCacheTTL, cfg.Graphite.Read.CacheSize)
+	}
+
+	if n := cfg.Graphite.Write.MaxLinesPerSecond; n > 0 {
+		c.limiter = rate.NewLimiter(rate.Limit(n), n)
+	}
+
+	if cfg.Graphite.Write.Dedup {
+		c.dedup = newDedupSet(cfg.Graphite.Write.DedupWindow)
+	}
+
+	if cfg.Graphite.Write.CounterDelta {
+		c.deltas = newDeltaTracker(cfg.Graphite.Write.CounterDeltaMaxPaths)
+	}
+
+	if cfg.Graphite.Write.BatchSize > 0 {
+		c.batcher = newBatcher(cfg.Graphite.Write.BatchSize, cfg.Graphite.Write.FlushInterval, c.flush, logger)
+	}
+
+	if interval := cfg.Graphite.Write.HeartbeatInterval; interval > 0 && len(c.destinations) > 0 {
+		c.heartbeat = newHeartbeat(cfg.Graphite.Write.HeartbeatPath, interval, c.flush, logger)
+	}
+
+	if cfg.Graphite.Write.DryRun {
+		c.dryRunLogger = newSampledLogger(logger, cfg.Graphite.Write.DryRunLogSample)
+	}
+
+	// Nothing is sent in dry run mode, not even the spool of a previous run.
+	if cfg.Graphite.Write.SpoolDir != "" && !cfg.Graphite.Write.DryRun {
+		spooling := false
+		for _, d := range c.destinations {
+			dir := cfg.Graphite.Write.SpoolDir
+			if len(c.destinations) > 1 {
+				// Each destination replays its own failed writes.
+				dir = filepath.Join(dir, spoolDirName(d.address))
+			}
+			spool, err := newSpool(dir, d.address, cfg.Graphite.Write.SpoolMaxSize, logger)
+			if err != nil {
+				level.Error(logger).Log(
+					"dir", dir, "err", err,
+					"msg", "Error initializing spool, failed writes won't be spooled")
+				continue
+			}
+			d.spool = spool
+			spooling = true
+		}
+		if spooling {
+			c.quit = make(chan struct{})
+			c.done = make(chan struct{})
+			go c.replaySpoolLoop()
+		}
+	}
+
+	return c
+}
+
+// newHTTPClient returns the client querying graphite-web.
+func newHTTPClient(readCfg *graphiteCfg.ReadConfig) *http.Client {
+	cfg := &readCfg.HTTP
+	proxy := http.ProxyFromEnvironment
+	if cfg.ProxyURL != "" {
+		// Validated with the configuration.
+		u, _ := url.Parse(cfg.ProxyURL)
+		proxy = http.ProxyURL(u)
+	}
+	var rt http.RoundTripper = &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          cfg.MaxIdleConns,
+		MaxIdleConnsPerHost:   cfg.MaxIdleConnsPerHost,
+		IdleConnTimeout:       cfg.IdleConnTimeout,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	if readCfg.Auth != nil {
+		rt = &authRoundTripper{auth: readCfg.Auth, rt: rt}
+	}
+	return &http.Client{Timeout: cfg.Timeout, Transport: rt}
+}
+
+// formatFromConfig tells which format we are using to write points.
+func formatFromConfig(cfg *graphiteCfg.Config) Format {
+	if cfg.UseInfluxLineProtocol {
+		return FormatInfluxLineProtocol
+	}
+	if cfg.EnableTags {
+		if cfg.UseOpenMetricsFormat {
+			return FormatCarbonOpenMetrics
+		}
+		return FormatCarbonTags
 	}
+	return FormatCarbon
 }
 
-// Shutdowns the client.
+// replaySpoolLoop periodically replays the spool until the client is shut down.
+func (c *Client) replaySpoolLoop() {
+	defer close(c.done)
+
+	ticker := time.NewTicker(c.cfg.Write.SpoolReplayInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.replaySpool()
+		case <-c.quit:
+			return
+		}
+	}
+}
+
+// Shutdowns the client. The client being both a writer and a reader, it may
+// be called more than once.
 func (c *Client) Shutdown() {
-	c.carbonConLock.Lock()
-	defer c.carbonConLock.Unlock()
-	c.disconnectFromCarbon()
+	c.shutdown.Do(func() {
+		if c.heartbeat != nil {
+			c.heartbeat.stop()
+		}
+		if c.batcher != nil {
+			c.batcher.stop()
+		}
+		if c.quit != nil {
+			close(c.quit)
+			<-c.done
+			// Last chance to send the spool, e.g. written by the batcher.
+			c.replaySpool()
+		}
+		for _, d := range c.destinations {
+			d.pool.close()
+		}
+		for _, d := range c.shadows {
+			d.pool.close()
+		}
+	})
 }
 
 // Name implements the client.Client interface.
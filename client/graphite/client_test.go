@@ -14,12 +14,19 @@
 package graphite
 
 import (
+	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/criteo/graphite-remote-adapter/client/graphite/config"
+	"github.com/criteo/graphite-remote-adapter/utils"
 	"github.com/go-kit/kit/log"
+	"golang.org/x/net/context"
 )
 
 var (
@@ -54,3 +61,108 @@ func TestGetCustomGraphitePrefix(t *testing.T) {
 		t.Errorf("Expected %s, got %s", expectedPrefix, actualPrefix)
 	}
 }
+
+func TestHTTPClientTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+	u, _ := url.Parse(server.URL)
+
+	cfg := config.DefaultConfig.Read
+	cfg.HTTP.Timeout = 50 * time.Millisecond
+	begin := time.Now()
+	_, err := utils.FetchURL(context.Background(), newHTTPClient(&cfg), log.NewNopLogger(), u)
+	if err == nil {
+		t.Fatal("Expected the request to time out")
+	}
+	if elapsed := time.Since(begin); elapsed > time.Second {
+		t.Errorf("Request took %s, expected it to time out after 50ms", elapsed)
+	}
+}
+
+func TestHTTPClientProxy(t *testing.T) {
+	cfg := config.DefaultConfig.Read
+	cfg.HTTP.ProxyURL = "http://proxy:3128"
+	transport := newHTTPClient(&cfg).Transport.(*http.Transport)
+
+	req, _ := http.NewRequest("GET", "http://graphite-web/render", nil)
+	proxy, err := transport.Proxy(req)
+	if err != nil || proxy.String() != "http://proxy:3128" {
+		t.Errorf("Expected proxy http://proxy:3128, got %v (err: %v)", proxy, err)
+	}
+	if transport.MaxIdleConns != 100 || transport.IdleConnTimeout != 90*time.Second {
+		t.Errorf("Unexpected default pool settings: %d, %s", transport.MaxIdleConns, transport.IdleConnTimeout)
+	}
+}
+
+func TestHTTPClientAuth(t *testing.T) {
+	var authorization string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+	}))
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+
+	f, err := ioutil.TempFile("", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	writeSecret := func(secret string) {
+		if err := ioutil.WriteFile(f.Name(), []byte(secret+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		auth     config.AuthConfig
+		secret   string
+		expected string
+	}{
+		{
+			auth:     config.AuthConfig{Username: "guest", Password: "guest"},
+			expected: "Basic Z3Vlc3Q6Z3Vlc3Q=",
+		},
+		{
+			auth:     config.AuthConfig{Username: "guest", PasswordFile: f.Name()},
+			secret:   "guest",
+			expected: "Basic Z3Vlc3Q6Z3Vlc3Q=",
+		},
+		{
+			auth:     config.AuthConfig{Token: "s3cr3t"},
+			expected: "Bearer s3cr3t",
+		},
+		{
+			auth:     config.AuthConfig{TokenFile: f.Name()},
+			secret:   "fr0m-f1le",
+			expected: "Bearer fr0m-f1le",
+		},
+	} {
+		writeSecret(tc.secret)
+		cfg := config.DefaultConfig.Read
+		cfg.Auth = &tc.auth
+		if _, err := utils.FetchURL(context.Background(), newHTTPClient(&cfg), log.NewNopLogger(), u); err != nil {
+			t.Fatal(err)
+		}
+		if authorization != tc.expected {
+			t.Errorf("Expected Authorization %q, got %q", tc.expected, authorization)
+		}
+	}
+
+	// Token files are read on each request.
+	cfg := config.DefaultConfig.Read
+	cfg.Auth = &config.AuthConfig{TokenFile: f.Name()}
+	hc := newHTTPClient(&cfg)
+	for _, token := range []string{"old", "new"} {
+		writeSecret(token)
+		if _, err := utils.FetchURL(context.Background(), hc, log.NewNopLogger(), u); err != nil {
+			t.Fatal(err)
+		}
+		if authorization != "Bearer "+token {
+			t.Errorf("Expected Authorization %q, got %q", "Bearer "+token, authorization)
+		}
+	}
+}
@@ -18,14 +18,162 @@ func AddCommandLine(app *kingpin.Application, cfg *Config) {
 		"If set, interval used to linearly interpolate intermediate points.").
 		DurationVar(&cfg.Read.MaxPointDelta)
 
+	app.Flag("graphite.read.concurrency",
+		"Maximum number of Graphite targets fetched in parallel for a query.").
+		IntVar(&cfg.Read.Concurrency)
+
+	app.Flag("graphite.read.http-timeout",
+		"Timeout of each request to Graphite Web, 0 for none besides the read timeout.").
+		DurationVar(&cfg.Read.HTTP.Timeout)
+
+	app.Flag("graphite.read.max-idle-conns",
+		"Maximum number of idle connections kept open to Graphite Web.").
+		IntVar(&cfg.Read.HTTP.MaxIdleConns)
+
+	app.Flag("graphite.read.max-idle-conns-per-host",
+		"Maximum number of idle connections kept open to each Graphite Web host.").
+		IntVar(&cfg.Read.HTTP.MaxIdleConnsPerHost)
+
+	app.Flag("graphite.read.idle-conn-timeout",
+		"Duration after which idle connections to Graphite Web are closed.").
+		DurationVar(&cfg.Read.HTTP.IdleConnTimeout)
+
+	app.Flag("graphite.read.proxy-url",
+		"URL of the proxy to reach Graphite Web through, taken from the environment if empty.").
+		StringVar(&cfg.Read.HTTP.ProxyURL)
+
 	app.Flag("graphite.write.carbon-address",
-		"The host:port of the Graphite server to send samples to.").
-		StringVar(&cfg.Write.CarbonAddress)
+		"The host:port of the Graphite server to send samples to, repeated to send them to several servers.").
+		SetValue(&cfg.Write.CarbonAddress)
+
+	app.Flag("graphite.write.shadow",
+		"The host:port of a Graphite server getting a copy of the samples whose failures are ignored, repeatable.").
+		SetValue(&cfg.Write.Shadow)
+
+	app.Flag("graphite.write.fanout-policy",
+		"Whether all the carbon servers (all_must_succeed) or any of them must accept a write for it to succeed.").
+		EnumVar(&cfg.Write.FanoutPolicy, "all_must_succeed", "any")
+
+	app.Flag("graphite.write.routing",
+		"How points are routed to the carbon servers: fanout to all of them or consistent_hash on the path.").
+		EnumVar(&cfg.Write.Routing, "fanout", "consistent_hash")
+
+	app.Flag("graphite.write.replication-factor",
+		"Number of carbon servers each path is sent to with consistent_hash routing.").
+		IntVar(&cfg.Write.ReplicationFactor)
 
 	app.Flag("graphite.write.carbon-transport",
-		"Transport protocol to use to communicate with Graphite.").
+		"Transport protocol to use to communicate with Graphite: tcp, udp, websocket or http.").
 		StringVar(&cfg.Write.CarbonTransport)
 
+	app.Flag("graphite.write.dial-timeout",
+		"Maximum duration to establish a connection to Graphite.").
+		DurationVar(&cfg.Write.DialTimeout)
+
+	app.Flag("graphite.write.write-timeout",
+		"Maximum duration to write a batch of samples to Graphite.").
+		DurationVar(&cfg.Write.WriteTimeout)
+
+	app.Flag("graphite.write.carbon-protocol",
+		"Protocol to use to send samples to Graphite: plaintext or pickle.").
+		StringVar(&cfg.Write.CarbonProtocol)
+
+	app.Flag("graphite.write.batch-size",
+		"Number of points to coalesce before writing them to Graphite, 0 to write each request on its own.").
+		IntVar(&cfg.Write.BatchSize)
+
+	app.Flag("graphite.write.flush-interval",
+		"Maximum duration a partial batch waits before being written to Graphite.").
+		DurationVar(&cfg.Write.FlushInterval)
+
+	app.Flag("graphite.write.dedup",
+		"Drop the points written recently with the same path, timestamp and value.").
+		BoolVar(&cfg.Write.Dedup)
+
+	app.Flag("graphite.write.dedup-window",
+		"Number of recently written points remembered to drop duplicates.").
+		IntVar(&cfg.Write.DedupWindow)
+
+	app.Flag("graphite.write.dedup-last-write-wins",
+		"Only keep the last of the points of a write sharing a path and timestamp.").
+		BoolVar(&cfg.Write.DedupLastWriteWins)
+
+	app.Flag("graphite.write.max-lines-per-second",
+		"Maximum number of lines per second written to Graphite, 0 for no limit.").
+		IntVar(&cfg.Write.MaxLinesPerSecond)
+
+	app.Flag("graphite.write.throttle-timeout",
+		"Maximum duration a write waits for the rate limit before failing.").
+		DurationVar(&cfg.Write.ThrottleTimeout)
+
+	app.Flag("graphite.write.nan-handling",
+		"What to do with NaN and Inf values: skip, zero or passthrough.").
+		EnumVar(&cfg.Write.NanHandling, "skip", "zero", "passthrough")
+
+	app.Flag("graphite.write.timestamp-unit",
+		"Unit of the timestamps of carbon plaintext lines: s or ms.").
+		EnumVar(&cfg.Write.TimestampUnit, "s", "ms")
+
+	app.Flag("graphite.write.max-sample-age",
+		"Samples older than this aren't written to Graphite, 0 to write them all.").
+		DurationVar(&cfg.Write.MaxSampleAge)
+
+	app.Flag("graphite.write.max-future-skew",
+		"Samples further than this in the future are handled with the future skew policy, 0 to write them all.").
+		DurationVar(&cfg.Write.MaxFutureSkew)
+
+	app.Flag("graphite.write.future-skew-policy",
+		"What to do with samples too far in the future: drop, or clamp to write them at the current time.").
+		EnumVar(&cfg.Write.FutureSkewPolicy, "drop", "clamp")
+
+	app.Flag("graphite.write.handle-staleness",
+		"What to do with Prometheus staleness markers: drop, or end to write the staleness end value. Unset, they are handled as NaN.").
+		EnumVar(&cfg.Write.HandleStaleness, "drop", "end")
+
+	app.Flag("graphite.write.staleness-end-value",
+		"Value written for staleness markers when handle-staleness is end.").
+		Float64Var(&cfg.Write.StalenessEndValue)
+
+	app.Flag("graphite.write.max-path-length",
+		"Maximum length of the paths written, 0 for no limit.").
+		IntVar(&cfg.Write.MaxPathLength)
+
+	app.Flag("graphite.write.path-length-policy",
+		"What to do with paths longer than max-path-length: drop, truncate or hash_suffix.").
+		EnumVar(&cfg.Write.PathLengthPolicy, "drop", "truncate", "hash_suffix")
+
+	app.Flag("graphite.write.name-collision-policy",
+		"What to do with a label named like the metric in carbon paths: keep, suffix, drop or error.").
+		EnumVar(&cfg.Write.NameCollisionPolicy, "keep", "suffix", "drop", "error")
+
+	app.Flag("graphite.write.empty-label-value-policy",
+		"What to do with empty label values in default paths: skip the label, replace them with the placeholder or keep them.").
+		EnumVar(&cfg.Write.EmptyLabelValuePolicy, "skip", "placeholder", "keep")
+
+	app.Flag("graphite.write.empty-label-placeholder",
+		"Value written instead of empty label values with the placeholder policy.").
+		StringVar(&cfg.Write.EmptyLabelPlaceholder)
+
+	app.Flag("graphite.write.lowercase-tag-keys",
+		"Lowercase the tag keys of tagged and openmetrics paths.").
+		BoolVar(&cfg.Write.LowercaseTagKeys)
+
+	app.Flag("graphite.write.lowercase-tag-values",
+		"Lowercase the tag values of tagged and openmetrics paths.").
+		BoolVar(&cfg.Write.LowercaseTagValues)
+
+	app.Flag("graphite.write.normalize-label-values",
+		"Normalize label values to Unicode NFC in default paths.").
+		BoolVar(&cfg.Write.NormalizeLabelValues)
+
+	app.Flag("graphite.write.collapse-histograms",
+		"Write the series of histograms and summaries under their family name in tagged and openmetrics paths.").
+		BoolVar(&cfg.Write.CollapseHistograms)
+
+	app.Flag("graphite.write.native-histograms",
+		"What to do with native histograms: convert them to bucket, sum and count series, or drop them.").
+		EnumVar(&cfg.Write.NativeHistograms, "convert", "drop")
+
 	app.Flag("graphite.write.enable-paths-cache",
 		"Enables a cache to graphite paths lists for written metrics.").
 		BoolVar(&cfg.Write.EnablePathsCache)
@@ -38,6 +186,18 @@ func AddCommandLine(app *kingpin.Application, cfg *Config) {
 		"Duration between purges for expired items in the paths cache.").
 		DurationVar(&cfg.Write.PathsCachePurgeInterval)
 
+	app.Flag("graphite.write.log-sample-unmatched",
+		"Fraction of the metrics matching no rule or dropped by one to log, e.g. 1/1000.").
+		SetValue(&cfg.Write.LogSampleUnmatched)
+
+	app.Flag("graphite.write.dry-run",
+		"Log the lines which would be written instead of sending them to Graphite.").
+		BoolVar(&cfg.Write.DryRun)
+
+	app.Flag("graphite.write.dry-run-log-sample",
+		"Fraction of the lines to log in dry run mode, e.g. 1/100.").
+		SetValue(&cfg.Write.DryRunLogSample)
+
 	app.Flag("graphite.enable-tags",
 		"Use Graphite tags.").
 		BoolVar(&cfg.EnableTags)
@@ -15,44 +15,104 @@ package config
 
 import (
 	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
 	"regexp"
+	"strconv"
+	"strings"
 	"text/template"
+	"text/template/parse"
 	"time"
 
 	"encoding/json"
 
 	"github.com/criteo/graphite-remote-adapter/utils"
 	"github.com/prometheus/common/model"
+	promconfig "github.com/prometheus/prometheus/config"
 
 	"gopkg.in/yaml.v2"
 )
 
 // DefaultConfig is the default graphite configuration.
 var DefaultConfig = Config{
-	DefaultPrefix:        "",
-	EnableTags:           false,
-	UseOpenMetricsFormat: false,
+	DefaultPrefix:         "",
+	EnableTags:            false,
+	UseOpenMetricsFormat:  false,
+	UseInfluxLineProtocol: false,
 	Write: WriteConfig{
-		CarbonAddress:           "",
+		CarbonAddress:           nil,
+		FanoutPolicy:            "all_must_succeed",
+		Routing:                 "fanout",
+		ReplicationFactor:       1,
 		CarbonTransport:         "tcp",
+		CarbonProtocol:          "plaintext",
+		CarbonPickleBatchSize:   500,
+		NanHandling:             "skip",
+		TimestampUnit:           "s",
+		FlushInterval:           1 * time.Second,
+		DedupWindow:             100000,
+		CounterDeltaMaxPaths:    100000,
+		ThrottleTimeout:         5 * time.Second,
+		MaxRetries:              3,
+		InitialBackoff:          100 * time.Millisecond,
+		MaxBackoff:              2 * time.Second,
+		SpoolMaxSize:            1 << 30,
+		SpoolReplayInterval:     30 * time.Second,
+		HeartbeatPath:           "graphite-remote-adapter.heartbeat",
 		CarbonReconnectInterval: 1 * time.Hour,
+		PathLengthPolicy:        "drop",
+		NameCollisionPolicy:     "keep",
+		EmptyLabelValuePolicy:   "skip",
+		EmptyLabelPlaceholder:   "empty",
+		NativeHistograms:        "convert",
+		NativeHistogramSuffixes: NativeHistogramSuffixes{
+			Bucket: "_bucket",
+			Sum:    "_sum",
+			Count:  "_count",
+		},
+		FutureSkewPolicy:        "drop",
+		DialTimeout:             5 * time.Second,
+		WriteTimeout:            5 * time.Second,
+		CarbonPoolSize:          1,
+		CarbonMaxDatagramSize:   1472,
 		EnablePathsCache:        true,
 		PathsCacheTTL:           1 * time.Hour,
 		PathsCachePurgeInterval: 2 * time.Hour,
+		DryRunLogSample:         0.01,
+		Escaping: EscapingConfig{
+			Policy: utils.EscapePercent,
+		},
 	},
 	Read: ReadConfig{
 		URL:           "",
 		MaxPointDelta: time.Duration(0),
+		Concurrency:   10,
+		CacheSize:     1000,
+		// Label names and values only help autocompletion.
+		MetadataCacheTTL: 1 * time.Minute,
+		// Same as http.DefaultTransport.
+		HTTP: HTTPConfig{
+			MaxIdleConns:        100,
+			MaxIdleConnsPerHost: http.DefaultMaxIdleConnsPerHost,
+			IdleConnTimeout:     90 * time.Second,
+		},
 	},
 }
 
 // Config is the graphite configuration.
 type Config struct {
-	Write                WriteConfig `yaml:"write,omitempty" json:"write,omitempty"`
-	Read                 ReadConfig  `yaml:"read,omitempty" json:"read,omitempty"`
-	DefaultPrefix        string      `yaml:"default_prefix,omitempty" json:"default_prefix,omitempty"`
-	EnableTags           bool        `yaml:"enable_tags,omitempty" json:"enable_tags,omitempty"`
-	UseOpenMetricsFormat bool        `yaml:"openmetrics,omitempty" json:"openmetrics,omitempty"`
+	Write                 WriteConfig `yaml:"write,omitempty" json:"write,omitempty"`
+	Read                  ReadConfig  `yaml:"read,omitempty" json:"read,omitempty"`
+	DefaultPrefix         string      `yaml:"default_prefix,omitempty" json:"default_prefix,omitempty"`
+	EnableTags            bool        `yaml:"enable_tags,omitempty" json:"enable_tags,omitempty"`
+	UseOpenMetricsFormat  bool        `yaml:"openmetrics,omitempty" json:"openmetrics,omitempty"`
+	UseInfluxLineProtocol bool        `yaml:"influx_line_protocol,omitempty" json:"influx_line_protocol,omitempty"`
+	// If set, the type of the metrics sent by Prometheus in its metadata is
+	// written as the __type__ label of the OpenMetrics paths.
+	OpenMetricsTypeHints bool `yaml:"openmetrics_type_hints,omitempty" json:"openmetrics_type_hints,omitempty"`
 
 	// Catches all undefined fields and must be empty after parsing.
 	XXX map[string]interface{} `yaml:",inline" json:"-"`
@@ -73,6 +133,23 @@ func (c *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	if err := unmarshal((*plain)(c)); err != nil {
 		return err
 	}
+	if c.OpenMetricsTypeHints && !c.UseOpenMetricsFormat {
+		return fmt.Errorf("openmetrics_type_hints requires openmetrics")
+	}
+	if c.UseInfluxLineProtocol {
+		if c.EnableTags {
+			return fmt.Errorf("influx_line_protocol can't be used with enable_tags")
+		}
+		if c.Write.CarbonProtocol != "plaintext" {
+			return fmt.Errorf("influx_line_protocol requires the plaintext carbon protocol")
+		}
+		if c.Write.CarbonTransport == "http" {
+			return fmt.Errorf("influx_line_protocol isn't supported over http")
+		}
+		if c.Write.TimestampUnit != "s" {
+			return fmt.Errorf("influx_line_protocol always uses nanosecond timestamps")
+		}
+	}
 	return utils.CheckOverflow(c.XXX, "graphite config")
 }
 
@@ -82,6 +159,30 @@ type ReadConfig struct {
 	// If set, MaxPointDelta is used to linearly interpolate intermediate points.
 	// It helps support prom1.x reading metrics with larger retention than staleness delta.
 	MaxPointDelta time.Duration `yaml:"max_point_delta,omitempty" json:"max_point_delta,omitempty"`
+	// If set, series are fetched with a single render request on a glob built
+	// from the query matchers instead of expanding their paths first.
+	UseGlobTargets bool `yaml:"use_glob_targets,omitempty" json:"use_glob_targets,omitempty"`
+	// If set, simple aggregations hinted by Prometheus are computed by
+	// graphite-web render functions instead of fetching the raw series.
+	Pushdown bool `yaml:"pushdown,omitempty" json:"pushdown,omitempty"`
+	// Maximum number of targets fetched in parallel for a query.
+	Concurrency int `yaml:"concurrency,omitempty" json:"concurrency,omitempty"`
+	// If set, queries matching more than MaxSeries series are rejected
+	// before fetching them.
+	MaxSeries int `yaml:"max_series,omitempty" json:"max_series,omitempty"`
+	// If set, render responses are cached for CacheTTL, keeping at most
+	// CacheSize of them.
+	CacheTTL  time.Duration `yaml:"cache_ttl,omitempty" json:"cache_ttl,omitempty"`
+	CacheSize int           `yaml:"cache_size,omitempty" json:"cache_size,omitempty"`
+	// The responses listing label names, label values and series are cached
+	// for MetadataCacheTTL, 0 disabling the cache.
+	MetadataCacheTTL time.Duration `yaml:"metadata_cache_ttl,omitempty" json:"metadata_cache_ttl,omitempty"`
+	// HTTP configures the client querying graphite-web.
+	HTTP HTTPConfig `yaml:"http,omitempty" json:"http,omitempty"`
+	// Auth holds the credentials sent to graphite-web, if any.
+	Auth *AuthConfig `yaml:"auth,omitempty" json:"auth,omitempty"`
+	// PathPatterns parse back the paths written by templates into labels.
+	PathPatterns []*PathPattern `yaml:"path_patterns,omitempty" json:"path_patterns,omitempty"`
 
 	// Catches all undefined fields and must be empty after parsing.
 	XXX map[string]interface{} `yaml:",inline" json:"-"`
@@ -93,20 +194,170 @@ func (c *ReadConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	if err := unmarshal((*plain)(c)); err != nil {
 		return err
 	}
+	if c.Concurrency <= 0 {
+		return fmt.Errorf("read concurrency must be positive")
+	}
+	if c.CacheTTL < 0 || c.CacheSize <= 0 {
+		return fmt.Errorf("read cache TTL can't be negative and its size must be positive")
+	}
+	if c.MetadataCacheTTL < 0 {
+		return fmt.Errorf("read metadata cache TTL can't be negative")
+	}
+	if c.MaxSeries < 0 {
+		return fmt.Errorf("read max_series can't be negative")
+	}
 
 	return utils.CheckOverflow(c.XXX, "readConfig")
 }
 
+// HTTPConfig configures the HTTP client querying graphite-web.
+type HTTPConfig struct {
+	// Timeout of each request, 0 for none besides the read timeout.
+	Timeout             time.Duration `yaml:"timeout,omitempty" json:"timeout,omitempty"`
+	MaxIdleConns        int           `yaml:"max_idle_conns,omitempty" json:"max_idle_conns,omitempty"`
+	MaxIdleConnsPerHost int           `yaml:"max_idle_conns_per_host,omitempty" json:"max_idle_conns_per_host,omitempty"`
+	IdleConnTimeout     time.Duration `yaml:"idle_conn_timeout,omitempty" json:"idle_conn_timeout,omitempty"`
+	// If empty, the proxy is taken from the environment.
+	ProxyURL string `yaml:"proxy_url,omitempty" json:"proxy_url,omitempty"`
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (c *HTTPConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain HTTPConfig
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+	if c.Timeout < 0 || c.IdleConnTimeout < 0 || c.MaxIdleConns < 0 || c.MaxIdleConnsPerHost < 0 {
+		return fmt.Errorf("read http timeouts and connection counts can't be negative")
+	}
+	if c.ProxyURL != "" {
+		if _, err := url.Parse(c.ProxyURL); err != nil {
+			return fmt.Errorf("invalid read http proxy url: %s", err)
+		}
+	}
+
+	return utils.CheckOverflow(c.XXX, "httpConfig")
+}
+
+// AuthConfig holds either basic auth or bearer token credentials. Passwords
+// and tokens may be read from files, which are read again on each request.
+type AuthConfig struct {
+	Username     string            `yaml:"username,omitempty" json:"username,omitempty"`
+	Password     promconfig.Secret `yaml:"password,omitempty" json:"-"`
+	PasswordFile string            `yaml:"password_file,omitempty" json:"password_file,omitempty"`
+	Token        promconfig.Secret `yaml:"token,omitempty" json:"-"`
+	TokenFile    string            `yaml:"token_file,omitempty" json:"token_file,omitempty"`
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (c *AuthConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain AuthConfig
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+
+	basic := c.Username != "" || c.Password != "" || c.PasswordFile != ""
+	bearer := c.Token != "" || c.TokenFile != ""
+	switch {
+	case basic && bearer:
+		return fmt.Errorf("auth can't use both basic auth and a bearer token")
+	case basic && c.Username == "":
+		return fmt.Errorf("basic auth requires a username")
+	case c.Password != "" && c.PasswordFile != "":
+		return fmt.Errorf("at most one of password and password_file must be configured")
+	case c.Token != "" && c.TokenFile != "":
+		return fmt.Errorf("at most one of token and token_file must be configured")
+	case !basic && !bearer:
+		return fmt.Errorf("auth requires a username or a token")
+	}
+
+	return utils.CheckOverflow(c.XXX, "authConfig")
+}
+
 // WriteConfig is the write graphite configuration.
 type WriteConfig struct {
-	CarbonAddress           string                 `yaml:"carbon_address,omitempty" json:"carbon_address,omitempty"`
-	CarbonTransport         string                 `yaml:"carbon_transport,omitempty" json:"carbon_transport,omitempty"`
-	CarbonReconnectInterval time.Duration          `yaml:"carbon_reconnect_interval,omitempty" json:"carbon_reconnect_interval,omitempty"`
-	EnablePathsCache        bool                   `yaml:"enable_paths_cache,omitempty" json:"enable_paths_cache,omitempty"`
-	PathsCacheTTL           time.Duration          `yaml:"paths_cache_ttl,omitempty" json:"paths_cache_ttl,omitempty"`
-	PathsCachePurgeInterval time.Duration          `yaml:"paths_cache_purge_interval,omitempty" json:"paths_cache_purge_interval,omitempty"`
-	TemplateData            map[string]interface{} `yaml:"template_data,omitempty" json:"template_data,omitempty"`
-	Rules                   []*Rule                `yaml:"rules,omitempty" json:"rules,omitempty"`
+	CarbonAddress           CarbonAddresses             `yaml:"carbon_address,omitempty" json:"carbon_address,omitempty"`
+	Shadow                  CarbonAddresses             `yaml:"shadow,omitempty" json:"shadow,omitempty"`
+	FanoutPolicy            string                      `yaml:"fanout_policy,omitempty" json:"fanout_policy,omitempty"`
+	Routing                 string                      `yaml:"routing,omitempty" json:"routing,omitempty"`
+	Destinations            map[string]string           `yaml:"destinations,omitempty" json:"destinations,omitempty"`
+	DefaultDestination      string                      `yaml:"default_destination,omitempty" json:"default_destination,omitempty"`
+	ReplicationFactor       int                         `yaml:"replication_factor,omitempty" json:"replication_factor,omitempty"`
+	CarbonTransport         string                      `yaml:"carbon_transport,omitempty" json:"carbon_transport,omitempty"`
+	CarbonReconnectInterval time.Duration               `yaml:"carbon_reconnect_interval,omitempty" json:"carbon_reconnect_interval,omitempty"`
+	DialTimeout             time.Duration               `yaml:"dial_timeout,omitempty" json:"dial_timeout,omitempty"`
+	WriteTimeout            time.Duration               `yaml:"write_timeout,omitempty" json:"write_timeout,omitempty"`
+	CarbonPoolSize          int                         `yaml:"carbon_pool_size,omitempty" json:"carbon_pool_size,omitempty"`
+	CarbonMaxDatagramSize   int                         `yaml:"carbon_max_datagram_size,omitempty" json:"carbon_max_datagram_size,omitempty"`
+	CarbonProtocol          string                      `yaml:"carbon_protocol,omitempty" json:"carbon_protocol,omitempty"`
+	CarbonPickleBatchSize   int                         `yaml:"carbon_pickle_batch_size,omitempty" json:"carbon_pickle_batch_size,omitempty"`
+	BatchSize               int                         `yaml:"batch_size,omitempty" json:"batch_size,omitempty"`
+	FlushInterval           time.Duration               `yaml:"flush_interval,omitempty" json:"flush_interval,omitempty"`
+	Dedup                   bool                        `yaml:"dedup,omitempty" json:"dedup,omitempty"`
+	DedupWindow             int                         `yaml:"dedup_window,omitempty" json:"dedup_window,omitempty"`
+	DedupLastWriteWins      bool                        `yaml:"dedup_last_write_wins,omitempty" json:"dedup_last_write_wins,omitempty"`
+	TimestampDedup          string                      `yaml:"timestamp_dedup,omitempty" json:"timestamp_dedup,omitempty"`
+	CounterDelta            bool                        `yaml:"counter_delta,omitempty" json:"counter_delta,omitempty"`
+	CounterDeltaMaxPaths    int                         `yaml:"counter_delta_max_paths,omitempty" json:"counter_delta_max_paths,omitempty"`
+	MaxLinesPerSecond       int                         `yaml:"max_lines_per_second,omitempty" json:"max_lines_per_second,omitempty"`
+	ThrottleTimeout         time.Duration               `yaml:"throttle_timeout,omitempty" json:"throttle_timeout,omitempty"`
+	NanHandling             string                      `yaml:"nan_handling,omitempty" json:"nan_handling,omitempty"`
+	TimestampUnit           string                      `yaml:"timestamp_unit,omitempty" json:"timestamp_unit,omitempty"`
+	MaxSampleAge            time.Duration               `yaml:"max_sample_age,omitempty" json:"max_sample_age,omitempty"`
+	MaxFutureSkew           time.Duration               `yaml:"max_future_skew,omitempty" json:"max_future_skew,omitempty"`
+	FutureSkewPolicy        string                      `yaml:"future_skew_policy,omitempty" json:"future_skew_policy,omitempty"`
+	HandleStaleness         string                      `yaml:"handle_staleness,omitempty" json:"handle_staleness,omitempty"`
+	StalenessEndValue       float64                     `yaml:"staleness_end_value,omitempty" json:"staleness_end_value,omitempty"`
+	TLS                     *promconfig.TLSConfig       `yaml:"tls,omitempty" json:"tls,omitempty"`
+	Auth                    *AuthConfig                 `yaml:"auth,omitempty" json:"auth,omitempty"`
+	MaxRetries              int                         `yaml:"max_retries,omitempty" json:"max_retries,omitempty"`
+	InitialBackoff          time.Duration               `yaml:"initial_backoff,omitempty" json:"initial_backoff,omitempty"`
+	MaxBackoff              time.Duration               `yaml:"max_backoff,omitempty" json:"max_backoff,omitempty"`
+	SpoolDir                string                      `yaml:"spool_dir,omitempty" json:"spool_dir,omitempty"`
+	SpoolMaxSize            int64                       `yaml:"spool_max_size,omitempty" json:"spool_max_size,omitempty"`
+	SpoolReplayInterval     time.Duration               `yaml:"spool_replay_interval,omitempty" json:"spool_replay_interval,omitempty"`
+	HeartbeatInterval       time.Duration               `yaml:"heartbeat_interval,omitempty" json:"heartbeat_interval,omitempty"`
+	HeartbeatPath           string                      `yaml:"heartbeat_path,omitempty" json:"heartbeat_path,omitempty"`
+	EnablePathsCache        bool                        `yaml:"enable_paths_cache,omitempty" json:"enable_paths_cache,omitempty"`
+	PathsCacheTTL           time.Duration               `yaml:"paths_cache_ttl,omitempty" json:"paths_cache_ttl,omitempty"`
+	PathsCachePurgeInterval time.Duration               `yaml:"paths_cache_purge_interval,omitempty" json:"paths_cache_purge_interval,omitempty"`
+	Escaping                EscapingConfig              `yaml:"escaping,omitempty" json:"escaping,omitempty"`
+	MaxPathLength           int                         `yaml:"max_path_length,omitempty" json:"max_path_length,omitempty"`
+	PathLengthPolicy        string                      `yaml:"path_length_policy,omitempty" json:"path_length_policy,omitempty"`
+	NameCollisionPolicy     string                      `yaml:"name_collision_policy,omitempty" json:"name_collision_policy,omitempty"`
+	EmptyLabelValuePolicy   string                      `yaml:"empty_label_value_policy,omitempty" json:"empty_label_value_policy,omitempty"`
+	EmptyLabelPlaceholder   string                      `yaml:"empty_label_placeholder,omitempty" json:"empty_label_placeholder,omitempty"`
+	LowercaseTagKeys        bool                        `yaml:"lowercase_tag_keys,omitempty" json:"lowercase_tag_keys,omitempty"`
+	LowercaseTagValues      bool                        `yaml:"lowercase_tag_values,omitempty" json:"lowercase_tag_values,omitempty"`
+	NormalizeLabelValues    bool                        `yaml:"normalize_label_values,omitempty" json:"normalize_label_values,omitempty"`
+	CollapseHistograms      bool                        `yaml:"collapse_histograms,omitempty" json:"collapse_histograms,omitempty"`
+	NativeHistograms        string                      `yaml:"native_histograms,omitempty" json:"native_histograms,omitempty"`
+	NativeHistogramSuffixes NativeHistogramSuffixes     `yaml:"native_histogram_suffixes,omitempty" json:"native_histogram_suffixes,omitempty"`
+	LabelOrder              []model.LabelName           `yaml:"label_order,omitempty" json:"label_order,omitempty"`
+	DropLabels              []model.LabelName           `yaml:"drop_labels,omitempty" json:"drop_labels,omitempty"`
+	KeepLabels              []model.LabelName           `yaml:"keep_labels,omitempty" json:"keep_labels,omitempty"`
+	ExtraLabels             model.LabelSet              `yaml:"extra_labels,omitempty" json:"extra_labels,omitempty"`
+	ExtraLabelsInRules      bool                        `yaml:"extra_labels_in_rules,omitempty" json:"extra_labels_in_rules,omitempty"`
+	RelabelConfigs          []*promconfig.RelabelConfig `yaml:"relabel_configs,omitempty" json:"relabel_configs,omitempty"`
+	TemplateData            map[string]interface{}      `yaml:"template_data,omitempty" json:"template_data,omitempty"`
+	TemplateDataFile        string                      `yaml:"template_data_file,omitempty" json:"template_data_file,omitempty"`
+	TemplateDataAllowUnset  bool                        `yaml:"template_data_allow_unset_env,omitempty" json:"template_data_allow_unset_env,omitempty"`
+	DefaultTmpl             *Template                   `yaml:"default_template,omitempty" json:"default_template,omitempty"`
+	Prefix                  *PrefixTemplate             `yaml:"prefix,omitempty" json:"prefix,omitempty"`
+	PrefixFallback          string                      `yaml:"prefix_fallback,omitempty" json:"prefix_fallback,omitempty"`
+	Rules                   []*Rule                     `yaml:"rules,omitempty" json:"rules,omitempty"`
+	LogSampleUnmatched      SampleRate                  `yaml:"log_sample_unmatched,omitempty" json:"log_sample_unmatched,omitempty"`
+	DryRun                  bool                        `yaml:"dry_run,omitempty" json:"dry_run,omitempty"`
+	DryRunLogSample         SampleRate                  `yaml:"dry_run_log_sample,omitempty" json:"dry_run_log_sample,omitempty"`
+
+	// finalRules tells whether some rules are final.
+	finalRules bool
 
 	// Catches all undefined fields and must be empty after parsing.
 	XXX map[string]interface{} `yaml:",inline" json:"-"`
@@ -118,10 +369,417 @@ func (c *WriteConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	if err := unmarshal((*plain)(c)); err != nil {
 		return err
 	}
+	if c.Prefix != nil {
+		// Metrics without the labels of the prefix get the fallback.
+		c.Prefix.Option("missingkey=error")
+	}
+
+	if c.CarbonPoolSize <= 0 {
+		return fmt.Errorf("carbon pool size must be positive")
+	}
+	if c.DialTimeout <= 0 || c.WriteTimeout <= 0 {
+		return fmt.Errorf("dial and write timeouts must be positive")
+	}
+	// Shadow destinations use the same transport.
+	addresses := append(append(CarbonAddresses{}, c.CarbonAddress...), c.Shadow...)
+	if c.CarbonTransport == "websocket" {
+		for _, address := range addresses {
+			u, err := url.Parse(address)
+			if err != nil {
+				return fmt.Errorf("invalid carbon websocket url: %s", err)
+			}
+			if u.Scheme != "ws" && u.Scheme != "wss" {
+				return fmt.Errorf("carbon websocket url must use the ws or wss scheme: %s", address)
+			}
+		}
+	}
+	if c.CarbonTransport == "http" {
+		for _, address := range addresses {
+			u, err := url.Parse(address)
+			if err != nil {
+				return fmt.Errorf("invalid carbon http url: %s", err)
+			}
+			if u.Scheme != "http" && u.Scheme != "https" {
+				return fmt.Errorf("carbon http url must use the http or https scheme: %s", address)
+			}
+		}
+		if c.TLS != nil {
+			return fmt.Errorf("tls isn't supported over http, use an https url instead")
+		}
+	} else if c.Auth != nil {
+		return fmt.Errorf("write auth is only supported over http")
+	}
+	switch c.FanoutPolicy {
+	case "all_must_succeed", "any":
+	default:
+		return fmt.Errorf("unknown fanout policy: %s", c.FanoutPolicy)
+	}
+	switch c.Routing {
+	case "fanout":
+	case "consistent_hash":
+		if c.CarbonTransport == "websocket" || c.CarbonTransport == "http" {
+			return fmt.Errorf("consistent_hash routing isn't supported over %s", c.CarbonTransport)
+		}
+		if c.ReplicationFactor <= 0 {
+			return fmt.Errorf("replication factor must be positive")
+		}
+	default:
+		return fmt.Errorf("unknown routing: %s", c.Routing)
+	}
+	if err := c.validateDestinations(); err != nil {
+		return err
+	}
+	if c.TLS != nil && c.CarbonTransport == "udp" {
+		return fmt.Errorf("tls isn't supported over udp")
+	}
+	if c.MaxRetries < 0 || c.InitialBackoff < 0 || c.MaxBackoff < c.InitialBackoff {
+		return fmt.Errorf("invalid retry settings: max_retries can't be negative and max_backoff can't be less than initial_backoff")
+	}
+	if c.SpoolMaxSize <= 0 || c.SpoolReplayInterval <= 0 {
+		return fmt.Errorf("spool_max_size and spool_replay_interval must be positive")
+	}
+
+	switch c.CarbonProtocol {
+	case "plaintext":
+	case "pickle":
+		if c.CarbonTransport == "udp" || c.CarbonTransport == "websocket" || c.CarbonTransport == "http" {
+			return fmt.Errorf("carbon pickle protocol isn't supported over %s", c.CarbonTransport)
+		}
+		if c.CarbonPickleBatchSize <= 0 {
+			return fmt.Errorf("carbon pickle batch size must be positive")
+		}
+	default:
+		return fmt.Errorf("unknown carbon protocol: %s", c.CarbonProtocol)
+	}
+
+	switch c.NanHandling {
+	case "skip", "zero":
+	case "passthrough":
+		if c.CarbonTransport == "http" {
+			return fmt.Errorf("passthrough nan handling isn't supported over http")
+		}
+	default:
+		return fmt.Errorf("unknown nan handling: %s", c.NanHandling)
+	}
+	switch c.TimestampUnit {
+	case "s":
+	case "ms":
+		if c.CarbonProtocol != "plaintext" || c.CarbonTransport == "http" {
+			return fmt.Errorf("millisecond timestamps require the carbon plaintext protocol")
+		}
+	default:
+		return fmt.Errorf("unknown timestamp unit: %s", c.TimestampUnit)
+	}
+	seen := make(map[model.LabelName]bool, len(c.LabelOrder))
+	for _, l := range c.LabelOrder {
+		if !l.IsValid() || l == model.MetricNameLabel {
+			return fmt.Errorf("invalid label in label_order: %q", l)
+		}
+		if seen[l] {
+			return fmt.Errorf("label %s is listed twice in label_order", l)
+		}
+		seen[l] = true
+	}
+	if len(c.DropLabels) > 0 && len(c.KeepLabels) > 0 {
+		return fmt.Errorf("drop_labels and keep_labels are mutually exclusive")
+	}
+	for _, l := range append(append([]model.LabelName{}, c.DropLabels...), c.KeepLabels...) {
+		if !l.IsValid() || l == model.MetricNameLabel {
+			return fmt.Errorf("invalid label in drop_labels or keep_labels: %q", l)
+		}
+	}
+	ruleNames := make(map[string]bool, len(c.Rules))
+	c.finalRules = false
+	for _, rule := range c.Rules {
+		c.finalRules = c.finalRules || rule.Final
+		if rule.RuleName == "" {
+			continue
+		}
+		if ruleNames[rule.RuleName] {
+			return fmt.Errorf("rule name %s is used twice", rule.RuleName)
+		}
+		ruleNames[rule.RuleName] = true
+	}
+	if err := c.ExtraLabels.Validate(); err != nil {
+		return fmt.Errorf("invalid extra_labels: %s", err)
+	}
+	for ln, lv := range c.ExtraLabels {
+		if ln == model.MetricNameLabel || lv == "" {
+			return fmt.Errorf("invalid extra label %s=%q", ln, lv)
+		}
+	}
+	if c.MaxSampleAge < 0 {
+		return fmt.Errorf("max sample age can't be negative")
+	}
+	if c.MaxFutureSkew < 0 {
+		return fmt.Errorf("max future skew can't be negative")
+	}
+	switch c.FutureSkewPolicy {
+	case "drop", "clamp":
+	default:
+		return fmt.Errorf("unknown future skew policy: %s", c.FutureSkewPolicy)
+	}
+	if c.BatchSize < 0 {
+		return fmt.Errorf("batch size can't be negative")
+	}
+	if c.BatchSize > 0 && c.FlushInterval <= 0 {
+		return fmt.Errorf("flush interval must be positive when batching")
+	}
+	if c.Dedup && c.DedupWindow <= 0 {
+		return fmt.Errorf("dedup window must be positive")
+	}
+	if c.CounterDelta && c.CounterDeltaMaxPaths <= 0 {
+		return fmt.Errorf("counter delta max paths must be positive")
+	}
+	switch c.TimestampDedup {
+	case "", "max", "min", "last":
+	default:
+		return fmt.Errorf("unknown timestamp dedup policy: %s", c.TimestampDedup)
+	}
+	if c.HeartbeatInterval < 0 {
+		return fmt.Errorf("heartbeat interval can't be negative")
+	}
+	if c.HeartbeatInterval > 0 && c.HeartbeatPath == "" {
+		return fmt.Errorf("heartbeat path can't be empty")
+	}
+	if c.MaxLinesPerSecond < 0 {
+		return fmt.Errorf("max lines per second can't be negative")
+	}
+	if c.MaxLinesPerSecond > 0 && c.ThrottleTimeout <= 0 {
+		return fmt.Errorf("throttle timeout must be positive when rate limiting")
+	}
+	switch c.HandleStaleness {
+	case "", "drop", "end":
+	default:
+		return fmt.Errorf("unknown staleness handling: %s", c.HandleStaleness)
+	}
+	if math.IsNaN(c.StalenessEndValue) || math.IsInf(c.StalenessEndValue, 0) {
+		return fmt.Errorf("staleness end value must be a finite number")
+	}
+	if c.MaxPathLength < 0 {
+		return fmt.Errorf("max path length can't be negative")
+	}
+	switch c.PathLengthPolicy {
+	case "drop", "truncate":
+	case "hash_suffix":
+		if c.MaxPathLength > 0 && c.MaxPathLength <= PathHashSuffixLength {
+			return fmt.Errorf("max path length must be greater than %d with the hash_suffix policy", PathHashSuffixLength)
+		}
+	default:
+		return fmt.Errorf("unknown path length policy: %s", c.PathLengthPolicy)
+	}
+	switch c.NameCollisionPolicy {
+	case "keep", "suffix", "drop", "error":
+	default:
+		return fmt.Errorf("unknown name collision policy: %s", c.NameCollisionPolicy)
+	}
+	switch c.EmptyLabelValuePolicy {
+	case "skip", "keep":
+	case "placeholder":
+		if c.EmptyLabelPlaceholder == "" {
+			return fmt.Errorf("empty label placeholder can't be empty with the placeholder policy")
+		}
+	default:
+		return fmt.Errorf("unknown empty label value policy: %s", c.EmptyLabelValuePolicy)
+	}
+	switch c.NativeHistograms {
+	case "convert", "drop":
+	default:
+		return fmt.Errorf("unknown native histograms policy: %s", c.NativeHistograms)
+	}
+	if err := c.loadTemplateData(); err != nil {
+		return err
+	}
 
 	return utils.CheckOverflow(c.XXX, "writeConfig")
 }
 
+// validateDestinations checks that the named destinations are carbon
+// addresses, and that the rules route to known destinations.
+func (c *WriteConfig) validateDestinations() error {
+	if len(c.Destinations) > 0 && c.Routing != "fanout" {
+		return fmt.Errorf("destinations aren't supported with %s routing", c.Routing)
+	}
+	for name, address := range c.Destinations {
+		found := false
+		for _, a := range c.CarbonAddress {
+			found = found || a == address
+		}
+		if !found {
+			return fmt.Errorf("destination %s isn't a carbon address: %s", name, address)
+		}
+	}
+	if _, ok := c.Destinations[c.DefaultDestination]; c.DefaultDestination != "" && !ok {
+		return fmt.Errorf("unknown default destination: %s", c.DefaultDestination)
+	}
+	for _, rule := range c.Rules {
+		if _, ok := c.Destinations[rule.Destination]; rule.Destination != "" && !ok {
+			return fmt.Errorf("unknown rule destination: %s", rule.Destination)
+		}
+	}
+	return nil
+}
+
+// loadTemplateData merges the template_data_file into the template data, the
+// inline values taking precedence, and expands the environment variables
+// referenced by the values.
+func (c *WriteConfig) loadTemplateData() error {
+	if c.TemplateDataFile != "" {
+		content, err := ioutil.ReadFile(c.TemplateDataFile)
+		if err != nil {
+			return fmt.Errorf("error reading template data file: %s", err)
+		}
+		var data map[string]interface{}
+		if err := yaml.Unmarshal(content, &data); err != nil {
+			return fmt.Errorf("error parsing template data file %s: %s", c.TemplateDataFile, err)
+		}
+		if data != nil {
+			for k, v := range c.TemplateData {
+				data[k] = v
+			}
+			c.TemplateData = data
+		}
+	}
+
+	for k, v := range c.TemplateData {
+		expanded, err := expandEnv(v, c.TemplateDataAllowUnset)
+		if err != nil {
+			return fmt.Errorf("template data %s: %s", k, err)
+		}
+		c.TemplateData[k] = expanded
+	}
+	return nil
+}
+
+// expandEnv replaces the ${VAR} and $VAR references to environment variables
+// in the strings of v, which may be nested in maps and lists. $$ stands for a
+// literal $. Unless allowUnset, referencing an unset variable is an error.
+func expandEnv(v interface{}, allowUnset bool) (interface{}, error) {
+	switch v := v.(type) {
+	case string:
+		var unset []string
+		expanded := os.Expand(v, func(name string) string {
+			if name == "$" {
+				return "$"
+			}
+			value, ok := os.LookupEnv(name)
+			if !ok {
+				unset = append(unset, name)
+			}
+			return value
+		})
+		if len(unset) > 0 && !allowUnset {
+			return nil, fmt.Errorf("environment variables not set: %s", strings.Join(unset, ", "))
+		}
+		return expanded, nil
+	case map[interface{}]interface{}:
+		for k, child := range v {
+			expanded, err := expandEnv(child, allowUnset)
+			if err != nil {
+				return nil, err
+			}
+			v[k] = expanded
+		}
+	case []interface{}:
+		for i, child := range v {
+			expanded, err := expandEnv(child, allowUnset)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = expanded
+		}
+	}
+	return v, nil
+}
+
+// HasFinalRules tells whether some rules are final.
+func (c *WriteConfig) HasFinalRules() bool {
+	return c.finalRules
+}
+
+// RuleName returns the name of the i-th rule, its index if it has none.
+func (c *WriteConfig) RuleName(i int) string {
+	if name := c.Rules[i].RuleName; name != "" {
+		return name
+	}
+	return strconv.Itoa(i)
+}
+
+// PathHashSuffixLength is the length of the suffix replacing the end of the
+// paths too long with the hash_suffix policy.
+const PathHashSuffixLength = 9
+
+// UsesSample tells whether one of the templates uses the value or the
+// timestamp of the samples, or the metadata of the metrics.
+func (c *WriteConfig) UsesSample() bool {
+	if c.DefaultTmpl != nil && c.DefaultTmpl.UsesSample() {
+		return true
+	}
+	if c.Prefix != nil && c.Prefix.UsesSample() {
+		return true
+	}
+	for _, rule := range c.Rules {
+		if rule.Tmpl.UsesSample() {
+			return true
+		}
+	}
+	return false
+}
+
+// EscapingConfig defines how label values are escaped in default paths.
+type EscapingConfig struct {
+	Policy string `yaml:"policy,omitempty" json:"policy,omitempty"`
+	// If set, replaces dots and slashes instead of the policy.
+	Replacement string `yaml:"replacement,omitempty" json:"replacement,omitempty"`
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (c *EscapingConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain EscapingConfig
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+
+	switch c.Policy {
+	case "", utils.EscapePercent, utils.EscapeUnderscore, utils.EscapeNone:
+	default:
+		return fmt.Errorf("unknown escaping policy: %s", c.Policy)
+	}
+
+	return utils.CheckOverflow(c.XXX, "escaping")
+}
+
+// NativeHistogramSuffixes are appended to the name of native histograms to
+// name the series they are converted to.
+type NativeHistogramSuffixes struct {
+	Bucket string `yaml:"bucket,omitempty" json:"bucket,omitempty"`
+	Sum    string `yaml:"sum,omitempty" json:"sum,omitempty"`
+	Count  string `yaml:"count,omitempty" json:"count,omitempty"`
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (c *NativeHistogramSuffixes) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain NativeHistogramSuffixes
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+
+	if c.Bucket == "" || c.Sum == "" || c.Count == "" {
+		return fmt.Errorf("native histogram suffixes can't be empty")
+	}
+	if c.Bucket == c.Sum || c.Bucket == c.Count || c.Sum == c.Count {
+		return fmt.Errorf("native histogram suffixes must be distinct")
+	}
+
+	return utils.CheckOverflow(c.XXX, "native_histogram_suffixes")
+}
+
 // LabelSet pairs a LabelName to a LabelValue.
 type LabelSet map[model.LabelName]model.LabelValue
 
@@ -131,15 +789,70 @@ type LabelSetRE map[model.LabelName]Regexp
 // Rule defines a templating rule that customize graphite path using the
 // Tmpl if a metric matching the labels exists.
 type Rule struct {
-	Tmpl     Template   `yaml:"template,omitempty" json:"template,omitempty"`
-	Match    LabelSet   `yaml:"match,omitempty" json:"match,omitempty"`
-	MatchRE  LabelSetRE `yaml:"match_re,omitempty" json:"match_re,omitempty"`
-	Continue bool       `yaml:"continue,omitempty" json:"continue,omitempty"`
+	// RuleName identifies the rule in the metrics and logs, instead of its
+	// index. Name matches the metric name.
+	RuleName   string           `yaml:"rule_name,omitempty" json:"rule_name,omitempty"`
+	Tmpl       Template         `yaml:"template,omitempty" json:"template,omitempty"`
+	Name       model.LabelValue `yaml:"name,omitempty" json:"name,omitempty"`
+	NameRE     *Regexp          `yaml:"name_re,omitempty" json:"name_re,omitempty"`
+	Match      LabelSet         `yaml:"match,omitempty" json:"match,omitempty"`
+	MatchRE    LabelSetRE       `yaml:"match_re,omitempty" json:"match_re,omitempty"`
+	MatchNot   LabelSet         `yaml:"match_not,omitempty" json:"match_not,omitempty"`
+	MatchNotRE LabelSetRE       `yaml:"match_not_re,omitempty" json:"match_not_re,omitempty"`
+	Continue   bool             `yaml:"continue,omitempty" json:"continue,omitempty"`
+	Format     string           `yaml:"format,omitempty" json:"format,omitempty"`
+	Action     string           `yaml:"action,omitempty" json:"action,omitempty"`
+	Prefix     string           `yaml:"prefix,omitempty" json:"prefix,omitempty"`
+	// Final rules are only evaluated, after the others, for the metrics
+	// which matched no other rule.
+	Final bool `yaml:"final,omitempty" json:"final,omitempty"`
+	// If set, the paths written by the rule are only sent to this named
+	// destination.
+	Destination string `yaml:"destination,omitempty" json:"destination,omitempty"`
+	// If set, the values written by the rule are value*Scale+Offset.
+	Scale  *float64 `yaml:"scale,omitempty" json:"scale,omitempty"`
+	Offset float64  `yaml:"offset,omitempty" json:"offset,omitempty"`
+	// If set, the values written by the rule are then rounded to Precision
+	// decimals.
+	Precision *int `yaml:"precision,omitempty" json:"precision,omitempty"`
 
 	// Catches all undefined fields and must be empty after parsing.
 	XXX map[string]interface{} `yaml:",inline" json:"-"`
 }
 
+// MaxPrecision is the maximum number of decimals of rule precisions, beyond
+// which float64s don't hold more.
+const MaxPrecision = 15
+
+// Value returns the value the rule writes for v.
+func (r *Rule) Value(v float64) float64 {
+	return r.round(r.scale(v) + r.Offset)
+}
+
+// DeltaValue returns the value the rule writes for the difference v of two
+// values, in which the offset cancels out.
+func (r *Rule) DeltaValue(v float64) float64 {
+	return r.round(r.scale(v))
+}
+
+func (r *Rule) scale(v float64) float64 {
+	if r.Scale != nil {
+		v *= *r.Scale
+	}
+	return v
+}
+
+func (r *Rule) round(v float64) float64 {
+	if r.Precision != nil {
+		pow := math.Pow10(*r.Precision)
+		// Values this large have no decimals left to round.
+		if rounded := math.Round(v*pow) / pow; !math.IsInf(rounded, 0) {
+			v = rounded
+		}
+	}
+	return v
+}
+
 // UnmarshalYAML implements the yaml.Unmarshaler interface.
 func (r *Rule) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	type plain Rule
@@ -147,13 +860,277 @@ func (r *Rule) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		return err
 	}
 
+	switch r.Format {
+	case "", "carbon", "carbon-tags", "carbon-openmetrics":
+	default:
+		return fmt.Errorf("unknown rule format: %s", r.Format)
+	}
+	// Templated paths are written as rendered.
+	if r.Format != "" && (r.Tmpl != Template{}) {
+		return fmt.Errorf("rule format only applies to default paths, it can't be used with a template")
+	}
+	switch r.Action {
+	case "", "drop":
+	default:
+		return fmt.Errorf("unknown rule action: %s", r.Action)
+	}
+	if r.Scale != nil && (math.IsNaN(*r.Scale) || math.IsInf(*r.Scale, 0)) {
+		return fmt.Errorf("rule scale must be a finite number")
+	}
+	if math.IsNaN(r.Offset) || math.IsInf(r.Offset, 0) {
+		return fmt.Errorf("rule offset must be a finite number")
+	}
+	if r.Precision != nil && (*r.Precision < 0 || *r.Precision > MaxPrecision) {
+		return fmt.Errorf("rule precision must be between 0 and %d decimals", MaxPrecision)
+	}
+
 	return utils.CheckOverflow(r.XXX, "rule")
 }
 
-// Template is a parsable template.
+// PathPattern describes the paths written by a template, so that they can be
+// read back: each node of the pattern is either literal or a {label} whose
+// value is the node of the path. Labels holds the labels the paths don't
+// carry, like a metric name written literally.
+type PathPattern struct {
+	Pattern string   `yaml:"pattern" json:"pattern"`
+	Labels  LabelSet `yaml:"labels,omitempty" json:"labels,omitempty"`
+
+	nodes []string
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (p *PathPattern) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain PathPattern
+	if err := unmarshal((*plain)(p)); err != nil {
+		return err
+	}
+	if err := p.parse(); err != nil {
+		return err
+	}
+	return utils.CheckOverflow(p.XXX, "path pattern")
+}
+
+func (p *PathPattern) parse() error {
+	if p.Pattern == "" {
+		return fmt.Errorf("path pattern can't be empty")
+	}
+	p.nodes = strings.Split(p.Pattern, ".")
+	seen := make(map[model.LabelName]bool)
+	for _, node := range p.nodes {
+		if node == "" {
+			return fmt.Errorf("path pattern %q has an empty node", p.Pattern)
+		}
+		label, ok := PatternLabel(node)
+		if !ok {
+			continue
+		}
+		if !label.IsValid() {
+			return fmt.Errorf("path pattern %q has an invalid label %q", p.Pattern, label)
+		}
+		if _, ok := p.Labels[label]; ok || seen[label] {
+			return fmt.Errorf("path pattern %q sets the label %s twice", p.Pattern, label)
+		}
+		seen[label] = true
+	}
+	if _, ok := p.Labels[model.MetricNameLabel]; !ok && !seen[model.MetricNameLabel] {
+		return fmt.Errorf("path pattern %q doesn't set the metric name", p.Pattern)
+	}
+	return nil
+}
+
+// Nodes returns the nodes of the pattern.
+func (p *PathPattern) Nodes() []string {
+	return p.nodes
+}
+
+// PatternLabel returns the label of a {label} pattern node.
+func PatternLabel(node string) (model.LabelName, bool) {
+	if len(node) < 2 || node[0] != '{' || node[len(node)-1] != '}' {
+		return "", false
+	}
+	return model.LabelName(node[1 : len(node)-1]), true
+}
+
+// Template is a parsable template, parsed once when the configuration is
+// loaded.
 type Template struct {
 	*template.Template
 	original string
+	// usesSample tells whether the template uses the value or the
+	// timestamp of the sample, or the metadata of the metric.
+	usesSample bool
+	// usesMetricFuncs tells whether the template calls functions bound to
+	// the metric, which requires cloning it for each execution.
+	usesMetricFuncs bool
+}
+
+// NewTemplate parses s as a write template.
+func NewTemplate(s string) (Template, error) {
+	t, err := template.New("").Funcs(utils.TmplFuncMap).Parse(s)
+	if err != nil {
+		return Template{}, err
+	}
+	return Template{
+		Template:   t,
+		original:   s,
+		usesSample: templateUsesSample(t),
+		usesMetricFuncs: anyTemplateNode(t, func(n parse.Node) bool {
+			ident, ok := n.(*parse.IdentifierNode)
+			if !ok {
+				return false
+			}
+			_, ok = utils.MetricFuncs[ident.Ident]
+			return ok
+		}),
+	}, nil
+}
+
+// UsesSample tells whether the template uses .value, .timestamp or .meta,
+// and so renders a path that can change from a sample to the next.
+func (tmpl Template) UsesSample() bool {
+	return tmpl.usesSample
+}
+
+// UsesMetricFuncs tells whether the template calls one of the
+// utils.MetricFuncs.
+func (tmpl Template) UsesMetricFuncs() bool {
+	return tmpl.usesMetricFuncs
+}
+
+// templateUsesSample tells whether t or one of the templates it defines may
+// use the sample. Paths are cached unless it does, so anything which may
+// reach it counts: the fields named like the sample ones whatever their
+// receiver, and the whole data given to a function or a range.
+func templateUsesSample(t *template.Template) bool {
+	for _, tmpl := range t.Templates() {
+		// Sub-templates may be given the whole data.
+		if tmpl.Tree != nil && nodeUsesSample(tmpl.Tree.Root, true) {
+			return true
+		}
+	}
+	return false
+}
+
+// nodeUsesSample tells whether n or one of its descendants may use the
+// sample, given whether dot is the whole data.
+func nodeUsesSample(n parse.Node, dotIsData bool) bool {
+	isSampleField := func(ident []string) bool {
+		return len(ident) > 0 && (ident[0] == "value" || ident[0] == "timestamp" || ident[0] == "meta")
+	}
+	var children []parse.Node
+	switch n := n.(type) {
+	case *parse.FieldNode:
+		return isSampleField(n.Ident)
+	case *parse.VariableNode:
+		// $, $.value or $x.value
+		return (len(n.Ident) == 1 && n.Ident[0] == "$") || isSampleField(n.Ident[1:])
+	case *parse.ChainNode:
+		return isSampleField(n.Field) || nodeUsesSample(n.Node, dotIsData)
+	case *parse.DotNode:
+		return dotIsData
+	case *parse.ListNode:
+		if n == nil {
+			return false
+		}
+		children = n.Nodes
+	case *parse.ActionNode:
+		children = []parse.Node{n.Pipe}
+	case *parse.IfNode:
+		children = []parse.Node{n.Pipe, n.List, n.ElseList}
+	case *parse.RangeNode:
+		// Dot is rebound to the result of the pipeline in the list.
+		return nodeUsesSample(n.Pipe, dotIsData) || nodeUsesSample(n.List, dotIsData && isDot(n.Pipe)) ||
+			nodeUsesSample(n.ElseList, dotIsData)
+	case *parse.WithNode:
+		return nodeUsesSample(n.Pipe, dotIsData) || nodeUsesSample(n.List, dotIsData && isDot(n.Pipe)) ||
+			nodeUsesSample(n.ElseList, dotIsData)
+	case *parse.TemplateNode:
+		// The sub-templates are analyzed on their own.
+		if isDot(n.Pipe) {
+			return false
+		}
+		children = []parse.Node{n.Pipe}
+	case *parse.PipeNode:
+		if n == nil {
+			return false
+		}
+		for _, cmd := range n.Cmds {
+			children = append(children, cmd)
+		}
+	case *parse.CommandNode:
+		children = n.Args
+	}
+	for _, child := range children {
+		if nodeUsesSample(child, dotIsData) {
+			return true
+		}
+	}
+	return false
+}
+
+// isDot tells whether pipe is only dot.
+func isDot(pipe *parse.PipeNode) bool {
+	if pipe == nil || len(pipe.Decl) > 0 || len(pipe.Cmds) != 1 || len(pipe.Cmds[0].Args) != 1 {
+		return false
+	}
+	_, ok := pipe.Cmds[0].Args[0].(*parse.DotNode)
+	return ok
+}
+
+// anyTemplateNode tells whether f holds for a node of t or of one of the
+// templates it defines.
+func anyTemplateNode(t *template.Template, f func(parse.Node) bool) bool {
+	for _, tmpl := range t.Templates() {
+		if tmpl.Tree != nil && anyNode(tmpl.Tree.Root, f) {
+			return true
+		}
+	}
+	return false
+}
+
+// anyNode tells whether f holds for n or one of its descendants.
+func anyNode(n parse.Node, f func(parse.Node) bool) bool {
+	if f(n) {
+		return true
+	}
+	var children []parse.Node
+	switch n := n.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return false
+		}
+		children = n.Nodes
+	case *parse.ActionNode:
+		children = []parse.Node{n.Pipe}
+	case *parse.IfNode:
+		children = []parse.Node{n.Pipe, n.List, n.ElseList}
+	case *parse.RangeNode:
+		children = []parse.Node{n.Pipe, n.List, n.ElseList}
+	case *parse.WithNode:
+		children = []parse.Node{n.Pipe, n.List, n.ElseList}
+	case *parse.TemplateNode:
+		children = []parse.Node{n.Pipe}
+	case *parse.PipeNode:
+		if n == nil {
+			return false
+		}
+		for _, cmd := range n.Cmds {
+			children = append(children, cmd)
+		}
+	case *parse.CommandNode:
+		children = n.Args
+	case *parse.ChainNode:
+		children = []parse.Node{n.Node}
+	}
+	for _, child := range children {
+		if anyNode(child, f) {
+			return true
+		}
+	}
+	return false
 }
 
 // UnmarshalYAML implements the yaml.Unmarshaler interface.
@@ -162,12 +1139,11 @@ func (tmpl *Template) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	if err := unmarshal(&s); err != nil {
 		return err
 	}
-	template, err := template.New("").Funcs(utils.TmplFuncMap).Parse(s)
+	t, err := NewTemplate(s)
 	if err != nil {
 		return err
 	}
-	tmpl.Template = template
-	tmpl.original = s
+	*tmpl = t
 	return nil
 }
 
@@ -176,6 +1152,56 @@ func (tmpl Template) MarshalYAML() (interface{}, error) {
 	return tmpl.original, nil
 }
 
+// PrefixTemplate is the template of the write prefix. It is configured either
+// as a single template or as a list of segments joined with dots, the last one
+// being followed by a dot. Segments holding a template action are templates,
+// the environment variables referenced by the other ones are expanded once.
+type PrefixTemplate struct {
+	Template
+	segments []string
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (tmpl *PrefixTemplate) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var segments []string
+	if err := unmarshal(&segments); err != nil {
+		tmpl.segments = nil
+		return tmpl.Template.UnmarshalYAML(unmarshal)
+	}
+	if len(segments) == 0 {
+		return fmt.Errorf("prefix has no segments")
+	}
+
+	parts := make([]string, 0, len(segments))
+	for i, segment := range segments {
+		if !strings.Contains(segment, "{{") {
+			expanded, err := expandEnv(segment, false)
+			if err != nil {
+				return fmt.Errorf("prefix segment %d: %s", i, err)
+			}
+			segment = expanded.(string)
+		}
+		if strings.TrimSpace(segment) == "" {
+			return fmt.Errorf("prefix segment %d is empty", i)
+		}
+		parts = append(parts, segment)
+	}
+	t, err := NewTemplate(strings.Join(parts, ".") + ".")
+	if err != nil {
+		return err
+	}
+	tmpl.Template, tmpl.segments = t, segments
+	return nil
+}
+
+// MarshalYAML implements the yaml.Marshaler interface.
+func (tmpl PrefixTemplate) MarshalYAML() (interface{}, error) {
+	if tmpl.segments != nil {
+		return tmpl.segments, nil
+	}
+	return tmpl.Template.MarshalYAML()
+}
+
 // Regexp encapsulates a regexp.Regexp and makes it YAML marshalable.
 type Regexp struct {
 	*regexp.Regexp
@@ -207,3 +1233,98 @@ func (re Regexp) MarshalJSON() ([]byte, error) {
 	}
 	return nil, nil
 }
+
+// SampleRate is the fraction of events kept, written as "1/1000" or 0.001.
+type SampleRate float64
+
+// Set parses s into the rate. It implements the kingpin.Value interface.
+func (r *SampleRate) Set(s string) error {
+	var rate float64
+	var err error
+	if i := strings.Index(s, "/"); i >= 0 {
+		var num, den float64
+		if num, err = strconv.ParseFloat(s[:i], 64); err == nil {
+			den, err = strconv.ParseFloat(s[i+1:], 64)
+		}
+		if err == nil && den == 0 {
+			err = fmt.Errorf("division by zero")
+		}
+		rate = num / den
+	} else {
+		rate, err = strconv.ParseFloat(s, 64)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid sample rate %q: %s", s, err)
+	}
+	if rate < 0 || rate > 1 {
+		return fmt.Errorf("sample rate %q must be between 0 and 1", s)
+	}
+	*r = SampleRate(rate)
+	return nil
+}
+
+func (r SampleRate) String() string {
+	if r > 0 {
+		if n := 1 / float64(r); n == math.Trunc(n) {
+			return fmt.Sprintf("1/%d", int64(n))
+		}
+	}
+	return strconv.FormatFloat(float64(r), 'g', -1, 64)
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (r *SampleRate) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	return r.Set(s)
+}
+
+// MarshalYAML implements the yaml.Marshaler interface.
+func (r SampleRate) MarshalYAML() (interface{}, error) {
+	return r.String(), nil
+}
+
+// CarbonAddresses are the carbon destinations, written as a single address or
+// a list of them.
+type CarbonAddresses []string
+
+// Set adds an address, so that the flag can be repeated. It implements the
+// kingpin.Value interface.
+func (a *CarbonAddresses) Set(s string) error {
+	*a = append(*a, s)
+	return nil
+}
+
+// IsCumulative tells kingpin that the flag can be repeated.
+func (a *CarbonAddresses) IsCumulative() bool {
+	return true
+}
+
+func (a CarbonAddresses) String() string {
+	return strings.Join(a, ",")
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (a *CarbonAddresses) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err == nil {
+		*a = CarbonAddresses{s}
+		return nil
+	}
+	var l []string
+	if err := unmarshal(&l); err != nil {
+		return err
+	}
+	*a = CarbonAddresses(l)
+	return nil
+}
+
+// MarshalYAML implements the yaml.Marshaler interface.
+func (a CarbonAddresses) MarshalYAML() (interface{}, error) {
+	if len(a) == 1 {
+		return a[0], nil
+	}
+	return []string(a), nil
+}
@@ -15,14 +15,18 @@ package config
 
 import (
 	"io/ioutil"
+	"math"
+	"reflect"
 	"regexp"
+	"strings"
 	"testing"
-	"text/template"
 	"time"
 
+	"github.com/prometheus/common/model"
+	kingpin "gopkg.in/alecthomas/kingpin.v2"
 	yaml "gopkg.in/yaml.v2"
 
-	"github.com/criteo/graphite-remote-adapter/utils"
+	promconfig "github.com/prometheus/prometheus/config"
 )
 
 var (
@@ -30,20 +34,122 @@ var (
 		DefaultPrefix:        "test.prefix.",
 		EnableTags:           true,
 		UseOpenMetricsFormat: true,
+		OpenMetricsTypeHints: true,
 		Read: ReadConfig{
-			URL:           "greatGraphiteWebURL",
-			MaxPointDelta: 5 * time.Minute,
+			URL:              "greatGraphiteWebURL",
+			MaxPointDelta:    5 * time.Minute,
+			Concurrency:      20,
+			MaxSeries:        50000,
+			CacheTTL:         30 * time.Second,
+			CacheSize:        500,
+			MetadataCacheTTL: 5 * time.Minute,
+			HTTP: HTTPConfig{
+				Timeout:             10 * time.Second,
+				MaxIdleConns:        20,
+				MaxIdleConnsPerHost: 10,
+				IdleConnTimeout:     1 * time.Minute,
+				ProxyURL:            "http://proxy:3128",
+			},
+			Auth: &AuthConfig{
+				Username:     "guest",
+				PasswordFile: "/etc/graphite-remote-adapter/password",
+			},
+			PathPatterns: []*PathPattern{
+				{
+					Pattern: "hosts.{instance}.cpu",
+					Labels:  LabelSet{model.MetricNameLabel: "cpu"},
+					nodes:   []string{"hosts", "{instance}", "cpu"},
+				},
+			},
 		},
 		Write: WriteConfig{
-			CarbonAddress:           "greatCarbonAddress",
+			CarbonAddress:           CarbonAddresses{"greatCarbonAddress"},
+			Shadow:                  CarbonAddresses{"newCarbonAddress"},
+			FanoutPolicy:            "any",
+			Routing:                 "consistent_hash",
+			ReplicationFactor:       2,
 			CarbonTransport:         "tcp",
 			EnablePathsCache:        true,
 			CarbonReconnectInterval: 2 * time.Minute,
+			DialTimeout:             3 * time.Second,
+			WriteTimeout:            10 * time.Second,
+			CarbonPoolSize:          4,
+			CarbonMaxDatagramSize:   1400,
+			CarbonProtocol:          "pickle",
+			CarbonPickleBatchSize:   1000,
+			BatchSize:               5000,
+			FlushInterval:           2 * time.Second,
+			Dedup:                   true,
+			DedupWindow:             1000,
+			TimestampDedup:          "max",
+			CounterDelta:            true,
+			CounterDeltaMaxPaths:    5000,
+			MaxLinesPerSecond:       10000,
+			ThrottleTimeout:         1 * time.Second,
+			NanHandling:             "zero",
+			TimestampUnit:           "s",
+			MaxSampleAge:            24 * time.Hour,
+			MaxFutureSkew:           10 * time.Minute,
+			FutureSkewPolicy:        "clamp",
+			TLS: &promconfig.TLSConfig{
+				CAFile:     "/etc/ssl/carbon-ca.pem",
+				ServerName: "carbon.example.com",
+			},
+			MaxRetries:              5,
+			InitialBackoff:          1 * time.Second,
+			MaxBackoff:              1 * time.Minute,
+			SpoolDir:                "/var/spool/graphite-remote-adapter",
+			SpoolMaxSize:            1048576,
+			SpoolReplayInterval:     10 * time.Second,
+			HeartbeatInterval:       1 * time.Minute,
+			HeartbeatPath:           "adapter.heartbeat",
 			PathsCacheTTL:           18 * time.Minute,
 			PathsCachePurgeInterval: 42 * time.Minute,
+			LogSampleUnmatched:      0.01,
+			DryRunLogSample:         0.01,
+			Escaping: EscapingConfig{
+				Policy:      "underscore",
+				Replacement: "-",
+			},
+			MaxPathLength:       200,
+			PathLengthPolicy:    "hash_suffix",
+			NameCollisionPolicy: "suffix",
+			LowercaseTagKeys:    true,
+			LabelOrder:          []model.LabelName{"job", "instance"},
+			DropLabels:          []model.LabelName{"pod"},
+			ExtraLabels:         model.LabelSet{"adapter": "dc1-a"},
+			ExtraLabelsInRules:  true,
+			NativeHistograms:    "drop",
+			NativeHistogramSuffixes: NativeHistogramSuffixes{
+				Bucket: "_buckets",
+				Sum:    "_sum",
+				Count:  "_count",
+			},
+			EmptyLabelValuePolicy: "placeholder",
+			EmptyLabelPlaceholder: "none",
+			NormalizeLabelValues:  true,
+			RelabelConfigs: []*promconfig.RelabelConfig{
+				{
+					Action:      promconfig.RelabelLabelDrop,
+					Regex:       promconfig.MustNewRegexp("instance"),
+					Separator:   ";",
+					Replacement: "$1",
+				},
+			},
 			TemplateData: map[string]interface{}{
 				"site_mapping": map[string]string{"eu-par": "fr_eqx"},
 			},
+			TemplateDataAllowUnset: true,
+			DefaultTmpl: func() *Template {
+				t := prepareExpectedTemplate("unmatched.{{.labels.__name__}}")
+				return &t
+			}(),
+			Prefix: func() *PrefixTemplate {
+				t := prepareExpectedTemplate("{{.labels.dc}}.{{.prefix}}")
+				t.Option("missingkey=error")
+				return &PrefixTemplate{Template: t}
+			}(),
+			PrefixFallback: "nodc.",
 			Rules: []*Rule{
 				{
 					Match: LabelSet{
@@ -62,6 +168,9 @@ var (
 					},
 					Continue: true,
 					Tmpl:     prepareExpectedTemplate("bla.bla.{{.labels.owner | escape}}.great.path"),
+					Prefix:   "teams.",
+					Scale:    &ruleScale,
+					Offset:   -1,
 				},
 				{
 					Match: LabelSet{
@@ -75,14 +184,16 @@ var (
 	testConfigFile = "testdata/graphite.good.yml"
 )
 
+var ruleScale = 0.001
+
 func prepareExpectedRegexp(s string) Regexp {
 	r, _ := regexp.Compile("^(?:" + s + ")$")
 	return Regexp{r}
 }
 
 func prepareExpectedTemplate(s string) Template {
-	t, _ := template.New("").Funcs(utils.TmplFuncMap).Parse(s)
-	return Template{t, s}
+	t, _ := NewTemplate(s)
+	return t
 }
 
 func TestUnmarshalConfig(t *testing.T) {
@@ -98,3 +209,441 @@ func TestUnmarshalConfig(t *testing.T) {
 			"testdata/conf.good.yml", cfg.String(), expectedConf.String())
 	}
 }
+
+func TestSampleRate(t *testing.T) {
+	for s, expected := range map[string]SampleRate{
+		"1/1000": 0.001,
+		"0.25":   0.25,
+		"1":      1,
+		"0":      0,
+	} {
+		var r SampleRate
+		if err := r.Set(s); err != nil || r != expected {
+			t.Errorf("%s: expected %v, got %v (err: %v)", s, expected, r, err)
+		}
+	}
+	if s := SampleRate(0.001).String(); s != "1/1000" {
+		t.Errorf("expected 1/1000, got %s", s)
+	}
+
+	for _, s := range []string{"1/0", "2", "-0.1", "one/ten", "1/x"} {
+		var r SampleRate
+		if err := r.Set(s); err == nil {
+			t.Errorf("%s: expected an error", s)
+		}
+	}
+}
+
+func TestAuthConfig(t *testing.T) {
+	for _, invalid := range []string{
+		"{}",
+		"{username: guest, token: s3cr3t}",
+		"{password: guest}",
+		"{username: guest, password: guest, password_file: /password}",
+		"{token: s3cr3t, token_file: /token}",
+	} {
+		var auth AuthConfig
+		if err := yaml.Unmarshal([]byte(invalid), &auth); err == nil {
+			t.Errorf("%s: expected an error", invalid)
+		}
+	}
+
+	var auth AuthConfig
+	if err := yaml.Unmarshal([]byte("{username: guest, password: guest}"), &auth); err != nil {
+		t.Fatal(err)
+	}
+	out, _ := yaml.Marshal(auth)
+	if string(out) != "username: guest\npassword: <secret>\n" {
+		t.Errorf("Unexpected marshalled auth: %s", out)
+	}
+}
+
+func TestCarbonAddresses(t *testing.T) {
+	for in, expected := range map[string]CarbonAddresses{
+		"carbon_address: a:2003":                {"a:2003"},
+		`carbon_address: ["a:2003", "b:2003"]`:  {"a:2003", "b:2003"},
+		"carbon_address:\n- a:2003\n- b:2003\n": {"a:2003", "b:2003"},
+	} {
+		cfg := DefaultConfig.Write
+		if err := yaml.Unmarshal([]byte(in), &cfg); err != nil {
+			t.Fatalf("%s: %s", in, err)
+		}
+		if !reflect.DeepEqual(cfg.CarbonAddress, expected) {
+			t.Errorf("%s: expected %v, got %v", in, expected, cfg.CarbonAddress)
+		}
+		out, _ := yaml.Marshal(cfg.CarbonAddress)
+		var back CarbonAddresses
+		if err := yaml.Unmarshal(out, &back); err != nil || !reflect.DeepEqual(back, expected) {
+			t.Errorf("%s: marshalled as %s", in, out)
+		}
+	}
+}
+
+func TestPathPattern(t *testing.T) {
+	for in, valid := range map[string]bool{
+		"pattern: '{__name__}.{instance}'":                    true,
+		"pattern: 'hosts.{instance}'\nlabels: {__name__: up}": true,
+		"pattern: ''":                                     false,
+		"pattern: 'hosts..{__name__}'":                    false,
+		"pattern: 'hosts.{instance}'":                     false,
+		"pattern: '{__name__}.{in-stance}'":               false,
+		"pattern: '{__name__}.{job}.{job}'":               false,
+		"pattern: '{__name__}.{job}'\nlabels: {job: api}": false,
+	} {
+		var p PathPattern
+		if err := yaml.Unmarshal([]byte(in), &p); (err == nil) != valid {
+			t.Errorf("%s: expected valid %v, got %v", in, valid, err)
+		}
+	}
+}
+
+func TestHTTPTransport(t *testing.T) {
+	for in, valid := range map[string]bool{
+		"{carbon_transport: http, carbon_address: 'https://ingest.example.com/metrics'}":                        true,
+		"{carbon_transport: http, carbon_address: 'http://ingest:8080/metrics', auth: {token: s3cr3t}}":         true,
+		"{carbon_transport: http, carbon_address: 'carbon:2003'}":                                               false,
+		"{carbon_transport: http, carbon_address: 'https://ingest/metrics', carbon_protocol: pickle}":           false,
+		"{carbon_transport: http, carbon_address: 'https://ingest/metrics', nan_handling: passthrough}":         false,
+		"{carbon_transport: http, carbon_address: 'https://ingest/metrics', tls: {insecure_skip_verify: true}}": false,
+		"{carbon_address: 'carbon:2003', auth: {token: s3cr3t}}":                                                false,
+	} {
+		var cfg Config
+		if err := yaml.Unmarshal([]byte("write: "+in), &cfg); (err == nil) != valid {
+			t.Errorf("%s: expected valid %v, got %v", in, valid, err)
+		}
+	}
+}
+
+func TestRetrySettings(t *testing.T) {
+	for in, valid := range map[string]bool{
+		"{max_retries: 0}":                        true,
+		"{initial_backoff: 1s, max_backoff: 1s}":  true,
+		"{max_retries: -1}":                       false,
+		"{initial_backoff: -1s}":                  false,
+		"{initial_backoff: 10s, max_backoff: 1s}": false,
+	} {
+		var cfg Config
+		if err := yaml.Unmarshal([]byte("write: "+in), &cfg); (err == nil) != valid {
+			t.Errorf("%s: expected valid %v, got %v", in, valid, err)
+		}
+	}
+}
+
+func TestSpoolSettings(t *testing.T) {
+	for in, valid := range map[string]bool{
+		"{spool_dir: /tmp/spool, spool_max_size: 1024, spool_replay_interval: 5s}": true,
+		"{spool_dir: /tmp/spool, spool_replay_interval: 0s}":                       false,
+		"{spool_dir: /tmp/spool, spool_replay_interval: -5s}":                      false,
+		"{spool_dir: /tmp/spool, spool_max_size: 0}":                               false,
+		"{spool_max_size: -1}":                                                     false,
+	} {
+		var cfg Config
+		if err := yaml.Unmarshal([]byte("write: "+in), &cfg); (err == nil) != valid {
+			t.Errorf("%s: expected valid %v, got %v", in, valid, err)
+		}
+	}
+}
+
+func TestLabelOrder(t *testing.T) {
+	for in, valid := range map[string]bool{
+		"[job, instance]":    true,
+		"[job, job]":         false,
+		"[__name__, job]":    false,
+		"[job, 'in-stance']": false,
+	} {
+		var cfg Config
+		if err := yaml.Unmarshal([]byte("write: {label_order: "+in+"}"), &cfg); (err == nil) != valid {
+			t.Errorf("%s: expected valid %v, got %v", in, valid, err)
+		}
+	}
+}
+
+func TestDropKeepLabels(t *testing.T) {
+	for in, valid := range map[string]bool{
+		"{drop_labels: [pod]}":                     true,
+		"{keep_labels: [job, dc]}":                 true,
+		"{drop_labels: [pod], keep_labels: [job]}": false,
+		"{keep_labels: [__name__]}":                false,
+		"{drop_labels: ['p-od']}":                  false,
+	} {
+		var cfg Config
+		if err := yaml.Unmarshal([]byte("write: "+in), &cfg); (err == nil) != valid {
+			t.Errorf("%s: expected valid %v, got %v", in, valid, err)
+		}
+	}
+}
+
+func TestExtraLabels(t *testing.T) {
+	for in, valid := range map[string]bool{
+		"{extra_labels: {adapter: dc1-a}}":  true,
+		"{extra_labels: {__name__: up}}":    false,
+		"{extra_labels: {adapter: ''}}":     false,
+		"{extra_labels: {'ad-apter': dc1}}": false,
+	} {
+		var cfg Config
+		if err := yaml.Unmarshal([]byte("write: "+in), &cfg); (err == nil) != valid {
+			t.Errorf("%s: expected valid %v, got %v", in, valid, err)
+		}
+	}
+}
+
+func TestRuleValue(t *testing.T) {
+	for in, valid := range map[string]bool{
+		"{scale: 0.001, offset: -1}": true,
+		"{precision: 0}":             true,
+		"{precision: 15}":            true,
+		"{precision: 16}":            false,
+		"{precision: -1}":            false,
+		"{scale: .inf}":              false,
+	} {
+		var rule Rule
+		if err := yaml.Unmarshal([]byte(in), &rule); (err == nil) != valid {
+			t.Errorf("%s: expected valid %v, got %v", in, valid, err)
+		}
+	}
+
+	scale, precision := 0.001, 2
+	rule := Rule{Scale: &scale, Offset: 1, Precision: &precision}
+	if v := rule.Value(1234.5); v != 2.23 {
+		t.Errorf("expected 2.23, got %v", v)
+	}
+	// Rounding leaves the values too large for decimals alone.
+	if v := rule.Value(math.MaxFloat64); v != math.MaxFloat64*0.001+1 {
+		t.Errorf("expected %v, got %v", math.MaxFloat64*0.001+1, v)
+	}
+}
+
+func TestRuleFormat(t *testing.T) {
+	for in, valid := range map[string]bool{
+		"{format: carbon-tags}":                             true,
+		"{template: 'a.{{.labels.owner}}'}":                 true,
+		"{format: graphite}":                                false,
+		"{format: carbon, template: 'a.{{.labels.owner}}'}": false,
+	} {
+		var rule Rule
+		if err := yaml.Unmarshal([]byte(in), &rule); (err == nil) != valid {
+			t.Errorf("%s: expected valid %v, got %v", in, valid, err)
+		}
+	}
+}
+
+func TestPrefixSegments(t *testing.T) {
+	t.Setenv("TEST_DC", "par")
+	t.Setenv("TEST_EMPTY", "")
+	for in, valid := range map[string]bool{
+		"'{{.labels.dc}}.{{.prefix}}'":         true,
+		"[prod, '$TEST_DC', '{{.labels.dc}}']": true,
+		"[]":                                   false,
+		"[prod, '']":                           false,
+		"[prod, '$TEST_EMPTY']":                false,
+		"[prod, '$TEST_UNSET_DC']":             false,
+		"[prod, '{{.labels.dc']":               false,
+	} {
+		var tmpl PrefixTemplate
+		if err := yaml.Unmarshal([]byte(in), &tmpl); (err == nil) != valid {
+			t.Errorf("%s: expected valid %v, got %v", in, valid, err)
+		}
+	}
+
+	var tmpl PrefixTemplate
+	if err := yaml.Unmarshal([]byte("[prod, '${TEST_DC}', '{{.labels.dc}}']"), &tmpl); err != nil {
+		t.Fatal(err)
+	}
+	if out, _ := yaml.Marshal(tmpl); string(out) != "- prod\n- ${TEST_DC}\n- '{{.labels.dc}}'\n" {
+		t.Errorf("Unexpected marshalled prefix: %s", out)
+	}
+}
+
+func TestTemplateData(t *testing.T) {
+	t.Setenv("TEST_DC", "par")
+	t.Setenv("TEST_CLUSTER", "c1")
+
+	cfg := DefaultConfig.Write
+	in := `
+template_data_file: testdata/template_data.yml
+template_data:
+  dc: ${TEST_DC}
+  price: $$5
+  site_mapping:
+    eu-par: ${TEST_DC}_eqx`
+	if err := yaml.Unmarshal([]byte(in), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"dc":           "par",
+		"price":        "$5",
+		"cluster":      "c1",
+		"site_mapping": map[interface{}]interface{}{"eu-par": "par_eqx"},
+	}
+	if !reflect.DeepEqual(cfg.TemplateData, expected) {
+		t.Errorf("expected %v, got %v", expected, cfg.TemplateData)
+	}
+
+	cfg = DefaultConfig.Write
+	in = "template_data: {dc: '${TEST_UNSET_DC}'}"
+	if err := yaml.Unmarshal([]byte(in), &cfg); err == nil || !strings.Contains(err.Error(), "TEST_UNSET_DC") {
+		t.Errorf("expected an error about TEST_UNSET_DC, got %v", err)
+	}
+
+	cfg = DefaultConfig.Write
+	in = "template_data_allow_unset_env: true\ntemplate_data: {dc: 'dc-${TEST_UNSET_DC}'}"
+	if err := yaml.Unmarshal([]byte(in), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.TemplateData["dc"] != "dc-" {
+		t.Errorf("expected dc-, got %v", cfg.TemplateData["dc"])
+	}
+
+	cfg = DefaultConfig.Write
+	if err := yaml.Unmarshal([]byte("template_data_file: testdata/missing.yml"), &cfg); err == nil {
+		t.Error("expected an error for a missing template data file")
+	}
+}
+
+func TestTemplateAnalysis(t *testing.T) {
+	for s, expected := range map[string][2]bool{
+		"a.{{.labels.owner}}":                                               {false, false},
+		"a.{{.labels.value}}":                                               {false, false},
+		"a.{{.value}}":                                                      {true, false},
+		"a{{ if gt $.value 1.0 }}.high{{ end }}":                            {true, false},
+		"a.{{ range .labels }}{{ .timestamp }}{{ end }}":                    {true, false},
+		`a.{{ labelsJoined "." }}`:                                          {false, true},
+		`a{{ with .labels.owner }}{{ hasLabel . }}{{ end }}`:                {false, true},
+		`{{ define "v" }}{{ .value }}{{ end }}a.{{ template "v" . }}`:       {true, false},
+		`{{ define "o" }}{{ .owner }}{{ end }}a.{{ template "o" .labels }}`: {false, false},
+		`{{ define "l" }}{{ labelsJoined "." }}{{ end }}{{ template "l" }}`: {false, true},
+		`{{ $l := .labels }}a.{{ $l.owner }}`:                               {false, false},
+		`{{ $d := . }}a.{{ $d.value }}`:                                     {true, false},
+		`a.{{ index . "value" }}`:                                           {true, false},
+		`a.{{ printf "%v" $ }}`:                                             {true, false},
+	} {
+		tmpl, err := NewTemplate(s)
+		if err != nil {
+			t.Fatalf("%s: %s", s, err)
+		}
+		if tmpl.UsesSample() != expected[0] || tmpl.UsesMetricFuncs() != expected[1] {
+			t.Errorf("%s: expected %v, got [%v %v]", s, expected, tmpl.UsesSample(), tmpl.UsesMetricFuncs())
+		}
+	}
+}
+
+func TestLint(t *testing.T) {
+	var cfg Config
+	err := yaml.Unmarshal([]byte(`
+write:
+  rules:
+  - match: {owner: team-X}
+    template: 'team-x.{{.labels.__name__}}'
+    continue: true
+  - match_re: {owner: 'team-.*'}
+    template: 'teams.{{.labels.__name__}}'
+  - match: {owner: team-Y}
+    template: 'team-y.{{.labels.__name__}}'
+  - name: up
+    match_re: {job: 'node|mysql'}
+    action: drop
+  - name: up
+    match: {job: node}
+    template: 'node.up'
+  - name_re: 'disk_.*'
+    match_not: {env: dev}
+    template: 'disk.{{.labels.__name__}}'
+`), &cfg)
+	if err != nil {
+		t.Fatalf("Error parsing rules: %s", err)
+	}
+	expected := []string{
+		`rule 1: match_re owner="team-.*" is only partially anchored: it starts or ends with a wildcard`,
+		"rule 2 is unreachable: rule 1 matches all its metrics and doesn't continue",
+		"rule 4 is unreachable: rule 3 matches all its metrics and doesn't continue",
+		`rule 5: name_re "disk_.*" is only partially anchored: it starts or ends with a wildcard`,
+	}
+	if warnings := cfg.Write.Lint(); !reflect.DeepEqual(warnings, expected) {
+		t.Errorf("Expected warnings:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(warnings, "\n"))
+	}
+}
+
+func TestRuleNames(t *testing.T) {
+	for in, valid := range map[string]bool{
+		"{rules: [{rule_name: a}, {rule_name: b}, {}, {}]}": true,
+		"{rules: [{rule_name: a}, {rule_name: a}]}":         false,
+	} {
+		var cfg Config
+		if err := yaml.Unmarshal([]byte("write: "+in), &cfg); (err == nil) != valid {
+			t.Errorf("%s: expected valid %v, got %v", in, valid, err)
+		}
+	}
+}
+
+func TestDestinations(t *testing.T) {
+	for in, valid := range map[string]bool{
+		"{carbon_address: ['a:2003', 'b:2003'], destinations: {a: 'a:2003', b: 'b:2003'}, default_destination: b, rules: [{destination: a}]}": true,
+		"{carbon_address: ['a:2003'], destinations: {b: 'b:2003'}}":                                                                           false,
+		"{carbon_address: ['a:2003'], destinations: {a: 'a:2003'}, default_destination: b}":                                                   false,
+		"{carbon_address: ['a:2003'], destinations: {a: 'a:2003'}, rules: [{destination: b}]}":                                                false,
+		"{carbon_address: ['a:2003'], rules: [{destination: a}]}":                                                                             false,
+		"{carbon_address: ['a:2003'], destinations: {a: 'a:2003'}, routing: consistent_hash}":                                                 false,
+	} {
+		var cfg Config
+		if err := yaml.Unmarshal([]byte("write: "+in), &cfg); (err == nil) != valid {
+			t.Errorf("%s: expected valid %v, got %v", in, valid, err)
+		}
+	}
+}
+
+func TestNativeHistograms(t *testing.T) {
+	for in, valid := range map[string]bool{
+		"{native_histograms: convert}":                                   true,
+		"{native_histograms: drop}":                                      true,
+		"{native_histograms: keep}":                                      false,
+		"{native_histogram_suffixes: {bucket: .bucket}}":                 true,
+		"{native_histogram_suffixes: {bucket: ''}}":                      false,
+		"{native_histogram_suffixes: {bucket: _sum}}":                    false,
+		"{native_histogram_suffixes: {bucket: _b, sum: _s, count: _c}}":  true,
+		"{native_histogram_suffixes: {bucket: _b, sum: _s, counts: _c}}": false,
+	} {
+		var cfg Config
+		if err := yaml.Unmarshal([]byte("write: "+in), &cfg); (err == nil) != valid {
+			t.Errorf("%s: expected valid %v, got %v", in, valid, err)
+		}
+	}
+}
+
+func TestEmptyLabelValuePolicy(t *testing.T) {
+	for in, valid := range map[string]bool{
+		"{empty_label_value_policy: skip}":                                     true,
+		"{empty_label_value_policy: keep}":                                     true,
+		"{empty_label_value_policy: placeholder}":                              true,
+		"{empty_label_value_policy: placeholder, empty_label_placeholder: na}": true,
+		"{empty_label_value_policy: placeholder, empty_label_placeholder: ''}": false,
+		"{empty_label_value_policy: drop}":                                     false,
+	} {
+		var cfg Config
+		if err := yaml.Unmarshal([]byte("write: "+in), &cfg); (err == nil) != valid {
+			t.Errorf("%s: expected valid %v, got %v", in, valid, err)
+		}
+	}
+}
+
+func TestCommandLinePolicies(t *testing.T) {
+	for in, valid := range map[string]bool{
+		"--graphite.write.nan-handling=zero":                    true,
+		"--graphite.write.nan-handling=nope":                    false,
+		"--graphite.write.handle-staleness=end":                 true,
+		"--graphite.write.handle-staleness=nope":                false,
+		"--graphite.write.path-length-policy=hash_suffix":       true,
+		"--graphite.write.path-length-policy=nope":              false,
+		"--graphite.write.name-collision-policy=suffix":         true,
+		"--graphite.write.name-collision-policy=nope":           false,
+		"--graphite.write.empty-label-value-policy=placeholder": true,
+		"--graphite.write.empty-label-value-policy=nope":        false,
+		"--graphite.write.native-histograms=drop":               true,
+		"--graphite.write.native-histograms=nope":               false,
+	} {
+		app := kingpin.New("test", "")
+		AddCommandLine(app, &Config{})
+		if _, err := app.Parse([]string{in}); (err == nil) != valid {
+			t.Errorf("%s: expected valid %v, got %v", in, valid, err)
+		}
+	}
+}
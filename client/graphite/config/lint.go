@@ -0,0 +1,138 @@
+// Copyright 2017 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/common/model"
+)
+
+// Lint returns warnings about the write rules: rules shadowed by an earlier
+// rule which stops the evaluation and matches all the metrics they match,
+// and regular expressions undoing their implicit anchoring with a leading or
+// trailing wildcard. The shadowing detection is best-effort: it only
+// compares the matchers one by one.
+func (c *WriteConfig) Lint() []string {
+	var warnings []string
+	for j, rule := range c.Rules {
+		for i, earlier := range c.Rules[:j] {
+			// Final rules are evaluated after the others.
+			if earlier.Final && !rule.Final {
+				continue
+			}
+			if (earlier.Continue && earlier.Action != "drop") || !covers(earlier, rule) {
+				continue
+			}
+			warnings = append(warnings, fmt.Sprintf(
+				"rule %d is unreachable: rule %d matches all its metrics and doesn't continue", j, i))
+			break
+		}
+
+		if rule.NameRE != nil && unanchored(*rule.NameRE) {
+			warnings = append(warnings, fmt.Sprintf(
+				"rule %d: name_re %q is only partially anchored: it starts or ends with a wildcard", j, pattern(*rule.NameRE)))
+		}
+		for _, ln := range sortedLabels(rule.MatchRE) {
+			if unanchored(rule.MatchRE[ln]) {
+				warnings = append(warnings, fmt.Sprintf(
+					"rule %d: match_re %s=%q is only partially anchored: it starts or ends with a wildcard", j, ln, pattern(rule.MatchRE[ln])))
+			}
+		}
+	}
+	return warnings
+}
+
+// covers tells whether all the metrics matched by rule are matched by
+// earlier, comparing their matchers. It may return false for rules which do
+// cover each other.
+func covers(earlier, rule *Rule) bool {
+	if earlier.Name != "" && rule.Name != earlier.Name {
+		return false
+	}
+	if earlier.NameRE != nil && pattern(*earlier.NameRE) != ".*" {
+		sameRE := rule.NameRE != nil && pattern(*rule.NameRE) == pattern(*earlier.NameRE)
+		if !sameRE && (rule.Name == "" || !earlier.NameRE.MatchString(string(rule.Name))) {
+			return false
+		}
+	}
+	for ln, lv := range earlier.Match {
+		if rule.Match[ln] != lv {
+			return false
+		}
+	}
+	for ln, re := range earlier.MatchRE {
+		if pattern(re) == ".*" {
+			continue
+		}
+		sameRE := rule.MatchRE[ln].Regexp != nil && pattern(rule.MatchRE[ln]) == pattern(re)
+		lv, ok := rule.Match[ln]
+		if !sameRE && (!ok || !re.MatchString(string(lv))) {
+			return false
+		}
+	}
+	for ln, lv := range earlier.MatchNot {
+		if rule.MatchNot[ln] == lv {
+			continue
+		}
+		if matched, ok := rule.Match[ln]; !ok || matched == lv {
+			return false
+		}
+	}
+	for ln, re := range earlier.MatchNotRE {
+		if rule.MatchNotRE[ln].Regexp != nil && pattern(rule.MatchNotRE[ln]) == pattern(re) {
+			continue
+		}
+		if lv, ok := rule.Match[ln]; !ok || re.MatchString(string(lv)) {
+			return false
+		}
+	}
+	return true
+}
+
+// pattern returns the regular expression as written in the config, without
+// the anchoring added when parsing it.
+func pattern(re Regexp) string {
+	return strings.TrimSuffix(strings.TrimPrefix(re.String(), "^(?:"), ")$")
+}
+
+// unanchored tells whether re starts or ends with a wildcard, without being
+// a plain catch-all.
+func unanchored(re Regexp) bool {
+	p := pattern(re)
+	if p == ".*" || p == ".+" {
+		return false
+	}
+	for _, wildcard := range []string{".*", ".+"} {
+		if strings.HasPrefix(p, wildcard) {
+			return true
+		}
+		// An escaped dot isn't a wildcard.
+		if strings.HasSuffix(p, wildcard) && !strings.HasSuffix(p, `\`+wildcard) {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedLabels(labels LabelSetRE) []model.LabelName {
+	names := make([]model.LabelName, 0, len(labels))
+	for ln := range labels {
+		names = append(names, ln)
+	}
+	sort.Slice(names, func(i, j int) bool { return names[i] < names[j] })
+	return names
+}
@@ -0,0 +1,100 @@
+// Copyright 2018 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphite
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/common/model"
+)
+
+// deltaTracker remembers the last value written for each path of counters,
+// to write their increases instead. The least recently written paths are
+// forgotten first once it holds size paths.
+type deltaTracker struct {
+	lock    sync.Mutex
+	size    int
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+type deltaEntry struct {
+	path      string
+	value     float64
+	timestamp float64
+}
+
+func newDeltaTracker(size int) *deltaTracker {
+	return &deltaTracker{
+		size:    size,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// delta returns the increase of the counter written at path since its
+// previous point, or its value if it was reset. It returns false for the
+// first point of a path, and for points older than the previous one.
+func (d *deltaTracker) delta(path string, timestamp float64, value float64) (float64, bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	e, ok := d.entries[path]
+	if !ok {
+		d.entries[path] = d.lru.PushFront(&deltaEntry{path: path, value: value, timestamp: timestamp})
+		for d.lru.Len() > d.size {
+			d.remove(d.lru.Back())
+		}
+		return 0, false
+	}
+	d.lru.MoveToFront(e)
+	entry := e.Value.(*deltaEntry)
+	if timestamp <= entry.timestamp {
+		return 0, false
+	}
+	previous := entry.value
+	entry.value, entry.timestamp = value, timestamp
+	if value < previous {
+		counterResets.Inc()
+		return value, true
+	}
+	return value - previous, true
+}
+
+// forget drops the last value of path, e.g. once its series went stale.
+func (d *deltaTracker) forget(path string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if e, ok := d.entries[path]; ok {
+		d.remove(e)
+	}
+}
+
+func (d *deltaTracker) remove(e *list.Element) {
+	d.lru.Remove(e)
+	delete(d.entries, e.Value.(*deltaEntry).path)
+}
+
+// isCounter tells whether m is a counter, according to the metadata sent by
+// Prometheus or, lacking it, to the _total suffix of its name.
+func isCounter(m model.Metric) bool {
+	name := m[model.MetricNameLabel]
+	if typ := metricsMetadata.get(name).Type; typ != "" {
+		return typ == "counter"
+	}
+	return strings.HasSuffix(string(name), "_total")
+}
@@ -0,0 +1,143 @@
+// Copyright 2018 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphite
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+
+	"github.com/criteo/graphite-remote-adapter/client/graphite/config"
+)
+
+func TestDeltaTracker(t *testing.T) {
+	d := newDeltaTracker(10)
+
+	// The first point only sets the base.
+	_, ok := d.delta("a", 1, 10)
+	require.False(t, ok)
+
+	v, ok := d.delta("a", 2, 15)
+	require.True(t, ok)
+	require.Equal(t, float64(5), v)
+
+	// On reset, the new value is the increase since the reset.
+	resets := counterValue(t, counterResets)
+	v, ok = d.delta("a", 3, 4)
+	require.True(t, ok)
+	require.Equal(t, float64(4), v)
+	require.Equal(t, resets+1, counterValue(t, counterResets))
+
+	v, ok = d.delta("a", 4, 6)
+	require.True(t, ok)
+	require.Equal(t, float64(2), v)
+
+	// Points older than the last one are ignored.
+	_, ok = d.delta("a", 4, 8)
+	require.False(t, ok)
+
+	d.forget("a")
+	_, ok = d.delta("a", 5, 8)
+	require.False(t, ok)
+}
+
+func TestDeltaTrackerForgetsLeastRecentPaths(t *testing.T) {
+	d := newDeltaTracker(2)
+	d.delta("a", 1, 1)
+	d.delta("b", 1, 1)
+	d.delta("a", 2, 2)
+	d.delta("c", 1, 1)
+
+	// b was evicted by c, a was written more recently.
+	_, ok := d.delta("a", 3, 3)
+	require.True(t, ok)
+	_, ok = d.delta("b", 2, 2)
+	require.False(t, ok)
+}
+
+func TestWriteCounterDeltas(t *testing.T) {
+	carbon := newFakeCarbon(t)
+	defer carbon.close()
+	c := newTestCarbonClient(carbon.address(), 1)
+	defer c.Shutdown()
+	c.deltas = newDeltaTracker(10)
+
+	now := model.Now()
+	write := func(value model.SampleValue, offset int) {
+		samples := model.Samples{
+			{Metric: model.Metric{model.MetricNameLabel: "requests_total"}, Value: value, Timestamp: now.Add(time.Duration(offset) * time.Second)},
+			{Metric: model.Metric{model.MetricNameLabel: "temperature"}, Value: value, Timestamp: now.Add(time.Duration(offset) * time.Second)},
+		}
+		r, _ := http.NewRequest("POST", "http://fakeHost:6666", nil)
+		require.NoError(t, c.Write(samples, r))
+	}
+	write(100, 0)
+	write(130, 15)
+	write(20, 30)
+
+	// Gauges are left as is, counters are written from their second point.
+	waitFor(t, func() bool { return len(carbon.received()) == 5 })
+	var lines []string
+	for _, line := range carbon.received() {
+		lines = append(lines, strings.Join(strings.Fields(line)[:2], " "))
+	}
+	require.Equal(t, []string{
+		"temperature 100.000000",
+		"requests_total 30.000000",
+		"temperature 130.000000",
+		"requests_total 20.000000",
+		"temperature 20.000000",
+	}, lines)
+}
+
+func TestWriteCounterDeltasRuleValues(t *testing.T) {
+	carbon := newFakeCarbon(t)
+	defer carbon.close()
+	c := newTestCarbonClient(carbon.address(), 1)
+	defer c.Shutdown()
+	c.deltas = newDeltaTracker(10)
+	scale := 0.001
+	c.cfg.Write.Rules = []*config.Rule{{
+		Match:  config.LabelSet{"unit": "bytes"},
+		Scale:  &scale,
+		Offset: 1,
+		Prefix: "kb.",
+	}}
+
+	now := model.Now()
+	for i, value := range []model.SampleValue{1000, 3000} {
+		samples := model.Samples{
+			{Metric: model.Metric{model.MetricNameLabel: "sent_total", "unit": "bytes"}, Value: value, Timestamp: now.Add(time.Duration(i) * time.Second)},
+			{Metric: model.Metric{model.MetricNameLabel: "buffer", "unit": "bytes"}, Value: value, Timestamp: now.Add(time.Duration(i) * time.Second)},
+		}
+		r, _ := http.NewRequest("POST", "http://fakeHost:6666", nil)
+		require.NoError(t, c.Write(samples, r))
+	}
+
+	// Increases are only scaled.
+	waitFor(t, func() bool { return len(carbon.received()) == 3 })
+	var lines []string
+	for _, line := range carbon.received() {
+		lines = append(lines, strings.Join(strings.Fields(line)[:2], " "))
+	}
+	require.Equal(t, []string{
+		"kb.buffer.unit.bytes 2.000000",
+		"kb.sent_total.unit.bytes 2.000000",
+		"kb.buffer.unit.bytes 4.000000",
+	}, lines)
+}
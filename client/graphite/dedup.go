@@ -0,0 +1,115 @@
+// Copyright 2018 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphite
+
+import "sync"
+
+type dedupKey struct {
+	path      string
+	timestamp float64
+}
+
+// dedupSet remembers the values of the last points written, to drop the
+// duplicates sent by Prometheus replicas. The oldest points are forgotten
+// first once it holds size points.
+type dedupSet struct {
+	lock sync.Mutex
+	seen map[dedupKey]float64
+	ring []dedupKey
+	next int
+}
+
+func newDedupSet(size int) *dedupSet {
+	return &dedupSet{
+		seen: make(map[dedupKey]float64, size),
+		ring: make([]dedupKey, 0, size),
+	}
+}
+
+// filter returns the points which weren't written recently with the same
+// value, and remembers them. With lastWriteWins, only the last of the points
+// sharing a path and timestamp is kept.
+func (d *dedupSet) filter(points []dataPoint, lastWriteWins bool) []dataPoint {
+	var last map[dedupKey]int
+	if lastWriteWins {
+		last = make(map[dedupKey]int, len(points))
+		for i, p := range points {
+			last[dedupKey{p.path, p.timestamp}] = i
+		}
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	kept := points[:0:0]
+	for i, p := range points {
+		key := dedupKey{p.path, p.timestamp}
+		if lastWriteWins && last[key] != i {
+			dedupedPoints.Inc()
+			continue
+		}
+		if v, ok := d.seen[key]; ok && v == p.value {
+			dedupedPoints.Inc()
+			continue
+		}
+		d.remember(key, p.value)
+		kept = append(kept, p)
+	}
+	return kept
+}
+
+func (d *dedupSet) remember(key dedupKey, value float64) {
+	if _, ok := d.seen[key]; !ok {
+		if len(d.ring) < cap(d.ring) {
+			d.ring = append(d.ring, key)
+		} else {
+			delete(d.seen, d.ring[d.next])
+			d.ring[d.next] = key
+			d.next = (d.next + 1) % len(d.ring)
+		}
+	}
+	d.seen[key] = value
+}
+
+// resolveTimestamps keeps a single point per path and timestamp of points,
+// where the first of them was, with the maximum, minimum or last of their
+// values according to policy. The result doesn't depend on the order in which
+// Prometheus replicas sent the points, but with "last".
+func resolveTimestamps(points []dataPoint, policy string) []dataPoint {
+	first := make(map[dedupKey]int, len(points))
+	kept := points[:0:0]
+	for _, p := range points {
+		key := dedupKey{p.path, p.timestamp}
+		i, ok := first[key]
+		if !ok {
+			first[key] = len(kept)
+			kept = append(kept, p)
+			continue
+		}
+		dedupedPoints.Inc()
+		switch policy {
+		case "max":
+			if p.value > kept[i].value {
+				kept[i] = p
+			}
+		case "min":
+			if p.value < kept[i].value {
+				kept[i] = p
+			}
+		case "last":
+			kept[i] = p
+		}
+	}
+	return kept
+}
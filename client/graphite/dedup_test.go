@@ -0,0 +1,92 @@
+// Copyright 2018 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphite
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDedupSet(t *testing.T) {
+	d := newDedupSet(10)
+
+	first := []dataPoint{
+		{path: "a", value: 1, timestamp: 1},
+		{path: "b", value: 2, timestamp: 1},
+	}
+	require.Equal(t, first, d.filter(first, false))
+
+	// The same points sent by another replica are dropped, but a differing
+	// value at the same timestamp is kept.
+	second := []dataPoint{
+		{path: "a", value: 1, timestamp: 1},
+		{path: "b", value: 3, timestamp: 1},
+		{path: "a", value: 1, timestamp: 2},
+	}
+	require.Equal(t, second[1:], d.filter(second, false))
+
+	// The conflicting value replaced the previous one.
+	require.Empty(t, d.filter([]dataPoint{{path: "b", value: 3, timestamp: 1}}, false))
+	require.Len(t, d.filter([]dataPoint{{path: "b", value: 2, timestamp: 1}}, false), 1)
+}
+
+func TestDedupSetLastWriteWins(t *testing.T) {
+	d := newDedupSet(10)
+
+	points := []dataPoint{
+		{path: "a", value: 1, timestamp: 1},
+		{path: "a", value: 2, timestamp: 1},
+		{path: "b", value: 1, timestamp: 1},
+		{path: "a", value: 3, timestamp: 1},
+	}
+	require.Equal(t, []dataPoint{points[2], points[3]}, d.filter(points, true))
+}
+
+func TestDedupSetForgetsOldestPoints(t *testing.T) {
+	d := newDedupSet(2)
+
+	a := dataPoint{path: "a", value: 1, timestamp: 1}
+	b := dataPoint{path: "b", value: 1, timestamp: 1}
+	c := dataPoint{path: "c", value: 1, timestamp: 1}
+	require.Len(t, d.filter([]dataPoint{a, b, c}, false), 3)
+
+	// a was evicted by c.
+	require.Empty(t, d.filter([]dataPoint{b, c}, false))
+	require.Equal(t, []dataPoint{a}, d.filter([]dataPoint{a}, false))
+}
+
+func TestResolveTimestamps(t *testing.T) {
+	points := []dataPoint{
+		{path: "a", value: 2, timestamp: 1},
+		{path: "b", value: 1, timestamp: 1},
+		{path: "a", value: 3, timestamp: 1},
+		{path: "a", value: 1, timestamp: 1},
+		{path: "a", value: 5, timestamp: 2},
+	}
+	for policy, expected := range map[string]float64{"max": 3, "min": 1, "last": 1} {
+		deduped := counterValue(t, dedupedPoints)
+		resolved := resolveTimestamps(points, policy)
+		require.Equal(t, []dataPoint{
+			{path: "a", value: expected, timestamp: 1},
+			points[1],
+			points[4],
+		}, resolved, policy)
+		require.Equal(t, deduped+2, counterValue(t, dedupedPoints), policy)
+	}
+
+	// The arrival order of the replicas doesn't matter.
+	reversed := []dataPoint{points[3], points[2], points[0]}
+	require.Equal(t, []dataPoint{points[2]}, resolveTimestamps(reversed, "max"))
+}
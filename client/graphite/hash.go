@@ -0,0 +1,100 @@
+// Copyright 2018 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphite
+
+import (
+	"fmt"
+	"sort"
+)
+
+// ringReplicas is the number of positions of each node on the ring, as in
+// carbon.
+const ringReplicas = 100
+
+// hashRing is a consistent hash ring compatible with the fnv1a_ch hashing of
+// carbon-relay, so that a path is routed to the same carbon instances.
+type hashRing struct {
+	// entries are sorted by position.
+	entries []ringEntry
+	nodes   int
+}
+
+type ringEntry struct {
+	position int
+	node     int
+}
+
+// newHashRing places the nodes, named after their carbon instance, on the
+// ring.
+func newHashRing(instances []string) *hashRing {
+	r := &hashRing{nodes: len(instances)}
+	taken := map[int]bool{}
+	for node, instance := range instances {
+		for i := 0; i < ringReplicas; i++ {
+			position := ringPosition(fmt.Sprintf("%d-%s", i, instance))
+			// Like carbon, move to the next free position on collisions.
+			for taken[position] {
+				position++
+			}
+			taken[position] = true
+			r.entries = append(r.entries, ringEntry{position: position, node: node})
+		}
+	}
+	sort.Slice(r.entries, func(i, j int) bool { return r.entries[i].position < r.entries[j].position })
+	return r
+}
+
+// get returns the n distinct nodes key is routed to, walking the ring from
+// its position.
+func (r *hashRing) get(key string, n int) []int {
+	if n > r.nodes {
+		n = r.nodes
+	}
+	position := ringPosition(key)
+	start := sort.Search(len(r.entries), func(i int) bool { return r.entries[i].position >= position })
+
+	nodes := make([]int, 0, n)
+	for i := 0; i < len(r.entries) && len(nodes) < n; i++ {
+		node := r.entries[(start+i)%len(r.entries)].node
+		if !containsInt(nodes, node) {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+func containsInt(l []int, v int) bool {
+	for _, e := range l {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
+
+// ringPosition folds the 32 bits fnv1a hash of key into 16 bits, as carbon
+// does.
+func ringPosition(key string) int {
+	h := fnv1a32(key)
+	return int((h >> 16) ^ (h & 0xffff))
+}
+
+func fnv1a32(s string) uint32 {
+	h := uint32(0x811c9dc5)
+	for i := 0; i < len(s); i++ {
+		h ^= uint32(s[i])
+		h *= 0x01000193
+	}
+	return h
+}
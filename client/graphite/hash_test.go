@@ -0,0 +1,111 @@
+// Copyright 2018 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphite
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHashRingMatchesCarbon(t *testing.T) {
+	// Computed with carbon's ConsistentHashRing and the fnv1a_ch hash type.
+	r := newHashRing([]string{"a", "b", "c"})
+	for key, expected := range map[string][]int{
+		"servers.web01.cpu.user": {2, 1, 0},
+		"prometheus.up.job.node": {0, 1, 2},
+		"foo":                    {2, 1, 0},
+	} {
+		require.Equal(t, expected, r.get(key, 3), key)
+		require.Equal(t, expected[:2], r.get(key, 2), key)
+	}
+	require.Len(t, r.get("foo", 10), 3)
+}
+
+func TestHashRingIsStable(t *testing.T) {
+	instances := []string{"carbon-a:2003", "carbon-b:2003", "carbon-c:2003"}
+	r, other := newHashRing(instances), newHashRing(instances)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("test.metric.%d", i)
+		require.Equal(t, r.get(key, 1), r.get(key, 1))
+		require.Equal(t, r.get(key, 1), other.get(key, 1))
+	}
+}
+
+func TestHashRingMinimalReshuffle(t *testing.T) {
+	before := newHashRing([]string{"a", "b", "c"})
+	after := newHashRing([]string{"a", "b", "c", "d"})
+
+	moved := 0
+	const keys = 10000
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("test.metric.%d", i)
+		if from, to := before.get(key, 1)[0], after.get(key, 1)[0]; from != to {
+			// Keys only move to the new node.
+			require.Equal(t, 3, to, key)
+			moved++
+		}
+	}
+	// About a quarter of the keys should move to the new node.
+	require.InDelta(t, 0.25, float64(moved)/keys, 0.1)
+}
+
+func TestSplitInstance(t *testing.T) {
+	for address, expected := range map[string][2]string{
+		"carbon:2003":        {"carbon:2003", "carbon:2003"},
+		"carbon:2003:a":      {"carbon:2003", "a"},
+		"[::1]:2003":         {"[::1]:2003", "[::1]:2003"},
+		"[::1]:2003:a":       {"[::1]:2003", "a"},
+		"carbon.example.com": {"carbon.example.com", "carbon.example.com"},
+	} {
+		host, instance := splitInstance(address)
+		require.Equal(t, expected, [2]string{host, instance}, address)
+	}
+}
+
+func TestWriteConsistentHash(t *testing.T) {
+	carbons := []*fakeCarbon{newFakeCarbon(t), newFakeCarbon(t)}
+	defer carbons[0].close()
+	defer carbons[1].close()
+
+	c := newTestFanOutClient("all_must_succeed", carbons[0].address(), carbons[1].address())
+	c.cfg.Write.Routing = "consistent_hash"
+	c.cfg.Write.ReplicationFactor = 1
+	c.ring = newHashRing([]string{carbons[0].address(), carbons[1].address()})
+	defer c.Shutdown()
+
+	var samples model.Samples
+	expected := make([][]string, 2)
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("test_%d", i)
+		samples = append(samples, &model.Sample{
+			Metric: model.Metric{model.MetricNameLabel: model.LabelValue(name)}, Value: 1, Timestamp: 1000,
+		})
+		node := c.ring.get(name, 1)[0]
+		expected[node] = append(expected[node], name+" 1.000000 1.000000")
+	}
+	require.NotEmpty(t, expected[0])
+	require.NotEmpty(t, expected[1])
+
+	r, _ := http.NewRequest("POST", "/write", nil)
+	require.NoError(t, c.Write(samples, r))
+	waitFor(t, func() bool {
+		return len(carbons[0].received())+len(carbons[1].received()) == len(samples)
+	})
+	require.Equal(t, expected[0], carbons[0].received())
+	require.Equal(t, expected[1], carbons[1].received())
+}
@@ -0,0 +1,93 @@
+// Copyright 2018 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphite
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/context/ctxhttp"
+
+	"github.com/criteo/graphite-remote-adapter/client"
+)
+
+// healthCheckTimeout bounds each reachability check.
+const healthCheckTimeout = 2 * time.Second
+
+// Check implements the client.Checker interface. It connects to carbon and
+// sends a HEAD request to graphite-web, if they are configured.
+func (c *Client) Check() []client.CheckResult {
+	var results []client.CheckResult
+	for _, d := range c.destinations {
+		backend := "carbon"
+		if len(c.destinations) > 1 {
+			backend = fmt.Sprintf("carbon %s", d.address)
+		}
+		results = append(results, checkResult(backend, c.checkCarbon(d.address)))
+	}
+	if c.cfg.Read.URL != "" {
+		results = append(results, checkResult("graphite-web", c.checkGraphiteWeb()))
+	}
+	return results
+}
+
+func checkResult(backend string, err error) client.CheckResult {
+	if err != nil {
+		return client.CheckResult{Backend: backend, Error: err.Error()}
+	}
+	return client.CheckResult{Backend: backend, Up: true}
+}
+
+// checkCarbon opens a new connection to the carbon server at address, without
+// any handshake.
+func (c *Client) checkCarbon(address string) error {
+	network := c.cfg.Write.CarbonTransport
+	if network == "websocket" || network == "http" {
+		u, err := url.Parse(address)
+		if err != nil {
+			return err
+		}
+		network, address = "tcp", urlAddress(u)
+	}
+
+	timeout := c.cfg.Write.DialTimeout
+	if timeout <= 0 || timeout > healthCheckTimeout {
+		timeout = healthCheckTimeout
+	}
+	conn, err := dialCarbon(network, address, timeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// checkGraphiteWeb sends a HEAD request to graphite-web, server errors
+// meaning it isn't ready.
+func (c *Client) checkGraphiteWeb() error {
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+
+	resp, err := ctxhttp.Head(ctx, c.httpClient, c.cfg.Read.URL)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("server returned HTTP status %s", resp.Status)
+	}
+	return nil
+}
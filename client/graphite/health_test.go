@@ -0,0 +1,66 @@
+// Copyright 2018 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphite
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/criteo/graphite-remote-adapter/client"
+)
+
+func TestCheckBackendsUp(t *testing.T) {
+	carbon := newFakeCarbon(t)
+	defer carbon.close()
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "HEAD", r.Method)
+	}))
+	defer web.Close()
+
+	c := newTestCarbonClient(carbon.address(), 1)
+	c.cfg.Read.URL = web.URL
+	require.Equal(t, []client.CheckResult{
+		{Backend: "carbon", Up: true},
+		{Backend: "graphite-web", Up: true},
+	}, c.Check())
+}
+
+func TestCheckBackendsDown(t *testing.T) {
+	carbon := newFakeCarbon(t)
+	carbon.close()
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer web.Close()
+
+	c := newTestCarbonClient(carbon.address(), 1)
+	c.cfg.Read.URL = web.URL
+	results := c.Check()
+	require.Len(t, results, 2)
+	require.Equal(t, "carbon", results[0].Backend)
+	require.False(t, results[0].Up)
+	require.Contains(t, results[0].Error, "connection refused")
+	require.Equal(t, client.CheckResult{
+		Backend: "graphite-web",
+		Error:   "server returned HTTP status 502 Bad Gateway",
+	}, results[1])
+
+	// Backends which aren't configured aren't checked.
+	c.destinations = nil
+	c.cfg.Read.URL = ""
+	require.Empty(t, c.Check())
+}
@@ -0,0 +1,84 @@
+// Copyright 2018 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphite
+
+import (
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// heartbeatPrecision writes the heartbeats as integers.
+var heartbeatPrecision = 0
+
+// heartbeat periodically writes 1 to path, so that the whole write path can
+// be monitored from graphite.
+type heartbeat struct {
+	path   string
+	flush  func([]dataPoint) error
+	logger log.Logger
+
+	quit chan struct{}
+	done chan struct{}
+}
+
+func newHeartbeat(path string, interval time.Duration, flush func([]dataPoint) error, logger log.Logger) *heartbeat {
+	h := &heartbeat{
+		path:   path,
+		flush:  flush,
+		logger: logger,
+		quit:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go h.loop(interval)
+	return h
+}
+
+func (h *heartbeat) loop(interval time.Duration) {
+	defer close(h.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			h.beat(now)
+		case <-h.quit:
+			return
+		}
+	}
+}
+
+// beat writes the heartbeat of now.
+func (h *heartbeat) beat(now time.Time) {
+	p := dataPoint{
+		path:      h.path,
+		value:     1,
+		timestamp: float64(now.Unix()),
+		precision: &heartbeatPrecision,
+	}
+	if err := h.flush([]dataPoint{p}); err != nil {
+		heartbeats.WithLabelValues("failure").Inc()
+		level.Warn(h.logger).Log("path", h.path, "err", err, "msg", "Error writing heartbeat")
+		return
+	}
+	heartbeats.WithLabelValues("success").Inc()
+}
+
+// stop stops the heartbeats.
+func (h *heartbeat) stop() {
+	close(h.quit)
+	<-h.done
+}
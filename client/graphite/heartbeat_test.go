@@ -0,0 +1,59 @@
+// Copyright 2018 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphite
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHeartbeatCadence(t *testing.T) {
+	flush, flushed := recordFlushes()
+	h := newHeartbeat("adapter.heartbeat", 50*time.Millisecond, flush, log.NewNopLogger())
+
+	start := time.Now()
+	waitFor(t, func() bool { return len(flushed()) >= 3 })
+	elapsed := time.Since(start)
+	h.stop()
+
+	require.True(t, elapsed >= 150*time.Millisecond, "3 heartbeats in %s", elapsed)
+	for _, batch := range flushed() {
+		require.Len(t, batch, 1)
+		require.Equal(t, "adapter.heartbeat", batch[0].path)
+		require.Equal(t, float64(1), batch[0].value)
+	}
+
+	// No heartbeat once stopped.
+	n := len(flushed())
+	time.Sleep(100 * time.Millisecond)
+	require.Len(t, flushed(), n)
+}
+
+func TestHeartbeatLine(t *testing.T) {
+	carbon := newFakeCarbon(t)
+	defer carbon.close()
+
+	c := newTestCarbonClient(carbon.address(), 1)
+	defer c.Shutdown()
+	before := counterValue(t, heartbeats.WithLabelValues("success"))
+
+	h := &heartbeat{path: "adapter.heartbeat", flush: c.flush, logger: log.NewNopLogger()}
+	h.beat(time.Unix(1500000000, 0))
+	waitFor(t, func() bool { return len(carbon.received()) == 1 })
+	require.Equal(t, []string{"adapter.heartbeat 1 1500000000.000000"}, carbon.received())
+	require.Equal(t, before+1, counterValue(t, heartbeats.WithLabelValues("success")))
+}
@@ -0,0 +1,88 @@
+// Copyright 2018 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphite
+
+import (
+	"strings"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/criteo/graphite-remote-adapter/client/graphite/config"
+)
+
+// fieldLabel tells apart the series of a collapsed histogram or summary,
+// like the field keys of InfluxDB.
+const fieldLabel = "field"
+
+// collapseHistogram returns m under the name of its histogram or summary
+// family, with the kind of series in the field tag, when configured for the
+// tagged formats: foo_bucket{le="1"} becomes foo{field="bucket",le="1"}.
+// Buckets and quantiles are recognized by their le and quantile labels,
+// sums and counts only if the metadata of the family is known.
+func collapseHistogram(m model.Metric, format Format, cfg *config.WriteConfig) model.Metric {
+	if format != FormatCarbonTags && format != FormatCarbonOpenMetrics {
+		return m
+	}
+	if !cfg.CollapseHistograms {
+		return m
+	}
+	if _, ok := m[fieldLabel]; ok {
+		return m
+	}
+	family, field := histogramField(m)
+	if field == "" {
+		return m
+	}
+
+	collapsed := make(model.Metric, len(m)+1)
+	for l, v := range m {
+		collapsed[l] = v
+	}
+	collapsed[model.MetricNameLabel] = model.LabelValue(family)
+	collapsed[fieldLabel] = model.LabelValue(field)
+	return collapsed
+}
+
+// histogramField returns the family of m and the kind of series it is, if
+// it's part of a histogram or a summary.
+func histogramField(m model.Metric) (string, string) {
+	name := string(m[model.MetricNameLabel])
+	familyType := func(family string) string {
+		return metricsMetadata.get(model.LabelValue(family)).Type
+	}
+
+	if family := strings.TrimSuffix(name, "_bucket"); family != name && m["le"] != "" {
+		if typ := familyType(family); typ == "" || typ == "histogram" || typ == "gaugehistogram" {
+			return family, "bucket"
+		}
+		return "", ""
+	}
+	if m["quantile"] != "" {
+		if typ := familyType(name); typ == "" || typ == "summary" {
+			return name, "quantile"
+		}
+		return "", ""
+	}
+	for _, suffix := range []string{"_sum", "_count"} {
+		family := strings.TrimSuffix(name, suffix)
+		if family == name {
+			continue
+		}
+		switch familyType(family) {
+		case "histogram", "gaugehistogram", "summary":
+			return family, suffix[1:]
+		}
+	}
+	return "", ""
+}
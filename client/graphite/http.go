@@ -15,7 +15,12 @@ package graphite
 
 import (
 	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
 
+	"github.com/criteo/graphite-remote-adapter/client/graphite/config"
 	"github.com/criteo/graphite-remote-adapter/utils"
 )
 
@@ -25,6 +30,51 @@ var (
 	prepareURL = utils.PrepareURL
 )
 
+// authRoundTripper sets the Authorization header of the requests to
+// graphite-web. Password and token files are read on each request so that
+// they can be rotated.
+type authRoundTripper struct {
+	auth *config.AuthConfig
+	rt   http.RoundTripper
+}
+
+// readSecret returns secret, or the content of file if set.
+func readSecret(secret string, file string) (string, error) {
+	if file == "" {
+		return secret, nil
+	}
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("unable to read %s: %s", file, err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// RoundTrip implements the http.RoundTripper interface.
+func (rt *authRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Round trippers must not modify the request.
+	clone := *req
+	clone.Header = make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		clone.Header[k] = v
+	}
+
+	if rt.auth.Username != "" {
+		password, err := readSecret(string(rt.auth.Password), rt.auth.PasswordFile)
+		if err != nil {
+			return nil, err
+		}
+		clone.SetBasicAuth(rt.auth.Username, password)
+	} else {
+		token, err := readSecret(string(rt.auth.Token), rt.auth.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+		clone.Header.Set("Authorization", "Bearer "+token)
+	}
+	return rt.rt.RoundTrip(&clone)
+}
+
 // ExpandResponse is a parsed response of graphite expand endpoint.
 type ExpandResponse struct {
 	Results []string `yaml:"results,omitempty" json:"results,omitempty"`
@@ -0,0 +1,76 @@
+// Copyright 2018 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphite
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/common/model"
+)
+
+// See https://docs.influxdata.com/influxdb/v1.5/write_protocols/line_protocol_reference/#special-characters
+var (
+	influxMeasurementEscaper = strings.NewReplacer(",", "\\,", " ", "\\ ")
+	// Backslashes are escaped too, not to escape the character following them.
+	influxTagEscaper = strings.NewReplacer("\\", "\\\\", ",", "\\,", "=", "\\=", " ", "\\ ")
+)
+
+// influxSeriesKey returns the "measurement,tag=value,..." series key of m,
+// the metric name being the measurement and the sorted labels the tags.
+func influxSeriesKey(m model.Metric, prefix string) string {
+	buffer := getBuffer()
+	defer putBuffer(buffer)
+	buffer.WriteString(prefix)
+	buffer.WriteString(influxMeasurementEscaper.Replace(string(m[model.MetricNameLabel])))
+
+	labels := make(model.LabelNames, 0, len(m))
+	for l := range m {
+		labels = append(labels, l)
+	}
+	sort.Sort(labels)
+
+	for _, l := range labels {
+		// Influx rejects empty tag values.
+		if l == model.MetricNameLabel || len(l) == 0 || len(m[l]) == 0 {
+			continue
+		}
+		buffer.WriteRune(',')
+		buffer.WriteString(influxTagEscaper.Replace(string(l)))
+		buffer.WriteRune('=')
+		buffer.WriteString(influxTagEscaper.Replace(string(m[l])))
+	}
+	return buffer.String()
+}
+
+// influxLine formats the dataPoint using the influx line protocol, the path
+// being the series key and the timestamp in nanoseconds.
+func (p dataPoint) influxLine() string {
+	return string(p.appendInfluxLine(nil))
+}
+
+// appendInfluxLine appends the dataPoint formatted using the influx line
+// protocol to dst, like influxLine does.
+func (p dataPoint) appendInfluxLine(dst []byte) []byte {
+	// Prometheus timestamps are in milliseconds, round to avoid float errors.
+	ns := int64(math.Round(p.timestamp*1e3)) * 1e6
+	dst = append(dst, p.path...)
+	dst = append(dst, " value="...)
+	dst = strconv.AppendFloat(dst, p.value, 'g', -1, 64)
+	dst = append(dst, ' ')
+	dst = strconv.AppendInt(dst, ns, 10)
+	return append(dst, '\n')
+}
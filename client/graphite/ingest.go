@@ -0,0 +1,99 @@
+// Copyright 2018 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphite
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	graphiteCfg "github.com/criteo/graphite-remote-adapter/client/graphite/config"
+)
+
+// ingestPoint is a single point of the JSON array posted to the HTTP ingest
+// API of metrictank-like backends.
+type ingestPoint struct {
+	Name  string   `json:"name"`
+	Value float64  `json:"value"`
+	Time  int64    `json:"time"`
+	Tags  []string `json:"tags"`
+}
+
+// httpStatusError is returned when the HTTP ingest API rejects a payload.
+type httpStatusError struct {
+	code   int
+	status string
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("server returned HTTP status %s", e.status)
+}
+
+// transient tells whether the payload may be accepted if sent again.
+func (e *httpStatusError) transient() bool {
+	return e.code >= http.StatusInternalServerError || e.code == http.StatusTooManyRequests
+}
+
+// encodeIngest encodes points as a JSON array for the HTTP ingest API. With
+// tags enabled, the tags of the paths are sent apart from the name.
+func encodeIngest(points []dataPoint, format Format) ([]byte, error) {
+	ingest := make([]ingestPoint, 0, len(points))
+	for _, p := range points {
+		ip := ingestPoint{Name: p.path, Value: p.value, Time: int64(p.timestamp), Tags: []string{}}
+		if format == FormatCarbonTags {
+			parts := strings.Split(p.path, ";")
+			ip.Name, ip.Tags = parts[0], parts[1:]
+		}
+		ingest = append(ingest, ip)
+	}
+	return json.Marshal(ingest)
+}
+
+// newIngestHTTPClient returns the client posting to the HTTP ingest API.
+func newIngestHTTPClient(writeCfg *graphiteCfg.WriteConfig) *http.Client {
+	var rt http.RoundTripper = &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		MaxIdleConnsPerHost: writeCfg.CarbonPoolSize,
+		TLSHandshakeTimeout: writeCfg.DialTimeout,
+	}
+	if writeCfg.Auth != nil {
+		rt = &authRoundTripper{auth: writeCfg.Auth, rt: rt}
+	}
+	return &http.Client{Timeout: writeCfg.WriteTimeout, Transport: rt}
+}
+
+// post sends payload to the HTTP ingest API of d.
+func (c *Client) post(d *destination, payload []byte) error {
+	req, err := http.NewRequest("POST", d.address, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.ingestClient.Do(req)
+	if err != nil {
+		return err
+	}
+	// Drain the body so that the connection can be reused.
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return &httpStatusError{code: resp.StatusCode, status: resp.Status}
+	}
+	return nil
+}
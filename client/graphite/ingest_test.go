@@ -0,0 +1,133 @@
+// Copyright 2018 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphite
+
+import (
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+
+	"github.com/criteo/graphite-remote-adapter/client/graphite/config"
+)
+
+// fakeIngest is an HTTP ingest API recording the bodies it receives, failing
+// the first failures requests.
+type fakeIngest struct {
+	*httptest.Server
+
+	lock     sync.Mutex
+	failures int
+	auth     []string
+	bodies   []string
+}
+
+func newFakeIngest(failures int) *fakeIngest {
+	f := &fakeIngest{failures: failures}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.handle))
+	return f
+}
+
+func (f *fakeIngest) handle(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.failures > 0 {
+		f.failures--
+		http.Error(w, "overloaded", http.StatusServiceUnavailable)
+		return
+	}
+	if r.Method != "POST" || r.Header.Get("Content-Type") != "application/json" {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	b, _ := ioutil.ReadAll(r.Body)
+	f.auth = append(f.auth, r.Header.Get("Authorization"))
+	f.bodies = append(f.bodies, string(b))
+}
+
+func newTestIngestClient(address string) *Client {
+	c := newTestCarbonClient(address, 1)
+	c.cfg.Write.CarbonTransport = "http"
+	c.cfg.Write.Auth = &config.AuthConfig{Token: "s3cr3t"}
+	c.ingestClient = newIngestHTTPClient(&c.cfg.Write)
+	return c
+}
+
+func TestWriteOverHTTP(t *testing.T) {
+	ingest := newFakeIngest(0)
+	defer ingest.Close()
+	c := newTestIngestClient(ingest.URL + "/metrics")
+	defer c.Shutdown()
+
+	r, _ := http.NewRequest("POST", "http://fakeHost:6666", nil)
+	require.NoError(t, c.Write(testSamples, r))
+
+	c.format = FormatCarbonTags
+	samples := model.Samples{
+		{Metric: model.Metric{model.MetricNameLabel: "test", "dc": "par"}, Value: 2.5, Timestamp: 2000},
+		{Metric: model.Metric{model.MetricNameLabel: "other"}, Value: 3, Timestamp: 3000},
+	}
+	require.NoError(t, c.Write(samples, r))
+
+	require.Equal(t, []string{"Bearer s3cr3t", "Bearer s3cr3t"}, ingest.auth)
+	require.Len(t, ingest.bodies, 2)
+	require.JSONEq(t, `[{"name": "test", "value": 1, "time": 1, "tags": []}]`, ingest.bodies[0])
+	require.JSONEq(t, `[
+		{"name": "test", "value": 2.5, "time": 2, "tags": ["dc=par"]},
+		{"name": "other", "value": 3, "time": 3, "tags": []}
+	]`, ingest.bodies[1])
+}
+
+func TestWriteOverHTTPEncodingError(t *testing.T) {
+	ingest := newFakeIngest(0)
+	defer ingest.Close()
+	c := newTestIngestClient(ingest.URL)
+	defer c.Shutdown()
+	// Refused by the config, JSON has no NaN.
+	c.cfg.Write.NanHandling = "passthrough"
+
+	r, _ := http.NewRequest("POST", "http://fakeHost:6666", nil)
+	samples := model.Samples{{Metric: model.Metric{model.MetricNameLabel: "test"}, Value: model.SampleValue(math.NaN()), Timestamp: 1000}}
+	require.Error(t, c.Write(samples, r))
+	require.Empty(t, ingest.bodies)
+}
+
+func TestWriteOverHTTPRetries(t *testing.T) {
+	ingest := newFakeIngest(2)
+	defer ingest.Close()
+	c := newTestIngestClient(ingest.URL)
+	defer c.Shutdown()
+
+	r, _ := http.NewRequest("POST", "http://fakeHost:6666", nil)
+	require.Error(t, c.Write(testSamples, r))
+
+	c.cfg.Write.MaxRetries = 2
+	c.cfg.Write.InitialBackoff = time.Millisecond
+	c.cfg.Write.MaxBackoff = 2 * time.Millisecond
+	ingest.failures = 2
+	require.NoError(t, c.Write(testSamples, r))
+	require.Len(t, ingest.bodies, 1)
+}
+
+func TestHTTPStatusErrorIsTransient(t *testing.T) {
+	require.True(t, isTransientError(&httpStatusError{code: http.StatusBadGateway}))
+	require.True(t, isTransientError(&httpStatusError{code: http.StatusTooManyRequests}))
+	require.False(t, isTransientError(&httpStatusError{code: http.StatusBadRequest}))
+}
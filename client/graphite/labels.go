@@ -0,0 +1,330 @@
+// Copyright 2018 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphite
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	"golang.org/x/net/context"
+
+	"github.com/criteo/graphite-remote-adapter/utils"
+)
+
+const (
+	findEndpoint                   = "/metrics/find"
+	tagsEndpoint                   = "/tags"
+	tagsAutoCompleteTagsEndpoint   = "/tags/autoComplete/tags"
+	tagsAutoCompleteValuesEndpoint = "/tags/autoComplete/values"
+	tagsFindSeriesEndpoint         = "/tags/findSeries"
+	metadataAutoCompleteLimit      = "10000"
+)
+
+// findNode is a node of the treejson response of the find endpoint.
+type findNode struct {
+	ID   string `json:"id"`
+	Text string `json:"text"`
+	Leaf int    `json:"leaf"`
+}
+
+// tagResponse is a tag returned by the tags endpoints, along with its values
+// when asked for a single tag.
+type tagResponse struct {
+	Tag    string `json:"tag"`
+	Values []struct {
+		Value string `json:"value"`
+	} `json:"values"`
+}
+
+// LabelNames implements the client.LabelReader interface.
+func (c *Client) LabelNames(metric string, r *http.Request) ([]string, error) {
+	if c.cfg.Read.URL == "" {
+		return nil, nil
+	}
+	ctx, cancel := c.metadataContext(r)
+	defer cancel()
+	prefix, err := c.getGraphitePrefix(r)
+	if err != nil {
+		return nil, err
+	}
+
+	names := map[string]bool{}
+	if c.cfg.EnableTags {
+		var tags []string
+		if metric == "" {
+			var resp []tagResponse
+			if err := c.fetchMetadata(ctx, tagsEndpoint, nil, &resp); err != nil {
+				return nil, err
+			}
+			for _, tag := range resp {
+				tags = append(tags, tag.Tag)
+			}
+		} else {
+			params := map[string]string{"expr": c.nameExpr(prefix, metric), "limit": metadataAutoCompleteLimit}
+			if err := c.fetchMetadata(ctx, tagsAutoCompleteTagsEndpoint, params, &tags); err != nil {
+				return nil, err
+			}
+		}
+		for _, tag := range tags {
+			if tag == "name" {
+				names[model.MetricNameLabel] = true
+			} else {
+				names[c.unescape(tag)] = true
+			}
+		}
+		return sortedKeys(names), nil
+	}
+
+	series, err := c.untaggedSeries(ctx, prefix, metric)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range series {
+		for name := range m {
+			names[string(name)] = true
+		}
+	}
+	return sortedKeys(names), nil
+}
+
+// LabelValues implements the client.LabelReader interface.
+func (c *Client) LabelValues(name string, metric string, r *http.Request) ([]string, error) {
+	if c.cfg.Read.URL == "" {
+		return nil, nil
+	}
+	ctx, cancel := c.metadataContext(r)
+	defer cancel()
+	prefix, err := c.getGraphitePrefix(r)
+	if err != nil {
+		return nil, err
+	}
+
+	values := map[string]bool{}
+	if c.cfg.EnableTags {
+		tag := "name"
+		if name != model.MetricNameLabel {
+			tag = utils.EscapeTagName(name, c.cfg.Write.Escaping.Policy)
+		}
+		var tagValues []string
+		if metric == "" {
+			var resp tagResponse
+			if err := c.fetchMetadata(ctx, tagsEndpoint+"/"+tag, nil, &resp); err != nil {
+				return nil, err
+			}
+			for _, v := range resp.Values {
+				tagValues = append(tagValues, v.Value)
+			}
+		} else {
+			params := map[string]string{"tag": tag, "expr": c.nameExpr(prefix, metric), "limit": metadataAutoCompleteLimit}
+			if err := c.fetchMetadata(ctx, tagsAutoCompleteValuesEndpoint, params, &tagValues); err != nil {
+				return nil, err
+			}
+		}
+		for _, v := range tagValues {
+			if tag == "name" {
+				// Other prefixes are other Prometheus.
+				if !strings.HasPrefix(v, prefix) {
+					continue
+				}
+				v = strings.TrimPrefix(v, prefix)
+			}
+			values[c.unescape(v)] = true
+		}
+		return sortedKeys(values), nil
+	}
+
+	if name == model.MetricNameLabel && metric == "" {
+		// The first nodes under the prefix are the metric names.
+		var nodes []findNode
+		if err := c.fetchMetadata(ctx, findEndpoint, map[string]string{"query": prefix + "*"}, &nodes); err != nil {
+			return nil, err
+		}
+		for _, node := range nodes {
+			labels, err := c.labelsFromPath(node.ID, prefix)
+			if err != nil {
+				continue
+			}
+			values[labels[0].Value] = true
+		}
+		return sortedKeys(values), nil
+	}
+
+	series, err := c.untaggedSeries(ctx, prefix, metric)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range series {
+		if v, ok := m[model.LabelName(name)]; ok {
+			values[string(v)] = true
+		}
+	}
+	return sortedKeys(values), nil
+}
+
+// Series implements the client.LabelReader interface.
+func (c *Client) Series(metric string, r *http.Request) ([]model.Metric, error) {
+	if c.cfg.Read.URL == "" {
+		return nil, nil
+	}
+	ctx, cancel := c.metadataContext(r)
+	defer cancel()
+	prefix, err := c.getGraphitePrefix(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if !c.cfg.EnableTags {
+		return c.untaggedSeries(ctx, prefix, metric)
+	}
+
+	expr := "name=~^" + regexp.QuoteMeta(prefix)
+	if metric != "" {
+		expr = c.nameExpr(prefix, metric)
+	}
+	var paths []string
+	if err := c.fetchMetadata(ctx, tagsFindSeriesEndpoint, map[string]string{"expr": expr}, &paths); err != nil {
+		return nil, err
+	}
+	var series []model.Metric
+	for _, path := range paths {
+		labels, err := metricLabelsFromTaggedPath(path, prefix)
+		if err != nil {
+			continue
+		}
+		c.unescapeLabels(labels)
+		series = append(series, labelsToMetric(labels))
+	}
+	return series, nil
+}
+
+// untaggedSeries expands the default and path pattern paths of the series of
+// metric, or of all the series under prefix, and parses them back into labels.
+// Paths which don't parse weren't written by the adapter and are skipped.
+func (c *Client) untaggedSeries(ctx context.Context, prefix string, metric string) ([]model.Metric, error) {
+	query := &prompb.Query{}
+	queries := []string{prefix + "**"}
+	if metric != "" {
+		query.Matchers = []*prompb.LabelMatcher{
+			{Type: prompb.LabelMatcher_EQ, Name: model.MetricNameLabel, Value: metric},
+		}
+		queries = []string{prefix + metric + ".**"}
+	}
+	for _, p := range c.cfg.Read.PathPatterns {
+		if glob, ok := patternGlob(p, query); ok {
+			queries = append(queries, glob)
+		}
+	}
+
+	var series []model.Metric
+	seen := make(map[string]bool)
+	for _, queryStr := range queries {
+		var resp ExpandResponse
+		params := map[string]string{"format": "json", "leavesOnly": "1", "query": queryStr}
+		if err := c.fetchMetadata(ctx, expandEndpoint, params, &resp); err != nil {
+			return nil, err
+		}
+		for _, path := range resp.Results {
+			if seen[path] {
+				continue
+			}
+			seen[path] = true
+			labels, err := c.labelsFromPath(path, prefix)
+			if err != nil {
+				continue
+			}
+			m := labelsToMetric(labels)
+			if metric != "" && string(m[model.MetricNameLabel]) != metric {
+				continue
+			}
+			series = append(series, m)
+		}
+	}
+	return series, nil
+}
+
+// fetchMetadata fetches endpoint of graphite-web and parses its JSON response
+// into v. Responses are cached for the metadata cache TTL.
+func (c *Client) fetchMetadata(ctx context.Context, endpoint string, params map[string]string, v interface{}) error {
+	u, err := prepareURL(c.cfg.Read.URL, endpoint, params)
+	if err != nil {
+		level.Warn(c.logger).Log(
+			"graphite_web", c.cfg.Read.URL, "path", endpoint,
+			"err", err, "msg", "Error preparing URL")
+		return err
+	}
+	return c.fetchMetadataURL(ctx, u, v)
+}
+
+// fetchMetadataURL is fetchMetadata on a prepared URL.
+func (c *Client) fetchMetadataURL(ctx context.Context, u *url.URL, v interface{}) error {
+	body, cached := []byte(nil), false
+	if c.metadataCache != nil {
+		body, cached = c.metadataCache.get(u.String())
+	}
+	if !cached {
+		var err error
+		body, err = fetchURL(ctx, c.httpClient, c.logger, u)
+		if err != nil {
+			level.Warn(c.logger).Log("url", u, "err", err, "msg", "Error fetching URL")
+			return err
+		}
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		level.Warn(c.logger).Log(
+			"url", u, "err", err, "msg", "Error parsing metadata response body")
+		return err
+	}
+	if c.metadataCache != nil && !cached {
+		c.metadataCache.set(u.String(), body)
+	}
+	return nil
+}
+
+// metadataContext returns the context of a metadata request, bounded by the
+// read timeout.
+func (c *Client) metadataContext(r *http.Request) (context.Context, context.CancelFunc) {
+	if c.readTimeout <= 0 {
+		return context.WithCancel(r.Context())
+	}
+	return context.WithTimeout(r.Context(), c.readTimeout)
+}
+
+// nameExpr returns the tag expression selecting the series of metric.
+func (c *Client) nameExpr(prefix string, metric string) string {
+	return "name=" + prefix + c.escapeTagValue(metric, prompb.LabelMatcher_EQ)
+}
+
+func labelsToMetric(labels []*prompb.Label) model.Metric {
+	m := make(model.Metric, len(labels))
+	for _, l := range labels {
+		m[model.LabelName(l.Name)] = model.LabelValue(l.Value)
+	}
+	return m
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,123 @@
+// Copyright 2018 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphite
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+
+	"golang.org/x/net/context"
+
+	"github.com/criteo/graphite-remote-adapter/client/graphite/config"
+)
+
+// fakeGraphiteMetadata returns fetchURL answering the metadata requests with
+// the bodies of responses by URL, and counting the requests.
+func fakeGraphiteMetadata(responses map[string]string, fetches *int) func(context.Context, *http.Client, log.Logger, *url.URL) ([]byte, error) {
+	return func(ctx context.Context, hc *http.Client, l log.Logger, u *url.URL) ([]byte, error) {
+		*fetches++
+		body, ok := responses[u.String()]
+		if !ok {
+			return []byte("[]"), nil
+		}
+		return []byte(body), nil
+	}
+}
+
+func newTestMetadataClient(enableTags bool) *Client {
+	return &Client{
+		logger: log.NewNopLogger(),
+		cfg: &config.Config{
+			DefaultPrefix: "prometheus-prefix.",
+			EnableTags:    enableTags,
+			Read:          config.ReadConfig{URL: "http://fakeHost:6666"},
+		},
+		metadataCache: newReadCache(time.Minute, 100),
+	}
+}
+
+func TestLabelValuesFromFind(t *testing.T) {
+	fetches := 0
+	fetchURL = fakeGraphiteMetadata(map[string]string{
+		"http://fakeHost:6666/metrics/find?query=prometheus-prefix.%2A": `[
+			{"id": "prometheus-prefix.up", "text": "up", "leaf": 0},
+			{"id": "prometheus-prefix.test", "text": "test", "leaf": 0},
+			{"id": "prometheus-prefix.scrape_duration_seconds", "text": "scrape_duration_seconds", "leaf": 1}
+		]`,
+		"http://fakeHost:6666/metrics/expand?format=json&leavesOnly=1&query=prometheus-prefix.test.%2A%2A": `{"results": [
+			"prometheus-prefix.test.owner.team-X",
+			"prometheus-prefix.test.instance.host%3A9100.owner.team-Y",
+			"prometheus-prefix.test.odd"
+		]}`,
+	}, &fetches)
+	c := newTestMetadataClient(false)
+	r, _ := http.NewRequest("GET", "http://fakeHost:6666", nil)
+
+	values, err := c.LabelValues(string(model.MetricNameLabel), "", r)
+	require.NoError(t, err)
+	require.Equal(t, []string{"scrape_duration_seconds", "test", "up"}, values)
+
+	values, err = c.LabelValues("owner", "test", r)
+	require.NoError(t, err)
+	require.Equal(t, []string{"team-X", "team-Y"}, values)
+
+	names, err := c.LabelNames("test", r)
+	require.NoError(t, err)
+	require.Equal(t, []string{"__name__", "instance", "owner"}, names)
+
+	series, err := c.Series("test", r)
+	require.NoError(t, err)
+	require.Equal(t, []model.Metric{
+		{model.MetricNameLabel: "test", "owner": "team-X"},
+		{model.MetricNameLabel: "test", "instance": "host%3A9100", "owner": "team-Y"},
+	}, series)
+
+	// The responses are cached.
+	require.Equal(t, 2, fetches)
+}
+
+func TestLabelValuesFromTags(t *testing.T) {
+	fetches := 0
+	fetchURL = fakeGraphiteMetadata(map[string]string{
+		"http://fakeHost:6666/tags?":      `[{"tag": "name"}, {"tag": "owner"}, {"tag": "dc%3Bzone"}]`,
+		"http://fakeHost:6666/tags/name?": `{"tag": "name", "values": [{"value": "prometheus-prefix.up"}, {"value": "other.up"}, {"value": "prometheus-prefix.test"}]}`,
+		"http://fakeHost:6666/tags/autoComplete/values?expr=name%3Dprometheus-prefix.test&limit=10000&tag=owner": `["team-X", "team%3BY"]`,
+		"http://fakeHost:6666/tags/findSeries?expr=name%3Dprometheus-prefix.test":                                `["prometheus-prefix.test;owner=team-X"]`,
+	}, &fetches)
+	c := newTestMetadataClient(true)
+	r, _ := http.NewRequest("GET", "http://fakeHost:6666", nil)
+
+	names, err := c.LabelNames("", r)
+	require.NoError(t, err)
+	require.Equal(t, []string{"__name__", "dc;zone", "owner"}, names)
+
+	values, err := c.LabelValues(string(model.MetricNameLabel), "", r)
+	require.NoError(t, err)
+	require.Equal(t, []string{"test", "up"}, values)
+
+	values, err = c.LabelValues("owner", "test", r)
+	require.NoError(t, err)
+	require.Equal(t, []string{"team-X", "team;Y"}, values)
+
+	series, err := c.Series("test", r)
+	require.NoError(t, err)
+	require.Equal(t, []model.Metric{{model.MetricNameLabel: "test", "owner": "team-X"}}, series)
+	require.Equal(t, 4, fetches)
+}
@@ -0,0 +1,86 @@
+// Copyright 2018 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphite
+
+import (
+	"sync"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/criteo/graphite-remote-adapter/client"
+)
+
+// typeLabel holds the type hint of a metric written in the OpenMetrics
+// format.
+const typeLabel = "__type__"
+
+// metricsMetadata keeps the metadata of the metrics across the requests and
+// the config reloads, since Prometheus only sends it from time to time.
+var metricsMetadata = newMetadataStore()
+
+// metadataStore holds the metadata of the metrics by name.
+type metadataStore struct {
+	lock     sync.RWMutex
+	metadata map[string]client.MetricMetadata
+}
+
+func newMetadataStore() *metadataStore {
+	return &metadataStore{metadata: make(map[string]client.MetricMetadata)}
+}
+
+func (m *metadataStore) set(metadata []client.MetricMetadata) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, md := range metadata {
+		m.metadata[md.MetricFamilyName] = md
+	}
+}
+
+func (m *metadataStore) get(name model.LabelValue) client.MetricMetadata {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.metadata[string(name)]
+}
+
+// templateMetadata returns the metadata of m as the .meta of the templates,
+// with empty values if it isn't known.
+func templateMetadata(m model.Metric) map[string]string {
+	md := metricsMetadata.get(m[model.MetricNameLabel])
+	return map[string]string{
+		"type": md.Type,
+		"help": md.Help,
+		"unit": md.Unit,
+	}
+}
+
+// WriteMetadata implements the client.MetadataWriter interface.
+func (c *Client) WriteMetadata(metadata []client.MetricMetadata) {
+	metricsMetadata.set(metadata)
+}
+
+// withTypeHint returns s with the type of its metric as the __type__ label,
+// or s itself if the type isn't known. s is shared with the other writers,
+// so it's copied.
+func (c *Client) withTypeHint(s *model.Sample) *model.Sample {
+	typ := metricsMetadata.get(s.Metric[model.MetricNameLabel]).Type
+	if typ == "" {
+		return s
+	}
+	m := make(model.Metric, len(s.Metric)+1)
+	for k, v := range s.Metric {
+		m[k] = v
+	}
+	m[typeLabel] = model.LabelValue(typ)
+	return &model.Sample{Metric: m, Value: s.Value, Timestamp: s.Timestamp}
+}
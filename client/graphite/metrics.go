@@ -0,0 +1,245 @@
+// Copyright 2018 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphite
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Constants for instrumentation.
+const namespace = "remote_adapter_graphite"
+
+var (
+	carbonPoolSize = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "carbon_pool_size",
+			Help:      "Number of connections in the carbon connection pool.",
+		},
+	)
+	carbonPoolInUse = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "carbon_pool_in_use",
+			Help:      "Number of carbon connections currently used by writers.",
+		},
+	)
+	carbonReconnects = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "carbon_reconnects_total",
+			Help:      "Total number of attempts to replace a connection to carbon.",
+		},
+	)
+	droppedSamples = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "dropped_samples_total",
+			Help:      "Total number of samples not sent to Graphite because no path matched them, by reason: relabeling, rule or error.",
+		},
+		[]string{"reason"},
+	)
+	oldSamples = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "old_samples_total",
+			Help:      "Total number of samples not sent to Graphite because they were older than the max sample age.",
+		},
+	)
+	futureSamples = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "future_samples_total",
+			Help:      "Total number of samples further in the future than the max future skew, dropped or clamped.",
+		},
+	)
+	dryRunPoints = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "dry_run_points_total",
+			Help:      "Total number of points which would have been sent to Graphite in dry run mode.",
+		},
+	)
+	staleMarkers = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "stale_markers_total",
+			Help:      "Total number of Prometheus staleness markers dropped or written as an end value.",
+		},
+	)
+	counterResets = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "counter_resets_total",
+			Help:      "Total number of counter resets met while writing counter deltas.",
+		},
+	)
+	dedupedPoints = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "deduplicated_points_total",
+			Help:      "Total number of points not sent to Graphite because they duplicated a recent one.",
+		},
+	)
+	throttledPoints = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "throttled_points_total",
+			Help:      "Total number of points delayed or refused by the carbon write rate limit.",
+		},
+	)
+	matchedSamples = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "rule_matched_samples_total",
+			Help:      "Total number of samples matched by at least one write rule.",
+		},
+	)
+	ruleMatches = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "rule_matches_total",
+			Help:      "Total number of samples matched by each write rule.",
+		},
+		[]string{"rule_index", "rule_name"},
+	)
+	ruleDropped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "rule_dropped_total",
+			Help:      "Total number of samples dropped by each write rule.",
+		},
+		[]string{"rule_index", "rule_name"},
+	)
+	spoolSegments = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "spool_segments",
+			Help:      "Number of segments waiting in the spool to be replayed, by carbon destination.",
+		},
+		[]string{"destination"},
+	)
+	spoolSize = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "spool_size_bytes",
+			Help:      "Size of the segments waiting in the spool to be replayed, by carbon destination.",
+		},
+		[]string{"destination"},
+	)
+	destinationWrites = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "destination_writes_total",
+			Help:      "Total number of batches written to each carbon destination, by result: success, spooled or failure.",
+		},
+		[]string{"destination", "result"},
+	)
+	shadowWrites = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "shadow_writes_total",
+			Help:      "Total number of batches written to each shadow carbon destination, by result: success or failure.",
+		},
+		[]string{"destination", "result"},
+	)
+	heartbeats = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "heartbeats_total",
+			Help:      "Total number of heartbeats written to carbon, by result: success or failure.",
+		},
+		[]string{"result"},
+	)
+	longPaths = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "long_paths_total",
+			Help:      "Total number of paths longer than the maximum path length, dropped, truncated or hashed.",
+		},
+	)
+	nameCollisions = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "name_collisions_total",
+			Help:      "Total number of metrics with a label named like the metric in their default carbon path.",
+		},
+	)
+	batchFlushes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "batch_flushes_total",
+			Help:      "Total number of batches flushed, by reason: size, interval or shutdown.",
+		},
+		[]string{"reason"},
+	)
+	batchFlushPoints = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "batch_flush_points",
+			Help:      "Number of points of the flushed batches.",
+			Buckets:   prometheus.ExponentialBuckets(1, 4, 10),
+		},
+	)
+	readCacheHits = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "read_cache_hits_total",
+			Help:      "Total number of render requests served from the read cache.",
+		},
+	)
+	readCacheMisses = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "read_cache_misses_total",
+			Help:      "Total number of render requests not found in the read cache.",
+		},
+	)
+	rejectedReadQueries = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "rejected_read_queries_total",
+			Help:      "Total number of read queries rejected for matching more than max_series series.",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(carbonPoolSize)
+	prometheus.MustRegister(carbonPoolInUse)
+	prometheus.MustRegister(carbonReconnects)
+	prometheus.MustRegister(droppedSamples)
+	prometheus.MustRegister(oldSamples)
+	prometheus.MustRegister(futureSamples)
+	prometheus.MustRegister(dryRunPoints)
+	prometheus.MustRegister(staleMarkers)
+	prometheus.MustRegister(dedupedPoints)
+	prometheus.MustRegister(throttledPoints)
+	prometheus.MustRegister(matchedSamples)
+	prometheus.MustRegister(ruleMatches)
+	prometheus.MustRegister(ruleDropped)
+	prometheus.MustRegister(spoolSegments)
+	prometheus.MustRegister(spoolSize)
+	prometheus.MustRegister(destinationWrites)
+	prometheus.MustRegister(shadowWrites)
+	prometheus.MustRegister(heartbeats)
+	prometheus.MustRegister(longPaths)
+	prometheus.MustRegister(nameCollisions)
+	prometheus.MustRegister(batchFlushes)
+	prometheus.MustRegister(batchFlushPoints)
+	prometheus.MustRegister(readCacheHits)
+	prometheus.MustRegister(readCacheMisses)
+	prometheus.MustRegister(rejectedReadQueries)
+	prometheus.MustRegister(counterResets)
+}
@@ -0,0 +1,93 @@
+// Copyright 2018 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphite
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/prometheus/prometheus/prompb"
+
+	"github.com/criteo/graphite-remote-adapter/client/graphite/config"
+)
+
+// labelsFromPattern parses the labels of path with p, returning false if the
+// path doesn't match the pattern.
+func labelsFromPattern(p *config.PathPattern, path string) ([]*prompb.Label, bool) {
+	nodes := strings.Split(path, ".")
+	if len(nodes) != len(p.Nodes()) {
+		return nil, false
+	}
+	labels := make([]*prompb.Label, 0, len(nodes)+len(p.Labels))
+	for i, node := range p.Nodes() {
+		if label, ok := config.PatternLabel(node); ok {
+			labels = append(labels, &prompb.Label{Name: string(label), Value: nodes[i]})
+		} else if node != nodes[i] {
+			return nil, false
+		}
+	}
+	for ln, lv := range p.Labels {
+		labels = append(labels, &prompb.Label{Name: string(ln), Value: string(lv)})
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+	return labels, true
+}
+
+// patternGlob returns the glob expanding to the paths of p which may match
+// query, narrowed down by its equality matchers. It returns false if none can
+// match.
+func patternGlob(p *config.PathPattern, query *prompb.Query) (string, bool) {
+	equals := make(map[string]string)
+	for _, m := range query.Matchers {
+		if m.Type == prompb.LabelMatcher_EQ {
+			equals[m.Name] = m.Value
+		}
+	}
+	for ln, lv := range p.Labels {
+		if v, ok := equals[string(ln)]; ok && v != string(lv) {
+			return "", false
+		}
+	}
+
+	nodes := make([]string, len(p.Nodes()))
+	for i, node := range p.Nodes() {
+		label, ok := config.PatternLabel(node)
+		if !ok {
+			nodes[i] = node
+			continue
+		}
+		v, ok := equals[string(label)]
+		switch {
+		case !ok || v == "":
+			nodes[i] = "*"
+		case strings.Contains(v, "."):
+			// A node can't hold it.
+			return "", false
+		default:
+			nodes[i] = v
+		}
+	}
+	return strings.Join(nodes, "."), true
+}
+
+// labelsFromPath parses the labels of a path with the first path pattern
+// matching it, or as a default path.
+func (c *Client) labelsFromPath(path string, prefix string) ([]*prompb.Label, error) {
+	for _, p := range c.cfg.Read.PathPatterns {
+		if labels, ok := labelsFromPattern(p, path); ok {
+			return labels, nil
+		}
+	}
+	return metricLabelsFromPath(path, prefix)
+}
@@ -0,0 +1,72 @@
+// Copyright 2018 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphite
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+)
+
+// Pickle opcodes used to encode carbon datapoints, see
+// https://github.com/python/cpython/blob/master/Lib/pickletools.py
+const (
+	pickleProto      = 0x80
+	pickleEmptyList  = ']'
+	pickleMark       = '('
+	pickleBinUnicode = 'X'
+	pickleBinFloat   = 'G'
+	pickleTuple2     = 0x86
+	pickleAppends    = 'e'
+	pickleStop       = '.'
+)
+
+// encodePickle serializes points as a frame of the carbon pickle protocol:
+// a 4-byte big-endian length followed by the pickled list of
+// (path, (timestamp, value)) tuples.
+// See http://graphite.readthedocs.io/en/latest/feeding-carbon.html#the-pickle-protocol
+func encodePickle(points []dataPoint) []byte {
+	var buf bytes.Buffer
+
+	// Room for the length header, filled once the payload is known.
+	buf.Write([]byte{0, 0, 0, 0})
+
+	buf.Write([]byte{pickleProto, 2, pickleEmptyList, pickleMark})
+	for _, p := range points {
+		writePickleString(&buf, p.path)
+		writePickleFloat(&buf, p.timestamp)
+		writePickleFloat(&buf, p.value)
+		buf.Write([]byte{pickleTuple2, pickleTuple2})
+	}
+	buf.Write([]byte{pickleAppends, pickleStop})
+
+	frame := buf.Bytes()
+	binary.BigEndian.PutUint32(frame, uint32(len(frame)-4))
+	return frame
+}
+
+func writePickleString(buf *bytes.Buffer, s string) {
+	var size [4]byte
+	binary.LittleEndian.PutUint32(size[:], uint32(len(s)))
+	buf.WriteByte(pickleBinUnicode)
+	buf.Write(size[:])
+	buf.WriteString(s)
+}
+
+func writePickleFloat(buf *bytes.Buffer, f float64) {
+	var bits [8]byte
+	binary.BigEndian.PutUint64(bits[:], math.Float64bits(f))
+	buf.WriteByte(pickleBinFloat)
+	buf.Write(bits[:])
+}
@@ -0,0 +1,135 @@
+// Copyright 2018 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphite
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+
+	"github.com/criteo/graphite-remote-adapter/client/graphite/config"
+)
+
+// unpickle decodes the subset of pickle opcodes emitted by encodePickle.
+func unpickle(payload []byte) ([]dataPoint, error) {
+	var stack []interface{}
+	var marks []int
+	for i := 0; i < len(payload); {
+		op := payload[i]
+		i++
+		switch op {
+		case pickleProto:
+			i++
+		case pickleEmptyList:
+			stack = append(stack, []interface{}{})
+		case pickleMark:
+			marks = append(marks, len(stack))
+		case pickleBinUnicode:
+			size := int(binary.LittleEndian.Uint32(payload[i:]))
+			stack = append(stack, string(payload[i+4:i+4+size]))
+			i += 4 + size
+		case pickleBinFloat:
+			stack = append(stack, math.Float64frombits(binary.BigEndian.Uint64(payload[i:])))
+			i += 8
+		case pickleTuple2:
+			tuple := [2]interface{}{stack[len(stack)-2], stack[len(stack)-1]}
+			stack = append(stack[:len(stack)-2], tuple)
+		case pickleAppends:
+			mark := marks[len(marks)-1]
+			marks = marks[:len(marks)-1]
+			list := append(stack[mark-1].([]interface{}), stack[mark:]...)
+			stack = append(stack[:mark-1], list)
+		case pickleStop:
+			var points []dataPoint
+			for _, item := range stack[0].([]interface{}) {
+				tuple := item.([2]interface{})
+				datapoint := tuple[1].([2]interface{})
+				points = append(points, dataPoint{
+					path:      tuple[0].(string),
+					timestamp: datapoint[0].(float64),
+					value:     datapoint[1].(float64),
+				})
+			}
+			return points, nil
+		default:
+			return nil, fmt.Errorf("unexpected opcode %x", op)
+		}
+	}
+	return nil, fmt.Errorf("missing stop opcode")
+}
+
+func TestEncodePickle(t *testing.T) {
+	points := []dataPoint{
+		{path: "prefix.test:metric.owner.team-X", value: 42, timestamp: 1500000000},
+		{path: "prefix.test:metric;owner=team-Y", value: -1.5, timestamp: 1500000000.5},
+	}
+
+	frame := encodePickle(points)
+	require.Equal(t, uint32(len(frame)-4), binary.BigEndian.Uint32(frame))
+
+	actual, err := unpickle(frame[4:])
+	require.NoError(t, err)
+	require.Equal(t, points, actual)
+}
+
+func TestPickleRoundTrip(t *testing.T) {
+	c := &Client{
+		logger: log.NewNopLogger(),
+		cfg: &config.Config{
+			Write: config.WriteConfig{
+				CarbonProtocol:        "pickle",
+				CarbonPickleBatchSize: 2,
+			},
+		},
+		format:         FormatCarbon,
+		ignoredSamples: prometheus.NewCounter(prometheus.CounterOpts{Name: "ignored"}),
+	}
+
+	samples := model.Samples{
+		{Metric: model.Metric{model.MetricNameLabel: "a"}, Value: 1, Timestamp: 1000},
+		{Metric: model.Metric{model.MetricNameLabel: "b"}, Value: 2, Timestamp: 2000},
+		{Metric: model.Metric{model.MetricNameLabel: "c"}, Value: 3, Timestamp: 3500},
+	}
+	var points []dataPoint
+	for _, s := range samples {
+		for _, path := range pathsFromMetric(s.Metric, c.format, "prefix.", &config.WriteConfig{}) {
+			p, ok := c.prepareDataPoint(path, s)
+			require.True(t, ok)
+			points = append(points, p)
+		}
+	}
+
+	// Three points with a batch size of two make two frames.
+	frames, err := c.encodeDataPoints(points)
+	require.NoError(t, err)
+	require.Len(t, frames, 2)
+
+	var actual []dataPoint
+	for _, frame := range frames {
+		decoded, err := unpickle(frame[4:])
+		require.NoError(t, err)
+		actual = append(actual, decoded...)
+	}
+	require.Equal(t, []dataPoint{
+		{path: "prefix.a", value: 1, timestamp: 1},
+		{path: "prefix.b", value: 2, timestamp: 2},
+		{path: "prefix.c", value: 3, timestamp: 3.5},
+	}, actual)
+}
@@ -0,0 +1,250 @@
+// Copyright 2018 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphite
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	"golang.org/x/net/context"
+
+	"github.com/criteo/graphite-remote-adapter/client"
+)
+
+// pushdownFuncs maps the PromQL aggregations we can push down to the graphite
+// function aggregating a whole series list and to the groupByTags callback.
+var pushdownFuncs = map[string]struct{ series, callback string }{
+	"sum": {"sumSeries", "sum"},
+	"avg": {"averageSeries", "average"},
+	"max": {"maxSeries", "max"},
+	"min": {"minSeries", "min"},
+}
+
+// pushdownTarget returns the render target computing the aggregation hinted
+// for query. It returns false if the aggregation can't be computed by
+// graphite-web, the raw series must then be fetched.
+func (c *Client) pushdownTarget(query *prompb.Query, hints *client.ReadHints, graphitePrefix string) (string, bool, error) {
+	if hints == nil {
+		return "", false, nil
+	}
+	fn, ok := pushdownFuncs[hints.Func]
+	if !ok {
+		return "", false, nil
+	}
+	// Aggregating "without" labels would need to know all the others.
+	if len(hints.Grouping) > 0 && !hints.By {
+		return "", false, nil
+	}
+
+	if c.cfg.EnableTags {
+		targets, err := c.queryToTargetsWithTags(nil, query, graphitePrefix)
+		if err != nil {
+			return "", false, err
+		}
+		if len(hints.Grouping) == 0 {
+			return fn.series + "(" + targets[0] + ")", true, nil
+		}
+		args := []string{targets[0], strconv.Quote(fn.callback)}
+		for _, g := range hints.Grouping {
+			args = append(args, strconv.Quote(g))
+		}
+		return "groupByTags(" + strings.Join(args, ",") + ")", true, nil
+	}
+
+	// Without tags, only equality matchers can be part of the target and we
+	// can't group by label.
+	if len(hints.Grouping) > 0 {
+		return "", false, nil
+	}
+	for _, m := range query.Matchers {
+		if m.Type != prompb.LabelMatcher_EQ {
+			return "", false, nil
+		}
+	}
+	target, err := c.queryToGlobTarget(query, graphitePrefix)
+	if err != nil {
+		return "", false, err
+	}
+	return fn.series + "(" + target + ")", true, nil
+}
+
+// handlePushdownReadQuery fetches the aggregated series computed by target.
+// Their labels are the equality matchers of query and the grouping labels,
+// Prometheus then aggregates them again, which leaves them unchanged.
+func (c *Client) handlePushdownReadQuery(ctx context.Context, query *prompb.Query, hints *client.ReadHints, target string, fromStr string, untilStr string, step time.Duration) (*prompb.QueryResult, error) {
+	level.Debug(c.logger).Log(
+		"target", target, "from", fromStr, "until", untilStr, "msg", "Fetching aggregated data")
+	renderResponses, err := c.render(ctx, target, fromStr, untilStr, step)
+	if err != nil {
+		return nil, err
+	}
+
+	var name string
+	var labels []*prompb.Label
+	for _, m := range query.Matchers {
+		if m.Type != prompb.LabelMatcher_EQ || m.Value == "" {
+			continue
+		}
+		if m.Name == model.MetricNameLabel {
+			name = m.Value
+		}
+		labels = append(labels, &prompb.Label{Name: m.Name, Value: m.Value})
+	}
+	if name == "" {
+		return nil, fmt.Errorf("Invalid remote query: no %s label provided", model.MetricNameLabel)
+	}
+
+	queryResult := &prompb.QueryResult{}
+	for _, renderResponse := range renderResponses {
+		ts := &prompb.TimeSeries{Labels: labels}
+		if len(hints.Grouping) > 0 {
+			ts.Labels = []*prompb.Label{{Name: model.MetricNameLabel, Value: name}}
+			for _, g := range hints.Grouping {
+				if v := renderResponse.Tags[g]; v != "" {
+					ts.Labels = append(ts.Labels, &prompb.Label{Name: g, Value: v})
+				}
+			}
+		}
+		ts.Samples = alignSamples(
+			samplesFromDatapoints(renderResponse.Datapoints, c.cfg.Read.MaxPointDelta), step)
+		queryResult.Timeseries = append(queryResult.Timeseries, ts)
+	}
+	return queryResult, nil
+}
+
+// counterFuncs maps the PromQL functions on counters we can push down to the
+// graphite function computing them, resets included.
+var counterFuncs = map[string]string{
+	"rate":     "perSecond",
+	"increase": "nonNegativeDerivative",
+}
+
+// counterPushdownTarget returns the render target computing the counter
+// function hinted for query, and the graphite function it wraps the series
+// in. It returns false if the function can't be computed by graphite-web.
+func (c *Client) counterPushdownTarget(query *prompb.Query, hints *client.ReadHints, graphitePrefix string) (string, string, bool, error) {
+	if hints == nil {
+		return "", "", false, nil
+	}
+	fn, ok := counterFuncs[hints.Func]
+	if !ok {
+		return "", "", false, nil
+	}
+
+	if c.cfg.EnableTags {
+		targets, err := c.queryToTargetsWithTags(nil, query, graphitePrefix)
+		if err != nil {
+			return "", "", false, err
+		}
+		return fn + "(" + targets[0] + ")", fn, true, nil
+	}
+
+	// Without tags, the labels of the series are parsed back from their
+	// paths, which the glob must carry whole.
+	for _, m := range query.Matchers {
+		if m.Type != prompb.LabelMatcher_EQ {
+			return "", "", false, nil
+		}
+	}
+	target, err := c.queryToGlobTarget(query, graphitePrefix)
+	if err != nil {
+		return "", "", false, err
+	}
+	return fn + "(" + target + ")", fn, true, nil
+}
+
+// handleCounterPushdownReadQuery fetches the series computed by target, the
+// counter function fn of the series of query. Prometheus applies the function
+// again on the returned series, so they are integrated back into counters,
+// without the resets graphite accounted for. It returns false if a series
+// name isn't the one fn gives, the raw series must then be fetched.
+func (c *Client) handleCounterPushdownReadQuery(ctx context.Context, query *prompb.Query, target string, fn string, fromStr string, untilStr string, step time.Duration, graphitePrefix string) (*prompb.QueryResult, bool, error) {
+	level.Debug(c.logger).Log(
+		"target", target, "from", fromStr, "until", untilStr, "msg", "Fetching counter data")
+	renderResponses, err := c.render(ctx, target, fromStr, untilStr, step)
+	if err != nil {
+		return nil, false, err
+	}
+
+	queryResult := &prompb.QueryResult{}
+	for _, renderResponse := range renderResponses {
+		path := renderResponse.Target
+		if !strings.HasPrefix(path, fn+"(") || !strings.HasSuffix(path, ")") {
+			level.Debug(c.logger).Log(
+				"target", target, "series", path, "msg", "Unexpected counter series, fetching the raw series")
+			return nil, false, nil
+		}
+		path = path[len(fn)+1 : len(path)-1]
+
+		ts := &prompb.TimeSeries{}
+		if c.cfg.EnableTags && len(renderResponse.Tags) > 0 {
+			tags := Tags{}
+			for k, v := range renderResponse.Tags {
+				if k != fn {
+					tags[k] = v
+				}
+			}
+			ts.Labels, err = metricLabelsFromTags(tags, graphitePrefix)
+			c.unescapeLabels(ts.Labels)
+		} else if c.cfg.EnableTags {
+			ts.Labels, err = metricLabelsFromTaggedPath(path, graphitePrefix)
+			c.unescapeLabels(ts.Labels)
+		} else {
+			ts.Labels, err = c.labelsFromPath(path, graphitePrefix)
+		}
+		if err != nil {
+			return nil, false, err
+		}
+
+		match, err := matchQuery(query, ts.Labels)
+		if err != nil {
+			return nil, false, err
+		}
+		if !match {
+			continue
+		}
+		ts.Samples = alignSamples(integrateDatapoints(renderResponse.Datapoints, fn == "perSecond"), step)
+		queryResult.Timeseries = append(queryResult.Timeseries, ts)
+	}
+	return queryResult, true, nil
+}
+
+// integrateDatapoints returns the counter whose increases are datapoints,
+// starting from 0 before the first of them. Per second increases are
+// multiplied by the time elapsed since the previous datapoint.
+func integrateDatapoints(datapoints []*Datapoint, perSecond bool) []*prompb.Sample {
+	samples := []*prompb.Sample{}
+	var counter float64
+	for i, datapoint := range datapoints {
+		if datapoint.Value == nil || i == 0 {
+			continue
+		}
+		previous := datapoints[i-1].Timestamp
+		if len(samples) == 0 {
+			samples = append(samples, &prompb.Sample{Timestamp: previous * 1000})
+		}
+		if perSecond {
+			counter += *datapoint.Value * float64(datapoint.Timestamp-previous)
+		} else {
+			counter += *datapoint.Value
+		}
+		samples = append(samples, &prompb.Sample{Value: counter, Timestamp: datapoint.Timestamp * 1000})
+	}
+	return samples
+}
@@ -0,0 +1,182 @@
+// Copyright 2018 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphite
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"github.com/criteo/graphite-remote-adapter/client"
+)
+
+var pushdownQuery = &prompb.Query{
+	StartTimestampMs: int64(0),
+	EndTimestampMs:   int64(300000),
+	Matchers: []*prompb.LabelMatcher{
+		&prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: model.MetricNameLabel, Value: "test"},
+		&prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: "owner", Value: "team-X"},
+	},
+}
+
+func TestPushdownTargetWithTags(t *testing.T) {
+	testClient.cfg.EnableTags = true
+	defer func() { testClient.cfg.EnableTags = false }()
+
+	// sum by (owner) (test{owner="team-X"})
+	hints := &client.ReadHints{Func: "sum", Grouping: []string{"owner"}, By: true}
+	target, ok, err := testClient.pushdownTarget(pushdownQuery, hints, testClient.cfg.DefaultPrefix)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t,
+		`groupByTags(seriesByTag("name=prometheus-prefix.test","owner=team-X"),"sum","owner")`,
+		target)
+
+	// avg(test{owner="team-X"})
+	hints = &client.ReadHints{Func: "avg"}
+	target, ok, err = testClient.pushdownTarget(pushdownQuery, hints, testClient.cfg.DefaultPrefix)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, `averageSeries(seriesByTag("name=prometheus-prefix.test","owner=team-X"))`, target)
+}
+
+func TestPushdownTargetWithPaths(t *testing.T) {
+	hints := &client.ReadHints{Func: "max"}
+	target, ok, err := testClient.pushdownTarget(pushdownQuery, hints, testClient.cfg.DefaultPrefix)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "maxSeries(prometheus-prefix.test.**.owner.team-X.**)", target)
+}
+
+func TestPushdownTargetFallback(t *testing.T) {
+	reQuery := &prompb.Query{
+		Matchers: []*prompb.LabelMatcher{
+			&prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: model.MetricNameLabel, Value: "test"},
+			&prompb.LabelMatcher{Type: prompb.LabelMatcher_RE, Name: "owner", Value: "team-.*"},
+		},
+	}
+	for _, tc := range []struct {
+		query *prompb.Query
+		hints *client.ReadHints
+	}{
+		// No hints.
+		{query: pushdownQuery, hints: nil},
+		// Unsupported function.
+		{query: pushdownQuery, hints: &client.ReadHints{Func: "rate"}},
+		// Aggregation without labels.
+		{query: pushdownQuery, hints: &client.ReadHints{Func: "sum", Grouping: []string{"owner"}}},
+		// Grouping by label requires tags.
+		{query: pushdownQuery, hints: &client.ReadHints{Func: "sum", Grouping: []string{"owner"}, By: true}},
+		// Non equality matchers can't be part of a path.
+		{query: reQuery, hints: &client.ReadHints{Func: "sum"}},
+	} {
+		_, ok, err := testClient.pushdownTarget(tc.query, tc.hints, testClient.cfg.DefaultPrefix)
+		require.NoError(t, err)
+		require.False(t, ok, "hints: %v", tc.hints)
+	}
+}
+
+func TestPushdownReadQuery(t *testing.T) {
+	fetchURL = func(ctx context.Context, hc *http.Client, l log.Logger, u *url.URL) ([]byte, error) {
+		var body bytes.Buffer
+		if u.String() == "http://fakeHost:6666/render/?format=json&from=0&target=groupByTags%28seriesByTag%28%22name%3Dprometheus-prefix.test%22%2C%22owner%3Dteam-X%22%29%2C%22sum%22%2C%22owner%22%29&until=300" {
+			body.WriteString("[{\"target\": \"sum;owner=team-X\", \"tags\": {\"name\": \"sum\", \"owner\": \"team-X\"}, \"datapoints\": [[18,0], [42,300]]}]")
+		}
+		return body.Bytes(), nil
+	}
+	testClient.cfg.EnableTags = true
+	testClient.cfg.Read.Pushdown = true
+	defer func() {
+		testClient.cfg.EnableTags = false
+		testClient.cfg.Read.Pushdown = false
+	}()
+
+	hints := &client.ReadHints{Func: "sum", Grouping: []string{"owner"}, By: true}
+	result, err := testClient.handleReadQuery(nil, pushdownQuery, hints, testClient.cfg.DefaultPrefix)
+	require.NoError(t, err)
+	require.Equal(t, []*prompb.TimeSeries{{Labels: expectedLabels, Samples: expectedSamples}}, result.Timeseries)
+}
+
+func TestCounterPushdownTarget(t *testing.T) {
+	// rate(test{owner="team-X"}[5m])
+	hints := &client.ReadHints{Func: "rate", RangeMs: 300000}
+	target, fn, ok, err := testClient.counterPushdownTarget(pushdownQuery, hints, testClient.cfg.DefaultPrefix)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "perSecond", fn)
+	require.Equal(t, "perSecond(prometheus-prefix.test.**.owner.team-X.**)", target)
+
+	testClient.cfg.EnableTags = true
+	defer func() { testClient.cfg.EnableTags = false }()
+
+	// increase(test{owner="team-X"}[5m])
+	hints = &client.ReadHints{Func: "increase", RangeMs: 300000}
+	target, fn, ok, err = testClient.counterPushdownTarget(pushdownQuery, hints, testClient.cfg.DefaultPrefix)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "nonNegativeDerivative", fn)
+	require.Equal(t, `nonNegativeDerivative(seriesByTag("name=prometheus-prefix.test","owner=team-X"))`, target)
+
+	// Other functions aren't pushed down.
+	_, _, ok, err = testClient.counterPushdownTarget(pushdownQuery, &client.ReadHints{Func: "deriv"}, testClient.cfg.DefaultPrefix)
+	require.NoError(t, err)
+	require.False(t, ok)
+}
+
+func TestCounterPushdownReadQuery(t *testing.T) {
+	renderURL := "http://fakeHost:6666/render/?format=json&from=0&target=perSecond%28prometheus-prefix.test.%2A%2A.owner.team-X.%2A%2A%29&until=300"
+	series := "perSecond(prometheus-prefix.test.owner.team-X)"
+	expanded := false
+	fetchURL = func(ctx context.Context, hc *http.Client, l log.Logger, u *url.URL) ([]byte, error) {
+		var body bytes.Buffer
+		if u.String() == renderURL {
+			body.WriteString("[{\"target\": \"" + series + "\", \"datapoints\": [[null,0], [0.5,100], [0.25,200], [null,300]]}]")
+		} else if u.Path == "/metrics/expand" {
+			expanded = true
+			body.WriteString("{\"results\": []}")
+		}
+		return body.Bytes(), nil
+	}
+	testClient.cfg.Read.Pushdown = true
+	defer func() { testClient.cfg.Read.Pushdown = false }()
+
+	hints := &client.ReadHints{Func: "rate", RangeMs: 300000}
+	result, err := testClient.handleReadQuery(nil, pushdownQuery, hints, testClient.cfg.DefaultPrefix)
+	require.NoError(t, err)
+	require.Equal(t, []*prompb.TimeSeries{{
+		Labels: []*prompb.Label{
+			{Name: model.MetricNameLabel, Value: "test"},
+			{Name: "owner", Value: "team-X"},
+		},
+		Samples: []*prompb.Sample{
+			{Value: 0, Timestamp: 0},
+			{Value: 50, Timestamp: 100000},
+			{Value: 75, Timestamp: 200000},
+		},
+	}}, result.Timeseries)
+
+	// Series not named as expected are fetched raw.
+	series = "prometheus-prefix.test.owner.team-X"
+	result, err = testClient.handleReadQuery(nil, pushdownQuery, hints, testClient.cfg.DefaultPrefix)
+	require.NoError(t, err)
+	require.Empty(t, result.Timeseries)
+	require.True(t, expanded)
+}
@@ -18,6 +18,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
+	"regexp"
+	"regexp/syntax"
+	"sort"
 	"strconv"
 	"sync"
 	"time"
@@ -27,6 +31,10 @@ import (
 	"github.com/prometheus/prometheus/prompb"
 	pmetric "github.com/prometheus/prometheus/storage/metric"
 
+	"github.com/criteo/graphite-remote-adapter/client"
+	"github.com/criteo/graphite-remote-adapter/tracing"
+	"github.com/criteo/graphite-remote-adapter/utils"
+
 	"strings"
 
 	"golang.org/x/net/context"
@@ -47,8 +55,35 @@ func (c *Client) queryToTargets(ctx context.Context, query *prompb.Query, graphi
 		return nil, err
 	}
 
-	// Prepare the url to fetch
-	queryStr := graphitePrefix + name + ".**"
+	// The paths written by templates are expanded with their patterns.
+	queries := []string{graphitePrefix + name + ".**"}
+	for _, p := range c.cfg.Read.PathPatterns {
+		if glob, ok := patternGlob(p, query); ok {
+			queries = append(queries, glob)
+		}
+	}
+
+	var paths []string
+	seen := make(map[string]bool)
+	for _, queryStr := range queries {
+		results, err := c.expand(ctx, queryStr)
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range results {
+			if !seen[path] {
+				seen[path] = true
+				paths = append(paths, path)
+			}
+		}
+	}
+
+	targets, err := c.filterTargets(query, paths, graphitePrefix)
+	return targets, err
+}
+
+// expand returns the leaves matching queryStr.
+func (c *Client) expand(ctx context.Context, queryStr string) ([]string, error) {
 	expandURL, err := prepareURL(c.cfg.Read.URL, expandEndpoint, map[string]string{"format": "json", "leavesOnly": "1", "query": queryStr})
 	if err != nil {
 		level.Warn(c.logger).Log(
@@ -59,7 +94,7 @@ func (c *Client) queryToTargets(ctx context.Context, query *prompb.Query, graphi
 
 	// Get the list of targets
 	expandResponse := ExpandResponse{}
-	body, err := fetchURL(ctx, c.logger, expandURL)
+	body, err := fetchURL(ctx, c.httpClient, c.logger, expandURL)
 	if err != nil {
 		level.Warn(c.logger).Log(
 			"url", expandURL, "err", err, "msg", "Error fetching URL")
@@ -73,12 +108,21 @@ func (c *Client) queryToTargets(ctx context.Context, query *prompb.Query, graphi
 			"msg", "Error parsing expand endpoint response body")
 		return nil, err
 	}
-
-	targets, err := c.filterTargets(query, expandResponse.Results, graphitePrefix)
-	return targets, err
+	return expandResponse.Results, nil
 }
 
 func (c *Client) queryToTargetsWithTags(ctx context.Context, query *prompb.Query, graphitePrefix string) ([]string, error) {
+	exprs, err := c.queryToTagExprs(query, graphitePrefix)
+	if err != nil {
+		return nil, err
+	}
+	targets := []string{"seriesByTag(\"" + strings.Join(exprs, "\",\"") + "\")"}
+	return targets, nil
+}
+
+// queryToTagExprs returns the tag expressions of the tagged series matching
+// query.
+func (c *Client) queryToTagExprs(query *prompb.Query, graphitePrefix string) ([]string, error) {
 	tagSet := []string{}
 
 	for _, m := range query.Matchers {
@@ -86,28 +130,203 @@ func (c *Client) queryToTargetsWithTags(ctx context.Context, query *prompb.Query
 		var value string
 		if m.Name == model.MetricNameLabel {
 			name = "name"
-			value = graphitePrefix + m.Value
+			value = graphitePrefix + c.escapeTagValue(m.Value, m.Type)
 		} else {
-			name = m.Name
-			value = m.Value
+			name = utils.EscapeTagName(m.Name, c.cfg.Write.Escaping.Policy)
+			value = c.escapeTagValue(m.Value, m.Type)
 		}
 
 		switch m.Type {
 		case prompb.LabelMatcher_EQ:
-			tagSet = append(tagSet, "\""+name+"="+value+"\"")
+			tagSet = append(tagSet, name+"="+value)
 		case prompb.LabelMatcher_NEQ:
-			tagSet = append(tagSet, "\""+name+"!="+value+"\"")
+			tagSet = append(tagSet, name+"!="+value)
 		case prompb.LabelMatcher_RE:
-			tagSet = append(tagSet, "\""+name+"=~^("+value+")$\"")
+			tagSet = append(tagSet, name+"=~^("+value+")$")
 		case prompb.LabelMatcher_NRE:
-			tagSet = append(tagSet, "\""+name+"!=~^("+value+")$\"")
+			tagSet = append(tagSet, name+"!=~^("+value+")$")
 		default:
 			return nil, fmt.Errorf("unknown match type %v", m.Type)
 		}
 	}
+	return tagSet, nil
+}
 
-	targets := []string{"seriesByTag(" + strings.Join(tagSet, ",") + ")"}
-	return targets, nil
+// escapeTagValue escapes the value of an equality matcher like label values
+// are escaped in tagged paths, so that they match. Regexps are left as is.
+func (c *Client) escapeTagValue(value string, matcherType prompb.LabelMatcher_Type) string {
+	if matcherType != prompb.LabelMatcher_EQ && matcherType != prompb.LabelMatcher_NEQ {
+		return value
+	}
+	escaping := c.cfg.Write.Escaping
+	return utils.EscapeTagValue(utils.EscapeWithPolicy(value, escaping.Policy, escaping.Replacement), escaping.Policy)
+}
+
+// unescapeLabels decodes the label names and values read from tagged paths,
+// when they are escaped with the reversible percent policy.
+func (c *Client) unescapeLabels(labels []*prompb.Label) {
+	if policy := c.cfg.Write.Escaping.Policy; policy != "" && policy != utils.EscapePercent {
+		return
+	}
+	for _, l := range labels {
+		l.Name = utils.Unescape(l.Name)
+		l.Value = utils.Unescape(l.Value)
+	}
+}
+
+// unescape decodes a label name or value read from tagged paths, when it's
+// escaped with the reversible percent policy.
+func (c *Client) unescape(s string) string {
+	if policy := c.cfg.Write.Escaping.Policy; policy != "" && policy != utils.EscapePercent {
+		return s
+	}
+	return utils.Unescape(s)
+}
+
+// queryToGlobTarget builds a single render target matching the default
+// paths of the series selected by query. Equality matchers and regexp matchers
+// on alternations of literals narrow the glob, others must be applied on the
+// returned series.
+func (c *Client) queryToGlobTarget(query *prompb.Query, graphitePrefix string) (string, error) {
+	escaping := c.cfg.Write.Escaping
+	escape := func(s string) string {
+		return utils.EscapeWithPolicy(s, escaping.Policy, escaping.Replacement)
+	}
+
+	var name string
+	globs := map[string]string{}
+	for _, m := range query.Matchers {
+		var glob string
+		switch m.Type {
+		case prompb.LabelMatcher_EQ:
+			if m.Value == "" {
+				continue
+			}
+			glob = escape(m.Value)
+		case prompb.LabelMatcher_RE:
+			var ok bool
+			if glob, ok = regexpToGlob(m.Value, escape); !ok {
+				continue
+			}
+		default:
+			continue
+		}
+		if m.Name == model.MetricNameLabel {
+			name = glob
+		} else {
+			globs[m.Name] = glob
+		}
+	}
+	if name == "" {
+		return "", fmt.Errorf("Invalid remote query: no %s label provided", model.MetricNameLabel)
+	}
+
+	// Labels are sorted in default paths, other labels may be in between.
+	names := make([]string, 0, len(globs))
+	for ln := range globs {
+		names = append(names, ln)
+	}
+	sort.Strings(names)
+
+	target := graphitePrefix + name
+	for _, ln := range names {
+		target += ".**." + ln + "." + globs[ln]
+	}
+	return target + ".**", nil
+}
+
+// regexpToGlob translates the anchored regexp re into a glob if it matches a
+// small set of non empty literals, escaped with escape.
+func regexpToGlob(re string, escape func(string) string) (string, bool) {
+	// An empty value also matches series without the label.
+	if matched, err := regexp.MatchString("^(?:"+re+")$", ""); err != nil || matched {
+		return "", false
+	}
+	parsed, err := syntax.Parse(re, syntax.Perl)
+	if err != nil {
+		return "", false
+	}
+	return syntaxToGlob(parsed.Simplify(), escape)
+}
+
+// maxGlobCharClass is the maximum number of characters of a class expanded
+// into a glob alternation.
+const maxGlobCharClass = 16
+
+func syntaxToGlob(re *syntax.Regexp, escape func(string) string) (string, bool) {
+	if re.Flags&syntax.FoldCase != 0 {
+		return "", false
+	}
+	switch re.Op {
+	case syntax.OpEmptyMatch:
+		return "", true
+	case syntax.OpLiteral:
+		literal := string(re.Rune)
+		// Keep glob metacharacters out of the way.
+		if strings.ContainsAny(literal, "*?[]{},.") {
+			return "", false
+		}
+		return escape(literal), true
+	case syntax.OpCapture:
+		return syntaxToGlob(re.Sub[0], escape)
+	case syntax.OpConcat:
+		var glob string
+		for _, sub := range re.Sub {
+			g, ok := syntaxToGlob(sub, escape)
+			if !ok {
+				return "", false
+			}
+			glob += g
+		}
+		return glob, true
+	case syntax.OpAlternate:
+		var alternatives []string
+		for _, sub := range re.Sub {
+			g, ok := syntaxToGlob(sub, escape)
+			if !ok {
+				return "", false
+			}
+			alternatives = append(alternatives, g)
+		}
+		return "{" + strings.Join(alternatives, ",") + "}", true
+	case syntax.OpCharClass:
+		var alternatives []string
+		for i := 0; i+1 < len(re.Rune); i += 2 {
+			for r := re.Rune[i]; r <= re.Rune[i+1]; r++ {
+				if len(alternatives) == maxGlobCharClass {
+					return "", false
+				}
+				g, ok := syntaxToGlob(&syntax.Regexp{Op: syntax.OpLiteral, Rune: []rune{r}}, escape)
+				if !ok {
+					return "", false
+				}
+				alternatives = append(alternatives, g)
+			}
+		}
+		return "{" + strings.Join(alternatives, ",") + "}", true
+	}
+	return "", false
+}
+
+// matchQuery tells whether labels satisfy all the matchers of query.
+func matchQuery(query *prompb.Query, labels []*prompb.Label) (bool, error) {
+	labelSet := make(model.LabelSet, len(labels))
+	for _, label := range labels {
+		labelSet[model.LabelName(label.Name)] = model.LabelValue(label.Value)
+	}
+
+	for _, m := range query.Matchers {
+		matcher, err := pmetric.NewLabelMatcher(
+			pmetric.MatchType(m.Type), model.LabelName(m.Name), model.LabelValue(m.Value))
+		if err != nil {
+			return false, err
+		}
+
+		if !matcher.Match(labelSet[model.LabelName(m.Name)]) {
+			return false, nil
+		}
+	}
+	return true, nil
 }
 
 func (c *Client) filterTargets(query *prompb.Query, targets []string, graphitePrefix string) ([]string, error) {
@@ -115,35 +334,21 @@ func (c *Client) filterTargets(query *prompb.Query, targets []string, graphitePr
 	var results []string
 	for _, target := range targets {
 		// Put labels in a map.
-		labels, err := metricLabelsFromPath(target, graphitePrefix)
+		labels, err := c.labelsFromPath(target, graphitePrefix)
 		if err != nil {
 			level.Warn(c.logger).Log(
 				"path", target, "prefix", graphitePrefix, "err", err)
 			continue
 		}
-		labelSet := make(model.LabelSet, len(labels))
-
-		for _, label := range labels {
-			labelSet[model.LabelName(label.Name)] = model.LabelValue(label.Value)
-		}
 
 		level.Debug(c.logger).Log(
 			"target", target, "prefix", graphitePrefix,
-			"labels", labelSet, "msg", "Filtering target")
+			"labels", fmt.Sprint(labels), "msg", "Filtering target")
 
 		// See if all matchers are satisfied.
-		match := true
-		for _, m := range query.Matchers {
-			matcher, err := pmetric.NewLabelMatcher(
-				pmetric.MatchType(m.Type), model.LabelName(m.Name), model.LabelValue(m.Value))
-			if err != nil {
-				return nil, err
-			}
-
-			if !matcher.Match(labelSet[model.LabelName(m.Name)]) {
-				match = false
-				break
-			}
+		match, err := matchQuery(query, labels)
+		if err != nil {
+			return nil, err
 		}
 
 		// If everything is fine, keep this target.
@@ -154,8 +359,14 @@ func (c *Client) filterTargets(query *prompb.Query, targets []string, graphitePr
 	return results, nil
 }
 
-func (c *Client) targetToTimeseries(ctx context.Context, target string, from string, until string, graphitePrefix string) ([]*prompb.TimeSeries, error) {
-	renderURL, err := prepareURL(c.cfg.Read.URL, renderEndpoint, map[string]string{"format": "json", "from": from, "until": until, "target": target})
+// render fetches the datapoints of target from graphite-web. If step is set,
+// graphite-web consolidates them so that there is about one per step.
+func (c *Client) render(ctx context.Context, target string, from string, until string, step time.Duration) ([]RenderResponse, error) {
+	params := map[string]string{"format": "json", "from": from, "until": until, "target": target}
+	if n := maxDataPoints(from, until, step); n > 0 {
+		params["maxDataPoints"] = strconv.Itoa(n)
+	}
+	renderURL, err := prepareURL(c.cfg.Read.URL, renderEndpoint, params)
 	if err != nil {
 		level.Warn(c.logger).Log(
 			"graphite_web", c.cfg.Read.URL, "path", renderEndpoint,
@@ -163,12 +374,27 @@ func (c *Client) targetToTimeseries(ctx context.Context, target string, from str
 		return nil, err
 	}
 
+	ctx, span := tracing.StartSpan(ctx, "graphite.render")
+	defer span.End()
+	span.SetAttribute("target", target)
+
 	renderResponses := make([]RenderResponse, 0)
-	body, err := fetchURL(ctx, c.logger, renderURL)
-	if err != nil {
-		level.Warn(c.logger).Log(
-			"url", renderURL, "err", err, "ctx", ctx, "msg", "Error fetching URL")
-		return nil, err
+	var body []byte
+	cached := false
+	if c.readCache != nil {
+		body, cached = c.readCache.get(renderURL.String())
+	}
+	span.SetAttribute("cached", cached)
+	if !cached {
+		begin := time.Now()
+		body, err = fetchURL(ctx, c.httpClient, c.logger, renderURL)
+		client.ReadStatsFromContext(ctx).AddTarget(time.Since(begin))
+		if err != nil {
+			span.SetError(err)
+			level.Warn(c.logger).Log(
+				"url", renderURL, "err", err, "ctx", ctx, "msg", "Error fetching URL")
+			return nil, err
+		}
 	}
 
 	err = json.Unmarshal(body, &renderResponses)
@@ -178,15 +404,48 @@ func (c *Client) targetToTimeseries(ctx context.Context, target string, from str
 			"msg", "Error parsing render endpoint response body")
 		return nil, err
 	}
+	if c.readCache != nil && !cached {
+		c.readCache.set(renderURL.String(), body)
+	}
+	return renderResponses, nil
+}
+
+// maxDataPoints returns the number of points of the from-until range
+// sampled every step, or 0 if there is no step.
+func maxDataPoints(from string, until string, step time.Duration) int {
+	stepSeconds := int(step / time.Second)
+	if stepSeconds <= 0 {
+		return 0
+	}
+	f, err := strconv.Atoi(from)
+	if err != nil {
+		return 0
+	}
+	u, err := strconv.Atoi(until)
+	if err != nil {
+		return 0
+	}
+	return (u-f)/stepSeconds + 1
+}
+
+func (c *Client) targetToTimeseries(ctx context.Context, target string, from string, until string, step time.Duration, graphitePrefix string) ([]*prompb.TimeSeries, error) {
+	renderResponses, err := c.render(ctx, target, from, until, step)
+	if err != nil {
+		return nil, err
+	}
 
 	ret := make([]*prompb.TimeSeries, len(renderResponses))
 	for i, renderResponse := range renderResponses {
 		ts := &prompb.TimeSeries{}
 
-		if c.cfg.EnableTags {
+		if c.cfg.EnableTags && len(renderResponse.Tags) > 0 {
 			ts.Labels, err = metricLabelsFromTags(renderResponse.Tags, graphitePrefix)
+			c.unescapeLabels(ts.Labels)
+		} else if c.cfg.EnableTags {
+			ts.Labels, err = metricLabelsFromTaggedPath(renderResponse.Target, graphitePrefix)
+			c.unescapeLabels(ts.Labels)
 		} else {
-			ts.Labels, err = metricLabelsFromPath(renderResponse.Target, graphitePrefix)
+			ts.Labels, err = c.labelsFromPath(renderResponse.Target, graphitePrefix)
 		}
 
 		if err != nil {
@@ -195,7 +454,8 @@ func (c *Client) targetToTimeseries(ctx context.Context, target string, from str
 			return nil, err
 		}
 
-		ts.Samples = samplesFromDatapoints(renderResponse.Datapoints, c.cfg.Read.MaxPointDelta)
+		ts.Samples = alignSamples(
+			samplesFromDatapoints(renderResponse.Datapoints, c.cfg.Read.MaxPointDelta), step)
 
 		ret[i] = ts
 	}
@@ -237,6 +497,24 @@ func samplesFromDatapoints(datapoints []*Datapoint, maxPointDelta time.Duration)
 	return samples
 }
 
+// alignSamples moves the timestamps of samples to the beginning of their
+// step, keeping the first sample of each step.
+func alignSamples(samples []*prompb.Sample, step time.Duration) []*prompb.Sample {
+	stepMs := int64(step / time.Millisecond)
+	if stepMs <= 0 {
+		return samples
+	}
+	aligned := samples[:0]
+	for _, sample := range samples {
+		sample.Timestamp -= sample.Timestamp % stepMs
+		if len(aligned) > 0 && aligned[len(aligned)-1].Timestamp == sample.Timestamp {
+			continue
+		}
+		aligned = append(aligned, sample)
+	}
+	return aligned
+}
+
 func min(a, b int) int {
 	if a < b {
 		return a
@@ -244,9 +522,25 @@ func min(a, b int) int {
 	return b
 }
 
-func (c *Client) handleReadQuery(ctx context.Context, query *prompb.Query, graphitePrefix string) (*prompb.QueryResult, error) {
+func (c *Client) handleReadQuery(ctx context.Context, query *prompb.Query, hints *client.ReadHints, graphitePrefix string) (*prompb.QueryResult, error) {
 	queryResult := &prompb.QueryResult{}
+	if err := c.streamReadQuery(ctx, query, hints, graphitePrefix, appendTo(queryResult)); err != nil {
+		return nil, err
+	}
+	return queryResult, nil
+}
+
+// appendTo returns a function appending series to queryResult.
+func appendTo(queryResult *prompb.QueryResult) func([]*prompb.TimeSeries) error {
+	return func(series []*prompb.TimeSeries) error {
+		queryResult.Timeseries = append(queryResult.Timeseries, series...)
+		return nil
+	}
+}
 
+// streamReadQuery calls send with the series matching query as they are
+// fetched.
+func (c *Client) streamReadQuery(ctx context.Context, query *prompb.Query, hints *client.ReadHints, graphitePrefix string, send func([]*prompb.TimeSeries) error) error {
 	now := int(time.Now().Unix())
 	from := int(query.StartTimestampMs / 1000)
 	until := int(query.EndTimestampMs / 1000)
@@ -255,14 +549,62 @@ func (c *Client) handleReadQuery(ctx context.Context, query *prompb.Query, graph
 
 	if until < from {
 		level.Debug(c.logger).Log("msg", "Skipping query with empty time range")
-		return queryResult, nil
+		return nil
 	}
 	fromStr := strconv.Itoa(from)
 	untilStr := strconv.Itoa(until)
 
+	// Let graphite-web downsample the series to the step of the query.
+	var step time.Duration
+	if hints != nil {
+		step = time.Duration(hints.StepMs) * time.Millisecond
+	}
+
+	if c.cfg.Read.MaxSeries > 0 {
+		if err := c.checkMaxSeries(ctx, query, graphitePrefix); err != nil {
+			return err
+		}
+	}
+
 	targets := []string{}
 	var err error
 
+	if c.cfg.Read.Pushdown {
+		target, ok, err := c.pushdownTarget(query, hints, graphitePrefix)
+		if err != nil {
+			return err
+		}
+		if ok {
+			queryResult, err := c.handlePushdownReadQuery(ctx, query, hints, target, fromStr, untilStr, step)
+			if err != nil {
+				return err
+			}
+			return send(queryResult.Timeseries)
+		}
+
+		target, fn, ok, err := c.counterPushdownTarget(query, hints, graphitePrefix)
+		if err != nil {
+			return err
+		}
+		if ok {
+			queryResult, ok, err := c.handleCounterPushdownReadQuery(ctx, query, target, fn, fromStr, untilStr, step, graphitePrefix)
+			if err != nil {
+				return err
+			}
+			if ok {
+				return send(queryResult.Timeseries)
+			}
+		}
+	}
+
+	if !c.cfg.EnableTags && c.cfg.Read.UseGlobTargets {
+		queryResult, err := c.handleGlobReadQuery(ctx, query, fromStr, untilStr, step, graphitePrefix)
+		if err != nil {
+			return err
+		}
+		return send(queryResult.Timeseries)
+	}
+
 	if c.cfg.EnableTags {
 		targets, err = c.queryToTargetsWithTags(ctx, query, graphitePrefix)
 	} else {
@@ -270,101 +612,237 @@ func (c *Client) handleReadQuery(ctx context.Context, query *prompb.Query, graph
 		targets, err = c.queryToTargets(ctx, query, graphitePrefix)
 	}
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	level.Debug(c.logger).Log(
 		"targets", targets, "from", fromStr, "until", untilStr, "msg", "Fetching data")
-	c.fetchData(ctx, queryResult, targets, fromStr, untilStr, graphitePrefix)
+	return c.streamData(ctx, targets, fromStr, untilStr, step, graphitePrefix, send)
+}
+
+// handleGlobReadQuery fetches the series matching query with a single render
+// request, filtering them on the matchers which couldn't be part of the glob.
+func (c *Client) handleGlobReadQuery(ctx context.Context, query *prompb.Query, fromStr string, untilStr string, step time.Duration, graphitePrefix string) (*prompb.QueryResult, error) {
+	target, err := c.queryToGlobTarget(query, graphitePrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	level.Debug(c.logger).Log(
+		"target", target, "from", fromStr, "until", untilStr, "msg", "Fetching data")
+	series, err := c.targetToTimeseries(ctx, target, fromStr, untilStr, step, graphitePrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	queryResult := &prompb.QueryResult{}
+	for _, ts := range series {
+		match, err := matchQuery(query, ts.Labels)
+		if err != nil {
+			return nil, err
+		}
+		if match {
+			queryResult.Timeseries = append(queryResult.Timeseries, ts)
+		}
+	}
 	return queryResult, nil
+}
+
+// checkMaxSeries returns an error if query matches more than max_series
+// series, to spare graphite-web from fetching them. Tagged series are counted
+// with /tags/findSeries, others with /metrics/find on the glob of query and
+// on those of the path patterns.
+func (c *Client) checkMaxSeries(ctx context.Context, query *prompb.Query, graphitePrefix string) error {
+	var target string
+	var count int
+	if c.cfg.EnableTags {
+		exprs, err := c.queryToTagExprs(query, graphitePrefix)
+		if err != nil {
+			return err
+		}
+		// findSeries takes one expr parameter per expression.
+		u, err := prepareURL(c.cfg.Read.URL, tagsFindSeriesEndpoint, nil)
+		if err != nil {
+			return err
+		}
+		u.RawQuery = url.Values{"expr": exprs}.Encode()
+		var paths []string
+		if err := c.fetchMetadataURL(ctx, u, &paths); err != nil {
+			return err
+		}
+		target, count = strings.Join(exprs, ","), len(paths)
+	} else {
+		glob, err := c.queryToGlobTarget(query, graphitePrefix)
+		if err != nil {
+			return err
+		}
+		globs := []string{glob}
+		for _, p := range c.cfg.Read.PathPatterns {
+			if glob, ok := patternGlob(p, query); ok {
+				globs = append(globs, glob)
+			}
+		}
+		leaves := make(map[string]bool)
+		for _, glob := range globs {
+			var nodes []findNode
+			if err := c.fetchMetadata(ctx, findEndpoint, map[string]string{"query": glob}, &nodes); err != nil {
+				return err
+			}
+			for _, node := range nodes {
+				if node.Leaf != 0 {
+					leaves[node.ID] = true
+				}
+			}
+		}
+		target, count = strings.Join(globs, ","), len(leaves)
+	}
+	if count > c.cfg.Read.MaxSeries {
+		rejectedReadQueries.Inc()
+		return fmt.Errorf("%s matches %d series, more than the %d allowed by max_series", target, count, c.cfg.Read.MaxSeries)
+	}
+	return nil
+}
 
+// fetchData fetches targets with a bounded pool of workers and appends the
+// series to queryResult in the order of targets. Targets failing to be fetched
+// are skipped, an error is only returned if all of them failed.
+func (c *Client) fetchData(ctx context.Context, queryResult *prompb.QueryResult, targets []string, fromStr string, untilStr string, step time.Duration, graphitePrefix string) error {
+	return c.streamData(ctx, targets, fromStr, untilStr, step, graphitePrefix, appendTo(queryResult))
 }
 
-func (c *Client) fetchData(ctx context.Context, queryResult *prompb.QueryResult, targets []string, fromStr string, untilStr string, graphitePrefix string) {
-	input := make(chan string, len(targets))
-	output := make(chan *prompb.TimeSeries, len(targets)+1)
+// streamData is fetchData calling send with the series of each target, in
+// order, as soon as they and those of the previous targets are fetched.
+func (c *Client) streamData(ctx context.Context, targets []string, fromStr string, untilStr string, step time.Duration, graphitePrefix string, send func([]*prompb.TimeSeries) error) error {
+	type job struct {
+		index  int
+		target string
+	}
+	input := make(chan job, len(targets))
+	series := make([][]*prompb.TimeSeries, len(targets))
+	errs := make([]error, len(targets))
+	fetched := make([]chan struct{}, len(targets))
+	for i := range fetched {
+		fetched[i] = make(chan struct{})
+	}
+	// Closed when send fails, to skip the remaining targets.
+	stop := make(chan struct{})
 
 	wg := sync.WaitGroup{}
+	defer wg.Wait()
 
 	// TODO: Send multiple targets per query, Graphite supports that.
 	// Start only a few workers to avoid killing graphite.
-	for i := 0; i < maxFetchWorkers; i++ {
+	workers := c.cfg.Read.Concurrency
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
 		wg.Add(1)
 
-		go func(fromStr string, untilStr string, ctx context.Context) {
+		go func() {
 			defer wg.Done()
 
-			for target := range input {
-				// We simply ignore errors here as it is better to return "some" data
-				// than nothing.
-				ts, err := c.targetToTimeseries(ctx, target, fromStr, untilStr, graphitePrefix)
-				if err != nil {
-					level.Warn(c.logger).Log("target", target, "err", err, "msg", "Error fetching and parsing target datapoints")
-				} else {
-					level.Debug(c.logger).Log("reading responses")
-					for _, t := range ts {
-						output <- t
-					}
+			// Each job has its own slot in series and errs.
+			for j := range input {
+				select {
+				case <-stop:
+				default:
+					series[j.index], errs[j.index] = c.targetToTimeseries(ctx, j.target, fromStr, untilStr, step, graphitePrefix)
 				}
+				close(fetched[j.index])
 			}
-		}(fromStr, untilStr, ctx)
+		}()
 	}
 
 	// Feed the input.
-	for _, target := range targets {
-		input <- target
+	for i, target := range targets {
+		input <- job{index: i, target: target}
 	}
 	close(input)
 
-	// Close the output as soon as all jobs are done.
-	go func() {
-		wg.Wait()
-		output <- nil
-		close(output)
-	}()
-
-	// Read output until channel is closed.
-	for {
-		done := false
-		select {
-		case ts := <-output:
-			if ts != nil {
-				queryResult.Timeseries = append(queryResult.Timeseries, ts)
-			} else {
-				// A nil result means that we are done.
-				done = true
-			}
+	// We simply skip failed targets as it is better to return "some" data
+	// than nothing.
+	var failed int
+	var lastErr error
+	for i, target := range targets {
+		<-fetched[i]
+		if errs[i] != nil {
+			level.Warn(c.logger).Log(
+				"target", target, "err", errs[i],
+				"msg", "Error fetching and parsing target datapoints")
+			failed++
+			lastErr = errs[i]
+			continue
 		}
-		if done {
-			break
+		if err := send(series[i]); err != nil {
+			close(stop)
+			return err
 		}
+		series[i] = nil
 	}
+	if failed > 0 && failed == len(targets) {
+		return fmt.Errorf("all %d targets failed, last error: %v", failed, lastErr)
+	}
+	return nil
 }
 
 // Read implements the client.Reader interface.
 func (c *Client) Read(req *prompb.ReadRequest, r *http.Request) (*prompb.ReadResponse, error) {
-	level.Debug(c.logger).Log("req", req, "msg", "Remote read")
-
 	if c.cfg.Read.URL == "" {
+		level.Debug(c.logger).Log(
+			"req", req, "query_count", len(req.Queries), "storage", c.Name(), "msg", "Remote read")
 		return nil, nil
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), c.readTimeout)
+	resp := &prompb.ReadResponse{Results: make([]*prompb.QueryResult, len(req.Queries))}
+	for i := range resp.Results {
+		resp.Results[i] = &prompb.QueryResult{}
+	}
+	err := c.ReadStream(req, r, func(i int, series []*prompb.TimeSeries) error {
+		return appendTo(resp.Results[i])(series)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// ReadStream implements the client.StreamReader interface.
+func (c *Client) ReadStream(req *prompb.ReadRequest, r *http.Request, send func(queryIndex int, series []*prompb.TimeSeries) error) error {
+	level.Debug(c.logger).Log(
+		"req", req, "query_count", len(req.Queries), "storage", c.Name(), "msg", "Remote read")
+
+	if c.cfg.Read.URL == "" {
+		return nil
+	}
+
+	// Keep the trace of the request, but not its cancellation: the read timeout
+	// applies.
+	ctx, cancel := context.WithTimeout(
+		tracing.ContextWithSpanContext(context.Background(), tracing.SpanContextFromContext(r.Context())),
+		c.readTimeout)
 	defer cancel()
+	ctx = client.ContextWithReadStats(ctx, client.ReadStatsFromContext(r.Context()))
+	ctx, span := tracing.StartSpan(ctx, "graphite.Read")
+	defer span.End()
+	span.SetAttribute("queries", len(req.Queries))
 
 	graphitePrefix, err := c.getGraphitePrefix(r)
 	if err != nil {
 		level.Warn(c.logger).Log("prefix", graphitePrefix, "err", err)
-		return nil, err
+		return err
 	}
 
-	resp := &prompb.ReadResponse{}
-	for _, query := range req.Queries {
-		queryResult, err := c.handleReadQuery(ctx, query, graphitePrefix)
+	for i, query := range req.Queries {
+		i := i
+		hints := client.ReadHintsFromRequest(r, i)
+		err := c.streamReadQuery(ctx, query, hints, graphitePrefix, func(series []*prompb.TimeSeries) error {
+			return send(i, series)
+		})
 		if err != nil {
-			return nil, err
+			span.SetError(err)
+			return err
 		}
-		resp.Results = append(resp.Results, queryResult)
 	}
-	return resp, nil
+	return nil
 }
@@ -16,15 +16,19 @@ package graphite
 import (
 	"bytes"
 	"fmt"
+	"net/http"
 	"net/url"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/prompb"
 
 	"golang.org/x/net/context"
+
+	"github.com/criteo/graphite-remote-adapter/client"
 )
 
 var (
@@ -38,7 +42,7 @@ var (
 	}
 )
 
-func fakeFetchExpandURL(ctx context.Context, l log.Logger, u *url.URL) ([]byte, error) {
+func fakeFetchExpandURL(ctx context.Context, hc *http.Client, l log.Logger, u *url.URL) ([]byte, error) {
 	var body bytes.Buffer
 	if u.String() == "http://fakeHost:6666/metrics/expand?format=json&leavesOnly=1&query=prometheus-prefix.test.%2A%2A" {
 		body.WriteString("{\"results\": [\"prometheus-prefix.test.owner.team-X\", \"prometheus-prefix.test.owner.team-Y\"]}")
@@ -46,7 +50,7 @@ func fakeFetchExpandURL(ctx context.Context, l log.Logger, u *url.URL) ([]byte,
 	return body.Bytes(), nil
 }
 
-func fakeFetchRenderURL(ctx context.Context, l log.Logger, u *url.URL) ([]byte, error) {
+func fakeFetchRenderURL(ctx context.Context, hc *http.Client, l log.Logger, u *url.URL) ([]byte, error) {
 	var body bytes.Buffer
 	if u.String() == "http://fakeHost:6666/render/?format=json&from=0&target=prometheus-prefix.test.owner.team-X&until=300" {
 		body.WriteString("[{\"target\": \"prometheus-prefix.test.owner.team-X\", \"datapoints\": [[18,0], [42,300]]}]")
@@ -108,7 +112,7 @@ func TestTargetToTimeseries(t *testing.T) {
 		Samples: expectedSamples,
 	}
 
-	actualTs, err := testClient.targetToTimeseries(nil, "prometheus-prefix.test.owner.team-X", "0", "300", testClient.cfg.DefaultPrefix)
+	actualTs, err := testClient.targetToTimeseries(nil, "prometheus-prefix.test.owner.team-X", "0", "300", 0, testClient.cfg.DefaultPrefix)
 	if !reflect.DeepEqual(err, nil) {
 		t.Errorf("Expected err: %s, got %s", nil, err)
 	}
@@ -158,7 +162,7 @@ func TestQueryTargetsWithTags(t *testing.T) {
 		t.Errorf("Expected %s, got %s", expectedTargets, targets)
 	}
 
-	actualTs, err := testClient.targetToTimeseries(nil, targets[0], "0", "300", testClient.cfg.DefaultPrefix)
+	actualTs, err := testClient.targetToTimeseries(nil, targets[0], "0", "300", 0, testClient.cfg.DefaultPrefix)
 	testClient.cfg.EnableTags = false
 	if err != nil {
 		t.Errorf("Unexpected err: %s", err)
@@ -167,3 +171,426 @@ func TestQueryTargetsWithTags(t *testing.T) {
 		t.Errorf("Expected %s, got %s", expectedTs, actualTs)
 	}
 }
+
+func TestQueryToGlobTarget(t *testing.T) {
+	for _, tc := range []struct {
+		matchers []*prompb.LabelMatcher
+		target   string
+	}{
+		{
+			matchers: []*prompb.LabelMatcher{
+				&prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: model.MetricNameLabel, Value: "test"},
+			},
+			target: "prometheus-prefix.test.**",
+		},
+		{
+			// Labels are sorted and values escaped.
+			matchers: []*prompb.LabelMatcher{
+				&prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: "owner", Value: "team-X"},
+				&prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: model.MetricNameLabel, Value: "test"},
+				&prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: "instance", Value: "host.example.com"},
+			},
+			target: "prometheus-prefix.test.**.instance.host%2Eexample%2Ecom.**.owner.team-X.**",
+		},
+		{
+			// Other matchers can't be part of the glob.
+			matchers: []*prompb.LabelMatcher{
+				&prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: model.MetricNameLabel, Value: "test"},
+				&prompb.LabelMatcher{Type: prompb.LabelMatcher_RE, Name: "owner", Value: "team.*"},
+				&prompb.LabelMatcher{Type: prompb.LabelMatcher_NEQ, Name: "env", Value: "prod"},
+			},
+			target: "prometheus-prefix.test.**",
+		},
+		{
+			// Alternations of literals become brace globs.
+			matchers: []*prompb.LabelMatcher{
+				&prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: model.MetricNameLabel, Value: "test"},
+				&prompb.LabelMatcher{Type: prompb.LabelMatcher_RE, Name: "owner", Value: "team-(X|Y)"},
+			},
+			target: "prometheus-prefix.test.**.owner.team-{X,Y}.**",
+		},
+	} {
+		query := &prompb.Query{Matchers: tc.matchers}
+		target, err := testClient.queryToGlobTarget(query, testClient.cfg.DefaultPrefix)
+		if err != nil {
+			t.Errorf("Unexpected err: %s", err)
+		}
+		if target != tc.target {
+			t.Errorf("Expected %s, got %s", tc.target, target)
+		}
+	}
+}
+
+func TestGlobReadQuery(t *testing.T) {
+	fetchURL = func(ctx context.Context, hc *http.Client, l log.Logger, u *url.URL) ([]byte, error) {
+		var body bytes.Buffer
+		if u.String() == "http://fakeHost:6666/render/?format=json&from=0&target=prometheus-prefix.test.%2A%2A&until=300" {
+			body.WriteString("[{\"target\": \"prometheus-prefix.test.owner.team-X\", \"datapoints\": [[18,0], [42,300]]},")
+			body.WriteString("{\"target\": \"prometheus-prefix.test.owner.other\", \"datapoints\": [[18,0], [42,300]]}]")
+		}
+		return body.Bytes(), nil
+	}
+	testClient.cfg.Read.UseGlobTargets = true
+	defer func() { testClient.cfg.Read.UseGlobTargets = false }()
+
+	query := &prompb.Query{
+		StartTimestampMs: int64(0),
+		EndTimestampMs:   int64(300000),
+		Matchers: []*prompb.LabelMatcher{
+			&prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: model.MetricNameLabel, Value: "test"},
+			&prompb.LabelMatcher{Type: prompb.LabelMatcher_RE, Name: "owner", Value: "team-.*"},
+		},
+	}
+	expectedTs := []*prompb.TimeSeries{{Labels: expectedLabels, Samples: expectedSamples}}
+
+	result, err := testClient.handleReadQuery(nil, query, nil, testClient.cfg.DefaultPrefix)
+	if err != nil {
+		t.Errorf("Unexpected err: %s", err)
+	}
+	if !reflect.DeepEqual(expectedTs, result.Timeseries) {
+		t.Errorf("Expected %s, got %s", expectedTs, result.Timeseries)
+	}
+}
+
+func TestReadQueryWithStep(t *testing.T) {
+	fetchURL = func(ctx context.Context, hc *http.Client, l log.Logger, u *url.URL) ([]byte, error) {
+		var body bytes.Buffer
+		if u.String() == "http://fakeHost:6666/render/?format=json&from=0&maxDataPoints=61&target=prometheus-prefix.test.%2A%2A&until=3600" {
+			body.WriteString("[{\"target\": \"prometheus-prefix.test.owner.team-X\", \"datapoints\": [[18,10], [42,70]]}]")
+		}
+		return body.Bytes(), nil
+	}
+	testClient.cfg.Read.UseGlobTargets = true
+	defer func() { testClient.cfg.Read.UseGlobTargets = false }()
+
+	query := &prompb.Query{
+		StartTimestampMs: int64(0),
+		EndTimestampMs:   int64(3600000),
+		Matchers: []*prompb.LabelMatcher{
+			&prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: model.MetricNameLabel, Value: "test"},
+		},
+	}
+	hints := &client.ReadHints{StepMs: 60000}
+	// Timestamps are aligned on the step.
+	expectedTs := []*prompb.TimeSeries{{
+		Labels: expectedLabels,
+		Samples: []*prompb.Sample{
+			&prompb.Sample{Value: float64(18), Timestamp: int64(0)},
+			&prompb.Sample{Value: float64(42), Timestamp: int64(60000)},
+		},
+	}}
+
+	result, err := testClient.handleReadQuery(nil, query, hints, testClient.cfg.DefaultPrefix)
+	if err != nil {
+		t.Errorf("Unexpected err: %s", err)
+	}
+	if !reflect.DeepEqual(expectedTs, result.Timeseries) {
+		t.Errorf("Expected %s, got %s", expectedTs, result.Timeseries)
+	}
+}
+
+func TestFetchDataConcurrently(t *testing.T) {
+	// Every target takes 100ms to render, the third one fails.
+	fetchURL = func(ctx context.Context, hc *http.Client, l log.Logger, u *url.URL) ([]byte, error) {
+		time.Sleep(100 * time.Millisecond)
+		target := u.Query().Get("target")
+		if target == "prometheus-prefix.test.owner.team-2" {
+			return nil, fmt.Errorf("graphite-web is overloaded")
+		}
+		return []byte("[{\"target\": \"" + target + "\", \"datapoints\": [[18,0]]}]"), nil
+	}
+	testClient.cfg.Read.Concurrency = 5
+	defer func() { testClient.cfg.Read.Concurrency = 0 }()
+
+	var targets []string
+	for i := 0; i < 5; i++ {
+		targets = append(targets, fmt.Sprintf("prometheus-prefix.test.owner.team-%d", i))
+	}
+
+	start := time.Now()
+	queryResult := &prompb.QueryResult{}
+	err := testClient.fetchData(nil, queryResult, targets, "0", "300", 0, testClient.cfg.DefaultPrefix)
+	if err != nil {
+		t.Errorf("Unexpected err: %s", err)
+	}
+	if elapsed := time.Since(start); elapsed > 300*time.Millisecond {
+		t.Errorf("Expected targets to be fetched concurrently, took %s", elapsed)
+	}
+
+	// Series come in the order of the targets, without the failed one.
+	var owners []string
+	for _, ts := range queryResult.Timeseries {
+		owners = append(owners, ts.Labels[1].Value)
+	}
+	expectedOwners := []string{"team-0", "team-1", "team-3", "team-4"}
+	if !reflect.DeepEqual(expectedOwners, owners) {
+		t.Errorf("Expected %s, got %s", expectedOwners, owners)
+	}
+
+	// The query fails if all the targets failed.
+	err = testClient.fetchData(nil, &prompb.QueryResult{}, targets[2:3], "0", "300", 0, testClient.cfg.DefaultPrefix)
+	if err == nil {
+		t.Errorf("Expected an error when all targets fail")
+	}
+}
+
+func TestQueryTargetsWithTagMatchers(t *testing.T) {
+	query := &prompb.Query{
+		Matchers: []*prompb.LabelMatcher{
+			&prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: model.MetricNameLabel, Value: "test"},
+			&prompb.LabelMatcher{Type: prompb.LabelMatcher_NEQ, Name: "env", Value: "prod"},
+			&prompb.LabelMatcher{Type: prompb.LabelMatcher_RE, Name: "owner", Value: "team-.*"},
+			&prompb.LabelMatcher{Type: prompb.LabelMatcher_NRE, Name: "dc", Value: "par|ams"},
+		},
+	}
+	expectedTargets := []string{
+		"seriesByTag(\"name=prometheus-prefix.test\",\"env!=prod\",\"owner=~^(team-.*)$\",\"dc!=~^(par|ams)$\")",
+	}
+
+	targets, err := testClient.queryToTargetsWithTags(nil, query, testClient.cfg.DefaultPrefix)
+	if err != nil {
+		t.Errorf("Unexpected err: %s", err)
+	}
+	if !reflect.DeepEqual(expectedTargets, targets) {
+		t.Errorf("Expected %s, got %s", expectedTargets, targets)
+	}
+}
+
+func TestTargetToTimeseriesWithoutTags(t *testing.T) {
+	// Some backends only return the tagged path of the series.
+	fetchURL = func(ctx context.Context, hc *http.Client, l log.Logger, u *url.URL) ([]byte, error) {
+		return []byte("[{\"target\": \"prometheus-prefix.test;owner=team-X\", \"datapoints\": [[18,0], [42,300]]}]"), nil
+	}
+	testClient.cfg.EnableTags = true
+	defer func() { testClient.cfg.EnableTags = false }()
+
+	expectedTs := []*prompb.TimeSeries{{Labels: expectedLabels, Samples: expectedSamples}}
+	actualTs, err := testClient.targetToTimeseries(nil, "seriesByTag(\"name=prometheus-prefix.test\")", "0", "300", 0, testClient.cfg.DefaultPrefix)
+	if err != nil {
+		t.Errorf("Unexpected err: %s", err)
+	}
+	if !reflect.DeepEqual(expectedTs, actualTs) {
+		t.Errorf("Expected %s, got %s", expectedTs, actualTs)
+	}
+}
+
+func TestPathPatternRoundTrip(t *testing.T) {
+	cfg := loadTestConfig(`
+write:
+  rules:
+  - match:
+      job: node
+    template: 'hosts.{{.labels.instance}}.{{.labels.__name__}}'
+    continue: false
+read:
+  path_patterns:
+  - pattern: 'hosts.{instance}.{__name__}'`)
+	if cfg == nil {
+		t.Fatal("Invalid config")
+	}
+	c := &Client{logger: log.NewNopLogger(), cfg: cfg}
+	c.cfg.Read.URL = "http://fakeHost:6666"
+
+	// The job label isn't written, it's only used by the rule.
+	m := model.Metric{model.MetricNameLabel: "load1", "instance": "host-1", "job": "node"}
+	paths := pathsFromMetric(m, FormatCarbon, "prefix.", &cfg.Write)
+	if !reflect.DeepEqual([]string{"hosts.host-1.load1"}, paths) {
+		t.Fatalf("Unexpected paths %s", paths)
+	}
+	expectedLabels := []*prompb.Label{
+		{Name: model.MetricNameLabel, Value: "load1"},
+		{Name: "instance", Value: "host-1"},
+	}
+	// Default paths are still parsed as such.
+	for _, path := range []string{paths[0], "prefix.load1.instance.host-1"} {
+		labels, err := c.labelsFromPath(path, "prefix.")
+		if err != nil {
+			t.Errorf("Unexpected err: %s", err)
+		}
+		if !reflect.DeepEqual(expectedLabels, labels) {
+			t.Errorf("%s: expected %s, got %s", path, expectedLabels, labels)
+		}
+	}
+
+	var queries []string
+	fetchURL = func(ctx context.Context, hc *http.Client, l log.Logger, u *url.URL) ([]byte, error) {
+		queries = append(queries, u.Query().Get("query"))
+		if u.Query().Get("query") == "hosts.*.load1" {
+			return []byte(`{"results": ["hosts.host-1.load1", "hosts.host-2.load1"]}`), nil
+		}
+		return []byte(`{"results": []}`), nil
+	}
+	query := &prompb.Query{Matchers: []*prompb.LabelMatcher{
+		{Type: prompb.LabelMatcher_EQ, Name: model.MetricNameLabel, Value: "load1"},
+		{Type: prompb.LabelMatcher_NEQ, Name: "instance", Value: "host-2"},
+	}}
+	targets, err := c.queryToTargets(nil, query, "prefix.")
+	if err != nil {
+		t.Errorf("Unexpected err: %s", err)
+	}
+	if expected := []string{"prefix.load1.**", "hosts.*.load1"}; !reflect.DeepEqual(expected, queries) {
+		t.Errorf("Expected queries %s, got %s", expected, queries)
+	}
+	if expected := []string{"hosts.host-1.load1"}; !reflect.DeepEqual(expected, targets) {
+		t.Errorf("Expected %s, got %s", expected, targets)
+	}
+}
+
+func TestCheckMaxSeries(t *testing.T) {
+	cfg := loadTestConfig(`
+read:
+  max_series: 2
+  path_patterns:
+  - pattern: 'hosts.{instance}.{__name__}'`)
+	if cfg == nil {
+		t.Fatal("Invalid config")
+	}
+	c := &Client{logger: log.NewNopLogger(), cfg: cfg}
+	c.cfg.Read.URL = "http://fakeHost:6666"
+	fetchURL = func(ctx context.Context, hc *http.Client, l log.Logger, u *url.URL) ([]byte, error) {
+		switch {
+		case u.Path == "/tags/findSeries" &&
+			reflect.DeepEqual(u.Query()["expr"], []string{"name=prefix.load1", "instance!=host-2"}):
+			return []byte(`["prefix.load1;instance=host-1", "prefix.load1;instance=host-3", "prefix.load1;instance=host-4"]`), nil
+		case u.Query().Get("query") == "prefix.load1.**":
+			return []byte(`[{"id": "prefix.load1.instance.host-1", "text": "host-1", "leaf": 1}]`), nil
+		case u.Query().Get("query") == "hosts.*.load1":
+			return []byte(`[{"id": "hosts.host-1.load1", "text": "load1", "leaf": 1},
+				{"id": "hosts.host-3.load1", "text": "load1", "leaf": 1}]`), nil
+		}
+		return []byte(`[]`), nil
+	}
+	query := &prompb.Query{Matchers: []*prompb.LabelMatcher{
+		{Type: prompb.LabelMatcher_EQ, Name: model.MetricNameLabel, Value: "load1"},
+		{Type: prompb.LabelMatcher_NEQ, Name: "instance", Value: "host-2"},
+	}}
+
+	// The paths written by templates count too.
+	if err := c.checkMaxSeries(nil, query, "prefix."); err == nil {
+		t.Errorf("Expected an error for a query over max_series")
+	}
+	c.cfg.Read.MaxSeries = 3
+	if err := c.checkMaxSeries(nil, query, "prefix."); err != nil {
+		t.Errorf("Unexpected err: %s", err)
+	}
+
+	// Tagged series are counted with findSeries.
+	c.cfg.EnableTags = true
+	c.cfg.Read.MaxSeries = 2
+	if err := c.checkMaxSeries(nil, query, "prefix."); err == nil {
+		t.Errorf("Expected an error for a tagged query over max_series")
+	}
+	c.cfg.Read.MaxSeries = 3
+	if err := c.checkMaxSeries(nil, query, "prefix."); err != nil {
+		t.Errorf("Unexpected err: %s", err)
+	}
+}
+
+func TestRegexpToGlob(t *testing.T) {
+	escape := func(s string) string { return s }
+	for _, tc := range []struct {
+		re   string
+		glob string
+		ok   bool
+	}{
+		{re: "team-X", glob: "team-X", ok: true},
+		{re: "team-(X|Y)", glob: "team-{X,Y}", ok: true},
+		{re: "(prod|staging)-eu", glob: "{prod,staging}-eu", ok: true},
+		{re: "foo|foobar", glob: "foo{,bar}", ok: true},
+		// Lossy: they are only applied on the fetched series.
+		{re: "team.*", ok: false},
+		{re: "team-[a-z]", ok: false},
+		{re: "(?i)team", ok: false},
+		{re: "team|", ok: false},
+		{re: "host\\.example", ok: false},
+	} {
+		glob, ok := regexpToGlob(tc.re, escape)
+		if ok != tc.ok || glob != tc.glob {
+			t.Errorf("%s: expected %q (%v), got %q (%v)", tc.re, tc.glob, tc.ok, glob, ok)
+		}
+	}
+}
+
+func TestGlobReadQueryFiltersNegativeMatchers(t *testing.T) {
+	fetchURL = func(ctx context.Context, hc *http.Client, l log.Logger, u *url.URL) ([]byte, error) {
+		var body bytes.Buffer
+		if u.String() == "http://fakeHost:6666/render/?format=json&from=0&target=prometheus-prefix.test.%2A%2A&until=300" {
+			body.WriteString("[{\"target\": \"prometheus-prefix.test.owner.team-X\", \"datapoints\": [[18,0], [42,300]]},")
+			body.WriteString("{\"target\": \"prometheus-prefix.test.owner.team-Y\", \"datapoints\": [[18,0], [42,300]]}]")
+		}
+		return body.Bytes(), nil
+	}
+	testClient.cfg.Read.UseGlobTargets = true
+	defer func() { testClient.cfg.Read.UseGlobTargets = false }()
+
+	query := &prompb.Query{
+		StartTimestampMs: int64(0),
+		EndTimestampMs:   int64(300000),
+		Matchers: []*prompb.LabelMatcher{
+			&prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: model.MetricNameLabel, Value: "test"},
+			&prompb.LabelMatcher{Type: prompb.LabelMatcher_NEQ, Name: "owner", Value: "team-Y"},
+		},
+	}
+	expectedTs := []*prompb.TimeSeries{{Labels: expectedLabels, Samples: expectedSamples}}
+
+	result, err := testClient.handleReadQuery(nil, query, nil, testClient.cfg.DefaultPrefix)
+	if err != nil {
+		t.Errorf("Unexpected err: %s", err)
+	}
+	if !reflect.DeepEqual(expectedTs, result.Timeseries) {
+		t.Errorf("Expected %s, got %s", expectedTs, result.Timeseries)
+	}
+}
+
+func TestReadQueryOverMaxSeries(t *testing.T) {
+	rendered := false
+	fetchURL = func(ctx context.Context, hc *http.Client, l log.Logger, u *url.URL) ([]byte, error) {
+		var body bytes.Buffer
+		switch u.Path {
+		case "/metrics/find":
+			if u.Query().Get("query") == "prometheus-prefix.test.**" {
+				body.WriteString("[{\"id\": \"prometheus-prefix.test.owner\", \"text\": \"owner\", \"leaf\": 0},")
+				body.WriteString("{\"id\": \"prometheus-prefix.test.owner.team-X\", \"text\": \"team-X\", \"leaf\": 1},")
+				body.WriteString("{\"id\": \"prometheus-prefix.test.owner.team-Y\", \"text\": \"team-Y\", \"leaf\": 1}]")
+			}
+		case "/render/":
+			rendered = true
+			body.WriteString("[]")
+		}
+		return body.Bytes(), nil
+	}
+	testClient.cfg.Read.UseGlobTargets = true
+	testClient.cfg.Read.MaxSeries = 1
+	defer func() {
+		testClient.cfg.Read.UseGlobTargets = false
+		testClient.cfg.Read.MaxSeries = 0
+	}()
+
+	query := &prompb.Query{
+		StartTimestampMs: int64(0),
+		EndTimestampMs:   int64(300000),
+		Matchers: []*prompb.LabelMatcher{
+			&prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: model.MetricNameLabel, Value: "test"},
+		},
+	}
+	rejected := counterValue(t, rejectedReadQueries)
+	_, err := testClient.handleReadQuery(nil, query, nil, testClient.cfg.DefaultPrefix)
+	if err == nil {
+		t.Errorf("Expected an error for a query over max_series")
+	}
+	if rendered {
+		t.Errorf("Expected the query not to be rendered")
+	}
+	if got := counterValue(t, rejectedReadQueries); got != rejected+1 {
+		t.Errorf("Expected %v rejected queries, got %v", rejected+1, got)
+	}
+
+	// Queries within the limit are fetched.
+	testClient.cfg.Read.MaxSeries = 2
+	if _, err := testClient.handleReadQuery(nil, query, nil, testClient.cfg.DefaultPrefix); err != nil {
+		t.Errorf("Unexpected err: %s", err)
+	}
+	if !rendered {
+		t.Errorf("Expected the query to be rendered")
+	}
+}
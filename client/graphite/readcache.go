@@ -0,0 +1,95 @@
+// Copyright 2018 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphite
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// readCache is a LRU cache of render response bodies keyed by render URL.
+// The URL query parameters being sorted, the key holds the normalized target,
+// time range and options of the request.
+type readCache struct {
+	lock    sync.Mutex
+	ttl     time.Duration
+	size    int
+	lru     *list.List
+	entries map[string]*list.Element
+
+	// now is mocked in tests.
+	now func() time.Time
+}
+
+type readCacheEntry struct {
+	key     string
+	body    []byte
+	expires time.Time
+}
+
+func newReadCache(ttl time.Duration, size int) *readCache {
+	return &readCache{
+		ttl:     ttl,
+		size:    size,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+		now:     time.Now,
+	}
+}
+
+// get returns the body cached under key, if it hasn't expired.
+func (c *readCache) get(key string) ([]byte, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		readCacheMisses.Inc()
+		return nil, false
+	}
+	entry := e.Value.(*readCacheEntry)
+	if !c.now().Before(entry.expires) {
+		c.remove(e)
+		readCacheMisses.Inc()
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	readCacheHits.Inc()
+	return entry.body, true
+}
+
+// set caches body under key, evicting the least recently used entries
+// beyond the size of the cache.
+func (c *readCache) set(key string, body []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	expires := c.now().Add(c.ttl)
+	if e, ok := c.entries[key]; ok {
+		entry := e.Value.(*readCacheEntry)
+		entry.body, entry.expires = body, expires
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&readCacheEntry{key: key, body: body, expires: expires})
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *readCache) remove(e *list.Element) {
+	c.lru.Remove(e)
+	delete(c.entries, e.Value.(*readCacheEntry).key)
+}
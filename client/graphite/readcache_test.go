@@ -0,0 +1,96 @@
+// Copyright 2018 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphite
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestReadCacheHitAndMiss(t *testing.T) {
+	c := newReadCache(time.Minute, 10)
+
+	_, ok := c.get("a")
+	require.False(t, ok)
+
+	c.set("a", []byte("body-a"))
+	body, ok := c.get("a")
+	require.True(t, ok)
+	require.Equal(t, []byte("body-a"), body)
+
+	_, ok = c.get("b")
+	require.False(t, ok)
+}
+
+func TestReadCacheExpiry(t *testing.T) {
+	now := time.Unix(1000, 0)
+	c := newReadCache(time.Minute, 10)
+	c.now = func() time.Time { return now }
+
+	c.set("a", []byte("body-a"))
+	now = now.Add(59 * time.Second)
+	_, ok := c.get("a")
+	require.True(t, ok)
+
+	now = now.Add(time.Second)
+	_, ok = c.get("a")
+	require.False(t, ok)
+	require.Empty(t, c.entries)
+}
+
+func TestReadCacheEviction(t *testing.T) {
+	c := newReadCache(time.Minute, 2)
+
+	c.set("a", []byte("body-a"))
+	c.set("b", []byte("body-b"))
+	// Using "a" makes "b" the least recently used entry.
+	_, ok := c.get("a")
+	require.True(t, ok)
+	c.set("c", []byte("body-c"))
+
+	_, ok = c.get("b")
+	require.False(t, ok)
+	_, ok = c.get("a")
+	require.True(t, ok)
+	_, ok = c.get("c")
+	require.True(t, ok)
+}
+
+func TestRenderUsesReadCache(t *testing.T) {
+	fetches := 0
+	fetchURL = func(ctx context.Context, hc *http.Client, l log.Logger, u *url.URL) ([]byte, error) {
+		fetches++
+		return []byte("[{\"target\": \"prometheus-prefix.test.owner.team-X\", \"datapoints\": [[18,0], [42,300]]}]"), nil
+	}
+	testClient.readCache = newReadCache(time.Minute, 10)
+	defer func() { testClient.readCache = nil }()
+
+	for i := 0; i < 2; i++ {
+		ts, err := testClient.targetToTimeseries(nil, "prometheus-prefix.test.owner.team-X", "0", "300", 0, testClient.cfg.DefaultPrefix)
+		require.NoError(t, err)
+		require.Equal(t, expectedSamples, ts[0].Samples)
+	}
+	require.Equal(t, 1, fetches)
+
+	// Another time range isn't cached.
+	_, err := testClient.targetToTimeseries(nil, "prometheus-prefix.test.owner.team-X", "0", "600", 0, testClient.cfg.DefaultPrefix)
+	require.NoError(t, err)
+	require.Equal(t, 2, fetches)
+}
@@ -14,14 +14,21 @@
 package graphite
 
 import (
-	"bytes"
 	"fmt"
 	"sort"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"text/template"
 	"time"
+	"unicode/utf8"
 
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/relabel"
+	"golang.org/x/text/unicode/norm"
 
 	"github.com/criteo/graphite-remote-adapter/client/graphite/config"
 	"github.com/criteo/graphite-remote-adapter/utils"
@@ -32,14 +39,19 @@ import (
 type Format int
 
 const (
-	FormatCarbon            Format = 1
-	FormatCarbonTags               = 2
-	FormatCarbonOpenMetrics        = 3
+	FormatCarbon             Format = 1
+	FormatCarbonTags                = 2
+	FormatCarbonOpenMetrics         = 3
+	FormatInfluxLineProtocol        = 4
 )
 
 var (
 	pathsCache        *cache.Cache
 	pathsCacheEnabled = false
+
+	// unmatchedLogger logs a sample of the metrics matching no rule or
+	// dropped by one, nil when disabled.
+	unmatchedLogger *sampledLogger
 )
 
 func initPathsCache(pathsCacheTTL time.Duration, pathsCachePurgeInterval time.Duration) {
@@ -47,6 +59,46 @@ func initPathsCache(pathsCacheTTL time.Duration, pathsCachePurgeInterval time.Du
 	pathsCacheEnabled = true
 }
 
+// sampledLogger logs the first event and then one out of every n.
+type sampledLogger struct {
+	logger log.Logger
+	every  uint64
+	count  uint64
+}
+
+// newSampledLogger returns a logger keeping a fraction rate of the events,
+// or nil if rate is 0.
+func newSampledLogger(logger log.Logger, rate config.SampleRate) *sampledLogger {
+	if rate <= 0 {
+		return nil
+	}
+	return &sampledLogger{logger: logger, every: uint64(1/float64(rate) + 0.5)}
+}
+
+// Log logs keyvals if the event is sampled.
+func (l *sampledLogger) Log(keyvals ...interface{}) {
+	if l == nil || (atomic.AddUint64(&l.count, 1)-1)%l.every != 0 {
+		return
+	}
+	level.Info(l.logger).Log(keyvals...)
+}
+
+// logUnmatched logs a sample of the metrics which matched no rule or were
+// dropped by one.
+func logUnmatched(m model.Metric, paths []string, rules []int, cfg *config.WriteConfig) {
+	if unmatchedLogger == nil {
+		return
+	}
+	if len(rules) == 0 {
+		unmatchedLogger.Log("metric", m, "paths", strings.Join(paths, ","),
+			"msg", "Metric matched no rule, using the default path")
+	} else if len(paths) == 0 {
+		last := rules[len(rules)-1]
+		unmatchedLogger.Log("metric", m, "rule_index", last, "rule_name", cfg.RuleName(last),
+			"msg", "Metric dropped by a rule")
+	}
+}
+
 func loadContext(templateData map[string]interface{}, m model.Metric) map[string]interface{} {
 	ctx := make(map[string]interface{})
 	for k, v := range templateData {
@@ -60,114 +112,690 @@ func loadContext(templateData map[string]interface{}, m model.Metric) map[string
 	return ctx
 }
 
-func match(m model.Metric, match config.LabelSet, matchRE config.LabelSetRE) bool {
-	for ln, lv := range match {
+func match(m model.Metric, rule *config.Rule) bool {
+	name := m[model.MetricNameLabel]
+	if rule.Name != "" && name != rule.Name {
+		return false
+	}
+	if rule.NameRE != nil && !rule.NameRE.MatchString(string(name)) {
+		return false
+	}
+	for ln, lv := range rule.Match {
 		if m[ln] != lv {
 			return false
 		}
 	}
-	for ln, r := range matchRE {
+	for ln, r := range rule.MatchRE {
 		if !r.MatchString(string(m[ln])) {
 			return false
 		}
 	}
+	for ln, lv := range rule.MatchNot {
+		if m[ln] == lv {
+			return false
+		}
+	}
+	for ln, r := range rule.MatchNotRE {
+		if r.MatchString(string(m[ln])) {
+			return false
+		}
+	}
 	return true
 }
 
-func pathsFromMetric(m model.Metric, format Format, prefix string, rules []*config.Rule, templateData map[string]interface{}) []string {
+// cachedPaths are the paths of a metric, the rules which wrote them and the
+// indexes of the rules it matched.
+type cachedPaths struct {
+	paths  []string
+	owners []*config.Rule
+	rules  []int
+
+	// What the paths were computed with: a reloaded config or the prefix
+	// of a request may give other paths for the same metric.
+	cfg    *config.WriteConfig
+	format Format
+	prefix string
+}
+
+// relabelMetric applies the relabel_configs to m, returning nil if they drop
+// it. m is shared with the other writers, so it's copied.
+func relabelMetric(m model.Metric, cfg *config.WriteConfig) model.Metric {
+	if len(cfg.RelabelConfigs) == 0 {
+		return m
+	}
+	labels := make(model.LabelSet, len(m))
+	for ln, lv := range m {
+		labels[ln] = lv
+	}
+	labels = relabel.Process(labels, cfg.RelabelConfigs...)
+	if labels == nil {
+		return nil
+	}
+	return model.Metric(labels)
+}
+
+// pathsFromSample returns the paths of s and the rule which wrote each of
+// them, nil for default paths, along with the indexes of the rules it matched. The paths cache is bypassed when templates use
+// the value or the timestamp of the sample, or the metadata of the metric
+// which may arrive after the first samples.
+func pathsFromSample(s *model.Sample, format Format, prefix string, cfg *config.WriteConfig) ([]string, []*config.Rule, []int) {
+	if !cfg.UsesSample() {
+		return metricPaths(s.Metric, format, prefix, cfg)
+	}
+	paths, owners, rules, _ := computeRulePaths(s.Metric, s, format, prefix, cfg)
+	countRuleMatches(rules, cfg)
+	logUnmatched(s.Metric, paths, rules, cfg)
+	return paths, owners, rules
+}
+
+func pathsFromMetric(m model.Metric, format Format, prefix string, cfg *config.WriteConfig) []string {
+	paths, _, _ := metricPaths(m, format, prefix, cfg)
+	return paths
+}
+
+// metricPaths returns the paths of m, the rule which wrote each of them and
+// the indexes of the rules it matched, from the paths cache if it's enabled.
+func metricPaths(m model.Metric, format Format, prefix string, cfg *config.WriteConfig) ([]string, []*config.Rule, []int) {
 	if pathsCacheEnabled {
-		cachedPaths, cached := pathsCache.Get(m.Fingerprint().String())
-		if cached {
-			return cachedPaths.([]string)
+		cached, ok := pathsCache.Get(m.Fingerprint().String())
+		if ok && cached.(cachedPaths).cfg == cfg && cached.(cachedPaths).format == format &&
+			cached.(cachedPaths).prefix == prefix {
+			countRuleMatches(cached.(cachedPaths).rules, cfg)
+			logUnmatched(m, cached.(cachedPaths).paths, cached.(cachedPaths).rules, cfg)
+			return cached.(cachedPaths).paths, cached.(cachedPaths).owners, cached.(cachedPaths).rules
+		}
+	}
+	// Template errors are only reported by check-config.
+	paths, owners, rules, _ := computeRulePaths(m, nil, format, prefix, cfg)
+	countRuleMatches(rules, cfg)
+	logUnmatched(m, paths, rules, cfg)
+	if pathsCacheEnabled {
+		pathsCache.Set(m.Fingerprint().String(), cachedPaths{
+			paths: paths, owners: owners, rules: rules, cfg: cfg, format: format, prefix: prefix,
+		}, cache.DefaultExpiration)
+	}
+	return paths, owners, rules
+}
+
+// dropReason returns the reason a sample which matched rules was left
+// without any path: "rule" if the last rule it matched drops or silences it,
+// "error" if its paths failed to be rendered or were too long.
+func dropReason(rules []int, cfg *config.WriteConfig) string {
+	if len(rules) > 0 {
+		rule := cfg.Rules[rules[len(rules)-1]]
+		silences := (rule.Tmpl == config.Template{}) && rule.Format == "" && rule.Prefix == "" && !rule.Continue
+		if rule.Action == "drop" || silences {
+			return "rule"
+		}
+	}
+	return "error"
+}
+
+// countRuleMatches accounts for a sample which matched the given rules.
+func countRuleMatches(rules []int, cfg *config.WriteConfig) {
+	if len(rules) > 0 {
+		matchedSamples.Inc()
+	}
+	for _, i := range rules {
+		index, name := strconv.Itoa(i), cfg.RuleName(i)
+		ruleMatches.WithLabelValues(index, name).Inc()
+		if cfg.Rules[i].Action == "drop" {
+			ruleDropped.WithLabelValues(index, name).Inc()
 		}
 	}
-	paths, stop := templatedPaths(m, rules, templateData)
+}
+
+// computePaths returns the paths of m and the indexes of the rules it
+// matched, along with the first error met while executing the templates or
+// applying the name collision policy.
+// s is the sample being written, if any.
+func computePaths(m model.Metric, s *model.Sample, format Format, prefix string, cfg *config.WriteConfig) ([]string, []int, error) {
+	paths, _, rules, err := computeRulePaths(m, s, format, prefix, cfg)
+	return paths, rules, err
+}
+
+// computeRulePaths is computePaths, also returning the rule which wrote each
+// path, nil for default paths.
+func computeRulePaths(m model.Metric, s *model.Sample, format Format, prefix string, cfg *config.WriteConfig) ([]string, []*config.Rule, []int, error) {
+	if cfg.ExtraLabelsInRules {
+		m = withExtraLabels(m, cfg)
+	}
+	prefix = metricPrefix(m, s, prefix, cfg)
+	paths, owners, rules, stop, err := templatedPaths(m, s, format, prefix, cfg)
 	// if it doesn't match any rule, use default path
 	if !stop {
-		paths = append(paths, defaultPath(m, format, prefix))
+		if cfg.DefaultTmpl != nil {
+			path, tmplErr := renderTemplate(*cfg.DefaultTmpl, withExtraLabels(m, cfg), s, prefix, cfg, nil)
+			if tmplErr != nil && err == nil {
+				err = tmplErr
+			}
+			paths = append(paths, prefix+path)
+			owners = append(owners, nil)
+		} else if path, pathErr := metricDefaultPath(m, format, prefix, cfg); pathErr != nil {
+			if err == nil {
+				err = pathErr
+			}
+		} else {
+			paths = append(paths, path)
+			owners = append(owners, nil)
+		}
 	}
-	if pathsCacheEnabled {
-		pathsCache.Set(m.Fingerprint().String(), paths, cache.DefaultExpiration)
+	paths, owners = limitPathLength(paths, owners, cfg)
+	return paths, owners, rules, err
+}
+
+// metricDefaultPath returns the default path of m in format, with the extra
+// labels and the label policies of cfg, or an error if the name collision
+// policy rejects m.
+func metricDefaultPath(m model.Metric, format Format, prefix string, cfg *config.WriteConfig) (string, error) {
+	if !cfg.ExtraLabelsInRules {
+		m = withExtraLabels(m, cfg)
 	}
-	return paths
+	m, err := resolveNameCollision(m, format, cfg)
+	if err != nil {
+		return "", err
+	}
+	m = normalizeLabelValues(emptyLabelValues(m, cfg), cfg)
+	return defaultPath(lowercaseTags(collapseHistogram(m, format, cfg), format, cfg), format, prefix, cfg), nil
+}
+
+// withExtraLabels returns a copy of m with the extra labels it lacks, its own
+// labels taking precedence.
+func withExtraLabels(m model.Metric, cfg *config.WriteConfig) model.Metric {
+	if len(cfg.ExtraLabels) == 0 {
+		return m
+	}
+	merged := make(model.Metric, len(m)+len(cfg.ExtraLabels))
+	for ln, lv := range cfg.ExtraLabels {
+		merged[ln] = lv
+	}
+	for ln, lv := range m {
+		merged[ln] = lv
+	}
+	return merged
+}
+
+// metricPrefix returns the prefix of the paths of m, rendered from the prefix
+// template if any. The template gets the static prefix as .prefix, and the
+// metrics lacking one of its labels get the fallback prefix.
+func metricPrefix(m model.Metric, s *model.Sample, prefix string, cfg *config.WriteConfig) string {
+	if cfg.Prefix == nil {
+		return prefix
+	}
+	rendered, err := renderTemplate(cfg.Prefix.Template, m, s, prefix, cfg, nil)
+	if err != nil {
+		if cfg.PrefixFallback != "" {
+			return cfg.PrefixFallback
+		}
+		return prefix
+	}
+	return rendered
+}
+
+// resolveNameCollision applies the name collision policy to m, if one of
+// its labels is named like the metric: in carbon paths, where the name is
+// followed by label names and values, the path would be ambiguous.
+func resolveNameCollision(m model.Metric, format Format, cfg *config.WriteConfig) (model.Metric, error) {
+	if format != FormatCarbon || cfg.NameCollisionPolicy == "keep" || cfg.NameCollisionPolicy == "" {
+		return m, nil
+	}
+	name := model.LabelName(m[model.MetricNameLabel])
+	if _, ok := m[name]; !ok {
+		return m, nil
+	}
+	nameCollisions.Inc()
+
+	if cfg.NameCollisionPolicy == "error" {
+		return nil, fmt.Errorf("label %s is named like the metric", name)
+	}
+	// m is shared with the other writers, so it's copied.
+	resolved := make(model.Metric, len(m))
+	for ln, lv := range m {
+		if ln != name {
+			resolved[ln] = lv
+		}
+	}
+	if cfg.NameCollisionPolicy == "suffix" {
+		renamed := name + "_"
+		for {
+			if _, ok := m[renamed]; !ok {
+				break
+			}
+			renamed += "_"
+		}
+		resolved[renamed] = m[name]
+	}
+	return resolved, nil
+}
+
+// limitPathLength applies the path length policy to the paths longer than
+// the maximum path length, if any. The rules which wrote the paths are kept
+// along.
+func limitPathLength(paths []string, owners []*config.Rule, cfg *config.WriteConfig) ([]string, []*config.Rule) {
+	if cfg.MaxPathLength <= 0 {
+		return paths, owners
+	}
+	kept := paths[:0]
+	keptOwners := owners[:0]
+	for i, path := range paths {
+		if len(path) > cfg.MaxPathLength {
+			longPaths.Inc()
+			switch cfg.PathLengthPolicy {
+			case "truncate":
+				path = truncatePath(path, cfg.MaxPathLength)
+			case "hash_suffix":
+				// The hash of the whole path keeps truncated paths apart.
+				path = truncatePath(path, cfg.MaxPathLength-config.PathHashSuffixLength) +
+					fmt.Sprintf("-%08x", fnv1a32(path))
+			default:
+				continue
+			}
+		}
+		kept = append(kept, path)
+		keptOwners = append(keptOwners, owners[i])
+	}
+	return kept, keptOwners
+}
+
+// truncatePath returns the first n bytes of path at most, not cutting a
+// rune in the middle.
+func truncatePath(path string, n int) string {
+	if len(path) <= n {
+		return path
+	}
+	for n > 0 && !utf8.RuneStart(path[n]) {
+		n--
+	}
+	return path[:n]
 }
 
-func templatedPaths(m model.Metric, rules []*config.Rule, templateData map[string]interface{}) ([]string, bool) {
+// ruleFormats maps the formats allowed in rules to the matching Format.
+var ruleFormats = map[string]Format{
+	"carbon":             FormatCarbon,
+	"carbon-tags":        FormatCarbonTags,
+	"carbon-openmetrics": FormatCarbonOpenMetrics,
+}
+
+// matchREGroups returns the submatches of the rule's match_re regexps by
+// label, indexed by "_<n>" and by name for named groups.
+func matchREGroups(m model.Metric, rule *config.Rule) map[string]map[string]string {
+	groups := make(map[string]map[string]string, len(rule.MatchRE))
+	for ln, r := range rule.MatchRE {
+		submatches := r.FindStringSubmatch(string(m[ln]))
+		if submatches == nil {
+			continue
+		}
+		names := r.SubexpNames()
+		g := make(map[string]string, len(submatches))
+		for i, submatch := range submatches[1:] {
+			g[fmt.Sprintf("_%d", i+1)] = submatch
+			if name := names[i+1]; name != "" {
+				g[name] = submatch
+			}
+		}
+		groups[string(ln)] = g
+	}
+	return groups
+}
+
+// renderTemplate executes tmpl with the context of m, holding the prefix,
+// the match_re groups of rule, the value and timestamp of s if any and the
+// metadata of m.
+func renderTemplate(tmpl config.Template, m model.Metric, s *model.Sample, prefix string, cfg *config.WriteConfig, rule *config.Rule) (string, error) {
+	context := loadContext(cfg.TemplateData, m)
+	context["prefix"] = prefix
+	if s != nil {
+		context["value"] = float64(s.Value)
+		context["timestamp"] = s.Timestamp.Unix()
+	}
+	if tmpl.UsesSample() {
+		context["meta"] = templateMetadata(m)
+	}
+	if rule != nil {
+		context["match_re"] = matchREGroups(m, rule)
+	} else {
+		context["match_re"] = map[string]map[string]string{}
+	}
+	// The template is only cloned when functions have to be bound to m,
+	// as executing a template is safe for concurrent use.
+	t := tmpl.Template
+	if tmpl.UsesMetricFuncs() {
+		var err error
+		if t, err = tmpl.Clone(); err != nil {
+			return "", err
+		}
+		t.Funcs(metricFuncs(m, cfg.Escaping))
+	}
+
+	path := getBuffer()
+	defer putBuffer(path)
+	err := t.Execute(path, context)
+	return path.String(), err
+}
+
+// metricFuncs returns the template functions bound to the labels of m.
+func metricFuncs(m model.Metric, escaping config.EscapingConfig) template.FuncMap {
+	return template.FuncMap{
+		// labelsJoined joins the sorted names and escaped values of the
+		// labels of m, or of the given ones, with sep.
+		"labelsJoined": func(sep string, names ...string) string {
+			var labels []string
+			if len(names) > 0 {
+				labels = append(labels, names...)
+			} else {
+				for ln := range m {
+					if ln != model.MetricNameLabel {
+						labels = append(labels, string(ln))
+					}
+				}
+			}
+			sort.Strings(labels)
+
+			var segments []string
+			for _, ln := range labels {
+				if lv := m[model.LabelName(ln)]; lv != "" {
+					segments = append(segments, ln,
+						utils.EscapeWithPolicy(string(lv), escaping.Policy, escaping.Replacement))
+				}
+			}
+			return strings.Join(segments, sep)
+		},
+		// hasLabel tells whether m has a non-empty label called name.
+		"hasLabel": func(name string) bool {
+			return m[model.LabelName(name)] != ""
+		},
+	}
+}
+
+func templatedPaths(m model.Metric, s *model.Sample, format Format, prefix string, cfg *config.WriteConfig) ([]string, []*config.Rule, []int, bool, error) {
 	var paths []string
+	var owners []*config.Rule
+	var rules []int
 	var stop = false
-	for _, rule := range rules {
-		match := match(m, rule.Match, rule.MatchRE)
-		if !match {
-			continue
+	var tmplErr error
+	for _, final := range [2]bool{false, true} {
+		// The final rules are only evaluated if no other rule matched.
+		if final && (len(rules) > 0 || !cfg.HasFinalRules()) {
+			break
 		}
-		// We have a rule to silence this metric
-		if rule.Continue == false && (rule.Tmpl == config.Template{}) {
-			return nil, true
+		for i, rule := range cfg.Rules {
+			if rule.Final != final {
+				continue
+			}
+			match := match(m, rule)
+			if !match {
+				continue
+			}
+			rules = append(rules, i)
+			if rule.Action == "drop" {
+				return nil, nil, rules, true, nil
+			}
+			// The prefix of the rule replaces the global one.
+			rulePrefix := prefix
+			if rule.Prefix != "" {
+				rulePrefix = rule.Prefix
+			}
+			if (rule.Tmpl == config.Template{}) {
+				if rule.Format != "" || rule.Prefix != "" {
+					// Use the default path, in the format of the rule.
+					ruleFormat := format
+					if rule.Format != "" {
+						ruleFormat = ruleFormats[rule.Format]
+					}
+					if path, err := metricDefaultPath(m, ruleFormat, rulePrefix, cfg); err != nil {
+						if tmplErr == nil {
+							tmplErr = err
+						}
+					} else {
+						paths = append(paths, path)
+						owners = append(owners, rule)
+					}
+				} else if rule.Continue == false {
+					// We have a rule to silence this metric
+					return nil, nil, rules, true, nil
+				}
+			} else {
+				path, err := renderTemplate(rule.Tmpl, m, s, rulePrefix, cfg, rule)
+				if err != nil && tmplErr == nil {
+					tmplErr = err
+				}
+				// Like the global prefix, the prefix of the rule is only
+				// given to its template as .prefix.
+				for _, p := range splitPaths(path) {
+					paths = append(paths, p)
+					owners = append(owners, rule)
+				}
+			}
+
+			stop = !rule.Continue
+			if rule.Continue == false {
+				break
+			}
 		}
+	}
+	return paths, owners, rules, stop, tmplErr
+}
+
+// splitPaths returns the paths rendered by a template, one per line. Blank
+// lines are ignored and surrounding spaces trimmed.
+func splitPaths(rendered string) []string {
+	if !strings.Contains(rendered, "\n") {
+		return []string{rendered}
+	}
+	var paths []string
+	for _, line := range strings.Split(rendered, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			paths = append(paths, line)
+		}
+	}
+	return paths
+}
+
+// inDefaultPath tells whether the label l is written in default paths, given
+// the dropped or kept labels.
+func inDefaultPath(l model.LabelName, cfg *config.WriteConfig) bool {
+	if len(cfg.KeepLabels) > 0 {
+		return l == model.MetricNameLabel || containsLabel(cfg.KeepLabels, l)
+	}
+	return !containsLabel(cfg.DropLabels, l)
+}
+
+// containsLabel tells whether l is one of labels.
+func containsLabel(labels []model.LabelName, l model.LabelName) bool {
+	for _, label := range labels {
+		if label == l {
+			return true
+		}
+	}
+	return false
+}
 
-		context := loadContext(templateData, m)
-		var path bytes.Buffer
-		rule.Tmpl.Execute(&path, context)
-		paths = append(paths, path.String())
+// orderLabels returns the sorted labels with the ones listed in order first,
+// in this order.
+func orderLabels(labels model.LabelNames, order []model.LabelName) model.LabelNames {
+	ordered := make(model.LabelNames, 0, len(labels))
+	listed := make(map[model.LabelName]bool, len(order))
+	for _, l := range order {
+		listed[l] = true
+	}
+	present := make(map[model.LabelName]bool, len(labels))
+	for _, l := range labels {
+		present[l] = true
+	}
+	for _, l := range order {
+		if present[l] {
+			ordered = append(ordered, l)
+		}
+	}
+	for _, l := range labels {
+		if !listed[l] {
+			ordered = append(ordered, l)
+		}
+	}
+	return ordered
+}
 
-		stop = !rule.Continue
-		if rule.Continue == false {
+// emptyLabelValues applies the empty label value policy to m: in default
+// paths, empty values would leave doubled separators or empty tags. Labels
+// are skipped unless configured otherwise, as Prometheus treats empty labels
+// as missing ones.
+func emptyLabelValues(m model.Metric, cfg *config.WriteConfig) model.Metric {
+	if cfg.EmptyLabelValuePolicy == "keep" {
+		return m
+	}
+	empty := false
+	for l, v := range m {
+		if v == "" && l != model.MetricNameLabel {
+			empty = true
 			break
 		}
 	}
-	return paths, stop
+	if !empty {
+		return m
+	}
+
+	// m is shared with the other writers, so it's copied.
+	filled := make(model.Metric, len(m))
+	for l, v := range m {
+		if v != "" || l == model.MetricNameLabel {
+			filled[l] = v
+		} else if cfg.EmptyLabelValuePolicy == "placeholder" {
+			filled[l] = model.LabelValue(cfg.EmptyLabelPlaceholder)
+		}
+	}
+	return filled
 }
 
-func defaultPath(m model.Metric, format Format, prefix string) string {
-	var buffer bytes.Buffer
-	var lbuffer bytes.Buffer
+// normalizeLabelValues returns m with its label values normalized to Unicode
+// NFC when configured, so that the composed and decomposed forms of a value
+// are escaped to the same path.
+func normalizeLabelValues(m model.Metric, cfg *config.WriteConfig) model.Metric {
+	if !cfg.NormalizeLabelValues {
+		return m
+	}
+	var normalized model.Metric
+	for l, v := range m {
+		if norm.NFC.IsNormalString(string(v)) {
+			continue
+		}
+		if normalized == nil {
+			// m is shared with the other writers, so it's copied.
+			normalized = m.Clone()
+		}
+		normalized[l] = model.LabelValue(norm.NFC.String(string(v)))
+	}
+	if normalized == nil {
+		return m
+	}
+	return normalized
+}
+
+// lowercaseTags returns m with lowercase label names and/or values when
+// configured for the tagged formats. Rules were evaluated on the original
+// labels; labels only differing by case are merged, the one which already was
+// lowercase or else the first one in order winning.
+func lowercaseTags(m model.Metric, format Format, cfg *config.WriteConfig) model.Metric {
+	if format != FormatCarbonTags && format != FormatCarbonOpenMetrics {
+		return m
+	}
+	if !cfg.LowercaseTagKeys && !cfg.LowercaseTagValues {
+		return m
+	}
+
+	lowercased := make(model.Metric, len(m))
+	origins := make(map[model.LabelName]model.LabelName, len(m))
+	for l, v := range m {
+		name := l
+		if cfg.LowercaseTagKeys {
+			name = model.LabelName(strings.ToLower(string(l)))
+		}
+		if origin, ok := origins[name]; ok && (origin == name || (l != name && origin < l)) {
+			continue
+		}
+		if cfg.LowercaseTagValues && l != model.MetricNameLabel {
+			v = model.LabelValue(strings.ToLower(string(v)))
+		}
+		lowercased[name] = v
+		origins[name] = l
+	}
+	return lowercased
+}
+
+func defaultPath(m model.Metric, format Format, prefix string, cfg *config.WriteConfig) string {
+	if format == FormatInfluxLineProtocol {
+		return influxSeriesKey(m, prefix)
+	}
+
+	buffer := getBuffer()
+	defer putBuffer(buffer)
 
 	buffer.WriteString(prefix)
-	buffer.WriteString(utils.Escape(string(m[model.MetricNameLabel])))
+	escaping := cfg.Escaping
+	escape := func(s string) string {
+		return utils.EscapeWithPolicy(s, escaping.Policy, escaping.Replacement)
+	}
+
+	name := escape(string(m[model.MetricNameLabel]))
+	if format == FormatCarbonTags {
+		name = utils.EscapeTagValue(name, escaping.Policy)
+	}
+	buffer.WriteString(name)
 
 	// We want to sort the labels.
 	labels := make(model.LabelNames, 0, len(m))
 	for l := range m {
-		labels = append(labels, l)
+		if inDefaultPath(l, cfg) {
+			labels = append(labels, l)
+		}
 	}
 	sort.Sort(labels)
+	if format == FormatCarbon && len(cfg.LabelOrder) > 0 {
+		labels = orderLabels(labels, cfg.LabelOrder)
+	}
 
 	first := true
 	for _, l := range labels {
+		// Carbon rejects empty tag names.
 		if l == model.MetricNameLabel || len(l) == 0 {
 			continue
 		}
 
 		k := string(l)
-		v := utils.Escape(string(m[l]))
+		v := escape(string(m[l]))
 
 		if format == FormatCarbonOpenMetrics {
 			// https://github.com/RichiH/OpenMetrics/blob/master/metric_exposition_format.md
-			if !first {
-				lbuffer.WriteString(",")
+			if first {
+				buffer.WriteByte('{')
+			} else {
+				buffer.WriteByte(',')
 			}
-			lbuffer.WriteString(fmt.Sprintf("%s=\"%s\"", k, v))
+			buffer.WriteString(k)
+			buffer.WriteString("=\"")
+			buffer.WriteString(v)
+			buffer.WriteByte('"')
 		} else if format == FormatCarbonTags {
-			// See http://graphite.readthedocs.io/en/latest/tags.html
-			lbuffer.WriteString(fmt.Sprintf(";%s=%s", k, v))
+			// See http://graphite.readthedocs.io/en/latest/tags.html, carbon
+			// silently drops the series with reserved characters in tags.
+			buffer.WriteByte(';')
+			buffer.WriteString(utils.EscapeTagName(k, escaping.Policy))
+			buffer.WriteByte('=')
+			buffer.WriteString(utils.EscapeTagValue(v, escaping.Policy))
 		} else {
 			// For each label, in order, add ".<label>.<value>".
 			// Since we use '.' instead of '=' to separate label and values
 			// it means that we can't have an '.' in the metric name. Fortunately
 			// this is prohibited in prometheus metrics.
-			lbuffer.WriteString(fmt.Sprintf(".%s.%s", k, v))
+			buffer.WriteByte('.')
+			buffer.WriteString(k)
+			buffer.WriteByte('.')
+			buffer.WriteString(v)
 		}
 		first = false
 	}
 
-	if lbuffer.Len() > 0 {
-		if format == FormatCarbonOpenMetrics {
-			buffer.WriteRune('{')
-			buffer.Write(lbuffer.Bytes())
-			buffer.WriteRune('}')
-		} else {
-			buffer.Write(lbuffer.Bytes())
-		}
+	if format == FormatCarbonOpenMetrics && !first {
+		buffer.WriteByte('}')
 	}
 	return buffer.String()
 }
@@ -196,6 +824,22 @@ func metricLabelsFromTags(tags Tags, prefix string) ([]*prompb.Label, error) {
 	return labels, nil
 }
 
+// metricLabelsFromTaggedPath parses a carbon tagged series
+// (<prefix.><__name__>[;<labelName>=<labelValue> for each label]) for graphite
+// backends which don't return the tags of the series they render.
+func metricLabelsFromTaggedPath(path string, prefix string) ([]*prompb.Label, error) {
+	nodes := strings.Split(path, ";")
+	tags := Tags{"name": nodes[0]}
+	for _, node := range nodes[1:] {
+		kv := strings.SplitN(node, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("Unable to parse labels from tagged path: invalid tag %q", node)
+		}
+		tags[kv[0]] = kv[1]
+	}
+	return metricLabelsFromTags(tags, prefix)
+}
+
 func metricLabelsFromPath(path string, prefix string) ([]*prompb.Label, error) {
 	// It uses the "default" write format to read back (See defaultPath function)
 	// <prefix.><__name__.>[<labelName>.<labelValue>. for each label in alphabetic order]
@@ -14,13 +14,21 @@
 package graphite
 
 import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/go-kit/kit/log"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/prompb"
 	"github.com/stretchr/testify/require"
 	yaml "gopkg.in/yaml.v2"
 
+	"github.com/criteo/graphite-remote-adapter/client"
 	"github.com/criteo/graphite-remote-adapter/client/graphite/config"
 )
 
@@ -79,7 +87,7 @@ func TestDefaultPathsFromMetric(t *testing.T) {
 		".many_chars.abc!ABC:012-3!45%C3%B667~89%2E%2F\\(\\)\\{\\}\\,%3D%2E\\\"\\\\" +
 		".owner.team-X" +
 		".testlabel.test:value"
-	actual := pathsFromMetric(metric, FormatCarbon, "prefix.", nil, nil)
+	actual := pathsFromMetric(metric, FormatCarbon, "prefix.", &config.WriteConfig{})
 	require.Equal(t, expected, actual[0])
 
 	expected = "prefix." +
@@ -88,7 +96,7 @@ func TestDefaultPathsFromMetric(t *testing.T) {
 		";owner=team-X" +
 		";testlabel=test:value"
 
-	actual = pathsFromMetric(metric, FormatCarbonTags, "prefix.", nil, nil)
+	actual = pathsFromMetric(metric, FormatCarbonTags, "prefix.", &config.WriteConfig{})
 	require.Equal(t, expected, actual[0])
 
 	expected = "prefix." +
@@ -97,10 +105,136 @@ func TestDefaultPathsFromMetric(t *testing.T) {
 		",owner=\"team-X\"" +
 		",testlabel=\"test:value\"" +
 		"}"
-	actual = pathsFromMetric(metric, FormatCarbonOpenMetrics, "prefix.", nil, nil)
+	actual = pathsFromMetric(metric, FormatCarbonOpenMetrics, "prefix.", &config.WriteConfig{})
 	require.Equal(t, expected, actual[0])
 }
 
+func TestEscapingPolicyPathsFromMetric(t *testing.T) {
+	manyChars := model.Metric{
+		model.MetricNameLabel: "test:metric",
+		"many_chars":          "abc!ABC:012-3!45ö67~89./(){},=.\"\\",
+	}
+	for _, tc := range []struct {
+		escaping config.EscapingConfig
+		value    string
+	}{
+		{
+			escaping: config.EscapingConfig{Policy: "percent"},
+			value:    "abc!ABC:012-3!45%C3%B667~89%2E%2F\\(\\)\\{\\}\\,%3D%2E\\\"\\\\",
+		},
+		{
+			escaping: config.EscapingConfig{Policy: "percent", Replacement: "_"},
+			value:    "abc!ABC:012-3!45%C3%B667~89__\\(\\)\\{\\}\\,%3D_\\\"\\\\",
+		},
+		{
+			escaping: config.EscapingConfig{Policy: "underscore"},
+			value:    "abc!ABC:012-3!45_67~89___________",
+		},
+		{
+			escaping: config.EscapingConfig{Policy: "underscore", Replacement: "-"},
+			value:    "abc!ABC:012-3!45_67~89--______-__",
+		},
+		{
+			escaping: config.EscapingConfig{Policy: "none"},
+			value:    "abc!ABC:012-3!45ö67~89./(){},=.\"\\",
+		},
+	} {
+		cfg := &config.WriteConfig{Escaping: tc.escaping}
+
+		actual := pathsFromMetric(manyChars, FormatCarbon, "prefix.", cfg)
+		require.Equal(t, []string{"prefix.test:metric.many_chars." + tc.value}, actual, "%v", tc.escaping)
+
+		tagValue := tc.value
+		if tc.escaping.Policy == "none" {
+			tagValue = strings.Replace(tagValue, "=", "_", -1)
+		}
+		actual = pathsFromMetric(manyChars, FormatCarbonTags, "prefix.", cfg)
+		require.Equal(t, []string{"prefix.test:metric;many_chars=" + tagValue}, actual, "%v", tc.escaping)
+
+		actual = pathsFromMetric(manyChars, FormatCarbonOpenMetrics, "prefix.", cfg)
+		require.Equal(t, []string{"prefix.test:metric{many_chars=\"" + tc.value + "\"}"}, actual, "%v", tc.escaping)
+	}
+}
+
+func TestNormalizeLabelValuesPathsFromMetric(t *testing.T) {
+	composed := model.Metric{
+		model.MetricNameLabel: "test:metric",
+		"many_chars":          "abc!ABC:012-3!45\u00f667~89./(){},=.\"\\",
+	}
+	decomposed := model.Metric{
+		model.MetricNameLabel: "test:metric",
+		"many_chars":          "abc!ABC:012-3!45o\u030867~89./(){},=.\"\\",
+	}
+	expected := []string{"prefix.test:metric.many_chars.abc!ABC:012-3!45%C3%B667~89%2E%2F\\(\\)\\{\\}\\,%3D%2E\\\"\\\\"}
+
+	// Disabled by default.
+	cfg := &config.WriteConfig{Escaping: config.EscapingConfig{Policy: "percent"}}
+	require.Equal(t, expected, pathsFromMetric(composed, FormatCarbon, "prefix.", cfg))
+	require.NotEqual(t, expected, pathsFromMetric(decomposed, FormatCarbon, "prefix.", cfg))
+
+	cfg.NormalizeLabelValues = true
+	require.Equal(t, expected, pathsFromMetric(composed, FormatCarbon, "prefix.", cfg))
+	require.Equal(t, expected, pathsFromMetric(decomposed, FormatCarbon, "prefix.", cfg))
+	// The metric, shared with the other writers, is left untouched.
+	require.Equal(t, model.LabelValue("abc!ABC:012-3!45o\u030867~89./(){},=.\"\\"), decomposed["many_chars"])
+
+	// So are the default paths written by rules.
+	cfg.Rules = []*config.Rule{
+		{Match: config.LabelSet{model.MetricNameLabel: "test:metric"}, Prefix: "prefix.", Continue: true},
+		{Match: config.LabelSet{model.MetricNameLabel: "test:metric"}, Format: "carbon-tags"},
+	}
+	paths := pathsFromMetric(decomposed, FormatCarbon, "prefix.", cfg)
+	require.Equal(t, pathsFromMetric(composed, FormatCarbon, "prefix.", cfg), paths)
+	require.Len(t, paths, 2)
+	require.Equal(t, expected[0], paths[0])
+}
+
+func TestCarbonTagsReservedPathsFromMetric(t *testing.T) {
+	reserved := model.Metric{
+		model.MetricNameLabel: "test;metric",
+		"a=b":                 "~c;d=e",
+		"f!g":                 "h",
+	}
+	for _, tc := range []struct {
+		policy   string
+		expected string
+	}{
+		{"percent", "prefix.test%3Bmetric;a%3Db=%7Ec%3Bd%3De;f%21g=h"},
+		{"underscore", "prefix.test_metric;a_b=_c_d_e;f_g=h"},
+		{"none", "prefix.test_metric;a_b=_c_d_e;f_g=h"},
+	} {
+		cfg := &config.WriteConfig{Escaping: config.EscapingConfig{Policy: tc.policy}}
+		actual := pathsFromMetric(reserved, FormatCarbonTags, "prefix.", cfg)
+		require.Equal(t, []string{tc.expected}, actual, tc.policy)
+		_, err := metricLabelsFromTaggedPath(actual[0], "prefix.")
+		require.NoError(t, err, tc.policy)
+	}
+}
+
+func TestInfluxPathsFromMetric(t *testing.T) {
+	expected := "prefix." +
+		"test:metric" +
+		",many_chars=abc!ABC:012-3!45ö67~89./(){}\\,\\=.\"\\\\" +
+		",owner=team-X" +
+		",testlabel=test:value"
+	actual := pathsFromMetric(metric, FormatInfluxLineProtocol, "prefix.", &config.WriteConfig{})
+	require.Equal(t, expected, actual[0])
+
+	// Spaces are escaped and empty tags are dropped.
+	spaced := model.Metric{
+		model.MetricNameLabel: "test metric",
+		"with space":          "a value",
+		"empty":               "",
+	}
+	actual = pathsFromMetric(spaced, FormatInfluxLineProtocol, "", &config.WriteConfig{})
+	require.Equal(t, "test\\ metric,with\\ space=a\\ value", actual[0])
+
+	// A backslash doesn't escape the character following it.
+	slashed := model.Metric{model.MetricNameLabel: "test", "path": `c:\,d`}
+	actual = pathsFromMetric(slashed, FormatInfluxLineProtocol, "", &config.WriteConfig{})
+	require.Equal(t, `test,path=c:\\\,d`, actual[0])
+}
+
 func TestUnmatchedMetricPathsFromMetric(t *testing.T) {
 	unmatchedMetric := model.Metric{
 		model.MetricNameLabel: "test:metric",
@@ -114,14 +248,14 @@ func TestUnmatchedMetricPathsFromMetric(t *testing.T) {
 		".owner.team-K"+
 		".testlabel.test:value"+
 		".testlabel2.test:value2")
-	actual := pathsFromMetric(unmatchedMetric, FormatCarbon, "prefix.", testConfig.Write.Rules, testConfig.Write.TemplateData)
+	actual := pathsFromMetric(unmatchedMetric, FormatCarbon, "prefix.", &testConfig.Write)
 	require.Equal(t, expected, actual)
 }
 
 func TestTemplatedPathsFromMetric(t *testing.T) {
 	expected := make([]string, 0)
 	expected = append(expected, "tmpl_3.team-Y.data.foo")
-	actual := pathsFromMetric(metricY, FormatCarbon, "", testConfig.Write.Rules, testConfig.Write.TemplateData)
+	actual := pathsFromMetric(metricY, FormatCarbon, "", &testConfig.Write)
 	require.Equal(t, expected, actual)
 }
 
@@ -133,7 +267,7 @@ func TestTemplatedPathsFromMetricWithDefault(t *testing.T) {
 		".many_chars.abc!ABC:012-3!45%C3%B667~89%2E%2F\\(\\)\\{\\}\\,%3D%2E\\\"\\\\"+
 		".owner.team-X"+
 		".testlabel.test:value")
-	actual := pathsFromMetric(metric, FormatCarbon, "prefix.", testConfig.Write.Rules, testConfig.Write.TemplateData)
+	actual := pathsFromMetric(metric, FormatCarbon, "prefix.", &testConfig.Write)
 	require.Equal(t, expected, actual)
 }
 
@@ -147,7 +281,7 @@ func TestMultiTemplatedPathsFromMetric(t *testing.T) {
 	expected := make([]string, 0)
 	expected = append(expected, "tmpl_1.data%2Efoo.team-X")
 	expected = append(expected, "tmpl_2.team-X.data.foo")
-	actual := pathsFromMetric(multiMatchMetric, FormatCarbon, "prefix.", testConfig.Write.Rules, testConfig.Write.TemplateData)
+	actual := pathsFromMetric(multiMatchMetric, FormatCarbon, "prefix.", &testConfig.Write)
 	require.Equal(t, expected, actual)
 }
 
@@ -159,10 +293,649 @@ func TestSkipedTemplatedPathsFromMetric(t *testing.T) {
 		"testlabel2":          "test:value2",
 	}
 	t.Log(testConfig.Write.Rules[2])
-	actual := pathsFromMetric(skipedMetric, FormatCarbon, "", testConfig.Write.Rules, testConfig.Write.TemplateData)
+	actual := pathsFromMetric(skipedMetric, FormatCarbon, "", &testConfig.Write)
 	require.Empty(t, actual)
 }
 
+func TestPerRuleFormatPathsFromMetric(t *testing.T) {
+	cfg := loadTestConfig(`
+write:
+  rules:
+  - match:
+      owner: team-X
+    format: carbon-tags
+    continue: false
+  - match:
+      owner: team-Y
+    format: carbon-openmetrics
+    continue: true`)
+	require.NotNil(t, cfg)
+
+	metricX := model.Metric{model.MetricNameLabel: "test", "owner": "team-X"}
+	actual := pathsFromMetric(metricX, FormatCarbon, "prefix.", &cfg.Write)
+	require.Equal(t, []string{"prefix.test;owner=team-X"}, actual)
+
+	// Falls back to the global format for the default path.
+	metricY := model.Metric{model.MetricNameLabel: "test", "owner": "team-Y"}
+	actual = pathsFromMetric(metricY, FormatCarbon, "prefix.", &cfg.Write)
+	require.Equal(t, []string{"prefix.test{owner=\"team-Y\"}", "prefix.test.owner.team-Y"}, actual)
+
+	metricZ := model.Metric{model.MetricNameLabel: "test", "owner": "team-Z"}
+	actual = pathsFromMetric(metricZ, FormatCarbon, "prefix.", &cfg.Write)
+	require.Equal(t, []string{"prefix.test.owner.team-Z"}, actual)
+}
+
+func TestDropRulePathsFromMetric(t *testing.T) {
+	cfg := loadTestConfig(`
+write:
+  rules:
+  - match:
+      owner: team-X
+    action: drop
+  - match:
+      owner: team-X
+    template: 'never.{{.labels.owner}}'
+    continue: true`)
+	require.NotNil(t, cfg)
+
+	metricX := model.Metric{model.MetricNameLabel: "test", "owner": "team-X"}
+	require.Empty(t, pathsFromMetric(metricX, FormatCarbon, "prefix.", &cfg.Write))
+
+	metricY := model.Metric{model.MetricNameLabel: "test", "owner": "team-Y"}
+	actual := pathsFromMetric(metricY, FormatCarbon, "prefix.", &cfg.Write)
+	require.Equal(t, []string{"prefix.test.owner.team-Y"}, actual)
+}
+
+func TestPathsCacheReload(t *testing.T) {
+	defer func(enabled bool) { pathsCacheEnabled = enabled }(pathsCacheEnabled)
+	initPathsCache(time.Minute, time.Minute)
+
+	cfg := loadTestConfig(`
+write:
+  rules:
+  - match:
+      owner: team-X
+    template: 'old.{{.labels.owner}}'`)
+	require.NotNil(t, cfg)
+	reloaded := loadTestConfig(`
+write:
+  rules:
+  - match:
+      owner: team-X
+    template: 'new.{{.labels.owner}}'`)
+	require.NotNil(t, reloaded)
+
+	metricX := model.Metric{model.MetricNameLabel: "test", "owner": "team-X"}
+	require.Equal(t, []string{"old.team-X"}, pathsFromMetric(metricX, FormatCarbon, "prefix.", &cfg.Write))
+	require.Equal(t, []string{"new.team-X"}, pathsFromMetric(metricX, FormatCarbon, "prefix.", &reloaded.Write))
+
+	// Default paths depend on the prefix of the request.
+	metricY := model.Metric{model.MetricNameLabel: "test", "owner": "team-Y"}
+	require.Equal(t, []string{"a.test.owner.team-Y"}, pathsFromMetric(metricY, FormatCarbon, "a.", &cfg.Write))
+	require.Equal(t, []string{"b.test.owner.team-Y"}, pathsFromMetric(metricY, FormatCarbon, "b.", &cfg.Write))
+}
+
+func TestNameRulePathsFromMetric(t *testing.T) {
+	cfg := loadTestConfig(`
+write:
+  rules:
+  - name_re: node_cpu_.*
+    match:
+      owner: team-X
+    template: 'cpu.{{.labels.__name__}}'
+    continue: false
+  - name: node_load1
+    template: 'load.{{.labels.owner}}'
+    continue: false`)
+	require.NotNil(t, cfg)
+
+	for name, expected := range map[model.LabelValue]string{
+		"node_cpu_seconds_total": "cpu.node_cpu_seconds_total",
+		"node_cpu_guest_seconds": "cpu.node_cpu_guest_seconds",
+		"node_load1":             "load.team-X",
+		"node_cpu":               "prefix.node_cpu.owner.team-X",
+		"node_load15":            "prefix.node_load15.owner.team-X",
+	} {
+		m := model.Metric{model.MetricNameLabel: name, "owner": "team-X"}
+		require.Equal(t, []string{expected}, pathsFromMetric(m, FormatCarbon, "prefix.", &cfg.Write))
+	}
+
+	// All the matchers must match.
+	m := model.Metric{model.MetricNameLabel: "node_cpu_seconds_total", "owner": "team-Y"}
+	actual := pathsFromMetric(m, FormatCarbon, "prefix.", &cfg.Write)
+	require.Equal(t, []string{"prefix.node_cpu_seconds_total.owner.team-Y"}, actual)
+}
+
+func TestMatchREGroupsPathsFromMetric(t *testing.T) {
+	cfg := loadTestConfig(`
+write:
+  rules:
+  - match_re:
+      region: ^([a-z]+)-([0-9]+)$
+      instance: (?P<host>[^:]+):(?P<port>[0-9]+)
+    template: 'regions.{{.match_re.region._1}}.shards.{{.match_re.region._2}}.{{.match_re.instance.host}}.{{.match_re.instance._2}}'
+    continue: false`)
+	require.NotNil(t, cfg)
+
+	m := model.Metric{model.MetricNameLabel: "test", "region": "eu-42", "instance": "host1:9100"}
+	actual := pathsFromMetric(m, FormatCarbon, "prefix.", &cfg.Write)
+	require.Equal(t, []string{"regions.eu.shards.42.host1.9100"}, actual)
+}
+
+func TestDefaultTemplatePathsFromMetric(t *testing.T) {
+	cfg := loadTestConfig(`
+write:
+  template_data:
+    site: par
+  default_template: 'unmatched.{{.site}}.{{.labels.__name__}}.{{.labels.owner}}'
+  rules:
+  - match:
+      owner: team-X
+    template: 'team.{{.labels.owner}}.{{.labels.__name__}}'
+    continue: false
+  - match:
+      owner: team-Y
+    continue: false`)
+	require.NotNil(t, cfg)
+
+	m := model.Metric{model.MetricNameLabel: "default_tmpl", "owner": "team-Z"}
+	actual := pathsFromMetric(m, FormatCarbon, "prefix.", &cfg.Write)
+	require.Equal(t, []string{"prefix.unmatched.par.default_tmpl.team-Z"}, actual)
+
+	// Metrics matching a rule don't use it.
+	m = model.Metric{model.MetricNameLabel: "default_tmpl", "owner": "team-X"}
+	actual = pathsFromMetric(m, FormatCarbon, "prefix.", &cfg.Write)
+	require.Equal(t, []string{"team.team-X.default_tmpl"}, actual)
+	m = model.Metric{model.MetricNameLabel: "default_tmpl", "owner": "team-Y"}
+	require.Empty(t, pathsFromMetric(m, FormatCarbon, "prefix.", &cfg.Write))
+}
+
+func TestLabelFuncsPathsFromMetric(t *testing.T) {
+	cfg := loadTestConfig(`
+write:
+  rules:
+  - match:
+      owner: team-X
+    template: 'all.{{ labelsJoined "." }}'
+    continue: true
+  - match:
+      owner: team-X
+    template: 'some.{{ labelsJoined "." "testlabel" "owner" "missing" }}'
+    continue: true
+  - match:
+      owner: team-X
+    template: 'cond{{ if hasLabel "owner" }}.owned{{ end }}{{ if hasLabel "missing" }}.missing{{ end }}'
+    continue: false`)
+	require.NotNil(t, cfg)
+
+	actual := pathsFromMetric(metric, FormatCarbon, "", &cfg.Write)
+	require.Equal(t, []string{
+		"all.many_chars.abc!ABC:012-3!45%C3%B667~89%2E%2F\\(\\)\\{\\}\\,%3D%2E\\\"\\\\.owner.team-X.testlabel.test:value",
+		"some.owner.team-X.testlabel.test:value",
+		"cond.owned",
+	}, actual)
+}
+
+func TestSamplePathsFromSample(t *testing.T) {
+	cfg := loadTestConfig(`
+write:
+  rules:
+  - match:
+      owner: team-X
+    template: 'by_value.{{ if gt .value 10.0 }}high{{ else }}low{{ end }}.{{.labels.owner}}'
+    continue: true
+  - match:
+      owner: team-X
+    template: 'by_time.{{.timestamp}}'
+    continue: false`)
+	require.NotNil(t, cfg)
+	require.True(t, cfg.Write.UsesSample())
+
+	for _, tc := range []struct {
+		value    model.SampleValue
+		expected []string
+	}{
+		{42, []string{"by_value.high.team-X", "by_time.1500000000"}},
+		{1, []string{"by_value.low.team-X", "by_time.1500000000"}},
+	} {
+		s := &model.Sample{Metric: metric, Value: tc.value, Timestamp: model.TimeFromUnix(1500000000)}
+		actual, _, _ := pathsFromSample(s, FormatCarbon, "", &cfg.Write)
+		require.Equal(t, tc.expected, actual)
+	}
+
+	require.False(t, testConfig.Write.UsesSample())
+}
+
+func TestMultiLineTemplatePathsFromMetric(t *testing.T) {
+	cfg := loadTestConfig(`
+write:
+  rules:
+  - match:
+      owner: team-X
+    template: |
+      teams.{{.labels.owner}}.{{.labels.__name__}}
+
+      global.{{.labels.__name__}}
+    continue: true
+  - match:
+      owner: team-X
+    template: 'last.{{.labels.owner}}'
+    continue: false`)
+	require.NotNil(t, cfg)
+
+	actual := pathsFromMetric(metric, FormatCarbon, "", &cfg.Write)
+	require.Equal(t, []string{
+		"teams.team-X.test:metric",
+		"global.test:metric",
+		"last.team-X",
+	}, actual)
+}
+
+func TestMaxPathLengthPathsFromMetric(t *testing.T) {
+	long := "prefix.test:metric" + strings.Repeat(".label.value", 10)
+	for _, tc := range []struct {
+		policy   string
+		expected []string
+	}{
+		{"drop", []string{"prefix.short"}},
+		{"truncate", []string{"prefix.short", long[:40]}},
+		{"hash_suffix", []string{"prefix.short", long[:31] + fmt.Sprintf("-%08x", fnv1a32(long))}},
+	} {
+		cfg := &config.WriteConfig{MaxPathLength: 40, PathLengthPolicy: tc.policy}
+		exceeded := counterValue(t, longPaths)
+		rule := &config.Rule{}
+		actual, owners := limitPathLength([]string{"prefix.short", long}, []*config.Rule{nil, rule}, cfg)
+		require.Equal(t, tc.expected, actual, tc.policy)
+		require.Equal(t, []*config.Rule{nil, rule}[:len(actual)], owners, tc.policy)
+		require.Equal(t, exceeded+1, counterValue(t, longPaths), tc.policy)
+		for _, path := range actual {
+			require.True(t, len(path) <= 40, path)
+		}
+	}
+	require.Equal(t, "prefix.valu", truncatePath("prefix.valué", 12))
+
+	cfg := loadTestConfig(`
+write:
+  max_path_length: 20
+  path_length_policy: truncate`)
+	require.NotNil(t, cfg)
+	require.Equal(t, []string{"prefix.test:metric.m"}, pathsFromMetric(metric, FormatCarbon, "prefix.", &cfg.Write))
+}
+
+func TestRelabelPathsFromMetric(t *testing.T) {
+	cfg := loadTestConfig(`
+write:
+  relabel_configs:
+  - action: labeldrop
+    regex: many_chars|testlabel
+  - source_labels: [owner]
+    regex: team-(.*)
+    target_label: team
+    replacement: $1
+  - action: labeldrop
+    regex: owner
+  - source_labels: [__name__]
+    regex: drop:.*
+    action: drop`)
+	require.NotNil(t, cfg)
+
+	relabeled := relabelMetric(metric, &cfg.Write)
+	require.Equal(t, model.Metric{model.MetricNameLabel: "test:metric", "team": "X"}, relabeled)
+	require.Equal(t, []string{"prefix.test:metric.team.X"}, pathsFromMetric(relabeled, FormatCarbon, "prefix.", &cfg.Write))
+	// The metric, shared with the other writers, is left untouched.
+	require.Len(t, metric, 4)
+
+	require.Nil(t, relabelMetric(model.Metric{model.MetricNameLabel: "drop:me"}, &cfg.Write))
+}
+
+func TestNameCollisionPathsFromMetric(t *testing.T) {
+	colliding := model.Metric{
+		model.MetricNameLabel: "up",
+		"up":                  "yes",
+		"up_":                 "taken",
+		"job":                 "api",
+	}
+	for _, tc := range []struct {
+		policy   string
+		expected []string
+	}{
+		{"keep", []string{"prefix.up.job.api.up.yes.up_.taken"}},
+		{"suffix", []string{"prefix.up.job.api.up_.taken.up__.yes"}},
+		{"drop", []string{"prefix.up.job.api.up_.taken"}},
+		{"error", nil},
+	} {
+		cfg := &config.WriteConfig{NameCollisionPolicy: tc.policy}
+		collisions := counterValue(t, nameCollisions)
+		paths, _, err := computePaths(colliding, nil, FormatCarbon, "prefix.", cfg)
+		require.Equal(t, tc.expected, paths, tc.policy)
+		require.Equal(t, tc.policy == "error", err != nil, tc.policy)
+		if tc.policy != "keep" {
+			require.Equal(t, collisions+1, counterValue(t, nameCollisions), tc.policy)
+		}
+
+		// Tags and labels don't collide with the name.
+		paths, _, err = computePaths(colliding, nil, FormatCarbonTags, "prefix.", cfg)
+		require.NoError(t, err)
+		require.Equal(t, []string{"prefix.up;job=api;up=yes;up_=taken"}, paths, tc.policy)
+	}
+	require.Len(t, colliding, 4)
+}
+
+func TestEmptyLabelValuePathsFromMetric(t *testing.T) {
+	m := model.Metric{
+		model.MetricNameLabel: "up",
+		"job":                 "api",
+		"label":               "",
+		"next":                "x",
+	}
+	for _, tc := range []struct {
+		policy string
+		carbon string
+		tags   string
+	}{
+		{"", "prefix.up.job.api.next.x", "prefix.up;job=api;next=x"},
+		{"skip", "prefix.up.job.api.next.x", "prefix.up;job=api;next=x"},
+		{"placeholder", "prefix.up.job.api.label.none.next.x", "prefix.up;job=api;label=none;next=x"},
+		{"keep", "prefix.up.job.api.label..next.x", "prefix.up;job=api;label=;next=x"},
+	} {
+		cfg := &config.WriteConfig{EmptyLabelValuePolicy: tc.policy, EmptyLabelPlaceholder: "none"}
+		require.Equal(t, []string{tc.carbon}, pathsFromMetric(m, FormatCarbon, "prefix.", cfg), tc.policy)
+		require.Equal(t, []string{tc.tags}, pathsFromMetric(m, FormatCarbonTags, "prefix.", cfg), tc.policy)
+	}
+
+	// The default paths of rules follow the policy too.
+	cfg := &config.WriteConfig{Rules: []*config.Rule{
+		{Match: config.LabelSet{"job": "api"}, Prefix: "rule.", Continue: true},
+		{Match: config.LabelSet{"job": "api"}, Format: "carbon-tags"},
+	}}
+	require.Equal(t, []string{"rule.up.job.api.next.x", "prefix.up;job=api;next=x"}, pathsFromMetric(m, FormatCarbon, "prefix.", cfg))
+	require.Len(t, m, 4)
+}
+
+func TestLowercaseTagsPathsFromMetric(t *testing.T) {
+	m := model.Metric{
+		model.MetricNameLabel: "Up",
+		"Owner":               "Team-X",
+		"owner":               "team-y",
+		"Job":                 "API",
+	}
+	cfg := &config.WriteConfig{
+		Rules: []*config.Rule{
+			{Match: config.LabelSet{"Owner": "Team-X"}, Format: "carbon-openmetrics"},
+		},
+	}
+
+	// Disabled by default.
+	paths, _, err := computePaths(m, nil, FormatCarbonTags, "", &config.WriteConfig{})
+	require.NoError(t, err)
+	require.Equal(t, []string{"Up;Job=API;Owner=Team-X;owner=team-y"}, paths)
+
+	cfg.LowercaseTagKeys = true
+	paths, _, err = computePaths(m, nil, FormatCarbonTags, "", cfg)
+	require.NoError(t, err)
+	require.Equal(t, []string{`Up{job="API",owner="team-y"}`}, paths)
+
+	cfg.LowercaseTagValues = true
+	cfg.Rules = nil
+	paths, _, err = computePaths(m, nil, FormatCarbonTags, "", cfg)
+	require.NoError(t, err)
+	require.Equal(t, []string{"Up;job=api;owner=team-y"}, paths)
+
+	// Carbon paths are left alone.
+	paths, _, err = computePaths(m, nil, FormatCarbon, "", cfg)
+	require.NoError(t, err)
+	require.Equal(t, []string{"Up.Job.API.Owner.Team-X.owner.team-y"}, paths)
+}
+
+func TestCollapseHistogramPathsFromMetric(t *testing.T) {
+	defer func(m *metadataStore) { metricsMetadata = m }(metricsMetadata)
+	metricsMetadata = newMetadataStore()
+	metricsMetadata.set([]client.MetricMetadata{{MetricFamilyName: "rpc_duration_seconds", Type: "histogram"}})
+
+	cfg := &config.WriteConfig{CollapseHistograms: true}
+	for _, test := range []struct {
+		m        model.Metric
+		expected string
+	}{
+		{model.Metric{model.MetricNameLabel: "rpc_duration_seconds_bucket", "le": "0.5", "job": "api"},
+			"rpc_duration_seconds;field=bucket;job=api;le=0%2E5"},
+		{model.Metric{model.MetricNameLabel: "rpc_duration_seconds_sum", "job": "api"},
+			"rpc_duration_seconds;field=sum;job=api"},
+		{model.Metric{model.MetricNameLabel: "gc_duration_seconds", "quantile": "0.99"},
+			"gc_duration_seconds;field=quantile;quantile=0%2E99"},
+		// Without metadata, counts may not be part of a histogram.
+		{model.Metric{model.MetricNameLabel: "gc_duration_seconds_count"},
+			"gc_duration_seconds_count"},
+		{model.Metric{model.MetricNameLabel: "up_bucket", "job": "api"},
+			"up_bucket;job=api"},
+	} {
+		paths, _, err := computePaths(test.m, nil, FormatCarbonTags, "", cfg)
+		require.NoError(t, err)
+		require.Equal(t, []string{test.expected}, paths)
+	}
+
+	// Carbon paths and disabled collapsing are left alone.
+	bucket := model.Metric{model.MetricNameLabel: "rpc_duration_seconds_bucket", "le": "0.5"}
+	paths, _, err := computePaths(bucket, nil, FormatCarbon, "", cfg)
+	require.NoError(t, err)
+	require.Equal(t, []string{"rpc_duration_seconds_bucket.le.0%2E5"}, paths)
+	paths, _, err = computePaths(bucket, nil, FormatCarbonTags, "", &config.WriteConfig{})
+	require.NoError(t, err)
+	require.Equal(t, []string{"rpc_duration_seconds_bucket;le=0%2E5"}, paths)
+}
+
+func TestLabelOrderPathsFromMetric(t *testing.T) {
+	m := model.Metric{
+		model.MetricNameLabel: "up",
+		"dc":                  "par",
+		"instance":            "host:9100",
+		"job":                 "node",
+		"az":                  "a",
+	}
+	cfg := &config.WriteConfig{LabelOrder: []model.LabelName{"job", "missing", "instance"}}
+	paths, _, err := computePaths(m, nil, FormatCarbon, "prefix.", cfg)
+	require.NoError(t, err)
+	require.Equal(t, []string{"prefix.up.job.node.instance.host:9100.az.a.dc.par"}, paths)
+
+	// Tags are sorted by carbon anyway.
+	paths, _, err = computePaths(m, nil, FormatCarbonTags, "prefix.", cfg)
+	require.NoError(t, err)
+	require.Equal(t, []string{"prefix.up;az=a;dc=par;instance=host:9100;job=node"}, paths)
+}
+
+func TestDropLabelsPathsFromMetric(t *testing.T) {
+	cfg := loadTestConfig(`
+write:
+  drop_labels: [instance, pod]
+  rules:
+  - match:
+      instance: host:9100
+    template: 'hosts.{{.labels.instance | escape}}.{{.labels.__name__}}'
+    continue: true`)
+	require.NotNil(t, cfg)
+
+	m := model.Metric{model.MetricNameLabel: "up", "instance": "host:9100", "job": "node"}
+	for format, expected := range map[Format][]string{
+		FormatCarbon:            {"hosts.host:9100.up", "prefix.up.job.node"},
+		FormatCarbonTags:        {"hosts.host:9100.up", "prefix.up;job=node"},
+		FormatCarbonOpenMetrics: {"hosts.host:9100.up", `prefix.up{job="node"}`},
+	} {
+		paths, _, err := computePaths(m, nil, format, "prefix.", &cfg.Write)
+		require.NoError(t, err)
+		require.Equal(t, expected, paths)
+	}
+}
+
+func TestKeepLabelsPathsFromMetric(t *testing.T) {
+	cfg := &config.WriteConfig{KeepLabels: []model.LabelName{"job", "dc"}}
+	m := model.Metric{
+		model.MetricNameLabel: "up",
+		"instance":            "host:9100",
+		"job":                 "node",
+		"dc":                  "par",
+		"pod":                 "node-x7f2",
+	}
+	paths, _, err := computePaths(m, nil, FormatCarbon, "prefix.", cfg)
+	require.NoError(t, err)
+	require.Equal(t, []string{"prefix.up.dc.par.job.node"}, paths)
+
+	paths, _, err = computePaths(m, nil, FormatCarbonTags, "prefix.", cfg)
+	require.NoError(t, err)
+	require.Equal(t, []string{"prefix.up;dc=par;job=node"}, paths)
+}
+
+func TestExtraLabelsPathsFromMetric(t *testing.T) {
+	cfg := loadTestConfig(`
+write:
+  extra_labels:
+    adapter: dc1-a
+    job: unknown
+  rules:
+  - match:
+      adapter: dc1-a
+    template: 'adapters.{{.labels.adapter}}.{{.labels.__name__}}'
+    continue: true`)
+	require.NotNil(t, cfg)
+
+	m := model.Metric{model.MetricNameLabel: "up", "job": "node"}
+	paths, rules, err := computePaths(m, nil, FormatCarbon, "prefix.", &cfg.Write)
+	require.NoError(t, err)
+	require.Equal(t, []string{"prefix.up.adapter.dc1-a.job.node"}, paths)
+	require.Empty(t, rules)
+
+	paths, _, err = computePaths(m, nil, FormatCarbonTags, "prefix.", &cfg.Write)
+	require.NoError(t, err)
+	require.Equal(t, []string{"prefix.up;adapter=dc1-a;job=node"}, paths)
+	require.Len(t, m, 2)
+
+	// And in those of the rules.
+	cfg.Write.Rules = append(cfg.Write.Rules, &config.Rule{Match: config.LabelSet{"job": "node"}, Prefix: "nodes."})
+	paths, _, err = computePaths(m, nil, FormatCarbon, "prefix.", &cfg.Write)
+	require.NoError(t, err)
+	require.Equal(t, []string{"nodes.up.adapter.dc1-a.job.node"}, paths)
+	cfg.Write.Rules = cfg.Write.Rules[:1]
+
+	// The rules match the extra labels if asked to.
+	cfg.Write.ExtraLabelsInRules = true
+	paths, rules, err = computePaths(m, nil, FormatCarbon, "prefix.", &cfg.Write)
+	require.NoError(t, err)
+	require.Equal(t, []string{"adapters.dc1-a.up", "prefix.up.adapter.dc1-a.job.node"}, paths)
+	require.Equal(t, []int{0}, rules)
+}
+
+func TestTemplatedPrefixPathsFromMetric(t *testing.T) {
+	cfg := loadTestConfig(`
+write:
+  prefix: '{{.labels.dc}}.{{.prefix}}'
+  rules:
+  - match:
+      job: api
+    template: '{{.prefix}}api.{{.labels.__name__}}'
+    continue: false`)
+	require.NotNil(t, cfg)
+
+	m := model.Metric{model.MetricNameLabel: "up", "dc": "dc1"}
+	paths, _, err := computePaths(m, nil, FormatCarbon, "prometheus.", &cfg.Write)
+	require.NoError(t, err)
+	require.Equal(t, []string{"dc1.prometheus.up.dc.dc1"}, paths)
+
+	m = model.Metric{model.MetricNameLabel: "up", "dc": "dc2", "job": "api"}
+	paths, _, err = computePaths(m, nil, FormatCarbon, "prometheus.", &cfg.Write)
+	require.NoError(t, err)
+	require.Equal(t, []string{"dc2.prometheus.api.up"}, paths)
+
+	// Without the dc label, the static prefix or the fallback is used.
+	m = model.Metric{model.MetricNameLabel: "up"}
+	paths, _, err = computePaths(m, nil, FormatCarbon, "prometheus.", &cfg.Write)
+	require.NoError(t, err)
+	require.Equal(t, []string{"prometheus.up"}, paths)
+	cfg.Write.PrefixFallback = "nodc."
+	paths, _, err = computePaths(m, nil, FormatCarbon, "prometheus.", &cfg.Write)
+	require.NoError(t, err)
+	require.Equal(t, []string{"nodc.up"}, paths)
+}
+
+func TestPrefixSegmentsPathsFromMetric(t *testing.T) {
+	t.Setenv("TEST_PREFIX_DC", "par")
+	cfg := loadTestConfig(`
+write:
+  prefix: [prod, '${TEST_PREFIX_DC}', '{{.labels.region}}']
+  prefix_fallback: 'noregion.'`)
+	require.NotNil(t, cfg)
+
+	m := model.Metric{model.MetricNameLabel: "up", "region": "eu"}
+	paths, _, err := computePaths(m, nil, FormatCarbon, "prometheus.", &cfg.Write)
+	require.NoError(t, err)
+	require.Equal(t, []string{"prod.par.eu.up.region.eu"}, paths)
+
+	m = model.Metric{model.MetricNameLabel: "up"}
+	paths, _, err = computePaths(m, nil, FormatCarbon, "prometheus.", &cfg.Write)
+	require.NoError(t, err)
+	require.Equal(t, []string{"noregion.up"}, paths)
+}
+
+func TestRulePrefixPathsFromMetric(t *testing.T) {
+	cfg := loadTestConfig(`
+write:
+  rules:
+  - match:
+      owner: team-X
+    prefix: 'team_x.'
+    continue: true
+  - match:
+      owner: team-X
+    template: '{{.prefix}}owners.{{.labels.owner}}.{{.labels.__name__}}'
+    prefix: 'archive.'
+    continue: true
+  - match:
+      owner: team-X
+    template: 'unprefixed.{{.labels.__name__}}'
+    prefix: 'ignored.'
+    continue: true
+  - match:
+      owner: team-X
+    template: '{{.prefix}}all.{{.labels.__name__}}'
+    continue: false`)
+	require.NotNil(t, cfg)
+
+	m := model.Metric{model.MetricNameLabel: "up", "owner": "team-X"}
+	require.Equal(t, []string{
+		"team_x.up.owner.team-X",
+		"archive.owners.team-X.up",
+		"unprefixed.up",
+		"prometheus.all.up",
+	}, pathsFromMetric(m, FormatCarbon, "prometheus.", &cfg.Write))
+}
+
+func TestNegativeMatchPathsFromMetric(t *testing.T) {
+	cfg := loadTestConfig(`
+write:
+  rules:
+  - match_not:
+      owner: team-X
+    match_not_re:
+      env: dev|test
+    template: 'others.{{.labels.owner}}'
+    continue: false
+  - template: 'catch_all.{{.labels.owner}}'
+    continue: false`)
+	require.NotNil(t, cfg)
+
+	for _, tc := range []struct {
+		metric   model.Metric
+		expected string
+	}{
+		{model.Metric{"owner": "team-Y", "env": "prod"}, "others.team-Y"},
+		{model.Metric{"owner": "team-Y"}, "others.team-Y"},
+		{model.Metric{"owner": "team-X", "env": "prod"}, "catch_all.team-X"},
+		{model.Metric{"owner": "team-Y", "env": "dev"}, "catch_all.team-Y"},
+	} {
+		tc.metric[model.MetricNameLabel] = "test"
+		actual := pathsFromMetric(tc.metric, FormatCarbon, "prefix.", &cfg.Write)
+		require.Equal(t, []string{tc.expected}, actual, "%v", tc.metric)
+	}
+}
+
 func TestMetricLabelsFromPath(t *testing.T) {
 	path := "prometheus-prefix.test.owner.team-X"
 	prefix := "prometheus-prefix"
@@ -173,3 +946,240 @@ func TestMetricLabelsFromPath(t *testing.T) {
 	actualLabels, _ := metricLabelsFromPath(path, prefix)
 	require.Equal(t, expectedLabels, actualLabels)
 }
+
+func TestMetricLabelsFromTaggedPath(t *testing.T) {
+	path := "prometheus-prefix.test;owner=team-X;env=prod"
+	prefix := "prometheus-prefix."
+	expectedLabels := []*prompb.Label{
+		&prompb.Label{Name: "env", Value: "prod"},
+		&prompb.Label{Name: model.MetricNameLabel, Value: "test"},
+		&prompb.Label{Name: "owner", Value: "team-X"},
+	}
+	actualLabels, err := metricLabelsFromTaggedPath(path, prefix)
+	require.NoError(t, err)
+	require.Equal(t, expectedLabels, actualLabels)
+
+	// Tags without a value can't be parsed.
+	_, err = metricLabelsFromTaggedPath("prometheus-prefix.test;owner", prefix)
+	require.Error(t, err)
+}
+
+func TestMetricLabelsFromEscapedTaggedPath(t *testing.T) {
+	escaped := model.Metric{
+		model.MetricNameLabel: "test:metric",
+		"many_chars":          "abc!ABC:012-3!45ö67~89./(){},=.\"\\",
+		"reserved":            "~a;b=c",
+	}
+	paths := pathsFromMetric(escaped, FormatCarbonTags, "prometheus-prefix.", &config.WriteConfig{})
+	require.Len(t, paths, 1)
+
+	labels, err := metricLabelsFromTaggedPath(paths[0], "prometheus-prefix.")
+	require.NoError(t, err)
+	testClient.unescapeLabels(labels)
+	require.Equal(t, []*prompb.Label{
+		{Name: "many_chars", Value: "abc!ABC:012-3!45ö67~89./(){},=.\"\\"},
+		{Name: model.MetricNameLabel, Value: "test:metric"},
+		{Name: "reserved", Value: "~a;b=c"},
+	}, labels)
+
+	// Equality matchers are escaped to match the tags, regexps can't be.
+	require.Equal(t, "%7Ea%3Bb%3Dc", testClient.escapeTagValue("~a;b=c", prompb.LabelMatcher_EQ))
+	require.Equal(t, "~a;b=c", testClient.escapeTagValue("~a;b=c", prompb.LabelMatcher_RE))
+}
+
+// counterValue returns the current value of c.
+func counterValue(t *testing.T, c interface{ Write(*dto.Metric) error }) float64 {
+	var m dto.Metric
+	require.NoError(t, c.Write(&m))
+	return m.GetCounter().GetValue()
+}
+
+func TestRuleMatchedSamples(t *testing.T) {
+	cfg := loadTestConfig(`
+write:
+  rules:
+  - match:
+      owner: team-X
+    template: 'teams.{{.labels.owner}}'
+    continue: false`)
+	require.NotNil(t, cfg)
+
+	before := counterValue(t, matchedSamples)
+	pathsFromMetric(model.Metric{model.MetricNameLabel: "test", "owner": "team-X"}, FormatCarbon, "prefix.", &cfg.Write)
+	pathsFromMetric(model.Metric{model.MetricNameLabel: "test", "owner": "team-Y"}, FormatCarbon, "prefix.", &cfg.Write)
+	require.Equal(t, before+1, counterValue(t, matchedSamples))
+}
+
+func TestFinalRule(t *testing.T) {
+	cfg := loadTestConfig(`
+write:
+  rules:
+  - final: true
+    template: 'unowned.{{.labels.__name__}}'
+  - match:
+      owner: team-X
+    template: 'teams.{{.labels.owner}}.{{.labels.__name__}}'
+    continue: false
+  - match:
+      env: dev
+    action: drop`)
+	require.NotNil(t, cfg)
+
+	for _, test := range []struct {
+		m     model.Metric
+		paths []string
+		rules []int
+	}{
+		{model.Metric{model.MetricNameLabel: "test", "owner": "team-X"}, []string{"teams.team-X.test"}, []int{1}},
+		{model.Metric{model.MetricNameLabel: "test", "env": "dev"}, nil, []int{2}},
+		{model.Metric{model.MetricNameLabel: "test", "env": "prod"}, []string{"unowned.test"}, []int{0}},
+	} {
+		paths, rules, err := computePaths(test.m, nil, FormatCarbon, "prefix.", &cfg.Write)
+		require.NoError(t, err)
+		require.Equal(t, test.paths, paths, "%s", test.m)
+		require.Equal(t, test.rules, rules, "%s", test.m)
+	}
+}
+
+func TestRuleMatchCounters(t *testing.T) {
+	cfg := loadTestConfig(`
+write:
+  rules:
+  - match:
+      owner: team-X
+    template: 'teams.{{.labels.owner}}'
+    continue: true
+  - match:
+      env: dev
+    action: drop
+  - match:
+      owner: team-X
+    template: 'never.{{.labels.owner}}'
+    continue: false`)
+	require.NotNil(t, cfg)
+
+	before := make([]float64, 3)
+	for i := range before {
+		before[i] = counterValue(t, ruleMatches.WithLabelValues(strconv.Itoa(i), strconv.Itoa(i)))
+	}
+	dropped := counterValue(t, ruleDropped.WithLabelValues("1", "1"))
+
+	for _, m := range []model.Metric{
+		{model.MetricNameLabel: "test", "owner": "team-X", "env": "prod"},
+		{model.MetricNameLabel: "test", "owner": "team-X", "env": "dev"},
+		{model.MetricNameLabel: "test", "owner": "team-Y", "env": "dev"},
+		{model.MetricNameLabel: "test", "owner": "team-Y", "env": "prod"},
+	} {
+		pathsFromMetric(m, FormatCarbon, "prefix.", &cfg.Write)
+	}
+
+	// The drop rule shadows the last rule for dev metrics.
+	for i, expected := range []float64{2, 2, 1} {
+		require.Equal(t, before[i]+expected, counterValue(t, ruleMatches.WithLabelValues(strconv.Itoa(i), strconv.Itoa(i))), "rule %d", i)
+	}
+	require.Equal(t, dropped+2, counterValue(t, ruleDropped.WithLabelValues("1", "1")))
+}
+
+func TestRuleNameInMetrics(t *testing.T) {
+	cfg := loadTestConfig(`
+write:
+  rules:
+  - rule_name: team-x
+    match:
+      owner: team-X
+    template: 'teams.{{.labels.owner}}'
+    continue: true
+  - match:
+      env: dev
+    action: drop`)
+	require.NotNil(t, cfg)
+
+	named := ruleMatches.WithLabelValues("0", "team-x")
+	unnamed := ruleDropped.WithLabelValues("1", "1")
+	before, dropped := counterValue(t, named), counterValue(t, unnamed)
+
+	pathsFromMetric(model.Metric{model.MetricNameLabel: "test", "owner": "team-X", "env": "dev"}, FormatCarbon, "prefix.", &cfg.Write)
+	require.Equal(t, before+1, counterValue(t, named))
+	require.Equal(t, dropped+1, counterValue(t, unnamed))
+}
+
+func TestLogUnmatchedSampled(t *testing.T) {
+	cfg := loadTestConfig(`
+write:
+  rules:
+  - match:
+      owner: team-X
+    template: 'teams.{{.labels.owner}}'
+    continue: false
+  - rule_name: dev-drop
+    match:
+      env: dev
+    action: drop`)
+	require.NotNil(t, cfg)
+
+	var buf bytes.Buffer
+	unmatchedLogger = newSampledLogger(log.NewLogfmtLogger(&buf), config.SampleRate(0.5))
+	defer func() { unmatchedLogger = nil }()
+
+	unmatched := model.Metric{model.MetricNameLabel: "test", "owner": "team-Y"}
+	for i := 0; i < 4; i++ {
+		pathsFromMetric(unmatched, FormatCarbon, "prefix.", &cfg.Write)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 2)
+	require.Contains(t, lines[0], `paths=prefix.test.owner.team-Y msg="Metric matched no rule, using the default path"`)
+
+	// Matched metrics aren't logged, nor counted by the sampling.
+	buf.Reset()
+	pathsFromMetric(model.Metric{model.MetricNameLabel: "test", "owner": "team-X"}, FormatCarbon, "prefix.", &cfg.Write)
+	require.Empty(t, buf.String())
+
+	pathsFromMetric(model.Metric{model.MetricNameLabel: "test", "env": "dev"}, FormatCarbon, "prefix.", &cfg.Write)
+	require.Contains(t, buf.String(), `rule_index=1 rule_name=dev-drop msg="Metric dropped by a rule"`)
+}
+
+func TestSampledLoggerDisabled(t *testing.T) {
+	require.Nil(t, newSampledLogger(log.NewNopLogger(), 0))
+	var l *sampledLogger
+	l.Log("msg", "ignored")
+}
+
+func BenchmarkTemplatedPathsFromMetric(b *testing.B) {
+	cfg := loadTestConfig(`
+write:
+  rules:
+  - match:
+      owner: team-X
+    match_re:
+      testlabel: test:(.*)
+    template: 'teams.{{.labels.owner | escape}}.{{.match_re.testlabel._1}}'
+    continue: true
+  - match:
+      owner: team-X
+    template: 'all.{{ labelsJoined "." "owner" }}'
+    continue: false`)
+	require.NotNil(b, cfg)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		computePaths(metric, nil, FormatCarbon, "prefix.", &cfg.Write)
+	}
+}
+
+func BenchmarkPathsFromMetric(b *testing.B) {
+	defer func(enabled bool) { pathsCacheEnabled = enabled }(pathsCacheEnabled)
+	pathsCacheEnabled = false
+
+	for name, format := range map[string]Format{
+		"carbon":             FormatCarbon,
+		"carbon-tags":        FormatCarbonTags,
+		"carbon-openmetrics": FormatCarbonOpenMetrics,
+	} {
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				pathsFromMetric(metric, format, "prefix.", &config.WriteConfig{})
+			}
+		})
+	}
+}
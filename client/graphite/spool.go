@@ -0,0 +1,155 @@
+// Copyright 2018 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphite
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+const spoolSegmentSuffix = ".segment"
+
+// spoolDirName turns a carbon address into the name of its spool directory.
+func spoolDirName(address string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' {
+			return r
+		}
+		return '_'
+	}, address)
+}
+
+// spool stores the payloads which couldn't be sent to carbon in segment
+// files, to replay them once carbon is reachable again.
+type spool struct {
+	dir         string
+	destination string
+	maxSize     int64
+	logger      log.Logger
+
+	// Serializes the changes to the spool directory.
+	lock sync.Mutex
+	seq  uint64
+}
+
+func newSpool(dir, destination string, maxSize int64, logger log.Logger) (*spool, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &spool{dir: dir, destination: destination, maxSize: maxSize, logger: logger}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.updateSize(s.segments())
+	return s, nil
+}
+
+// segments returns the segments of the spool, oldest first.
+func (s *spool) segments() []os.FileInfo {
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		level.Warn(s.logger).Log("dir", s.dir, "err", err, "msg", "Error listing spool")
+		return nil
+	}
+	var segments []os.FileInfo
+	for _, info := range infos {
+		if strings.HasSuffix(info.Name(), spoolSegmentSuffix) {
+			segments = append(segments, info)
+		}
+	}
+	// Names start with a timestamp, so lexical order is age order.
+	sort.Slice(segments, func(i, j int) bool { return segments[i].Name() < segments[j].Name() })
+	return segments
+}
+
+func (s *spool) updateSize(segments []os.FileInfo) int64 {
+	var size int64
+	for _, segment := range segments {
+		size += segment.Size()
+	}
+	spoolSegments.WithLabelValues(s.destination).Set(float64(len(segments)))
+	spoolSize.WithLabelValues(s.destination).Set(float64(size))
+	return size
+}
+
+// store writes payloads in a new segment, evicting the oldest segments if the
+// spool gets bigger than its max size.
+func (s *spool) store(payloads [][]byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	name := fmt.Sprintf("%020d-%06d%s",
+		time.Now().UnixNano(), atomic.AddUint64(&s.seq, 1)%1000000, spoolSegmentSuffix)
+	path := filepath.Join(s.dir, name)
+	if err := ioutil.WriteFile(path, bytes.Join(payloads, nil), 0644); err != nil {
+		os.Remove(path)
+		return err
+	}
+
+	segments := s.segments()
+	size := s.updateSize(segments)
+	for len(segments) > 0 && size > s.maxSize {
+		level.Warn(s.logger).Log(
+			"segment", segments[0].Name(), "size", size, "max_size", s.maxSize,
+			"msg", "Spool is full, evicting oldest segment")
+		if err := os.Remove(filepath.Join(s.dir, segments[0].Name())); err != nil {
+			return err
+		}
+		segments = segments[1:]
+		size = s.updateSize(segments)
+	}
+	return nil
+}
+
+// replay sends the segments, oldest first, and deletes them once sent. It
+// stops at the first error as carbon is probably still unreachable.
+func (s *spool) replay(send func([][]byte) error) error {
+	s.lock.Lock()
+	segments := s.segments()
+	s.lock.Unlock()
+
+	for _, segment := range segments {
+		path := filepath.Join(s.dir, segment.Name())
+		payload, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			// Evicted in the meantime.
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := send([][]byte{payload}); err != nil {
+			return err
+		}
+
+		s.lock.Lock()
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			level.Warn(s.logger).Log("segment", path, "err", err, "msg", "Error removing replayed segment")
+		}
+		s.updateSize(s.segments())
+		s.lock.Unlock()
+		level.Debug(s.logger).Log("segment", path, "msg", "Replayed spooled segment")
+	}
+	return nil
+}
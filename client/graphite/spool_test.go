@@ -0,0 +1,105 @@
+// Copyright 2018 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphite
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestSpool(t *testing.T, maxSize int64) (*spool, func()) {
+	dir, err := ioutil.TempDir("", "spool")
+	require.NoError(t, err)
+	s, err := newSpool(dir, "carbon:2003", maxSize, log.NewNopLogger())
+	require.NoError(t, err)
+	return s, func() { os.RemoveAll(dir) }
+}
+
+func TestSpoolReplay(t *testing.T) {
+	s, cleanup := newTestSpool(t, 1<<20)
+	defer cleanup()
+
+	require.NoError(t, s.store([][]byte{[]byte("a 1 1\n"), []byte("b 1 1\n")}))
+	require.NoError(t, s.store([][]byte{[]byte("c 1 1\n")}))
+	require.Len(t, s.segments(), 2)
+
+	// Segments are kept as long as they can't be sent.
+	err := s.replay(func([][]byte) error { return errors.New("unreachable") })
+	require.Error(t, err)
+	require.Len(t, s.segments(), 2)
+
+	var sent []string
+	require.NoError(t, s.replay(func(payloads [][]byte) error {
+		for _, p := range payloads {
+			sent = append(sent, string(p))
+		}
+		return nil
+	}))
+	require.Equal(t, []string{"a 1 1\nb 1 1\n", "c 1 1\n"}, sent)
+	require.Empty(t, s.segments())
+}
+
+func TestSpoolEvictsOldestSegments(t *testing.T) {
+	s, cleanup := newTestSpool(t, 12)
+	defer cleanup()
+
+	require.NoError(t, s.store([][]byte{[]byte("a 1 1\n")}))
+	require.NoError(t, s.store([][]byte{[]byte("b 1 1\n")}))
+	require.NoError(t, s.store([][]byte{[]byte("c 1 1\n")}))
+
+	var sent []string
+	require.NoError(t, s.replay(func(payloads [][]byte) error {
+		sent = append(sent, string(payloads[0]))
+		return nil
+	}))
+	require.Equal(t, []string{"b 1 1\n", "c 1 1\n"}, sent)
+}
+
+func TestWriteSpoolsOnCarbonOutage(t *testing.T) {
+	s, cleanup := newTestSpool(t, 1<<20)
+	defer cleanup()
+
+	c := newTestCarbonClient("127.0.0.1:0", 1)
+	c.cfg.Write.MaxRetries = 0
+	c.destinations[0].spool = s
+	defer c.Shutdown()
+
+	defer func() { dialCarbon = net.DialTimeout }()
+	dialCarbon = func(string, string, time.Duration) (net.Conn, error) {
+		return nil, &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}
+	}
+
+	r, _ := http.NewRequest("POST", "/write", nil)
+	require.NoError(t, c.Write(testSamples, r))
+	require.Len(t, s.segments(), 1)
+
+	carbon := newFakeCarbon(t)
+	defer carbon.close()
+	dialCarbon = func(network, _ string, timeout time.Duration) (net.Conn, error) {
+		return net.DialTimeout(network, carbon.address(), timeout)
+	}
+
+	c.replaySpool()
+	require.Empty(t, s.segments())
+	waitFor(t, func() bool { return len(carbon.received()) == len(testSamples) })
+}
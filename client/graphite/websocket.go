@@ -0,0 +1,147 @@
+// Copyright 2018 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphite
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// See RFC 6455.
+const (
+	websocketGUID      = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	websocketOpText    = 0x1
+	websocketOpClose   = 0x8
+	websocketFinalBit  = 0x80
+	websocketMaskedBit = 0x80
+)
+
+// websocketConn sends each write as a single websocket text frame.
+type websocketConn struct {
+	net.Conn
+}
+
+// urlAddress returns the host:port to dial to reach u, a websocket or http url.
+func urlAddress(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	if u.Scheme == "wss" || u.Scheme == "https" {
+		return net.JoinHostPort(u.Hostname(), "443")
+	}
+	return net.JoinHostPort(u.Hostname(), "80")
+}
+
+// websocketAccept computes the Sec-WebSocket-Accept value expected for key.
+func websocketAccept(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// websocketHandshake upgrades conn to a websocket connection to u.
+func websocketHandshake(conn net.Conn, u *url.URL, timeout time.Duration) (net.Conn, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	req := &http.Request{
+		Method:     "GET",
+		URL:        &url.URL{Path: u.Path, RawQuery: u.RawQuery},
+		Host:       u.Host,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header: http.Header{
+			"Upgrade":               {"websocket"},
+			"Connection":            {"Upgrade"},
+			"Sec-Websocket-Key":     {key},
+			"Sec-Websocket-Version": {"13"},
+		},
+	}
+	if req.URL.Path == "" {
+		req.URL.Path = "/"
+	}
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("websocket handshake with %s failed: %s", u, resp.Status)
+	}
+	if resp.Header.Get("Sec-Websocket-Accept") != websocketAccept(key) {
+		return nil, fmt.Errorf("websocket handshake with %s failed: invalid Sec-WebSocket-Accept", u)
+	}
+	return &websocketConn{Conn: conn}, nil
+}
+
+// writeFrame sends payload in a single masked frame, as required from clients.
+func (c *websocketConn) writeFrame(opcode byte, payload []byte) error {
+	frame := make([]byte, 0, len(payload)+14)
+	frame = append(frame, websocketFinalBit|opcode)
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, websocketMaskedBit|byte(n))
+	case n <= 0xffff:
+		frame = append(frame, websocketMaskedBit|126, 0, 0)
+		binary.BigEndian.PutUint16(frame[len(frame)-2:], uint16(n))
+	default:
+		frame = append(frame, websocketMaskedBit|127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[len(frame)-8:], uint64(n))
+	}
+
+	var mask [4]byte
+	if _, err := rand.Read(mask[:]); err != nil {
+		return err
+	}
+	frame = append(frame, mask[:]...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+// Write implements the net.Conn interface.
+func (c *websocketConn) Write(b []byte) (int, error) {
+	if err := c.writeFrame(websocketOpText, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close implements the net.Conn interface.
+func (c *websocketConn) Close() error {
+	c.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+	c.writeFrame(websocketOpClose, nil)
+	return c.Conn.Close()
+}
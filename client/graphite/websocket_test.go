@@ -0,0 +1,133 @@
+// Copyright 2018 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphite
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeWebsocketCarbon is a websocket server recording the text frames it
+// receives.
+type fakeWebsocketCarbon struct {
+	*httptest.Server
+
+	lock   sync.Mutex
+	frames []string
+}
+
+func newFakeWebsocketCarbon() *fakeWebsocketCarbon {
+	f := &fakeWebsocketCarbon{}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.handle))
+	return f
+}
+
+func (f *fakeWebsocketCarbon) handle(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Upgrade") != "websocket" || r.URL.Path != "/carbon" {
+		http.Error(w, "not a websocket", http.StatusBadRequest)
+		return
+	}
+	conn, rw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + websocketAccept(r.Header.Get("Sec-WebSocket-Key")) + "\r\n\r\n")
+	rw.Flush()
+
+	for {
+		opcode, payload, err := readWebsocketFrame(rw.Reader)
+		if err != nil || opcode == websocketOpClose {
+			return
+		}
+		f.lock.Lock()
+		f.frames = append(f.frames, string(payload))
+		f.lock.Unlock()
+	}
+}
+
+func (f *fakeWebsocketCarbon) received() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]string{}, f.frames...)
+}
+
+func readWebsocketFrame(r *bufio.Reader) (byte, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	n := uint64(header[1] &^ websocketMaskedBit)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	var mask [4]byte
+	if _, err := io.ReadFull(r, mask[:]); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return header[0] &^ websocketFinalBit, payload, nil
+}
+
+func TestWriteOverWebsocket(t *testing.T) {
+	carbon := newFakeWebsocketCarbon()
+	defer carbon.Close()
+
+	c := newTestCarbonClient(strings.Replace(carbon.URL, "http://", "ws://", 1)+"/carbon", 1)
+	c.cfg.Write.CarbonTransport = "websocket"
+
+	r, _ := http.NewRequest("POST", "http://fakeHost:6666", nil)
+	require.NoError(t, c.Write(testSamples, r))
+
+	// Frames bigger than 125 bytes use an extended length.
+	var samples model.Samples
+	for i := 0; i < 10; i++ {
+		samples = append(samples, testSamples...)
+	}
+	require.NoError(t, c.Write(samples, r))
+	c.Shutdown()
+
+	waitFor(t, func() bool { return len(carbon.received()) == 2 })
+	require.Equal(t, "test 1.000000 1.000000\n", carbon.received()[0])
+	require.Equal(t, strings.Repeat("test 1.000000 1.000000\n", 10), carbon.received()[1])
+}
@@ -17,65 +17,185 @@ package graphite
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"math"
+	"math/rand"
 	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/go-kit/kit/log/level"
 	"github.com/prometheus/common/model"
+
+	"github.com/criteo/graphite-remote-adapter/client"
+	"github.com/criteo/graphite-remote-adapter/tracing"
 )
 
-func (c *Client) prepareDataPoint(path string, s *model.Sample) string {
+// staleNaN is the NaN value Prometheus uses to mark the end of a series, see
+// github.com/prometheus/prometheus/pkg/value.
+const staleNaN uint64 = 0x7ff0000000000002
+
+// isStaleNaN tells whether v is a staleness marker.
+func isStaleNaN(v float64) bool {
+	return math.Float64bits(v) == staleNaN
+}
+
+// dataPoint is a sample value ready to be sent to carbon under a given path.
+type dataPoint struct {
+	path      string
+	value     float64
+	timestamp float64
+	// precision is the number of decimals of the value in carbon lines, 6 if
+	// nil.
+	precision *int
+	// destination is the name of the destination the point is routed to by
+	// its rule, if any.
+	destination string
+}
+
+// String formats the dataPoint using the carbon plaintext protocol.
+func (p dataPoint) String() string {
+	return string(p.appendLine(nil, false))
+}
+
+// appendLine appends the dataPoint formatted using the carbon plaintext
+// protocol to dst, like String does. The timestamp is in seconds unless millis
+// is set.
+func (p dataPoint) appendLine(dst []byte, millis bool) []byte {
+	dst = append(dst, p.path...)
+	dst = append(dst, ' ')
+	precision := 6
+	if p.precision != nil {
+		precision = *p.precision
+	}
+	dst = strconv.AppendFloat(dst, p.value, 'f', precision, 64)
+	dst = append(dst, ' ')
+	if millis {
+		// Prometheus timestamps are in milliseconds, round to avoid float errors.
+		dst = strconv.AppendInt(dst, int64(math.Round(p.timestamp*1e3)), 10)
+	} else {
+		dst = strconv.AppendFloat(dst, p.timestamp, 'f', 6, 64)
+	}
+	return append(dst, '\n')
+}
+
+func (c *Client) prepareDataPoint(path string, s *model.Sample) (dataPoint, bool) {
 	t := float64(s.Timestamp.UnixNano()) / 1e9
 	v := float64(s.Value)
+	if isStaleNaN(v) && c.cfg.Write.HandleStaleness != "" {
+		staleMarkers.Inc()
+		if c.cfg.Write.HandleStaleness == "drop" {
+			return dataPoint{}, false
+		}
+		v = c.cfg.Write.StalenessEndValue
+	}
 	if math.IsNaN(v) || math.IsInf(v, 0) {
-		level.Debug(c.logger).Log(
-			"value", v, "sample", s, "msg", "cannot send a value, skipping sample")
-		c.ignoredSamples.Inc()
-		return ""
+		switch c.cfg.Write.NanHandling {
+		case "zero":
+			v = 0
+		case "passthrough":
+		default:
+			level.Debug(c.logger).Log(
+				"value", v, "sample", s, "msg", "cannot send a value, skipping sample")
+			c.ignoredSamples.Inc()
+			return dataPoint{}, false
+		}
 	}
-	return fmt.Sprintf("%s %f %f\n", path, v, t)
+	return dataPoint{path: path, value: v, timestamp: t}, true
 }
 
-func (c *Client) connectToCarbon() (net.Conn, error) {
-	if c.carbonCon != nil {
-		if time.Since(c.carbonLastReconnectTime) < c.cfg.Write.CarbonReconnectInterval {
-			// Last reconnect is not too long ago, re-use the connection.
-			return c.carbonCon, nil
+// encodeDataPoints serializes points into the payloads to write to carbon
+// according to the configured protocol.
+func (c *Client) encodeDataPoints(points []dataPoint) ([][]byte, error) {
+	if c.cfg.Write.CarbonTransport == "http" {
+		// Only NaN and Inf values may fail, passthrough is refused over http.
+		payload, err := encodeIngest(points, c.format)
+		if err != nil {
+			return nil, fmt.Errorf("error encoding points: %s", err)
 		}
-		level.Debug(c.logger).Log(
-			"last", c.carbonLastReconnectTime,
-			"msg", "Reinitializing the connection to carbon")
-		c.disconnectFromCarbon()
+		return [][]byte{payload}, nil
+	}
+	if c.cfg.Write.CarbonProtocol == "pickle" {
+		var frames [][]byte
+		batchSize := c.cfg.Write.CarbonPickleBatchSize
+		for i := 0; i < len(points); i += batchSize {
+			frames = append(frames, encodePickle(points[i:min(i+batchSize, len(points))]))
+		}
+		return frames, nil
 	}
 
-	level.Debug(c.logger).Log(
-		"transport", c.cfg.Write.CarbonTransport,
-		"address", c.cfg.Write.CarbonAddress,
-		"timeout", c.writeTimeout,
-		"msg", "Connecting to carbon")
-	conn, err := net.DialTimeout(c.cfg.Write.CarbonTransport, c.cfg.Write.CarbonAddress, c.writeTimeout)
-	if err != nil {
-		c.carbonCon = nil
-	} else {
-		c.carbonLastReconnectTime = time.Now()
-		c.carbonCon = conn
+	// The payload outlives this call, only the lines are formatted in place.
+	var buf []byte
+	millis := c.cfg.Write.TimestampUnit == "ms"
+	debug := level.Debug(c.logger)
+	for _, p := range points {
+		start := len(buf)
+		if c.format == FormatInfluxLineProtocol {
+			buf = p.appendInfluxLine(buf)
+		} else {
+			buf = p.appendLine(buf, millis)
+		}
+		debug.Log("line", buf[start:], "msg", "Sending")
 	}
+	return [][]byte{buf}, nil
+}
 
-	return c.carbonCon, err
+// splitDatagrams cuts buf into chunks of at most maxSize bytes, only splitting
+// at line boundaries. Lines which can't fit in a single datagram are returned
+// apart so that the caller can report them.
+func splitDatagrams(buf []byte, maxSize int) ([][]byte, [][]byte) {
+	var datagrams, oversized [][]byte
+	start, end := 0, 0
+	for end < len(buf) {
+		next := end + bytes.IndexByte(buf[end:], '\n') + 1
+		if next == end {
+			// Last line isn't terminated.
+			next = len(buf)
+		}
+		if next-end > maxSize {
+			if end > start {
+				datagrams = append(datagrams, buf[start:end])
+			}
+			oversized = append(oversized, buf[end:next])
+			start, end = next, next
+			continue
+		}
+		if next-start > maxSize {
+			datagrams = append(datagrams, buf[start:end])
+			start = end
+		}
+		end = next
+	}
+	if end > start {
+		datagrams = append(datagrams, buf[start:end])
+	}
+	return datagrams, oversized
 }
 
-func (c *Client) disconnectFromCarbon() {
-	if c.carbonCon != nil {
-		c.carbonCon.Close()
+func (c *Client) writeDatagrams(conn net.Conn, buf []byte) error {
+	datagrams, oversized := splitDatagrams(buf, c.cfg.Write.CarbonMaxDatagramSize)
+	for _, line := range oversized {
+		level.Warn(c.logger).Log(
+			"line", line, "len", len(line), "max", c.cfg.Write.CarbonMaxDatagramSize,
+			"msg", "Line doesn't fit in a datagram, dropping it")
 	}
-	c.carbonCon = nil
+	for _, datagram := range datagrams {
+		if _, err := conn.Write(datagram); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // Write implements the client.Writer interface.
 func (c *Client) Write(samples model.Samples, r *http.Request) error {
-	if c.cfg.Write.CarbonAddress == "" {
+	if len(c.cfg.Write.CarbonAddress) == 0 {
 		return nil
 	}
 
@@ -86,33 +206,398 @@ func (c *Client) Write(samples model.Samples, r *http.Request) error {
 	}
 
 	level.Debug(c.logger).Log(
-		"num_samples", len(samples), "storage", c.Name(), "msg", "Remote write")
+		"metric_count", len(samples), "storage", c.Name(), "msg", "Remote write")
+
+	ctx, span := tracing.StartSpan(r.Context(), "graphite.Write")
+	defer span.End()
+	span.SetAttribute("samples", len(samples))
 
-	var buf bytes.Buffer
+	_, pathsSpan := tracing.StartSpan(ctx, "graphite.pathsFromMetric")
+	relabeling := len(c.cfg.Write.RelabelConfigs) > 0
+	typeHints := c.format == FormatCarbonOpenMetrics && c.cfg.OpenMetricsTypeHints
+	now := model.Now()
+	var oldest model.Time
+	if c.cfg.Write.MaxSampleAge > 0 {
+		// Graphite's retention may have already aged these out, e.g. during backfills.
+		oldest = now.Add(-c.cfg.Write.MaxSampleAge)
+	}
+	var newest model.Time
+	if c.cfg.Write.MaxFutureSkew > 0 {
+		newest = now.Add(c.cfg.Write.MaxFutureSkew)
+	}
+	clamp := c.cfg.Write.FutureSkewPolicy == "clamp"
+	var points []dataPoint
 	for _, s := range samples {
-		paths := pathsFromMetric(s.Metric, c.format, graphitePrefix, c.cfg.Write.Rules, c.cfg.Write.TemplateData)
-		for _, k := range paths {
-			if str := c.prepareDataPoint(k, s); str != "" {
-				fmt.Fprint(&buf, str)
-				level.Debug(c.logger).Log("line", str, "msg", "Sending")
+		if s.Timestamp < oldest {
+			oldSamples.Inc()
+			continue
+		}
+		if newest != 0 && s.Timestamp > newest {
+			// Points far in the future corrupt whisper files.
+			futureSamples.Inc()
+			if !clamp {
+				continue
+			}
+			s = &model.Sample{Metric: s.Metric, Value: s.Value, Timestamp: now}
+		}
+		if relabeling {
+			m := relabelMetric(s.Metric, &c.cfg.Write)
+			if m == nil {
+				droppedSamples.WithLabelValues("relabeling").Inc()
+				continue
 			}
+			s = &model.Sample{Metric: m, Value: s.Value, Timestamp: s.Timestamp}
+		}
+		if typeHints {
+			s = c.withTypeHint(s)
+		}
+		paths, owners, rules := pathsFromSample(s, c.format, graphitePrefix, &c.cfg.Write)
+		if len(paths) == 0 {
+			droppedSamples.WithLabelValues(dropReason(rules, &c.cfg.Write)).Inc()
+		}
+		stale := isStaleNaN(float64(s.Value))
+		counter := c.deltas != nil && isCounter(s.Metric)
+		for i, k := range paths {
+			if counter && stale {
+				c.deltas.forget(k)
+			}
+			p, ok := c.prepareDataPoint(k, s)
+			if !ok {
+				continue
+			}
+			if counter && !stale && !math.IsNaN(p.value) {
+				if p.value, ok = c.deltas.delta(k, p.timestamp, p.value); !ok {
+					continue
+				}
+			}
+			if owners[i] != nil {
+				p.destination = owners[i].Destination
+				if !stale {
+					// Deltas are differences, offsetting them makes no sense.
+					if counter {
+						p.value = owners[i].DeltaValue(p.value)
+					} else {
+						p.value = owners[i].Value(p.value)
+					}
+					p.precision = owners[i].Precision
+				}
+			}
+			points = append(points, p)
 		}
 	}
+	pathsSpan.SetAttribute("points", len(points))
+	pathsSpan.End()
 
-	// We are going to use the socket, lock it.
-	c.carbonConLock.Lock()
-	defer c.carbonConLock.Unlock()
+	if c.dedup != nil {
+		points = c.dedup.filter(points, c.cfg.Write.DedupLastWriteWins)
+	}
 
-	conn, err := c.connectToCarbon()
-	if err != nil {
-		return err
+	_, sendSpan := tracing.StartSpan(ctx, "graphite.send")
+	if c.batcher != nil {
+		err = c.batcher.add(points)
+	} else {
+		err = c.flush(points)
+	}
+	sendSpan.SetError(err)
+	sendSpan.End()
+	span.SetError(err)
+	return err
+}
+
+// flush sends points to the carbon destinations they are routed to. Whether
+// the write failed then depends on the fanout policy.
+func (c *Client) flush(points []dataPoint) error {
+	if policy := c.cfg.Write.TimestampDedup; policy != "" {
+		// Batches merge the requests of Prometheus replicas.
+		points = resolveTimestamps(points, policy)
+	}
+	if c.cfg.Write.DryRun {
+		c.logDryRun(points)
+		return nil
+	}
+	if c.limiter != nil {
+		if err := c.throttle(len(points)); err != nil {
+			return err
+		}
+	}
+
+	// Everything is encoded before sending, so that points which can't be
+	// encoded fail the whole write.
+	routed := c.route(points)
+	var payloads [][]byte
+	var err error
+	if routed == nil || len(c.shadows) > 0 {
+		if payloads, err = c.encodeDataPoints(points); err != nil {
+			return err
+		}
+	}
+	routedPayloads := make([][][]byte, len(routed))
+	for i := range routed {
+		if len(routed[i]) == 0 {
+			continue
+		}
+		if routedPayloads[i], err = c.encodeDataPoints(routed[i]); err != nil {
+			return err
+		}
+	}
+
+	var errs []error
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	if len(c.shadows) > 0 {
+		// Shadows get all the points, whatever the routing.
+		for _, d := range c.shadows {
+			wg.Add(1)
+			go func(d *destination) {
+				defer wg.Done()
+				c.flushToShadow(d, payloads)
+			}(d)
+		}
+	}
+	for i, d := range c.destinations {
+		p := payloads
+		if routed != nil {
+			if len(routed[i]) == 0 {
+				continue
+			}
+			p = routedPayloads[i]
+		}
+		wg.Add(1)
+		go func(d *destination, p [][]byte) {
+			defer wg.Done()
+			err := c.flushTo(d, p)
+			lock.Lock()
+			errs = append(errs, err)
+			lock.Unlock()
+		}(d, p)
+	}
+	wg.Wait()
+
+	var firstErr error
+	failed := 0
+	for _, err := range errs {
+		if err != nil {
+			failed++
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	if c.cfg.Write.FanoutPolicy == "any" && failed < len(errs) {
+		return nil
+	}
+	return firstErr
+}
+
+// logDryRun logs a sample of the lines which would have been written.
+func (c *Client) logDryRun(points []dataPoint) {
+	dryRunPoints.Add(float64(len(points)))
+	if c.dryRunLogger == nil {
+		return
+	}
+	millis := c.cfg.Write.TimestampUnit == "ms"
+	for _, p := range points {
+		line := string(p.appendLine(nil, millis))
+		if c.format == FormatInfluxLineProtocol {
+			line = p.influxLine()
+		}
+		c.dryRunLogger.Log("line", strings.TrimSuffix(line, "\n"), "msg", "Dry run, not sending")
 	}
+}
 
-	_, err = conn.Write(buf.Bytes())
+// route splits points by destination index when they are routed by
+// consistent hashing on their path or by their rule. It returns nil when all
+// the destinations get all the points.
+func (c *Client) route(points []dataPoint) [][]dataPoint {
+	if c.ruleRoutes != nil {
+		return c.routeByRule(points)
+	}
+	if c.ring == nil {
+		return nil
+	}
+	routed := make([][]dataPoint, len(c.destinations))
+	for _, p := range points {
+		for _, node := range c.ring.get(p.path, c.cfg.Write.ReplicationFactor) {
+			routed[node] = append(routed[node], p)
+		}
+	}
+	return routed
+}
+
+// routeByRule splits points by destination index according to the
+// destination of their rule, the default destination otherwise. Points
+// without any go to all the destinations.
+func (c *Client) routeByRule(points []dataPoint) [][]dataPoint {
+	routed := make([][]dataPoint, len(c.destinations))
+	for _, p := range points {
+		name := p.destination
+		if name == "" {
+			name = c.cfg.Write.DefaultDestination
+		}
+		if i, ok := c.ruleRoutes[name]; ok {
+			routed[i] = append(routed[i], p)
+			continue
+		}
+		for i := range routed {
+			routed[i] = append(routed[i], p)
+		}
+	}
+	return routed
+}
+
+// flushToShadow sends payloads to the shadow destination d. Shadows are
+// neither retried nor spooled, and their failures are only logged and counted.
+func (c *Client) flushToShadow(d *destination, payloads [][]byte) {
+	if err := c.send(d, payloads); err != nil {
+		shadowWrites.WithLabelValues(d.address, "failure").Inc()
+		level.Warn(c.logger).Log(
+			"destination", d.address, "err", err, "msg", "Error writing to shadow carbon")
+		return
+	}
+	shadowWrites.WithLabelValues(d.address, "success").Inc()
+}
+
+// flushTo sends payloads to d, spooling them if this fails.
+func (c *Client) flushTo(d *destination, payloads [][]byte) error {
+	err := c.sendWithRetries(d, payloads)
+	if err == nil {
+		destinationWrites.WithLabelValues(d.address, "success").Inc()
+		return nil
+	}
+	if d.spool != nil {
+		spoolErr := d.spool.store(payloads)
+		if spoolErr == nil {
+			destinationWrites.WithLabelValues(d.address, "spooled").Inc()
+			level.Warn(c.logger).Log(
+				"destination", d.address, "err", err, "msg", "Error writing to carbon, spooled the batch")
+			return nil
+		}
+		level.Error(c.logger).Log(
+			"destination", d.address, "err", spoolErr, "msg", "Error spooling failed write")
+	}
+	destinationWrites.WithLabelValues(d.address, "failure").Inc()
+	if len(c.destinations) > 1 {
+		level.Warn(c.logger).Log("destination", d.address, "err", err, "msg", "Error writing to carbon")
+	}
+	return err
+}
+
+// throttle waits until n more lines may be sent to carbon. It returns
+// client.ErrThrottled if this would take more than the throttle timeout.
+func (c *Client) throttle(n int) error {
+	deadline := time.Now().Add(c.cfg.Write.ThrottleTimeout)
+	for n > 0 {
+		chunk := min(n, c.limiter.Burst())
+		now := time.Now()
+		r := c.limiter.ReserveN(now, chunk)
+		delay := r.DelayFrom(now)
+		if now.Add(delay).After(deadline) {
+			r.CancelAt(now)
+			throttledPoints.Add(float64(n))
+			return client.ErrThrottled
+		}
+		if delay > 0 {
+			throttledPoints.Add(float64(chunk))
+			time.Sleep(delay)
+		}
+		n -= chunk
+	}
+	return nil
+}
+
+// replaySpool sends the spooled batches to their carbon destination.
+func (c *Client) replaySpool() {
+	for _, d := range c.destinations {
+		if d.spool == nil {
+			continue
+		}
+		d := d
+		send := func(payloads [][]byte) error { return c.send(d, payloads) }
+		if err := d.spool.replay(send); err != nil {
+			level.Debug(c.logger).Log(
+				"destination", d.address, "err", err, "msg", "Error replaying spool, will try again later")
+		}
+	}
+}
+
+// sendWithRetries sends payloads to d, retrying with a jittered exponential
+// backoff as long as the errors are transient.
+func (c *Client) sendWithRetries(d *destination, payloads [][]byte) error {
+	backoff := c.cfg.Write.InitialBackoff
+	for attempt := 0; ; attempt++ {
+		err := c.send(d, payloads)
+		if err == nil || attempt >= c.cfg.Write.MaxRetries || !isTransientError(err) {
+			return err
+		}
+
+		// Sleep between half and the full backoff.
+		sleep := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		level.Debug(c.logger).Log(
+			"attempt", attempt+1, "backoff", sleep, "err", err,
+			"msg", "Error writing to carbon, retrying")
+		time.Sleep(sleep)
+
+		backoff *= 2
+		if backoff > c.cfg.Write.MaxBackoff {
+			backoff = c.cfg.Write.MaxBackoff
+		}
+	}
+}
+
+func (c *Client) send(d *destination, payloads [][]byte) error {
+	if c.cfg.Write.CarbonTransport == "http" {
+		for _, payload := range payloads {
+			if err := c.post(d, payload); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// We are going to use a connection, take it from the pool.
+	cc := d.pool.get()
+	defer d.pool.put(cc)
+
+	conn, err := c.connectToCarbon(cc)
 	if err != nil {
-		c.disconnectFromCarbon()
 		return err
 	}
 
+	for _, payload := range payloads {
+		// Don't let a hung carbon block the write forever.
+		err = conn.SetWriteDeadline(time.Now().Add(c.cfg.Write.WriteTimeout))
+		if err == nil {
+			if c.cfg.Write.CarbonTransport == "udp" {
+				err = c.writeDatagrams(conn, payload)
+			} else {
+				_, err = conn.Write(payload)
+			}
+		}
+		if err != nil {
+			c.disconnectFromCarbon(cc)
+			return err
+		}
+	}
+
 	return nil
 }
+
+// isTransientError tells whether err is a network error worth retrying.
+func isTransientError(err error) bool {
+	switch e := err.(type) {
+	case *httpStatusError:
+		return e.transient()
+	case *url.Error:
+		return e.Timeout() || isTransientError(e.Err)
+	case *net.OpError:
+		return e.Timeout() || isTransientError(e.Err)
+	case *os.SyscallError:
+		return isTransientError(e.Err)
+	case syscall.Errno:
+		return e == syscall.ECONNRESET || e == syscall.ECONNREFUSED ||
+			e == syscall.ECONNABORTED || e == syscall.EPIPE
+	case net.Error:
+		return e.Timeout()
+	}
+	return err == io.EOF || err == io.ErrUnexpectedEOF || err == io.ErrClosedPipe
+}
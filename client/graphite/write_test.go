@@ -0,0 +1,531 @@
+// Copyright 2018 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphite
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+
+	"github.com/criteo/graphite-remote-adapter/client"
+	"github.com/criteo/graphite-remote-adapter/client/graphite/config"
+)
+
+func TestSplitDatagrams(t *testing.T) {
+	buf := []byte("a.b 1.000000 0.000000\n" +
+		"a.c 2.000000 0.000000\n" +
+		"a.d 3.000000 0.000000\n")
+	lineLen := len("a.b 1.000000 0.000000\n")
+
+	// Two lines fit in a datagram, the third one goes to the next datagram.
+	datagrams, oversized := splitDatagrams(buf, 2*lineLen+1)
+	require.Empty(t, oversized)
+	require.Equal(t, [][]byte{buf[:2*lineLen], buf[2*lineLen:]}, datagrams)
+
+	// Exactly one line per datagram.
+	datagrams, oversized = splitDatagrams(buf, lineLen)
+	require.Empty(t, oversized)
+	require.Equal(t, [][]byte{buf[:lineLen], buf[lineLen : 2*lineLen], buf[2*lineLen:]}, datagrams)
+
+	// Everything fits in a single datagram.
+	datagrams, oversized = splitDatagrams(buf, len(buf))
+	require.Empty(t, oversized)
+	require.Equal(t, [][]byte{buf}, datagrams)
+}
+
+func TestSplitDatagramsOversizedLine(t *testing.T) {
+	long := "a.very.very.very.long.path 1.000000 0.000000\n"
+	buf := []byte("a.b 1.000000 0.000000\n" + long + "a.c 2.000000 0.000000\n")
+
+	datagrams, oversized := splitDatagrams(buf, len(long)-1)
+	require.Equal(t, [][]byte{[]byte(long)}, oversized)
+	require.Equal(t, [][]byte{
+		[]byte("a.b 1.000000 0.000000\n"),
+		[]byte("a.c 2.000000 0.000000\n"),
+	}, datagrams)
+}
+
+// failingConn is a connection whose writes always fail with err.
+type failingConn struct {
+	net.Conn
+	err error
+}
+
+func (c *failingConn) Write(b []byte) (int, error) {
+	return 0, c.err
+}
+
+func (c *failingConn) Close() error {
+	return nil
+}
+
+func (c *failingConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func TestWriteRetriesTransientErrors(t *testing.T) {
+	carbon := newFakeCarbon(t)
+	defer carbon.close()
+	c := newTestCarbonClient(carbon.address(), 1)
+	c.cfg.Write.MaxRetries = 3
+	c.cfg.Write.InitialBackoff = time.Millisecond
+	c.cfg.Write.MaxBackoff = 2 * time.Millisecond
+	defer c.Shutdown()
+
+	// The first two connections are reset by carbon.
+	dials := 0
+	dialCarbon = func(network, address string, timeout time.Duration) (net.Conn, error) {
+		dials++
+		if dials <= 2 {
+			return &failingConn{err: syscall.ECONNRESET}, nil
+		}
+		return net.DialTimeout(network, address, timeout)
+	}
+	defer func() { dialCarbon = net.DialTimeout }()
+
+	r, _ := http.NewRequest("POST", "http://fakeHost:6666", nil)
+	require.NoError(t, c.Write(testSamples, r))
+	require.Equal(t, 3, dials)
+	waitFor(t, func() bool { return len(carbon.received()) == 1 })
+}
+
+func TestWriteSkipsOldSamples(t *testing.T) {
+	carbon := newFakeCarbon(t)
+	defer carbon.close()
+	c := newTestCarbonClient(carbon.address(), 1)
+	c.cfg.Write.MaxSampleAge = time.Hour
+	defer c.Shutdown()
+
+	now := model.Now()
+	samples := model.Samples{
+		{Metric: model.Metric{model.MetricNameLabel: "old"}, Value: 1, Timestamp: now.Add(-2 * time.Hour)},
+		{Metric: model.Metric{model.MetricNameLabel: "fresh"}, Value: 2, Timestamp: now},
+	}
+	old := counterValue(t, oldSamples)
+	r, _ := http.NewRequest("POST", "http://fakeHost:6666", nil)
+	require.NoError(t, c.Write(samples, r))
+	require.Equal(t, old+1, counterValue(t, oldSamples))
+
+	waitFor(t, func() bool { return len(carbon.received()) == 1 })
+	require.True(t, strings.HasPrefix(carbon.received()[0], "fresh 2.000000 "), carbon.received()[0])
+}
+
+func TestWriteHandlesFutureSamples(t *testing.T) {
+	for _, policy := range []string{"drop", "clamp"} {
+		carbon := newFakeCarbon(t)
+		c := newTestCarbonClient(carbon.address(), 1)
+		c.cfg.Write.MaxFutureSkew = time.Minute
+		c.cfg.Write.FutureSkewPolicy = policy
+
+		now := model.Now()
+		future := now.Add(24 * 365 * time.Hour)
+		samples := model.Samples{
+			{Metric: model.Metric{model.MetricNameLabel: "future"}, Value: 1, Timestamp: future},
+			{Metric: model.Metric{model.MetricNameLabel: "skewed"}, Value: 2, Timestamp: now.Add(30 * time.Second)},
+		}
+		skewed := counterValue(t, futureSamples)
+		r, _ := http.NewRequest("POST", "http://fakeHost:6666", nil)
+		require.NoError(t, c.Write(samples, r), policy)
+		require.Equal(t, skewed+1, counterValue(t, futureSamples), policy)
+
+		if policy == "drop" {
+			waitFor(t, func() bool { return len(carbon.received()) == 1 })
+			require.True(t, strings.HasPrefix(carbon.received()[0], "skewed "), policy)
+		} else {
+			waitFor(t, func() bool { return len(carbon.received()) == 2 })
+			var ts float64
+			_, err := fmt.Sscanf(carbon.received()[0], "future 1.000000 %f", &ts)
+			require.NoError(t, err, policy)
+			require.True(t, ts >= float64(now.Unix()) && ts < float64(future.Unix()), policy)
+		}
+		c.Shutdown()
+		carbon.close()
+	}
+}
+
+func TestWriteScalesRuleValues(t *testing.T) {
+	carbon := newFakeCarbon(t)
+	defer carbon.close()
+	c := newTestCarbonClient(carbon.address(), 1)
+	defer c.Shutdown()
+	scale := 0.001
+	c.cfg.Write.Rules = []*config.Rule{{
+		Match:    config.LabelSet{"unit": "bytes"},
+		Scale:    &scale,
+		Offset:   1,
+		Continue: true,
+		Prefix:   "kb.",
+	}}
+
+	samples := model.Samples{
+		{Metric: model.Metric{model.MetricNameLabel: "size", "unit": "bytes"}, Value: 1536, Timestamp: model.Now()},
+	}
+	r, _ := http.NewRequest("POST", "http://fakeHost:6666", nil)
+	require.NoError(t, c.Write(samples, r))
+
+	// The default path isn't written by the rule, its value is left as is.
+	waitFor(t, func() bool { return len(carbon.received()) == 2 })
+	require.True(t, strings.HasPrefix(carbon.received()[0], "kb.size.unit.bytes 2.536000 "), carbon.received()[0])
+	require.True(t, strings.HasPrefix(carbon.received()[1], "size.unit.bytes 1536.000000 "), carbon.received()[1])
+}
+
+func TestWriteCountsDroppedSamples(t *testing.T) {
+	carbon := newFakeCarbon(t)
+	defer carbon.close()
+	c := newTestCarbonClient(carbon.address(), 1)
+	defer c.Shutdown()
+	c.cfg.Write.Rules = []*config.Rule{
+		{Match: config.LabelSet{"env": "dev"}, Action: "drop"},
+		{Match: config.LabelSet{"env": "test"}},
+	}
+	c.cfg.Write.MaxPathLength = 20
+
+	samples := model.Samples{
+		{Metric: model.Metric{model.MetricNameLabel: "dropped", "env": "dev"}, Value: 1, Timestamp: model.Now()},
+		{Metric: model.Metric{model.MetricNameLabel: "silenced", "env": "test"}, Value: 1, Timestamp: model.Now()},
+		{Metric: model.Metric{model.MetricNameLabel: "too_long", "env": "production"}, Value: 1, Timestamp: model.Now()},
+		{Metric: model.Metric{model.MetricNameLabel: "kept"}, Value: 1, Timestamp: model.Now()},
+	}
+	byRule := counterValue(t, droppedSamples.WithLabelValues("rule"))
+	byError := counterValue(t, droppedSamples.WithLabelValues("error"))
+	r, _ := http.NewRequest("POST", "http://fakeHost:6666", nil)
+	require.NoError(t, c.Write(samples, r))
+	require.Equal(t, byRule+2, counterValue(t, droppedSamples.WithLabelValues("rule")))
+	require.Equal(t, byError+1, counterValue(t, droppedSamples.WithLabelValues("error")))
+}
+
+func TestWriteRoundsRuleValues(t *testing.T) {
+	carbon := newFakeCarbon(t)
+	defer carbon.close()
+	c := newTestCarbonClient(carbon.address(), 1)
+	defer c.Shutdown()
+	two, zero := 2, 0
+	c.cfg.Write.Rules = []*config.Rule{
+		{Match: config.LabelSet{"job": "api"}, Prefix: "rounded.", Precision: &two, Continue: true},
+		{Match: config.LabelSet{"job": "api"}, Prefix: "integers.", Precision: &zero},
+	}
+
+	samples := model.Samples{
+		{Metric: model.Metric{model.MetricNameLabel: "load", "job": "api"}, Value: 3.14159, Timestamp: model.Now()},
+	}
+	r, _ := http.NewRequest("POST", "http://fakeHost:6666", nil)
+	require.NoError(t, c.Write(samples, r))
+
+	waitFor(t, func() bool { return len(carbon.received()) == 2 })
+	require.True(t, strings.HasPrefix(carbon.received()[0], "rounded.load.job.api 3.14 "), carbon.received()[0])
+	require.True(t, strings.HasPrefix(carbon.received()[1], "integers.load.job.api 3 "), carbon.received()[1])
+}
+
+func TestWriteResolvesDuplicateTimestamps(t *testing.T) {
+	carbon := newFakeCarbon(t)
+	defer carbon.close()
+	c := newTestCarbonClient(carbon.address(), 1)
+	defer c.Shutdown()
+	c.cfg.Write.TimestampDedup = "min"
+
+	now := model.Now()
+	samples := model.Samples{
+		{Metric: model.Metric{model.MetricNameLabel: "up", "replica": "a"}, Value: 1, Timestamp: now},
+		{Metric: model.Metric{model.MetricNameLabel: "up", "replica": "a"}, Value: 0, Timestamp: now},
+	}
+	r, _ := http.NewRequest("POST", "http://fakeHost:6666", nil)
+	require.NoError(t, c.Write(samples, r))
+
+	waitFor(t, func() bool { return len(carbon.received()) == 1 })
+	require.True(t, strings.HasPrefix(carbon.received()[0], "up.replica.a 0.000000 "), carbon.received()[0])
+}
+
+func TestWriteDryRun(t *testing.T) {
+	carbon := newFakeCarbon(t)
+	defer carbon.close()
+	c := newTestCarbonClient(carbon.address(), 1)
+	c.cfg.Write.DryRun = true
+	var buf bytes.Buffer
+	c.dryRunLogger = newSampledLogger(log.NewLogfmtLogger(&buf), 1)
+	defer c.Shutdown()
+
+	points := counterValue(t, dryRunPoints)
+	r, _ := http.NewRequest("POST", "http://fakeHost:6666", nil)
+	require.NoError(t, c.Write(testSamples, r))
+	require.Equal(t, points+1, counterValue(t, dryRunPoints))
+	require.Contains(t, buf.String(), `line="test 1.000000 1.000000"`)
+
+	time.Sleep(20 * time.Millisecond)
+	require.Equal(t, 0, carbon.accepted())
+	require.Empty(t, carbon.received())
+}
+
+func TestWriteGivesUpOnPermanentErrors(t *testing.T) {
+	c := newTestCarbonClient("fakeCarbon:2003", 1)
+	c.cfg.Write.MaxRetries = 3
+	c.cfg.Write.InitialBackoff = time.Millisecond
+	c.cfg.Write.MaxBackoff = 2 * time.Millisecond
+
+	dials := 0
+	permanent := errors.New("malformed line")
+	dialCarbon = func(network, address string, timeout time.Duration) (net.Conn, error) {
+		dials++
+		return &failingConn{err: permanent}, nil
+	}
+	defer func() { dialCarbon = net.DialTimeout }()
+
+	r, _ := http.NewRequest("POST", "http://fakeHost:6666", nil)
+	require.Equal(t, permanent, c.Write(testSamples, r))
+	require.Equal(t, 1, dials)
+
+	// Transient errors are returned once retries are exhausted.
+	dials = 0
+	dialCarbon = func(network, address string, timeout time.Duration) (net.Conn, error) {
+		dials++
+		return &failingConn{err: io.EOF}, nil
+	}
+	require.Equal(t, io.EOF, c.Write(testSamples, r))
+	require.Equal(t, 4, dials)
+}
+
+func TestWriteTimesOutOnBlockedCarbon(t *testing.T) {
+	c := newTestCarbonClient("fakeCarbon:2003", 1)
+	c.cfg.Write.WriteTimeout = 10 * time.Millisecond
+	defer c.Shutdown()
+
+	// Nobody ever reads from the other end of the pipe.
+	conn, blocked := net.Pipe()
+	defer blocked.Close()
+	dialCarbon = func(network, address string, timeout time.Duration) (net.Conn, error) {
+		return conn, nil
+	}
+	defer func() { dialCarbon = net.DialTimeout }()
+
+	r, _ := http.NewRequest("POST", "http://fakeHost:6666", nil)
+	errs := make(chan error)
+	go func() { errs <- c.Write(testSamples, r) }()
+	select {
+	case err := <-errs:
+		netErr, ok := err.(net.Error)
+		require.True(t, ok)
+		require.True(t, netErr.Timeout())
+	case <-time.After(time.Second):
+		t.Fatal("write didn't time out")
+	}
+
+	// The half-written connection is dropped.
+	cc := c.destinations[0].pool.get()
+	defer c.destinations[0].pool.put(cc)
+	require.Nil(t, cc.conn)
+}
+
+func TestEncodeInfluxLines(t *testing.T) {
+	c := newTestCarbonClient("fakeCarbon:2003", 1)
+	c.format = FormatInfluxLineProtocol
+
+	payloads, err := c.encodeDataPoints([]dataPoint{
+		{path: "test,owner=team-X", value: 1.5, timestamp: 1234567890.123},
+	})
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{[]byte("test,owner=team-X value=1.5 1234567890123000000\n")}, payloads)
+}
+
+func TestEncodeLinesTimestampUnit(t *testing.T) {
+	points := []dataPoint{{path: "a.b", value: 1.5, timestamp: 1234567890.123}}
+	for unit, expected := range map[string]string{
+		"":   "a.b 1.500000 1234567890.123000\n",
+		"s":  "a.b 1.500000 1234567890.123000\n",
+		"ms": "a.b 1.500000 1234567890123\n",
+	} {
+		c := newTestCarbonClient("fakeCarbon:2003", 1)
+		c.cfg.Write.TimestampUnit = unit
+		payloads, err := c.encodeDataPoints(points)
+		require.NoError(t, err)
+		require.Equal(t, [][]byte{[]byte(expected)}, payloads, unit)
+	}
+}
+
+func TestEncodeLinesMatchesFmt(t *testing.T) {
+	for _, v := range []float64{0, math.Copysign(0, -1), 1.5, -42, 1e21, 1.23456789e-7, math.Inf(1), math.Inf(-1), math.NaN()} {
+		p := dataPoint{path: "a.b", value: v, timestamp: 1234567890.123}
+		require.Equal(t, fmt.Sprintf("%s %f %f\n", p.path, p.value, p.timestamp), p.String())
+		require.Equal(t, fmt.Sprintf("%s value=%g %d\n", p.path, p.value, int64(1234567890123000000)), p.influxLine())
+	}
+}
+
+func BenchmarkEncodeDataPoints(b *testing.B) {
+	c := newTestCarbonClient("fakeCarbon:2003", 1)
+	points := make([]dataPoint, 100)
+	for i := range points {
+		points[i] = dataPoint{path: "test.owner.team-X", value: float64(i), timestamp: 1234567890.123}
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		c.encodeDataPoints(points)
+	}
+}
+
+func TestNanHandling(t *testing.T) {
+	values := []float64{math.NaN(), math.Inf(1), math.Inf(-1)}
+	for _, tc := range []struct {
+		mode     string
+		expected []string
+	}{
+		{mode: "skip", expected: nil},
+		{mode: "zero", expected: []string{"a 0.000000 1.000000\n", "a 0.000000 1.000000\n", "a 0.000000 1.000000\n"}},
+		{mode: "passthrough", expected: []string{"a NaN 1.000000\n", "a +Inf 1.000000\n", "a -Inf 1.000000\n"}},
+	} {
+		c := newTestCarbonClient("fakeCarbon:2003", 1)
+		c.cfg.Write.NanHandling = tc.mode
+
+		var lines []string
+		for _, v := range values {
+			s := &model.Sample{Value: model.SampleValue(v), Timestamp: 1000}
+			if p, ok := c.prepareDataPoint("a", s); ok {
+				lines = append(lines, p.String())
+			}
+		}
+		require.Equal(t, tc.expected, lines, tc.mode)
+	}
+}
+
+func TestHandleStaleness(t *testing.T) {
+	stale := &model.Sample{Value: model.SampleValue(math.Float64frombits(staleNaN)), Timestamp: 1000}
+	for _, tc := range []struct {
+		mode     string
+		endValue float64
+		ok       bool
+		expected string
+	}{
+		// Without staleness handling, the marker is a NaN like any other.
+		{mode: "", ok: false},
+		{mode: "drop", ok: false},
+		{mode: "end", ok: true, expected: "a 0.000000 1.000000\n"},
+		{mode: "end", endValue: -1, ok: true, expected: "a -1.000000 1.000000\n"},
+	} {
+		c := newTestCarbonClient("fakeCarbon:2003", 1)
+		c.cfg.Write.NanHandling = "passthrough"
+		c.cfg.Write.HandleStaleness = tc.mode
+		c.cfg.Write.StalenessEndValue = tc.endValue
+
+		p, ok := c.prepareDataPoint("a", stale)
+		if tc.mode == "" {
+			// Passed through as a NaN.
+			require.True(t, ok)
+			require.Equal(t, "a NaN 1.000000\n", p.String())
+			continue
+		}
+		require.Equal(t, tc.ok, ok, tc.mode)
+		if ok {
+			require.Equal(t, tc.expected, p.String(), tc.mode)
+		}
+	}
+
+	// Regular NaNs aren't staleness markers.
+	c := newTestCarbonClient("fakeCarbon:2003", 1)
+	c.cfg.Write.HandleStaleness = "drop"
+	c.cfg.Write.NanHandling = "zero"
+	p, ok := c.prepareDataPoint("a", &model.Sample{Value: model.SampleValue(math.NaN()), Timestamp: 1000})
+	require.True(t, ok)
+	require.Equal(t, "a 0.000000 1.000000\n", p.String())
+}
+
+func TestOpenMetricsTypeHints(t *testing.T) {
+	carbon := newFakeCarbon(t)
+	defer carbon.close()
+	c := newTestCarbonClient(carbon.address(), 1)
+	c.format = FormatCarbonOpenMetrics
+	c.cfg.OpenMetricsTypeHints = true
+	defer c.Shutdown()
+	defer func(m *metadataStore) { metricsMetadata = m }(metricsMetadata)
+	metricsMetadata = newMetadataStore()
+
+	c.WriteMetadata([]client.MetricMetadata{{MetricFamilyName: "requests_total", Type: "counter"}})
+	samples := model.Samples{
+		{Metric: model.Metric{model.MetricNameLabel: "requests_total", "job": "api"}, Value: 1, Timestamp: 1000},
+		// Without metadata, there is no hint.
+		{Metric: model.Metric{model.MetricNameLabel: "temperature", "job": "api"}, Value: 2, Timestamp: 1000},
+	}
+	r, _ := http.NewRequest("POST", "http://fakeHost:6666", nil)
+	require.NoError(t, c.Write(samples, r))
+	waitFor(t, func() bool { return len(carbon.received()) == 2 })
+	require.Equal(t, []string{
+		"requests_total{__type__=\"counter\",job=\"api\"} 1.000000 1.000000",
+		"temperature{job=\"api\"} 2.000000 1.000000",
+	}, carbon.received())
+	// The samples shared with the other writers are left untouched.
+	require.Len(t, samples[0].Metric, 2)
+}
+
+func TestMetadataTemplates(t *testing.T) {
+	carbon := newFakeCarbon(t)
+	defer carbon.close()
+	c := newTestCarbonClient(carbon.address(), 1)
+	defer c.Shutdown()
+	defer func(m *metadataStore) { metricsMetadata = m }(metricsMetadata)
+	metricsMetadata = newMetadataStore()
+
+	cfg := loadTestConfig(`
+write:
+  rules:
+  - match:
+      job: api
+    template: '{{.labels.__name__}}{{if .meta.unit}}_{{.meta.unit}}{{end}}.{{or .meta.type "untyped"}}'
+    continue: false`)
+	require.NotNil(t, cfg)
+	c.cfg.Write.Rules = cfg.Write.Rules
+
+	sample := &model.Sample{Metric: model.Metric{model.MetricNameLabel: "latency", "job": "api"}, Value: 1, Timestamp: 1000}
+	r, _ := http.NewRequest("POST", "http://fakeHost:6666", nil)
+	require.NoError(t, c.Write(model.Samples{sample}, r))
+	// Metadata sent by a later request, and kept for the next ones.
+	c.WriteMetadata([]client.MetricMetadata{{MetricFamilyName: "latency", Type: "gauge", Unit: "seconds"}})
+	require.NoError(t, c.Write(model.Samples{sample}, r))
+	require.NoError(t, c.Write(model.Samples{sample}, r))
+
+	waitFor(t, func() bool { return len(carbon.received()) == 3 })
+	require.Equal(t, []string{
+		"latency.untyped 1.000000 1.000000",
+		"latency_seconds.gauge 1.000000 1.000000",
+		"latency_seconds.gauge 1.000000 1.000000",
+	}, carbon.received())
+}
+
+func TestThrottleCapsThroughput(t *testing.T) {
+	c := newTestCarbonClient("fakeCarbon:2003", 1)
+	c.cfg.Write.ThrottleTimeout = time.Second
+	c.limiter = rate.NewLimiter(100, 100)
+
+	// The first 100 lines use the burst, the next 50 wait for half a second.
+	begin := time.Now()
+	for i := 0; i < 3; i++ {
+		require.NoError(t, c.throttle(50))
+	}
+	require.True(t, time.Since(begin) >= 450*time.Millisecond, "took %s", time.Since(begin))
+
+	// Waiting longer than the timeout fails right away.
+	c.cfg.Write.ThrottleTimeout = 200 * time.Millisecond
+	begin = time.Now()
+	require.Equal(t, client.ErrThrottled, c.throttle(100))
+	require.True(t, time.Since(begin) < 100*time.Millisecond, "took %s", time.Since(begin))
+}
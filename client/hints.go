@@ -0,0 +1,87 @@
+// Copyright 2018 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gogo/protobuf/proto"
+)
+
+// ReadHints are the hints recent Prometheus versions send along remote read
+// queries about the PromQL function and aggregation wrapping the selector.
+// The vendored prompb predates them, they are decoded from the raw request.
+type ReadHints struct {
+	StepMs   int64    `protobuf:"varint,1,opt,name=step_ms,json=stepMs,proto3"`
+	Func     string   `protobuf:"bytes,2,opt,name=func,proto3"`
+	StartMs  int64    `protobuf:"varint,3,opt,name=start_ms,json=startMs,proto3"`
+	EndMs    int64    `protobuf:"varint,4,opt,name=end_ms,json=endMs,proto3"`
+	Grouping []string `protobuf:"bytes,5,rep,name=grouping"`
+	By       bool     `protobuf:"varint,6,opt,name=by,proto3"`
+	RangeMs  int64    `protobuf:"varint,7,opt,name=range_ms,json=rangeMs,proto3"`
+}
+
+func (m *ReadHints) Reset()         { *m = ReadHints{} }
+func (m *ReadHints) String() string { return proto.CompactTextString(m) }
+func (*ReadHints) ProtoMessage()    {}
+
+// hintedQuery mirrors prompb.Query, only keeping its hints.
+type hintedQuery struct {
+	Hints *ReadHints `protobuf:"bytes,4,opt,name=hints"`
+}
+
+func (m *hintedQuery) Reset()         { *m = hintedQuery{} }
+func (m *hintedQuery) String() string { return proto.CompactTextString(m) }
+func (*hintedQuery) ProtoMessage()    {}
+
+// hintedReadRequest mirrors prompb.ReadRequest, only keeping the query hints.
+type hintedReadRequest struct {
+	Queries []*hintedQuery `protobuf:"bytes,1,rep,name=queries"`
+}
+
+func (m *hintedReadRequest) Reset()         { *m = hintedReadRequest{} }
+func (m *hintedReadRequest) String() string { return proto.CompactTextString(m) }
+func (*hintedReadRequest) ProtoMessage()    {}
+
+// DecodeReadHints returns the hints of each query of the uncompressed read
+// request in buf. Queries sent without hints get a nil entry.
+func DecodeReadHints(buf []byte) ([]*ReadHints, error) {
+	var req hintedReadRequest
+	if err := proto.Unmarshal(buf, &req); err != nil {
+		return nil, err
+	}
+	hints := make([]*ReadHints, len(req.Queries))
+	for i, q := range req.Queries {
+		hints[i] = q.Hints
+	}
+	return hints, nil
+}
+
+type readHintsKey struct{}
+
+// WithReadHints returns a shallow copy of r carrying the query hints.
+func WithReadHints(r *http.Request, hints []*ReadHints) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), readHintsKey{}, hints))
+}
+
+// ReadHintsFromRequest returns the hints of the i-th query of the read
+// request r, or nil if there are none.
+func ReadHintsFromRequest(r *http.Request, i int) *ReadHints {
+	hints, _ := r.Context().Value(readHintsKey{}).([]*ReadHints)
+	if i >= len(hints) {
+		return nil
+	}
+	return hints[i]
+}
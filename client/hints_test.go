@@ -0,0 +1,70 @@
+// Copyright 2018 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/require"
+)
+
+// encodeHintedQuery appends hints to an encoded query the way a recent
+// Prometheus does.
+func encodeHintedQuery(t *testing.T, query *prompb.Query, hints *ReadHints) []byte {
+	buf := proto.NewBuffer(nil)
+	require.NoError(t, buf.Marshal(query))
+	if hints != nil {
+		encoded, err := proto.Marshal(hints)
+		require.NoError(t, err)
+		require.NoError(t, buf.EncodeVarint(4<<3|proto.WireBytes))
+		require.NoError(t, buf.EncodeRawBytes(encoded))
+	}
+	return buf.Bytes()
+}
+
+func TestDecodeReadHints(t *testing.T) {
+	query := &prompb.Query{
+		StartTimestampMs: 1000,
+		EndTimestampMs:   2000,
+		Matchers: []*prompb.LabelMatcher{
+			{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "test"},
+		},
+	}
+	hints := &ReadHints{StepMs: 15000, Func: "sum", StartMs: 1000, EndMs: 2000, Grouping: []string{"owner", "env"}, By: true}
+
+	buf := proto.NewBuffer(nil)
+	for _, q := range [][]byte{encodeHintedQuery(t, query, hints), encodeHintedQuery(t, query, nil)} {
+		require.NoError(t, buf.EncodeVarint(1<<3|proto.WireBytes))
+		require.NoError(t, buf.EncodeRawBytes(q))
+	}
+
+	// The request is still readable by our prompb.
+	var req prompb.ReadRequest
+	require.NoError(t, proto.Unmarshal(buf.Bytes(), &req))
+	require.Len(t, req.Queries, 2)
+	require.Equal(t, query, req.Queries[0])
+
+	decoded, err := DecodeReadHints(buf.Bytes())
+	require.NoError(t, err)
+	require.Equal(t, []*ReadHints{hints, nil}, decoded)
+
+	r, _ := http.NewRequest("POST", "http://fakeHost:6666", nil)
+	r = WithReadHints(r, decoded)
+	require.Equal(t, hints, ReadHintsFromRequest(r, 0))
+	require.Nil(t, ReadHintsFromRequest(r, 1))
+	require.Nil(t, ReadHintsFromRequest(r, 2))
+}
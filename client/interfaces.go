@@ -14,6 +14,7 @@
 package client
 
 import (
+	"errors"
 	"net/http"
 
 	"github.com/prometheus/common/model"
@@ -27,14 +28,62 @@ type Client interface {
 	Shutdown()
 }
 
+// ErrThrottled is returned by writers refusing samples to protect their
+// backend. The write request then fails so that Prometheus retries it later.
+var ErrThrottled = errors.New("write throttled, rate limit exceeded")
+
 // Writer is a client taht sends a batch of samples to remote.
 type Writer interface {
 	Write(samples model.Samples, r *http.Request) error
 	Client
 }
 
+// MetricMetadata is the metadata Prometheus sends about a metric family.
+type MetricMetadata struct {
+	MetricFamilyName string
+	// Type is the OpenMetrics type of the family, e.g. "counter".
+	Type string
+	Help string
+	Unit string
+}
+
+// MetadataWriter is a writer using the metadata of the metrics it writes.
+// Prometheus only sends metadata from time to time, writers keep it.
+type MetadataWriter interface {
+	WriteMetadata(metadata []MetricMetadata)
+}
+
 // Reader is a client that read samples from remote.
 type Reader interface {
 	Read(req *prompb.ReadRequest, r *http.Request) (*prompb.ReadResponse, error)
 	Client
 }
+
+// StreamReader is a reader able to return the series of a read request as
+// they are fetched, rather than all at once.
+type StreamReader interface {
+	// ReadStream calls send with the series of the queries of req, in the
+	// order of the queries. It stops at the first error returned by send.
+	ReadStream(req *prompb.ReadRequest, r *http.Request, send func(queryIndex int, series []*prompb.TimeSeries) error) error
+}
+
+// LabelReader is a reader able to list the label names, label values and
+// series it stores, e.g. for the autocompletion of queries. When metric isn't
+// empty, only the series of this metric are considered.
+type LabelReader interface {
+	LabelNames(metric string, r *http.Request) ([]string, error)
+	LabelValues(name string, metric string, r *http.Request) ([]string, error)
+	Series(metric string, r *http.Request) ([]model.Metric, error)
+}
+
+// CheckResult is the outcome of checking that a backend is reachable.
+type CheckResult struct {
+	Backend string `json:"backend"`
+	Up      bool   `json:"up"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Checker is a client able to check that its backends are reachable.
+type Checker interface {
+	Check() []CheckResult
+}
@@ -0,0 +1,70 @@
+// Copyright 2018 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// ReadStats account for the cost of a read request, readers adding to the
+// stats carried by the context of the request, if any.
+type ReadStats struct {
+	targets int64
+	backend int64
+}
+
+// AddTarget accounts for a target fetched from the backend in d.
+func (s *ReadStats) AddTarget(d time.Duration) {
+	if s == nil {
+		return
+	}
+	atomic.AddInt64(&s.targets, 1)
+	atomic.AddInt64(&s.backend, int64(d))
+}
+
+// Targets returns the number of targets fetched.
+func (s *ReadStats) Targets() int64 {
+	return atomic.LoadInt64(&s.targets)
+}
+
+// Backend returns the time spent fetching the targets, summed over the
+// targets fetched concurrently.
+func (s *ReadStats) Backend() time.Duration {
+	return time.Duration(atomic.LoadInt64(&s.backend))
+}
+
+type readStatsKey struct{}
+
+// WithReadStats returns a shallow copy of r carrying stats.
+func WithReadStats(r *http.Request, stats *ReadStats) *http.Request {
+	return r.WithContext(ContextWithReadStats(r.Context(), stats))
+}
+
+// ContextWithReadStats returns a copy of ctx carrying stats.
+func ContextWithReadStats(ctx context.Context, stats *ReadStats) context.Context {
+	return context.WithValue(ctx, readStatsKey{}, stats)
+}
+
+// ReadStatsFromContext returns the stats carried by ctx, or nil. A nil
+// *ReadStats ignores what is added to it.
+func ReadStatsFromContext(ctx context.Context) *ReadStats {
+	if ctx == nil {
+		return nil
+	}
+	stats, _ := ctx.Value(readStatsKey{}).(*ReadStats)
+	return stats
+}
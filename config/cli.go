@@ -25,14 +25,26 @@ func ParseCommandLine() *Config {
 	a.Flag("config.file", "Graphite-remote-adapter configuration file path.").
 		StringVar(&cfg.ConfigFile)
 
+	a.Flag("config.dir",
+		"Directory of configuration fragments, merged in lexical filename order.").
+		StringVar(&cfg.ConfigDir)
+
 	a.Flag("web.listen-address", "Address to listen on for UI and telemtry.").
 		StringVar(&cfg.Web.ListenAddress)
 
 	a.Flag("web.telemetry-path", "Path to listen for telemtry.").
 		StringVar(&cfg.Web.TelemetryPath)
 
+	a.Flag("web.shutdown-timeout",
+		"Maximum duration spent flushing pending writes on shutdown.").
+		DurationVar(&cfg.Web.ShutdownTimeout)
+
+	a.Flag("web.max-concurrent-writes",
+		"Maximum number of write requests processed at once, 0 for no limit.").
+		IntVar(&cfg.Web.MaxConcurrentWrites)
+
 	a.Flag("write.timeout",
-		"Maximum duration before timing out remote write requests.").
+		"Deprecated and ignored, see --graphite.write.dial-timeout and --graphite.write.write-timeout.").
 		DurationVar(&cfg.Write.Timeout)
 
 	a.Flag("read.timeout",
@@ -47,14 +59,34 @@ func ParseCommandLine() *Config {
 		"Avoid returning error to promtheus returning empty result instead.").
 		BoolVar(&cfg.Read.IgnoreError)
 
+	a.Flag("tracing.enabled",
+		"Export traces of the write and read requests with OTLP.").
+		BoolVar(&cfg.Tracing.Enabled)
+
+	a.Flag("tracing.endpoint",
+		"OTLP/HTTP traces endpoint of the OpenTelemetry collector.").
+		StringVar(&cfg.Tracing.Endpoint)
+
 	// Add logLevel flag
 	a.Flag(promlogflag.LevelFlagName, promlogflag.LevelFlagHelp).
 		Default("info").SetValue(&cfg.LogLevel)
 
+	a.Flag("log.format", "Output format of log messages. One of: [logfmt, json]").
+		Default("logfmt").EnumVar(&cfg.LogFormat, "logfmt", "json")
+
 	// Add graphite flag
 	graphite.AddCommandLine(a, &cfg.Graphite)
 
-	_, err := a.Parse(os.Args[1:])
+	a.Command("serve", "Run the remote adapter.").Default()
+
+	check := a.Command("check-config",
+		"Check the configuration file and exit. Fails if rules can't be compiled or executed.")
+	check.Flag("samples",
+		"YAML file with a list of label sets to print the graphite paths of.").
+		StringVar(&cfg.CheckSamplesFile)
+
+	command, err := a.Parse(os.Args[1:])
+	cfg.Command = command
 	if err != nil {
 		fmt.Fprintln(os.Stderr, errors.Wrapf(err, "Error parsing commandline arguments"))
 		a.Usage(os.Args[1:])
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"crypto/tls"
 	"fmt"
 	"io/ioutil"
 	"time"
@@ -8,6 +9,7 @@ import (
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"github.com/prometheus/common/promlog"
+	promconfig "github.com/prometheus/prometheus/config"
 	yaml "gopkg.in/yaml.v2"
 
 	graphite "github.com/criteo/graphite-remote-adapter/client/graphite/config"
@@ -46,8 +48,9 @@ func LoadFile(logger log.Logger, filename string) (*Config, error) {
 // DefaultConfig is the default top-level configuration.
 var DefaultConfig = Config{
 	Web: webOptions{
-		ListenAddress: "0.0.0.0:9201",
-		TelemetryPath: "/metrics",
+		ListenAddress:   "0.0.0.0:9201",
+		TelemetryPath:   "/metrics",
+		ShutdownTimeout: 30 * time.Second,
 	},
 	Read: readOptions{
 		Timeout:     5 * time.Minute,
@@ -57,17 +60,30 @@ var DefaultConfig = Config{
 	Write: writeOptions{
 		Timeout: 5 * time.Minute,
 	},
+	Tracing: tracingOptions{
+		Enabled:  false,
+		Endpoint: "http://localhost:4318/v1/traces",
+	},
 	Graphite: graphite.DefaultConfig,
 }
 
 // Config is the top-level configuration.
 type Config struct {
 	ConfigFile string
-	LogLevel   promlog.AllowedLevel
-	Web        webOptions      `yaml:"web,omitempty" json:"web,omitempty"`
-	Read       readOptions     `yaml:"read,omitempty" json:"read,omitempty"`
-	Write      writeOptions    `yaml:"write,omitempty" json:"write,omitempty"`
-	Graphite   graphite.Config `yaml:"graphite,omitempty" json:"graphite,omitempty"`
+	// ConfigDir holds YAML fragments merged after the config file.
+	ConfigDir string `yaml:"-" json:"-"`
+	LogLevel  promlog.AllowedLevel
+	// LogFormat is the output format of the logs, logfmt or json.
+	LogFormat string `yaml:"-" json:"-"`
+	// Command is the subcommand given on the command line.
+	Command string `yaml:"-" json:"-"`
+	// CheckSamplesFile holds the label sets check-config prints the paths of.
+	CheckSamplesFile string          `yaml:"-" json:"-"`
+	Web              webOptions      `yaml:"web,omitempty" json:"web,omitempty"`
+	Read             readOptions     `yaml:"read,omitempty" json:"read,omitempty"`
+	Write            writeOptions    `yaml:"write,omitempty" json:"write,omitempty"`
+	Tracing          tracingOptions  `yaml:"tracing,omitempty" json:"tracing,omitempty"`
+	Graphite         graphite.Config `yaml:"graphite,omitempty" json:"graphite,omitempty"`
 
 	// Catches all undefined fields and must be empty after parsing.
 	XXX map[string]interface{} `yaml:",inline" json:"-"`
@@ -98,11 +114,88 @@ func (c *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
 type webOptions struct {
 	ListenAddress string `yaml:"listen_address,omitempty" json:"listen_address,omitempty"`
 	TelemetryPath string `yaml:"telemetry_path,omitempty" json:"telemetry_path,omitempty"`
+	// ShutdownTimeout bounds the time spent flushing the pending writes
+	// when shutting down.
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout,omitempty" json:"shutdown_timeout,omitempty"`
+	// MaxConcurrentWrites bounds the write requests processed at once,
+	// the others being rejected. Zero means no limit.
+	MaxConcurrentWrites int `yaml:"max_concurrent_writes,omitempty" json:"max_concurrent_writes,omitempty"`
+	// Auth holds the credentials required from clients, if any.
+	Auth *webAuthOptions `yaml:"auth,omitempty" json:"auth,omitempty"`
+	// TLS makes the adapter listen with TLS when set.
+	TLS *webTLSOptions `yaml:"tls,omitempty" json:"tls,omitempty"`
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// webAuthOptions are the credentials accepted by the adapter: basic auth,
+// a bearer token, or both.
+type webAuthOptions struct {
+	Username string            `yaml:"username,omitempty" json:"username,omitempty"`
+	Password promconfig.Secret `yaml:"password,omitempty" json:"-"`
+	Token    promconfig.Secret `yaml:"token,omitempty" json:"-"`
+	// If set, the telemetry path requires credentials too.
+	ProtectMetrics bool `yaml:"protect_metrics,omitempty" json:"protect_metrics,omitempty"`
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (opts *webAuthOptions) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain webAuthOptions
+	if err := unmarshal((*plain)(opts)); err != nil {
+		return err
+	}
+
+	if (opts.Username == "") != (opts.Password == "") {
+		return fmt.Errorf("web basic auth requires both a username and a password")
+	}
+	if opts.Username == "" && opts.Token == "" {
+		return fmt.Errorf("web auth requires a username and password or a token")
+	}
+
+	return utils.CheckOverflow(opts.XXX, "webAuthOptions")
+}
+
+// TLSVersions are the accepted values of the TLS min_version.
+var TLSVersions = map[string]uint16{
+	"TLS10": tls.VersionTLS10,
+	"TLS11": tls.VersionTLS11,
+	"TLS12": tls.VersionTLS12,
+	"TLS13": tls.VersionTLS13,
+}
+
+// webTLSOptions are the certificates of the adapter. Client certificates are
+// required and verified when ClientCAFile is set.
+type webTLSOptions struct {
+	CertFile     string `yaml:"cert_file,omitempty" json:"cert_file,omitempty"`
+	KeyFile      string `yaml:"key_file,omitempty" json:"key_file,omitempty"`
+	ClientCAFile string `yaml:"client_ca_file,omitempty" json:"client_ca_file,omitempty"`
+	MinVersion   string `yaml:"min_version,omitempty" json:"min_version,omitempty"`
 
 	// Catches all undefined fields and must be empty after parsing.
 	XXX map[string]interface{} `yaml:",inline" json:"-"`
 }
 
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (opts *webTLSOptions) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain webTLSOptions
+	if err := unmarshal((*plain)(opts)); err != nil {
+		return err
+	}
+
+	if opts.CertFile == "" || opts.KeyFile == "" {
+		return fmt.Errorf("web tls requires both a cert_file and a key_file")
+	}
+	if _, ok := TLSVersions[opts.MinVersion]; opts.MinVersion != "" && !ok {
+		return fmt.Errorf("unknown tls min_version %q", opts.MinVersion)
+	}
+
+	return utils.CheckOverflow(opts.XXX, "webTLSOptions")
+}
+
 // UnmarshalYAML implements the yaml.Unmarshaler interface.
 func (opts *webOptions) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	type plain webOptions
@@ -112,6 +205,10 @@ func (opts *webOptions) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		return err
 	}
 
+	if opts.MaxConcurrentWrites < 0 {
+		return fmt.Errorf("max concurrent writes can't be negative")
+	}
+
 	return utils.CheckOverflow(opts.XXX, "webOptions")
 }
 
@@ -154,3 +251,24 @@ func (opts *writeOptions) UnmarshalYAML(unmarshal func(interface{}) error) error
 
 	return utils.CheckOverflow(opts.XXX, "writeOptions")
 }
+
+type tracingOptions struct {
+	Enabled bool `yaml:"enabled,omitempty" json:"enabled,omitempty"`
+	// Endpoint is the OTLP/HTTP traces endpoint of the collector.
+	Endpoint string `yaml:"endpoint,omitempty" json:"endpoint,omitempty"`
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (opts *tracingOptions) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain tracingOptions
+
+	*opts = DefaultConfig.Tracing
+	if err := unmarshal((*plain)(opts)); err != nil {
+		return err
+	}
+
+	return utils.CheckOverflow(opts.XXX, "tracingOptions")
+}
@@ -14,6 +14,11 @@
 package config
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -23,8 +28,21 @@ import (
 
 var expectedConf = &Config{
 	Web: webOptions{
-		ListenAddress: "1.2.3.4:666",
-		TelemetryPath: "/coolMetrics",
+		ListenAddress:       "1.2.3.4:666",
+		TelemetryPath:       "/coolMetrics",
+		ShutdownTimeout:     10 * time.Second,
+		MaxConcurrentWrites: 8,
+		Auth: &webAuthOptions{
+			Username:       "prometheus",
+			Password:       "s3cret",
+			ProtectMetrics: true,
+		},
+		TLS: &webTLSOptions{
+			CertFile:     "/etc/graphite-remote-adapter/tls.crt",
+			KeyFile:      "/etc/graphite-remote-adapter/tls.key",
+			ClientCAFile: "/etc/graphite-remote-adapter/prometheus-ca.crt",
+			MinVersion:   "TLS13",
+		},
 	},
 	Read: readOptions{
 		Timeout:     18 * time.Minute,
@@ -34,6 +52,10 @@ var expectedConf = &Config{
 	Write: writeOptions{
 		Timeout: 18 * time.Minute,
 	},
+	Tracing: tracingOptions{
+		Enabled:  true,
+		Endpoint: "http://collector:4318/v1/traces",
+	},
 	Graphite: graphite.DefaultConfig,
 	original: "",
 }
@@ -50,3 +72,47 @@ func TestLoadConfigFile(t *testing.T) {
 			"testdata/conf.good.yml", c.String(), expectedConf.String())
 	}
 }
+
+func TestLoadFragments(t *testing.T) {
+	files, err := FragmentFiles("testdata/conf.d")
+	if err != nil {
+		t.Fatalf("Error listing fragments: %s", err)
+	}
+	expectedFiles := []string{"testdata/conf.d/10-team-a.yml", "testdata/conf.d/20-team-b.yaml"}
+	if !reflect.DeepEqual(files, expectedFiles) {
+		t.Fatalf("Expected fragments %v, got %v", expectedFiles, files)
+	}
+
+	c, err := LoadFiles(log.NewNopLogger(), files...)
+	if err != nil {
+		t.Fatalf("Error loading fragments: %s", err)
+	}
+	if c.Web.ListenAddress != "1.2.3.4:666" || c.Graphite.DefaultPrefix != "prometheus." {
+		t.Errorf("Unexpected scalars: %s", c)
+	}
+	rules := c.Graphite.Write.Rules
+	if len(rules) != 2 || rules[0].Match["owner"] != "team-a" || rules[1].Match["owner"] != "team-b" {
+		t.Errorf("Expected the rules of team-a then team-b, got %s", c)
+	}
+	expectedData := map[string]interface{}{"env": "prod", "region": "eu"}
+	if !reflect.DeepEqual(c.Graphite.Write.TemplateData, expectedData) {
+		t.Errorf("Expected template data %v, got %v", expectedData, c.Graphite.Write.TemplateData)
+	}
+}
+
+func TestLoadFragmentsConflict(t *testing.T) {
+	dir, err := ioutil.TempDir("", "conf.d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	a := filepath.Join(dir, "a.yml")
+	b := filepath.Join(dir, "b.yml")
+	ioutil.WriteFile(a, []byte("graphite:\n  default_prefix: a.\n"), 0644)
+	ioutil.WriteFile(b, []byte("graphite:\n  default_prefix: b.\n"), 0644)
+
+	_, err = LoadFiles(log.NewNopLogger(), a, b)
+	if err == nil || !strings.Contains(err.Error(), "graphite.default_prefix") {
+		t.Errorf("Expected a conflict on graphite.default_prefix, got %v", err)
+	}
+}
@@ -0,0 +1,96 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// concatenatedLists are the lists appended to each other when several
+// fragments set them, rather than conflicting.
+var concatenatedLists = map[string]bool{
+	"graphite.write.rules": true,
+}
+
+// FragmentFiles lists the YAML files of dir, in lexical order.
+func FragmentFiles(dir string) ([]string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, info := range infos {
+		ext := filepath.Ext(info.Name())
+		if info.IsDir() || (ext != ".yml" && ext != ".yaml") {
+			continue
+		}
+		files = append(files, filepath.Join(dir, info.Name()))
+	}
+	return files, nil
+}
+
+// LoadFiles parses the given YAML fragments into a single Config. The
+// write rules are concatenated in the order of the files and maps such as
+// template_data are merged; a key given different values by two fragments
+// is an error.
+func LoadFiles(logger log.Logger, filenames ...string) (*Config, error) {
+	merged := map[interface{}]interface{}{}
+	for _, filename := range filenames {
+		level.Info(logger).Log("file", filename, "msg", "Loading configuration fragment")
+		content, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		fragment := map[interface{}]interface{}{}
+		if err := yaml.Unmarshal(content, &fragment); err != nil {
+			return nil, fmt.Errorf("error parsing %s: %s", filename, err)
+		}
+		if err := mergeFragment(merged, fragment, ""); err != nil {
+			return nil, fmt.Errorf("error merging %s: %s", filename, err)
+		}
+	}
+
+	content, err := yaml.Marshal(merged)
+	if err != nil {
+		return nil, err
+	}
+	return Load(string(content))
+}
+
+// mergeFragment merges the fragment src into dst, path being the dotted
+// path of both.
+func mergeFragment(dst, src map[interface{}]interface{}, path string) error {
+	for k, v := range src {
+		keyPath := strings.TrimPrefix(fmt.Sprintf("%s.%v", path, k), ".")
+		current, ok := dst[k]
+		if !ok {
+			dst[k] = v
+			continue
+		}
+
+		switch v := v.(type) {
+		case map[interface{}]interface{}:
+			if current, ok := current.(map[interface{}]interface{}); ok {
+				if err := mergeFragment(current, v, keyPath); err != nil {
+					return err
+				}
+				continue
+			}
+		case []interface{}:
+			if current, ok := current.([]interface{}); ok && concatenatedLists[keyPath] {
+				dst[k] = append(current, v...)
+				continue
+			}
+		}
+		if !reflect.DeepEqual(current, v) {
+			return fmt.Errorf("%s is set to %v by an earlier file and to %v", keyPath, current, v)
+		}
+	}
+	return nil
+}
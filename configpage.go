@@ -0,0 +1,110 @@
+// Copyright 2018 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// configReport is the answer of /config.
+type configReport struct {
+	ConfigFile string    `yaml:"config_file" json:"config_file"`
+	ConfigDir  string    `yaml:"config_dir,omitempty" json:"config_dir,omitempty"`
+	LastReload time.Time `yaml:"last_reload" json:"last_reload"`
+	// Config is the loaded config, with its secrets redacted.
+	Config interface{} `yaml:"config" json:"config"`
+}
+
+// Config returns the currently loaded config, as YAML or as JSON with
+// ?format=json. Passwords and tokens are shown as <secret>.
+func (s *Server) Config(w http.ResponseWriter, r *http.Request) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if !s.authorize(w, r) {
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "This endpoint requires a GET request.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Secrets marshal to <secret> in YAML, while their JSON encoding omits
+	// them: go through YAML in both cases.
+	b, err := yaml.Marshal(s.cfg)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var cfg yaml.MapSlice
+	if err := yaml.Unmarshal(b, &cfg); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	report := configReport{
+		ConfigFile: s.cfg.ConfigFile,
+		ConfigDir:  s.cfg.ConfigDir,
+		LastReload: s.loadedAt,
+		Config:     cfg,
+	}
+
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "yaml":
+		if b, err = yaml.Marshal(report); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-yaml")
+		w.Write(b)
+	case "json":
+		report.Config = jsonValue(cfg)
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetEscapeHTML(false)
+		enc.Encode(report)
+	default:
+		http.Error(w, fmt.Sprintf("unknown format %q", format), http.StatusBadRequest)
+	}
+}
+
+// jsonValue turns a value decoded from YAML into one encoding/json
+// accepts, whose maps have string keys.
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case yaml.MapSlice:
+		m := make(map[string]interface{}, len(v))
+		for _, item := range v {
+			m[fmt.Sprint(item.Key)] = jsonValue(item.Value)
+		}
+		return m
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			m[fmt.Sprint(k)] = jsonValue(item)
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, len(v))
+		for i, item := range v {
+			l[i] = jsonValue(item)
+		}
+		return l
+	}
+	return v
+}
@@ -0,0 +1,85 @@
+// Copyright 2018 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/criteo/graphite-remote-adapter/config"
+)
+
+const configPageTestConfig = `
+web:
+  auth:
+    username: prometheus
+    password: s3cret
+    token: t0ken
+graphite:
+  read:
+    url: http://graphite:8080
+    auth:
+      username: reader
+      password: r3ader
+`
+
+func configServer(t *testing.T) *Server {
+	cfg, err := config.Load(configPageTestConfig)
+	require.NoError(t, err)
+	cfg.ConfigFile = "/etc/adapter.yml"
+	return &Server{cfg: cfg, loadedAt: time.Unix(1500000000, 0).UTC()}
+}
+
+func TestConfigRedactsSecrets(t *testing.T) {
+	server := configServer(t)
+
+	for _, format := range []string{"yaml", "json"} {
+		r := httptest.NewRequest("GET", "/config?format="+format, nil)
+		r.SetBasicAuth("prometheus", "s3cret")
+		w := httptest.NewRecorder()
+		server.Config(w, r)
+		require.Equal(t, http.StatusOK, w.Code, format)
+
+		body := w.Body.String()
+		for _, secret := range []string{"s3cret", "t0ken", "r3ader"} {
+			require.NotContains(t, body, secret, format)
+		}
+		require.Contains(t, body, "<secret>", format)
+		require.Contains(t, body, "reader", format)
+
+		var report struct {
+			ConfigFile string    `yaml:"config_file" json:"config_file"`
+			LastReload time.Time `yaml:"last_reload" json:"last_reload"`
+		}
+		if format == "json" {
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+		} else {
+			require.NoError(t, yaml.Unmarshal(w.Body.Bytes(), &report))
+		}
+		require.Equal(t, "/etc/adapter.yml", report.ConfigFile, format)
+		require.True(t, server.loadedAt.Equal(report.LastReload), format)
+	}
+}
+
+func TestConfigRequiresAuth(t *testing.T) {
+	w := httptest.NewRecorder()
+	configServer(t).Config(w, httptest.NewRequest("GET", "/config", nil))
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+}
@@ -0,0 +1,101 @@
+// Copyright 2018 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/criteo/graphite-remote-adapter/client/graphite"
+)
+
+// pathReport tells what the write rules do with a metric.
+type pathReport struct {
+	Metric model.Metric `json:"metric"`
+	Paths  []string     `json:"paths"`
+	// Rules are the indexes of the matched rules.
+	Rules   []int `json:"rules"`
+	Dropped bool  `json:"dropped"`
+}
+
+// DebugPath returns the paths the current config generates for a metric,
+// given by its name and labels in the query string with GET, or as a JSON
+// label map with POST.
+func (s *Server) DebugPath(w http.ResponseWriter, r *http.Request) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if !s.authorize(w, r) {
+		return
+	}
+	s.debugPath(w, r)
+}
+
+func (s *Server) debugPath(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		http.Error(w, "This endpoint requires a GET or POST request.", http.StatusMethodNotAllowed)
+		return
+	}
+	m, err := debugMetric(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	paths, rules, err := graphite.ExplainPaths(s.cfg, m)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	report := pathReport{
+		Metric:  m,
+		Paths:   paths,
+		Rules:   rules,
+		Dropped: len(paths) == 0,
+	}
+	if report.Paths == nil {
+		report.Paths = []string{}
+	}
+	if report.Rules == nil {
+		report.Rules = []int{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// debugMetric reads the metric of a /debug/path request.
+func debugMetric(r *http.Request) (model.Metric, error) {
+	m := model.Metric{}
+	if r.Method == "GET" {
+		for name, values := range r.URL.Query() {
+			if name == "metric" {
+				name = model.MetricNameLabel
+			}
+			m[model.LabelName(name)] = model.LabelValue(values[0])
+		}
+	} else {
+		if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+			return nil, fmt.Errorf("invalid label map: %s", err)
+		}
+	}
+
+	if m[model.MetricNameLabel] == "" {
+		return nil, fmt.Errorf("no metric name given")
+	}
+	return m, nil
+}
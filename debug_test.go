@@ -0,0 +1,86 @@
+// Copyright 2018 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/criteo/graphite-remote-adapter/config"
+)
+
+const debugTestConfig = `
+graphite:
+  default_prefix: prefix.
+  write:
+    rules:
+    - match:
+        owner: team-Y
+      continue: false
+    - match:
+        owner: team-X
+      template: 'team.{{.labels.owner}}.{{.labels.__name__}}'
+      continue: false
+`
+
+func debugPath(t *testing.T, r *http.Request) (int, pathReport) {
+	cfg, err := config.Load(debugTestConfig)
+	require.NoError(t, err)
+	server := &Server{cfg: cfg}
+
+	w := httptest.NewRecorder()
+	server.DebugPath(w, r)
+	var report pathReport
+	if w.Code == http.StatusOK {
+		require.Equal(t, "application/json", w.Header().Get("Content-Type"))
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+	}
+	return w.Code, report
+}
+
+func TestDebugPath(t *testing.T) {
+	code, report := debugPath(t, httptest.NewRequest("GET", "/debug/path?metric=up&owner=team-X", nil))
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, []string{"team.team-X.up"}, report.Paths)
+	require.Equal(t, []int{1}, report.Rules)
+	require.False(t, report.Dropped)
+
+	code, report = debugPath(t, httptest.NewRequest("POST", "/debug/path",
+		strings.NewReader(`{"__name__": "up", "owner": "team-Z"}`)))
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, []string{"prefix.up.owner.team-Z"}, report.Paths)
+	require.Equal(t, []int{}, report.Rules)
+
+	code, report = debugPath(t, httptest.NewRequest("GET", "/debug/path?metric=up&owner=team-Y", nil))
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, []string{}, report.Paths)
+	require.Equal(t, []int{0}, report.Rules)
+	require.True(t, report.Dropped)
+}
+
+func TestDebugPathInvalid(t *testing.T) {
+	code, _ := debugPath(t, httptest.NewRequest("GET", "/debug/path?owner=team-X", nil))
+	require.Equal(t, http.StatusBadRequest, code)
+
+	code, _ = debugPath(t, httptest.NewRequest("POST", "/debug/path", strings.NewReader(`["up"]`)))
+	require.Equal(t, http.StatusBadRequest, code)
+
+	code, _ = debugPath(t, httptest.NewRequest("DELETE", "/debug/path?metric=up", nil))
+	require.Equal(t, http.StatusMethodNotAllowed, code)
+}
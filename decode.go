@@ -0,0 +1,368 @@
+// Copyright 2018 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"strings"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+
+	"github.com/criteo/graphite-remote-adapter/client"
+)
+
+// maxPooledBodySize is the decoded size above which write requests are
+// decoded in buffers of their own, so that the pools don't hold on to the
+// memory of exceptionally large requests.
+var maxPooledBodySize = 8 << 20
+
+var (
+	bodyBufferPool = sync.Pool{
+		New: func() interface{} { return new(bytes.Buffer) },
+	}
+	decodedBufferPool = sync.Pool{
+		New: func() interface{} { return new([]byte) },
+	}
+	writeRequestPool = sync.Pool{
+		New: func() interface{} { return new(prompb.WriteRequest) },
+	}
+)
+
+// getBodyBuffer returns an empty buffer to read a request body into. It
+// must be given back with putBodyBuffer once the body is decoded.
+func getBodyBuffer() *bytes.Buffer {
+	buf := bodyBufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+// putBodyBuffer gives buf back to the pool, unless it grew too large.
+func putBodyBuffer(buf *bytes.Buffer) {
+	if buf.Cap() <= maxPooledBodySize {
+		bodyBufferPool.Put(buf)
+	}
+}
+
+// decodeWriteRequest decodes the snappy compressed protobuf write request,
+// reusing pooled buffers, along with the metadata and native histograms it
+// holds. The request must be given back with putWriteRequest once its
+// samples have been copied.
+func decodeWriteRequest(compressed []byte) (*prompb.WriteRequest, []client.MetricMetadata, []nativeHistogram, error) {
+	size, err := snappy.DecodedLen(compressed)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	// snappy.Decode only allocates when decoded is too short.
+	var decoded []byte
+	if size <= maxPooledBodySize {
+		bufp := decodedBufferPool.Get().(*[]byte)
+		defer decodedBufferPool.Put(bufp)
+		if cap(*bufp) < size {
+			*bufp = make([]byte, size)
+		}
+		decoded = (*bufp)[:size]
+	}
+	if decoded, err = snappy.Decode(decoded, compressed); err != nil {
+		return nil, nil, nil, err
+	}
+
+	// Unmarshal appends to the time series, reusing their slice.
+	req := writeRequestPool.Get().(*prompb.WriteRequest)
+	if err := req.Unmarshal(decoded); err != nil {
+		putWriteRequest(req)
+		return nil, nil, nil, err
+	}
+	metadata, err := decodeMetadata(decoded)
+	if err != nil {
+		putWriteRequest(req)
+		return nil, nil, nil, err
+	}
+	histograms, err := decodeHistograms(decoded)
+	if err != nil {
+		putWriteRequest(req)
+		return nil, nil, nil, err
+	}
+	return req, metadata, histograms, nil
+}
+
+// putWriteRequest resets req and gives it back to the pool. The strings of
+// the request are copies, so its samples can outlive it.
+func putWriteRequest(req *prompb.WriteRequest) {
+	for i := range req.Timeseries {
+		req.Timeseries[i] = nil
+	}
+	req.Timeseries = req.Timeseries[:0]
+	writeRequestPool.Put(req)
+}
+
+// The metadata of write requests is newer than our prompb, its messages are
+// mirrored here.
+
+// metadataRequest mirrors prompb.WriteRequest, only keeping the metadata.
+type metadataRequest struct {
+	Metadata []*metricMetadata `protobuf:"bytes,3,rep,name=metadata"`
+}
+
+func (m *metadataRequest) Reset()         { *m = metadataRequest{} }
+func (m *metadataRequest) String() string { return proto.CompactTextString(m) }
+func (*metadataRequest) ProtoMessage()    {}
+
+// metricMetadata mirrors prompb.MetricMetadata.
+type metricMetadata struct {
+	Type             int32  `protobuf:"varint,1,opt,name=type,proto3"`
+	MetricFamilyName string `protobuf:"bytes,2,opt,name=metric_family_name,json=metricFamilyName,proto3"`
+	Help             string `protobuf:"bytes,4,opt,name=help,proto3"`
+	Unit             string `protobuf:"bytes,5,opt,name=unit,proto3"`
+}
+
+func (m *metricMetadata) Reset()         { *m = metricMetadata{} }
+func (m *metricMetadata) String() string { return proto.CompactTextString(m) }
+func (*metricMetadata) ProtoMessage()    {}
+
+// metricTypes names the values of prompb.MetricMetadata_MetricType, as in
+// the OpenMetrics TYPE lines. UNKNOWN is left empty.
+var metricTypes = map[int32]string{
+	1: "counter",
+	2: "gauge",
+	3: "histogram",
+	4: "gaugehistogram",
+	5: "summary",
+	6: "info",
+	7: "stateset",
+}
+
+// decodeMetadata returns the metadata of the decoded write request, skipping
+// the entries without a name.
+func decodeMetadata(decoded []byte) ([]client.MetricMetadata, error) {
+	if !hasMetadata(decoded) {
+		return nil, nil
+	}
+	var req metadataRequest
+	if err := proto.Unmarshal(decoded, &req); err != nil {
+		return nil, err
+	}
+
+	var metadata []client.MetricMetadata
+	for _, m := range req.Metadata {
+		if m.MetricFamilyName == "" {
+			continue
+		}
+		metadata = append(metadata, client.MetricMetadata{
+			MetricFamilyName: m.MetricFamilyName,
+			Type:             metricTypes[m.Type],
+			Help:             m.Help,
+			Unit:             m.Unit,
+		})
+	}
+	return metadata, nil
+}
+
+// hasMetadata tells whether the decoded write request may hold metadata,
+// skipping over its time series, so that the requests without metadata
+// aren't unmarshaled twice.
+func hasMetadata(decoded []byte) bool {
+	return hasField(decoded, func(field uint64, _ []byte) bool { return field == 3 })
+}
+
+// hasField walks the fields of msg, which must all be length-delimited, and
+// tells whether match holds for one of them. Unexpected encodings are left
+// to proto.Unmarshal, as if they matched.
+func hasField(msg []byte, match func(field uint64, value []byte) bool) bool {
+	for i := 0; i < len(msg); {
+		key, n := proto.DecodeVarint(msg[i:])
+		if n == 0 || key&7 != proto.WireBytes {
+			return true
+		}
+		i += n
+		size, n := proto.DecodeVarint(msg[i:])
+		if n == 0 || size > uint64(len(msg)-i-n) {
+			return true
+		}
+		i += n
+		if match(key>>3, msg[i:i+int(size)]) {
+			return true
+		}
+		i += int(size)
+	}
+	return false
+}
+
+// Content types of the remote write protocols, negotiated with the proto
+// parameter of application/x-protobuf.
+const (
+	remoteWriteV1Proto = "prometheus.WriteRequest"
+	remoteWriteV2Proto = "io.prometheus.write.v2.Request"
+)
+
+// remoteWriteProto returns the remote write protocol of a request given its
+// content type. Requests which don't negotiate one are remote write 1.0.
+func remoteWriteProto(contentType string) (string, error) {
+	if contentType == "" {
+		return remoteWriteV1Proto, nil
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType != "application/x-protobuf" {
+		return remoteWriteV1Proto, nil
+	}
+	switch p := params["proto"]; p {
+	case "", remoteWriteV1Proto:
+		return remoteWriteV1Proto, nil
+	case remoteWriteV2Proto:
+		return remoteWriteV2Proto, nil
+	default:
+		return "", fmt.Errorf("unsupported remote write protobuf message: %s", p)
+	}
+}
+
+// The remote write 2.0 messages aren't in our prompb either, they are
+// mirrored here.
+
+// writeRequestV2 mirrors io.prometheus.write.v2.Request. The labels of the
+// series are references to pairs of its symbols.
+type writeRequestV2 struct {
+	Symbols    []string        `protobuf:"bytes,4,rep,name=symbols"`
+	Timeseries []*timeSeriesV2 `protobuf:"bytes,5,rep,name=timeseries"`
+}
+
+func (m *writeRequestV2) Reset()         { *m = writeRequestV2{} }
+func (m *writeRequestV2) String() string { return proto.CompactTextString(m) }
+func (*writeRequestV2) ProtoMessage()    {}
+
+// timeSeriesV2 mirrors io.prometheus.write.v2.TimeSeries, without the
+// exemplars.
+type timeSeriesV2 struct {
+	LabelsRefs []uint32     `protobuf:"varint,1,rep,packed,name=labels_refs,json=labelsRefs"`
+	Samples    []*sampleV2  `protobuf:"bytes,2,rep,name=samples"`
+	Histograms []*histogram `protobuf:"bytes,3,rep,name=histograms"`
+	Metadata   *metadataV2  `protobuf:"bytes,5,opt,name=metadata"`
+}
+
+func (m *timeSeriesV2) Reset()         { *m = timeSeriesV2{} }
+func (m *timeSeriesV2) String() string { return proto.CompactTextString(m) }
+func (*timeSeriesV2) ProtoMessage()    {}
+
+// sampleV2 mirrors io.prometheus.write.v2.Sample.
+type sampleV2 struct {
+	Value     float64 `protobuf:"fixed64,1,opt,name=value,proto3"`
+	Timestamp int64   `protobuf:"varint,2,opt,name=timestamp,proto3"`
+}
+
+func (m *sampleV2) Reset()         { *m = sampleV2{} }
+func (m *sampleV2) String() string { return proto.CompactTextString(m) }
+func (*sampleV2) ProtoMessage()    {}
+
+// metadataV2 mirrors io.prometheus.write.v2.Metadata. Its types are the
+// ones of metricTypes.
+type metadataV2 struct {
+	Type    int32  `protobuf:"varint,1,opt,name=type,proto3"`
+	HelpRef uint32 `protobuf:"varint,3,opt,name=help_ref,json=helpRef,proto3"`
+	UnitRef uint32 `protobuf:"varint,4,opt,name=unit_ref,json=unitRef,proto3"`
+}
+
+func (m *metadataV2) Reset()         { *m = metadataV2{} }
+func (m *metadataV2) String() string { return proto.CompactTextString(m) }
+func (*metadataV2) ProtoMessage()    {}
+
+// decodeWriteRequestV2 decodes the snappy compressed remote write 2.0
+// request into samples, resolving the label references, along with the
+// metadata and native histograms of its series.
+func decodeWriteRequestV2(compressed []byte) (model.Samples, []client.MetricMetadata, []nativeHistogram, error) {
+	decoded, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var req writeRequestV2
+	if err := proto.Unmarshal(decoded, &req); err != nil {
+		return nil, nil, nil, err
+	}
+
+	symbol := func(ref uint32) (string, error) {
+		if int(ref) >= len(req.Symbols) {
+			return "", fmt.Errorf("invalid symbol reference %d, only %d symbols", ref, len(req.Symbols))
+		}
+		return req.Symbols[ref], nil
+	}
+	var samples model.Samples
+	var metadata []client.MetricMetadata
+	var histograms []nativeHistogram
+	for _, ts := range req.Timeseries {
+		if len(ts.LabelsRefs)%2 != 0 {
+			return nil, nil, nil, fmt.Errorf("odd number of label references: %d", len(ts.LabelsRefs))
+		}
+		metric := make(model.Metric, len(ts.LabelsRefs)/2)
+		for i := 0; i < len(ts.LabelsRefs); i += 2 {
+			name, err := symbol(ts.LabelsRefs[i])
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			value, err := symbol(ts.LabelsRefs[i+1])
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			metric[model.LabelName(name)] = model.LabelValue(value)
+		}
+
+		for _, s := range ts.Samples {
+			samples = append(samples, &model.Sample{
+				Metric:    metric,
+				Value:     model.SampleValue(s.Value),
+				Timestamp: model.Time(s.Timestamp),
+			})
+		}
+		for _, h := range ts.Histograms {
+			histograms = append(histograms, nativeHistogram{metric: metric, histogram: h})
+		}
+
+		if ts.Metadata == nil || *ts.Metadata == (metadataV2{}) || metric[model.MetricNameLabel] == "" {
+			continue
+		}
+		help, err := symbol(ts.Metadata.HelpRef)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		unit, err := symbol(ts.Metadata.UnitRef)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		typ := metricTypes[ts.Metadata.Type]
+		metadata = append(metadata, client.MetricMetadata{
+			MetricFamilyName: metricFamily(string(metric[model.MetricNameLabel]), typ),
+			Type:             typ,
+			Help:             help,
+			Unit:             unit,
+		})
+	}
+	return samples, metadata, histograms, nil
+}
+
+// metricFamily returns the family of a series of the given type: the series
+// of histograms and summaries are suffixed.
+func metricFamily(name string, typ string) string {
+	switch typ {
+	case "histogram", "gaugehistogram", "summary":
+		for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+			if strings.HasSuffix(name, suffix) {
+				return strings.TrimSuffix(name, suffix)
+			}
+		}
+	}
+	return name
+}
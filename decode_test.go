@@ -0,0 +1,179 @@
+// Copyright 2018 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/require"
+
+	"github.com/criteo/graphite-remote-adapter/client"
+)
+
+// encodedWriteRequest returns a compressed write request of n series with
+// two samples each.
+func encodedWriteRequest(t testing.TB, n int) []byte {
+	req := &prompb.WriteRequest{}
+	for i := 0; i < n; i++ {
+		req.Timeseries = append(req.Timeseries, &prompb.TimeSeries{
+			Labels: []*prompb.Label{
+				{Name: "__name__", Value: "test"},
+				{Name: "instance", Value: fmt.Sprintf("host-%d", i)},
+			},
+			Samples: []*prompb.Sample{{Value: float64(i), Timestamp: 1000}, {Value: 42, Timestamp: 2000}},
+		})
+	}
+	data, err := proto.Marshal(req)
+	require.NoError(t, err)
+	return snappy.Encode(nil, data)
+}
+
+func TestDecodeWriteRequest(t *testing.T) {
+	defer func(size int) { maxPooledBodySize = size }(maxPooledBodySize)
+
+	for _, tc := range []struct {
+		name          string
+		maxPooledSize int
+	}{
+		{"pooled", 8 << 20},
+		{"oversized", 16},
+	} {
+		maxPooledBodySize = tc.maxPooledSize
+		// Decode a larger request first, to check that nothing leaks from
+		// a pooled request to the next.
+		for _, n := range []int{3, 2} {
+			req, _, _, err := decodeWriteRequest(encodedWriteRequest(t, n))
+			require.NoError(t, err, tc.name)
+			samples := protoToSamples(req)
+			putWriteRequest(req)
+
+			require.Len(t, samples, 2*n, tc.name)
+			for i := 0; i < n; i++ {
+				metric := model.Metric{"__name__": "test", "instance": model.LabelValue(fmt.Sprintf("host-%d", i))}
+				require.Equal(t, &model.Sample{Metric: metric, Value: model.SampleValue(i), Timestamp: 1000}, samples[2*i], tc.name)
+				require.Equal(t, &model.Sample{Metric: metric, Value: 42, Timestamp: 2000}, samples[2*i+1], tc.name)
+			}
+		}
+	}
+
+	_, _, _, err := decodeWriteRequest([]byte("not snappy"))
+	require.Error(t, err)
+	_, _, _, err = decodeWriteRequest(snappy.Encode(nil, []byte("not protobuf")))
+	require.Error(t, err)
+}
+
+func TestDecodeWriteRequestMetadata(t *testing.T) {
+	// Marshaled messages are merged when concatenated.
+	data, err := proto.Marshal(&metadataRequest{Metadata: []*metricMetadata{
+		{Type: 1, MetricFamilyName: "requests_total", Help: "Requests served."},
+		{Type: 0, MetricFamilyName: "", Unit: "seconds"},
+		{Type: 0, MetricFamilyName: "uptime", Unit: "seconds"},
+		{Type: 2, MetricFamilyName: "temperature", Unit: "celsius"},
+	}})
+	require.NoError(t, err)
+	decoded, err := snappy.Decode(nil, encodedWriteRequest(t, 2))
+	require.NoError(t, err)
+
+	req, metadata, _, err := decodeWriteRequest(snappy.Encode(nil, append(decoded, data...)))
+	require.NoError(t, err)
+	require.Len(t, protoToSamples(req), 4)
+	putWriteRequest(req)
+	require.Equal(t, []client.MetricMetadata{
+		{MetricFamilyName: "requests_total", Type: "counter", Help: "Requests served."},
+		{MetricFamilyName: "uptime", Unit: "seconds"},
+		{MetricFamilyName: "temperature", Type: "gauge", Unit: "celsius"},
+	}, metadata)
+}
+
+func TestDecodeWriteRequestV2(t *testing.T) {
+	data, err := proto.Marshal(&writeRequestV2{
+		Symbols: []string{"", "__name__", "http_request_duration_seconds_bucket", "le", "0.5", "+Inf", "instance", "host-1", "Request latency.", "seconds", "up"},
+		Timeseries: []*timeSeriesV2{
+			{
+				LabelsRefs: []uint32{1, 2, 3, 4, 6, 7},
+				Samples:    []*sampleV2{{Value: 3, Timestamp: 1000}, {Value: 4, Timestamp: 2000}},
+				Metadata:   &metadataV2{Type: 3, HelpRef: 8, UnitRef: 9},
+			},
+			{
+				LabelsRefs: []uint32{1, 2, 3, 5, 6, 7},
+				Samples:    []*sampleV2{{Value: 5, Timestamp: 1000}},
+				Metadata:   &metadataV2{Type: 3, HelpRef: 8, UnitRef: 9},
+			},
+			{
+				LabelsRefs: []uint32{1, 10},
+				Samples:    []*sampleV2{{Value: 1, Timestamp: 1000}},
+				Metadata:   &metadataV2{},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	samples, metadata, _, err := decodeWriteRequestV2(snappy.Encode(nil, data))
+	require.NoError(t, err)
+	le05 := model.Metric{"__name__": "http_request_duration_seconds_bucket", "le": "0.5", "instance": "host-1"}
+	leInf := model.Metric{"__name__": "http_request_duration_seconds_bucket", "le": "+Inf", "instance": "host-1"}
+	require.Equal(t, model.Samples{
+		{Metric: le05, Value: 3, Timestamp: 1000},
+		{Metric: le05, Value: 4, Timestamp: 2000},
+		{Metric: leInf, Value: 5, Timestamp: 1000},
+		{Metric: model.Metric{"__name__": "up"}, Value: 1, Timestamp: 1000},
+	}, samples)
+	meta := client.MetricMetadata{MetricFamilyName: "http_request_duration_seconds", Type: "histogram", Help: "Request latency.", Unit: "seconds"}
+	require.Equal(t, []client.MetricMetadata{meta, meta}, metadata)
+
+	for _, ts := range []*timeSeriesV2{
+		{LabelsRefs: []uint32{1}},
+		{LabelsRefs: []uint32{1, 11}},
+	} {
+		data, err := proto.Marshal(&writeRequestV2{Symbols: []string{"", "__name__"}, Timeseries: []*timeSeriesV2{ts}})
+		require.NoError(t, err)
+		_, _, _, err = decodeWriteRequestV2(snappy.Encode(nil, data))
+		require.Error(t, err, "%v", ts.LabelsRefs)
+	}
+}
+
+func TestRemoteWriteProto(t *testing.T) {
+	for contentType, expected := range map[string]string{
+		"":                       remoteWriteV1Proto,
+		"application/x-protobuf": remoteWriteV1Proto,
+		"application/x-protobuf;proto=prometheus.WriteRequest":         remoteWriteV1Proto,
+		"application/x-protobuf;proto=io.prometheus.write.v2.Request":  remoteWriteV2Proto,
+		"application/x-protobuf; proto=io.prometheus.write.v2.Request": remoteWriteV2Proto,
+		"application/octet-stream":                                     remoteWriteV1Proto,
+		"application/x-protobuf;proto=io.prometheus.write.v3.Request":  "",
+	} {
+		got, err := remoteWriteProto(contentType)
+		require.Equal(t, expected, got, contentType)
+		require.Equal(t, expected == "", err != nil, contentType)
+	}
+}
+
+func BenchmarkDecodeWriteRequest(b *testing.B) {
+	compressed := encodedWriteRequest(b, 1000)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		req, _, _, err := decodeWriteRequest(compressed)
+		if err != nil {
+			b.Fatal(err)
+		}
+		protoToSamples(req)
+		putWriteRequest(req)
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2018 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/criteo/graphite-remote-adapter/client"
+)
+
+// readinessTTL is how long a readiness report is served before checking the
+// backends again, so that probes don't hammer them.
+const readinessTTL = 5 * time.Second
+
+// readinessReport is the outcome of the last readiness check.
+type readinessReport struct {
+	Ready     bool                 `json:"ready"`
+	Timestamp time.Time            `json:"timestamp"`
+	Checks    []client.CheckResult `json:"checks"`
+}
+
+// Healthy tells that the adapter is alive.
+func (s *Server) Healthy(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintf(w, "Graphite Remote Adapter is Healthy.\n")
+}
+
+// Ready tells whether the backends of the clients are reachable, answering
+// 503 if one of them isn't.
+func (s *Server) Ready(w http.ResponseWriter, r *http.Request) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	report := s.readiness()
+	w.Header().Set("Content-Type", "application/json")
+	if !report.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+// readiness returns the cached readiness report, checking the backends again
+// once it's older than readinessTTL.
+func (s *Server) readiness() *readinessReport {
+	s.readinessLock.Lock()
+	defer s.readinessLock.Unlock()
+
+	if s.lastReadiness != nil && time.Since(s.lastReadiness.Timestamp) < readinessTTL {
+		return s.lastReadiness
+	}
+
+	report := &readinessReport{Ready: true, Timestamp: time.Now(), Checks: []client.CheckResult{}}
+	// A client may be both a writer and a reader.
+	checked := map[client.Checker]bool{}
+	var clients []client.Client
+	for _, w := range s.writers {
+		clients = append(clients, w)
+	}
+	for _, r := range s.readers {
+		clients = append(clients, r)
+	}
+	for _, c := range clients {
+		checker, ok := c.(client.Checker)
+		if !ok || checked[checker] {
+			continue
+		}
+		checked[checker] = true
+		for _, result := range checker.Check() {
+			report.Ready = report.Ready && result.Up
+			report.Checks = append(report.Checks, result)
+		}
+	}
+	s.lastReadiness = report
+	return report
+}
@@ -0,0 +1,88 @@
+// Copyright 2018 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+
+	"github.com/criteo/graphite-remote-adapter/client"
+)
+
+// fakeChecker is a writer whose backends are up or down.
+type fakeChecker struct {
+	results []client.CheckResult
+	checks  int
+}
+
+func (f *fakeChecker) Write(samples model.Samples, r *http.Request) error { return nil }
+func (f *fakeChecker) Name() string                                       { return "fake" }
+func (f *fakeChecker) String() string                                     { return "fake" }
+func (f *fakeChecker) Shutdown()                                          {}
+func (f *fakeChecker) Check() []client.CheckResult {
+	f.checks++
+	return f.results
+}
+
+func TestReady(t *testing.T) {
+	checker := &fakeChecker{results: []client.CheckResult{
+		{Backend: "carbon", Up: true},
+		{Backend: "graphite-web", Up: true},
+	}}
+	s := &Server{writers: []client.Writer{checker}}
+
+	w := httptest.NewRecorder()
+	s.Ready(w, httptest.NewRequest("GET", "/-/ready", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	var report readinessReport
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+	require.True(t, report.Ready)
+	require.False(t, report.Timestamp.IsZero())
+	require.Equal(t, checker.results, report.Checks)
+
+	// The report is cached briefly.
+	checker.results[1] = client.CheckResult{Backend: "graphite-web", Error: "connection refused"}
+	w = httptest.NewRecorder()
+	s.Ready(w, httptest.NewRequest("GET", "/-/ready", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, 1, checker.checks)
+}
+
+func TestNotReady(t *testing.T) {
+	for _, results := range [][]client.CheckResult{
+		{{Backend: "carbon", Error: "connection refused"}, {Backend: "graphite-web", Up: true}},
+		{{Backend: "carbon", Up: true}, {Backend: "graphite-web", Error: "connection refused"}},
+	} {
+		s := &Server{writers: []client.Writer{&fakeChecker{results: results}}}
+		w := httptest.NewRecorder()
+		s.Ready(w, httptest.NewRequest("GET", "/-/ready", nil))
+		require.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+		var report readinessReport
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+		require.False(t, report.Ready)
+		require.Equal(t, results, report.Checks)
+	}
+}
+
+func TestHealthy(t *testing.T) {
+	w := httptest.NewRecorder()
+	(&Server{}).Healthy(w, httptest.NewRequest("GET", "/-/healthy", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+}
@@ -0,0 +1,247 @@
+// Copyright 2018 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/common/model"
+
+	graphite "github.com/criteo/graphite-remote-adapter/client/graphite/config"
+)
+
+// customBucketsSchema is the schema of the native histograms with custom
+// bucket boundaries.
+const customBucketsSchema = -53
+
+// Native histograms are newer than our prompb, their messages are mirrored
+// here.
+
+// histogramRequest mirrors prompb.WriteRequest, only keeping the native
+// histograms of its time series.
+type histogramRequest struct {
+	Timeseries []*histogramSeries `protobuf:"bytes,1,rep,name=timeseries"`
+}
+
+func (m *histogramRequest) Reset()         { *m = histogramRequest{} }
+func (m *histogramRequest) String() string { return proto.CompactTextString(m) }
+func (*histogramRequest) ProtoMessage()    {}
+
+// histogramSeries mirrors prompb.TimeSeries, only keeping its labels and
+// native histograms.
+type histogramSeries struct {
+	Labels     []*label     `protobuf:"bytes,1,rep,name=labels"`
+	Histograms []*histogram `protobuf:"bytes,4,rep,name=histograms"`
+}
+
+func (m *histogramSeries) Reset()         { *m = histogramSeries{} }
+func (m *histogramSeries) String() string { return proto.CompactTextString(m) }
+func (*histogramSeries) ProtoMessage()    {}
+
+// label mirrors prompb.Label.
+type label struct {
+	Name  string `protobuf:"bytes,1,opt,name=name,proto3"`
+	Value string `protobuf:"bytes,2,opt,name=value,proto3"`
+}
+
+func (m *label) Reset()         { *m = label{} }
+func (m *label) String() string { return proto.CompactTextString(m) }
+func (*label) ProtoMessage()    {}
+
+// histogram mirrors prompb.Histogram, which is the same message in remote
+// write 2.0. The integer and float alternatives of its counts are kept side
+// by side: integer histograms have bucket deltas, float ones bucket counts.
+type histogram struct {
+	CountInt       uint64        `protobuf:"varint,1,opt,name=count_int,json=countInt,proto3"`
+	CountFloat     float64       `protobuf:"fixed64,2,opt,name=count_float,json=countFloat,proto3"`
+	Sum            float64       `protobuf:"fixed64,3,opt,name=sum,proto3"`
+	Schema         int32         `protobuf:"zigzag32,4,opt,name=schema,proto3"`
+	ZeroThreshold  float64       `protobuf:"fixed64,5,opt,name=zero_threshold,json=zeroThreshold,proto3"`
+	ZeroCountInt   uint64        `protobuf:"varint,6,opt,name=zero_count_int,json=zeroCountInt,proto3"`
+	ZeroCountFloat float64       `protobuf:"fixed64,7,opt,name=zero_count_float,json=zeroCountFloat,proto3"`
+	NegativeSpans  []*bucketSpan `protobuf:"bytes,8,rep,name=negative_spans,json=negativeSpans"`
+	NegativeDeltas []int64       `protobuf:"zigzag64,9,rep,packed,name=negative_deltas,json=negativeDeltas"`
+	NegativeCounts []float64     `protobuf:"fixed64,10,rep,packed,name=negative_counts,json=negativeCounts"`
+	PositiveSpans  []*bucketSpan `protobuf:"bytes,11,rep,name=positive_spans,json=positiveSpans"`
+	PositiveDeltas []int64       `protobuf:"zigzag64,12,rep,packed,name=positive_deltas,json=positiveDeltas"`
+	PositiveCounts []float64     `protobuf:"fixed64,13,rep,packed,name=positive_counts,json=positiveCounts"`
+	Timestamp      int64         `protobuf:"varint,15,opt,name=timestamp,proto3"`
+	CustomValues   []float64     `protobuf:"fixed64,16,rep,packed,name=custom_values,json=customValues"`
+}
+
+func (m *histogram) Reset()         { *m = histogram{} }
+func (m *histogram) String() string { return proto.CompactTextString(m) }
+func (*histogram) ProtoMessage()    {}
+
+// bucketSpan mirrors prompb.BucketSpan.
+type bucketSpan struct {
+	Offset int32  `protobuf:"zigzag32,1,opt,name=offset,proto3"`
+	Length uint32 `protobuf:"varint,2,opt,name=length,proto3"`
+}
+
+func (m *bucketSpan) Reset()         { *m = bucketSpan{} }
+func (m *bucketSpan) String() string { return proto.CompactTextString(m) }
+func (*bucketSpan) ProtoMessage()    {}
+
+// nativeHistogram is a native histogram sample of the series of metric.
+type nativeHistogram struct {
+	metric    model.Metric
+	histogram *histogram
+}
+
+// decodeHistograms returns the native histograms of the decoded write
+// request.
+func decodeHistograms(decoded []byte) ([]nativeHistogram, error) {
+	if !hasHistograms(decoded) {
+		return nil, nil
+	}
+	var req histogramRequest
+	if err := proto.Unmarshal(decoded, &req); err != nil {
+		return nil, err
+	}
+
+	var histograms []nativeHistogram
+	for _, ts := range req.Timeseries {
+		if len(ts.Histograms) == 0 {
+			continue
+		}
+		metric := make(model.Metric, len(ts.Labels))
+		for _, l := range ts.Labels {
+			metric[model.LabelName(l.Name)] = model.LabelValue(l.Value)
+		}
+		for _, h := range ts.Histograms {
+			histograms = append(histograms, nativeHistogram{metric: metric, histogram: h})
+		}
+	}
+	return histograms, nil
+}
+
+// hasHistograms tells whether the time series of the decoded write request
+// may hold native histograms, like hasMetadata.
+func hasHistograms(decoded []byte) bool {
+	return hasField(decoded, func(field uint64, value []byte) bool {
+		return field == 1 && hasField(value, func(field uint64, _ []byte) bool {
+			return field == 4
+		})
+	})
+}
+
+// samples converts the native histogram to the series of a classic one
+// named with the suffixes: its cumulative buckets, with their upper bound
+// as le label, its sum and its count.
+func (h nativeHistogram) samples(suffixes graphite.NativeHistogramSuffixes) model.Samples {
+	name := h.metric[model.MetricNameLabel]
+	timestamp := model.Time(h.histogram.Timestamp)
+	sample := func(suffix string, le string, value float64) *model.Sample {
+		metric := h.metric.Clone()
+		metric[model.MetricNameLabel] = name + model.LabelValue(suffix)
+		if le != "" {
+			metric[model.BucketLabel] = model.LabelValue(le)
+		}
+		return &model.Sample{Metric: metric, Value: model.SampleValue(value), Timestamp: timestamp}
+	}
+
+	var samples model.Samples
+	var cumulative float64
+	bucket := func(upper float64, count float64) {
+		cumulative += count
+		if math.IsInf(upper, 1) {
+			// The +Inf bucket is the count.
+			return
+		}
+		le := strconv.FormatFloat(upper, 'g', -1, 64)
+		samples = append(samples, sample(suffixes.Bucket, le, cumulative))
+	}
+
+	// The negative buckets are in increasing absolute value, the lowest
+	// comes first.
+	negative := h.histogram.buckets(h.histogram.NegativeSpans, h.histogram.NegativeDeltas, h.histogram.NegativeCounts)
+	sort.Slice(negative, func(i, j int) bool { return negative[i].index > negative[j].index })
+	for _, b := range negative {
+		bucket(-h.histogram.upperBound(b.index-1), b.count)
+	}
+	if zeroCount := h.histogram.zeroCount(); zeroCount != 0 || len(negative) > 0 {
+		bucket(h.histogram.ZeroThreshold, zeroCount)
+	}
+	for _, b := range h.histogram.buckets(h.histogram.PositiveSpans, h.histogram.PositiveDeltas, h.histogram.PositiveCounts) {
+		bucket(h.histogram.upperBound(b.index), b.count)
+	}
+	count := h.histogram.count()
+	samples = append(samples, sample(suffixes.Bucket, "+Inf", count))
+
+	return append(samples, sample(suffixes.Sum, "", h.histogram.Sum), sample(suffixes.Count, "", count))
+}
+
+// histogramBucket is a bucket of a native histogram, with its index in the
+// schema.
+type histogramBucket struct {
+	index int32
+	count float64
+}
+
+// buckets returns the buckets laid out in spans, whose counts are either
+// deltas or absolute.
+func (h *histogram) buckets(spans []*bucketSpan, deltas []int64, counts []float64) []histogramBucket {
+	var buckets []histogramBucket
+	var index int32
+	var current int64
+	for _, span := range spans {
+		// The offset of the first span is the index of its first bucket,
+		// the other ones are relative to the end of the previous span.
+		index += span.Offset
+		for i := uint32(0); i < span.Length; i, index = i+1, index+1 {
+			n := len(buckets)
+			switch {
+			case n < len(deltas):
+				current += deltas[n]
+				buckets = append(buckets, histogramBucket{index: index, count: float64(current)})
+			case n < len(counts):
+				buckets = append(buckets, histogramBucket{index: index, count: counts[n]})
+			default:
+				return buckets
+			}
+		}
+	}
+	return buckets
+}
+
+// upperBound returns the upper bound of the positive bucket of the given
+// index.
+func (h *histogram) upperBound(index int32) float64 {
+	if h.Schema == customBucketsSchema {
+		if index < 0 || int(index) >= len(h.CustomValues) {
+			return math.Inf(1)
+		}
+		return h.CustomValues[index]
+	}
+	// The bounds are powers of 2^(2^-schema).
+	return math.Exp2(float64(index) * math.Exp2(float64(-h.Schema)))
+}
+
+func (h *histogram) count() float64 {
+	if h.CountFloat != 0 {
+		return h.CountFloat
+	}
+	return float64(h.CountInt)
+}
+
+func (h *histogram) zeroCount() float64 {
+	if h.ZeroCountFloat != 0 {
+		return h.ZeroCountFloat
+	}
+	return float64(h.ZeroCountInt)
+}
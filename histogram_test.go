@@ -0,0 +1,138 @@
+// Copyright 2018 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+
+	"github.com/criteo/graphite-remote-adapter/client"
+	"github.com/criteo/graphite-remote-adapter/config"
+)
+
+// testHistogram has a negative bucket, zero bucket and three positive
+// buckets split in two spans.
+var testHistogram = &histogram{
+	CountInt:       6,
+	Sum:            10,
+	ZeroThreshold:  0.001,
+	ZeroCountInt:   1,
+	NegativeSpans:  []*bucketSpan{{Offset: 0, Length: 1}},
+	NegativeDeltas: []int64{1},
+	PositiveSpans:  []*bucketSpan{{Offset: 0, Length: 2}, {Offset: 1, Length: 1}},
+	PositiveDeltas: []int64{1, 1, -1},
+	Timestamp:      1000,
+}
+
+func TestNativeHistogramSamples(t *testing.T) {
+	suffixes := config.DefaultConfig.Graphite.Write.NativeHistogramSuffixes
+	h := nativeHistogram{
+		metric:    model.Metric{model.MetricNameLabel: "latency", "job": "api"},
+		histogram: testHistogram,
+	}
+
+	bucket := func(le model.LabelValue, value model.SampleValue) *model.Sample {
+		return &model.Sample{
+			Metric:    model.Metric{model.MetricNameLabel: "latency_bucket", "job": "api", "le": le},
+			Value:     value,
+			Timestamp: 1000,
+		}
+	}
+	require.Equal(t, model.Samples{
+		bucket("-0.5", 1),
+		bucket("0.001", 2),
+		bucket("1", 3),
+		bucket("2", 5),
+		bucket("8", 6),
+		bucket("+Inf", 6),
+		{Metric: model.Metric{model.MetricNameLabel: "latency_sum", "job": "api"}, Value: 10, Timestamp: 1000},
+		{Metric: model.Metric{model.MetricNameLabel: "latency_count", "job": "api"}, Value: 6, Timestamp: 1000},
+	}, h.samples(suffixes))
+
+	// Float histograms have absolute counts, custom buckets their bounds.
+	h.histogram = &histogram{
+		CountFloat:     3,
+		Sum:            1.5,
+		Schema:         customBucketsSchema,
+		PositiveSpans:  []*bucketSpan{{Offset: 0, Length: 2}},
+		PositiveCounts: []float64{2, 1},
+		CustomValues:   []float64{0.25},
+		Timestamp:      1000,
+	}
+	require.Equal(t, model.Samples{
+		bucket("0.25", 2),
+		bucket("+Inf", 3),
+		{Metric: model.Metric{model.MetricNameLabel: "latency_sum", "job": "api"}, Value: 1.5, Timestamp: 1000},
+		{Metric: model.Metric{model.MetricNameLabel: "latency_count", "job": "api"}, Value: 3, Timestamp: 1000},
+	}, h.samples(suffixes))
+}
+
+func TestWriteNativeHistograms(t *testing.T) {
+	data, err := proto.Marshal(&histogramRequest{Timeseries: []*histogramSeries{{
+		Labels:     []*label{{Name: "__name__", Value: "latency"}},
+		Histograms: []*histogram{testHistogram},
+	}}})
+	require.NoError(t, err)
+
+	for policy, expected := range map[string]struct{ samples, dropped int }{
+		"convert": {8, 0},
+		"drop":    {0, 1},
+	} {
+		cfg := config.DefaultConfig
+		cfg.Graphite.Write.NativeHistograms = policy
+		storage := &recordingStorage{}
+		server := &Server{cfg: &cfg, writers: []client.Writer{storage}}
+		dropped := counterValue(t, droppedHistograms)
+
+		r, err := http.NewRequest("POST", "/write", bytes.NewReader(snappy.Encode(nil, data)))
+		require.NoError(t, err)
+		w := httptest.NewRecorder()
+		server.Write(log.NewNopLogger(), w, r)
+		require.Equal(t, http.StatusOK, w.Code, policy)
+		require.Len(t, storage.samples, expected.samples, policy)
+		require.Equal(t, float64(expected.dropped), counterValue(t, droppedHistograms)-dropped, policy)
+	}
+}
+
+func TestWriteNativeHistogramsV2(t *testing.T) {
+	data, err := proto.Marshal(&writeRequestV2{
+		Symbols: []string{"", "__name__", "latency", "test"},
+		Timeseries: []*timeSeriesV2{
+			{LabelsRefs: []uint32{1, 2}, Histograms: []*histogram{testHistogram}},
+			{LabelsRefs: []uint32{1, 3}, Samples: []*sampleV2{{Value: 1, Timestamp: 1000}}},
+		},
+	})
+	require.NoError(t, err)
+
+	storage := &recordingStorage{}
+	server := &Server{cfg: &config.DefaultConfig, writers: []client.Writer{storage}}
+	r, err := http.NewRequest("POST", "/api/v1/write", bytes.NewReader(snappy.Encode(nil, data)))
+	require.NoError(t, err)
+	r.Header.Set("Content-Type", "application/x-protobuf;proto=io.prometheus.write.v2.Request")
+	w := httptest.NewRecorder()
+	server.Write(log.NewNopLogger(), w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Len(t, storage.samples, 9)
+	// The series the histogram is converted to aren't counted as samples.
+	require.Equal(t, "1", w.Header().Get("X-Prometheus-Remote-Write-Samples-Written"))
+	require.Equal(t, "1", w.Header().Get("X-Prometheus-Remote-Write-Histograms-Written"))
+}
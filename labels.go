@@ -0,0 +1,186 @@
+// Copyright 2018 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/criteo/graphite-remote-adapter/client"
+)
+
+// apiResponse is the envelope of the Prometheus HTTP API, which Grafana and
+// other query builders expect from the metadata endpoints.
+type apiResponse struct {
+	Status    string      `json:"status"`
+	Data      interface{} `json:"data,omitempty"`
+	ErrorType string      `json:"errorType,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
+
+// LabelNames returns the label names of the series in the Prometheus API
+// format, at /api/v1/labels.
+func (s *Server) LabelNames(w http.ResponseWriter, r *http.Request) {
+	s.withLabelReader(w, r, false, func(reader client.LabelReader, metrics []string) (interface{}, error) {
+		return unionStrings(metrics, func(metric string) ([]string, error) {
+			return reader.LabelNames(metric, r)
+		})
+	})
+}
+
+// LabelValues returns the values of a label in the Prometheus API format, at
+// /api/v1/label/<name>/values.
+func (s *Server) LabelValues(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/api/v1/label/")
+	if !strings.HasSuffix(path, "/values") {
+		apiError(w, http.StatusNotFound, fmt.Errorf("unknown endpoint: %s", r.URL.Path))
+		return
+	}
+	name := strings.TrimSuffix(path, "/values")
+	if !model.LabelName(name).IsValid() {
+		apiError(w, http.StatusBadRequest, fmt.Errorf("invalid label name: %q", name))
+		return
+	}
+	s.withLabelReader(w, r, false, func(reader client.LabelReader, metrics []string) (interface{}, error) {
+		return unionStrings(metrics, func(metric string) ([]string, error) {
+			return reader.LabelValues(name, metric, r)
+		})
+	})
+}
+
+// Series returns the series matching the match[] selectors in the Prometheus
+// API format, at /api/v1/series.
+func (s *Server) Series(w http.ResponseWriter, r *http.Request) {
+	s.withLabelReader(w, r, true, func(reader client.LabelReader, metrics []string) (interface{}, error) {
+		series := []model.Metric{}
+		for _, metric := range metrics {
+			ms, err := reader.Series(metric, r)
+			if err != nil {
+				return nil, err
+			}
+			series = append(series, ms...)
+		}
+		return series, nil
+	})
+}
+
+// withLabelReader answers a metadata request with the result of f, called
+// with the metric names of the match[] selectors, or with the empty name
+// when there is none and they aren't required.
+func (s *Server) withLabelReader(w http.ResponseWriter, r *http.Request, requireMatch bool, f func(client.LabelReader, []string) (interface{}, error)) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if !s.authorize(w, r) {
+		return
+	}
+	if r.Method != "GET" && r.Method != "POST" {
+		apiError(w, http.StatusMethodNotAllowed, fmt.Errorf("this endpoint requires a GET or POST request"))
+		return
+	}
+	if len(s.readers) != 1 {
+		apiError(w, http.StatusInternalServerError, fmt.Errorf("expected exactly one reader, found %d readers", len(s.readers)))
+		return
+	}
+	reader, ok := s.readers[0].(client.LabelReader)
+	if !ok {
+		apiError(w, http.StatusNotImplemented, fmt.Errorf("%s doesn't support metadata queries", s.readers[0].Name()))
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		apiError(w, http.StatusBadRequest, err)
+		return
+	}
+	if requireMatch && len(r.Form["match[]"]) == 0 {
+		apiError(w, http.StatusBadRequest, fmt.Errorf("no match[] parameter given"))
+		return
+	}
+	metrics, err := matchedMetrics(r.Form["match[]"])
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	data, err := f(reader, metrics)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(apiResponse{Status: "success", Data: data})
+}
+
+// matchedMetrics returns the metric names of match[] selectors. Only
+// selectors on the metric name are supported, e.g. `up`, `up{}` or
+// `{__name__="up"}`.
+func matchedMetrics(selectors []string) ([]string, error) {
+	if len(selectors) == 0 {
+		return []string{""}, nil
+	}
+	metrics := make([]string, 0, len(selectors))
+	for _, selector := range selectors {
+		metric := strings.TrimSpace(selector)
+		switch {
+		case strings.HasSuffix(metric, "{}"):
+			metric = strings.TrimSuffix(metric, "{}")
+		case strings.HasPrefix(metric, "{__name__=\"") && strings.HasSuffix(metric, "\"}"):
+			metric = metric[len("{__name__=\"") : len(metric)-len("\"}")]
+		}
+		if !model.IsValidMetricName(model.LabelValue(metric)) {
+			return nil, fmt.Errorf("unsupported match[] selector: %q", selector)
+		}
+		metrics = append(metrics, metric)
+	}
+	return metrics, nil
+}
+
+// unionStrings returns the sorted union of the results of f for metrics.
+func unionStrings(metrics []string, f func(string) ([]string, error)) ([]string, error) {
+	set := map[string]bool{}
+	for _, metric := range metrics {
+		values, err := f(metric)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range values {
+			set[v] = true
+		}
+	}
+	union := make([]string, 0, len(set))
+	for v := range set {
+		union = append(union, v)
+	}
+	sort.Strings(union)
+	return union, nil
+}
+
+func apiError(w http.ResponseWriter, code int, err error) {
+	errorType := "bad_data"
+	switch code {
+	case http.StatusInternalServerError:
+		errorType = "internal"
+	case http.StatusNotFound:
+		errorType = "not_found"
+	case http.StatusNotImplemented, http.StatusMethodNotAllowed:
+		errorType = "unavailable"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(apiResponse{Status: "error", ErrorType: errorType, Error: err.Error()})
+}
@@ -0,0 +1,146 @@
+// Copyright 2018 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+
+	"github.com/criteo/graphite-remote-adapter/client"
+	"github.com/criteo/graphite-remote-adapter/config"
+)
+
+// fakeLabelStorage is a remote storage with the series of metrics.
+type fakeLabelStorage struct {
+	fakeStorage
+	series []model.Metric
+}
+
+func (f *fakeLabelStorage) matching(metric string) []model.Metric {
+	var series []model.Metric
+	for _, m := range f.series {
+		if metric == "" || string(m[model.MetricNameLabel]) == metric {
+			series = append(series, m)
+		}
+	}
+	return series
+}
+
+func (f *fakeLabelStorage) LabelNames(metric string, r *http.Request) ([]string, error) {
+	var names []string
+	for _, m := range f.matching(metric) {
+		for name := range m {
+			names = append(names, string(name))
+		}
+	}
+	return names, nil
+}
+
+func (f *fakeLabelStorage) LabelValues(name string, metric string, r *http.Request) ([]string, error) {
+	if name == "error" {
+		return nil, fmt.Errorf("backend error")
+	}
+	var values []string
+	for _, m := range f.matching(metric) {
+		if v, ok := m[model.LabelName(name)]; ok {
+			values = append(values, string(v))
+		}
+	}
+	return values, nil
+}
+
+func (f *fakeLabelStorage) Series(metric string, r *http.Request) ([]model.Metric, error) {
+	return f.matching(metric), nil
+}
+
+func apiRequest(t *testing.T, handler func(*Server) http.HandlerFunc, url string) (int, apiResponse) {
+	storage := &fakeLabelStorage{series: []model.Metric{
+		{model.MetricNameLabel: "up", "owner": "team-X"},
+		{model.MetricNameLabel: "up", "owner": "team-Y", "instance": "host:9100"},
+		{model.MetricNameLabel: "test", "owner": "team-Z"},
+	}}
+	server := &Server{cfg: &config.DefaultConfig, readers: []client.Reader{storage}}
+
+	w := httptest.NewRecorder()
+	handler(server)(w, httptest.NewRequest("GET", url, nil))
+	require.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	var response apiResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	return w.Code, response
+}
+
+func labelNames(s *Server) http.HandlerFunc  { return s.LabelNames }
+func labelValues(s *Server) http.HandlerFunc { return s.LabelValues }
+func series(s *Server) http.HandlerFunc      { return s.Series }
+
+func TestLabelNames(t *testing.T) {
+	code, response := apiRequest(t, labelNames, "/api/v1/labels")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "success", response.Status)
+	require.Equal(t, []interface{}{"__name__", "instance", "owner"}, response.Data)
+
+	code, response = apiRequest(t, labelNames, "/api/v1/labels?match[]=test")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, []interface{}{"__name__", "owner"}, response.Data)
+}
+
+func TestLabelValues(t *testing.T) {
+	code, response := apiRequest(t, labelValues, "/api/v1/label/owner/values")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, []interface{}{"team-X", "team-Y", "team-Z"}, response.Data)
+
+	code, response = apiRequest(t, labelValues, "/api/v1/label/owner/values?match[]=up&match[]=%7B__name__%3D%22test%22%7D")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, []interface{}{"team-X", "team-Y", "team-Z"}, response.Data)
+
+	code, response = apiRequest(t, labelValues, "/api/v1/label/owner/values?match[]=up%7B%7D")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, []interface{}{"team-X", "team-Y"}, response.Data)
+
+	code, response = apiRequest(t, labelValues, "/api/v1/label/unknown/values")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, []interface{}{}, response.Data)
+}
+
+func TestSeries(t *testing.T) {
+	code, response := apiRequest(t, series, "/api/v1/series?match[]=test")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, []interface{}{
+		map[string]interface{}{"__name__": "test", "owner": "team-Z"},
+	}, response.Data)
+
+	code, response = apiRequest(t, series, "/api/v1/series")
+	require.Equal(t, http.StatusBadRequest, code)
+	require.Equal(t, "error", response.Status)
+}
+
+func TestLabelAPIErrors(t *testing.T) {
+	for url, expected := range map[string]int{
+		"/api/v1/label/error/values":                                    http.StatusInternalServerError,
+		"/api/v1/label/in-valid/values":                                 http.StatusBadRequest,
+		"/api/v1/label/owner":                                           http.StatusNotFound,
+		"/api/v1/label/owner/values?match[]=%7Bowner%3D%22team-X%22%7D": http.StatusBadRequest,
+	} {
+		code, response := apiRequest(t, labelValues, url)
+		require.Equal(t, expected, code, url)
+		require.Equal(t, "error", response.Status, url)
+		require.NotEmpty(t, response.Error, url)
+	}
+}
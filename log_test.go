@@ -0,0 +1,61 @@
+// Copyright 2018 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/common/promlog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJSONLogger(t *testing.T) {
+	var buf bytes.Buffer
+	var al promlog.AllowedLevel
+	require.NoError(t, al.Set("info"))
+	logger := newLogger(&buf, al, "json")
+
+	level.Debug(logger).Log("msg", "filtered out")
+	samples := model.Samples{{Metric: model.Metric{"__name__": "test"}, Value: 1}}
+	sendSamples(logger, &fakeStorage{err: errors.New("unreachable")}, samples, writeRequest(t))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 1)
+	var entry map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &entry))
+	for _, key := range []string{"level", "ts", "caller", "msg", "metric_count", "storage", "err"} {
+		require.Contains(t, entry, key)
+	}
+	require.Equal(t, "warn", entry["level"])
+	require.Equal(t, float64(1), entry["metric_count"])
+	require.Equal(t, "fake", entry["storage"])
+	require.Equal(t, "unreachable", entry["err"])
+}
+
+func TestLogfmtLogger(t *testing.T) {
+	var buf bytes.Buffer
+	var al promlog.AllowedLevel
+	require.NoError(t, al.Set("debug"))
+	logger := newLogger(&buf, al, "logfmt")
+
+	level.Debug(logger).Log("msg", "hello", "metric_count", 2)
+	require.Contains(t, buf.String(), "level=debug")
+	require.Contains(t, buf.String(), "msg=hello metric_count=2")
+}
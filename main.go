@@ -15,13 +15,19 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"html"
 	"io/ioutil"
+	"net"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -34,18 +40,25 @@ import (
 	"github.com/imdario/mergo"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/model"
-	"github.com/prometheus/common/promlog"
 	"github.com/prometheus/common/version"
 	"github.com/prometheus/prometheus/prompb"
 
 	"github.com/criteo/graphite-remote-adapter/client"
 	"github.com/criteo/graphite-remote-adapter/client/graphite"
 	"github.com/criteo/graphite-remote-adapter/config"
+	"github.com/criteo/graphite-remote-adapter/tracing"
 )
 
 // Constants for instrumentation.
 const namespace = "remote_adapter"
 
+// Headers telling the cost of a read, to find the expensive queries.
+const (
+	readTargetsHeader = "X-Read-Targets"
+	readPointsHeader  = "X-Read-Points"
+	readBackendHeader = "X-Read-Backend-Seconds"
+)
+
 var (
 	receivedSamples = prometheus.NewCounter(
 		prometheus.CounterOpts{
@@ -54,6 +67,13 @@ var (
 			Help:      "Total number of received samples.",
 		},
 	)
+	droppedHistograms = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "dropped_native_histograms_total",
+			Help:      "Total number of received native histogram samples dropped by the native_histograms policy.",
+		},
+	)
 	sentSamples = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Namespace: namespace,
@@ -70,6 +90,67 @@ var (
 		},
 		[]string{"remote"},
 	)
+	writeErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "write_errors_total",
+			Help:      "Total number of failed writes to remote storage, by type of error.",
+		},
+		[]string{"remote", "type"},
+	)
+	readQueries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "read_queries_total",
+			Help:      "Total number of queries read from remote storage.",
+		},
+		[]string{"remote"},
+	)
+	readErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "read_errors_total",
+			Help:      "Total number of failed read requests to remote storage.",
+		},
+		[]string{"remote"},
+	)
+	readDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "read_duration_seconds",
+			Help:      "Duration of read requests to the remote storage.",
+			Buckets:   prometheus.DefBuckets,
+		},
+		[]string{"remote"},
+	)
+	configSuccess = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "config_last_reload_successful",
+			Help:      "Whether the last configuration reload attempt was successful.",
+		},
+	)
+	configSuccessTime = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "config_last_reload_success_timestamp_seconds",
+			Help:      "Timestamp of the last successful configuration reload.",
+		},
+	)
+	inFlightWrites = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "in_flight_writes",
+			Help:      "Number of write requests being processed.",
+		},
+	)
+	rejectedWrites = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "rejected_writes_total",
+			Help:      "Total number of write requests rejected because too many were in flight.",
+		},
+	)
 	sentBatchDuration = prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Namespace: namespace,
@@ -83,39 +164,111 @@ var (
 
 func init() {
 	prometheus.MustRegister(receivedSamples)
+	prometheus.MustRegister(droppedHistograms)
 	prometheus.MustRegister(sentSamples)
 	prometheus.MustRegister(failedSamples)
 	prometheus.MustRegister(sentBatchDuration)
+	prometheus.MustRegister(writeErrors)
+	prometheus.MustRegister(readQueries)
+	prometheus.MustRegister(readErrors)
+	prometheus.MustRegister(readDuration)
+	prometheus.MustRegister(configSuccess)
+	prometheus.MustRegister(configSuccessTime)
+	prometheus.MustRegister(inFlightWrites)
+	prometheus.MustRegister(rejectedWrites)
 }
 
 func reload(cliCfg *config.Config, logger log.Logger, server *Server) (*config.Config, error) {
-	cfg := &config.DefaultConfig
+	cfg, err := loadConfig(cliCfg, logger)
+	if err == nil {
+		// Reload server
+		err = server.ReloadConfig(logger, cfg)
+	}
+	if err != nil {
+		configSuccess.Set(0)
+		return nil, err
+	}
+
+	configureTracing(cfg, logger)
+	configSuccess.Set(1)
+	configSuccessTime.Set(float64(time.Now().Unix()))
+	return cfg, nil
+}
+
+// tracingExporter exports the spans when tracing is enabled.
+var tracingExporter *tracing.OTLPExporter
+
+// configureTracing swaps the span exporter for the one of cfg.
+func configureTracing(cfg *config.Config, logger log.Logger) {
+	previous := tracingExporter
+	tracingExporter = nil
+	if cfg.Tracing.Enabled {
+		tracingExporter = tracing.NewOTLPExporter(cfg.Tracing.Endpoint, logger)
+		tracing.SetExporter(tracingExporter)
+	} else {
+		tracing.SetExporter(nil)
+	}
+	if previous != nil {
+		previous.Close()
+	}
+}
+
+func loadConfig(cliCfg *config.Config, logger log.Logger) (*config.Config, error) {
+	// Don't modify the defaults when merging the flags.
+	defaultCfg := config.DefaultConfig
+	cfg := &defaultCfg
 	// Parse config file if needed
-	if cliCfg.ConfigFile != "" {
-		fileCfg, err := config.LoadFile(logger, cliCfg.ConfigFile)
+	if cliCfg.ConfigFile != "" || cliCfg.ConfigDir != "" {
+		fileCfg, err := loadConfigFiles(cliCfg, logger)
 		if err != nil {
 			level.Error(logger).Log("err", err, "msg", "Error loading config file")
 			return nil, err
 		}
 		cfg = fileCfg
 	}
+	for _, warning := range cfg.Graphite.Write.Lint() {
+		level.Warn(logger).Log("msg", warning)
+	}
 	// Merge overwritting cliCfg into cfg
 	if err := mergo.MergeWithOverwrite(cfg, cliCfg); err != nil {
 		level.Error(logger).Log("err", err, "msg", "Error merging config file with flags")
 		return nil, err
 	}
+	if cfg.Write.Timeout != config.DefaultConfig.Write.Timeout {
+		level.Warn(logger).Log("msg", "The write timeout is deprecated and ignored, "+
+			"use the dial and write timeouts of the graphite writer instead")
+	}
+	return cfg, nil
+}
 
-	// Reload server
-	if err := server.ReloadConfig(logger, cfg); err != nil {
+// loadConfigFiles loads the config file, merged with the fragments of the
+// config directory if any.
+func loadConfigFiles(cliCfg *config.Config, logger log.Logger) (*config.Config, error) {
+	if cliCfg.ConfigDir == "" {
+		return config.LoadFile(logger, cliCfg.ConfigFile)
+	}
+	files, err := config.FragmentFiles(cliCfg.ConfigDir)
+	if err != nil {
 		return nil, err
 	}
-
-	return cfg, nil
+	if cliCfg.ConfigFile != "" {
+		files = append([]string{cliCfg.ConfigFile}, files...)
+	}
+	return config.LoadFiles(logger, files...)
 }
 
 func main() {
 	cliCfg := config.ParseCommandLine()
-	logger := promlog.New(cliCfg.LogLevel)
+	logger := newLogger(os.Stderr, cliCfg.LogLevel, cliCfg.LogFormat)
+
+	if cliCfg.Command == "check-config" {
+		if err := checkConfig(cliCfg, logger, os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	level.Info(logger).Log("msg", "Starting graphite-remote-adapter", "version", version.Info())
 	level.Info(logger).Log("build_context", version.BuildContext())
 
@@ -128,10 +281,10 @@ func main() {
 		return
 	}
 
-	http.Handle(cfg.Web.TelemetryPath, prometheus.Handler())
+	http.Handle(cfg.Web.TelemetryPath, server.withMetricsAuth(prometheus.Handler()))
 
 	// Tooling to dynamically reload the config for each clients.
-	hup := make(chan os.Signal)
+	hup := make(chan os.Signal, 1)
 	reloadCh := make(chan chan error)
 	signal.Notify(hup, syscall.SIGHUP)
 	go func() {
@@ -162,6 +315,12 @@ func main() {
 				fmt.Fprintf(w, "This endpoint requires a POST request.\n")
 				return
 			}
+			server.lock.RLock()
+			authorized := server.authorize(w, r)
+			server.lock.RUnlock()
+			if !authorized {
+				return
+			}
 
 			rc := make(chan error)
 			reloadCh <- rc
@@ -170,10 +329,31 @@ func main() {
 			}
 		})
 
+	// Flush the pending writes before leaving.
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGTERM, os.Interrupt)
+	shutdownDone := make(chan struct{})
+	go func() {
+		sig := <-term
+		level.Info(logger).Log("signal", sig, "msg", "Shutting down")
+		server.lock.RLock()
+		timeout := server.cfg.Web.ShutdownTimeout
+		server.lock.RUnlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			level.Warn(logger).Log("err", err, "msg", "Error shutting down")
+		}
+		close(shutdownDone)
+	}()
+
 	if len(server.writers) != 0 || len(server.readers) != 0 {
 		err := server.Serve(logger)
 		if err != nil {
 			level.Warn(logger).Log("err", err)
+		} else {
+			<-shutdownDone
 		}
 	} else {
 		level.Warn(logger).Log("msg", "No reader nor writer, leaving")
@@ -198,14 +378,35 @@ func buildClients(cfg *config.Config, logger log.Logger) ([]client.Writer, []cli
 type Server struct {
 	lock sync.RWMutex
 
-	cfg *config.Config
+	cfg       *config.Config
+	tlsConfig *tls.Config
+	// loadedAt is the time cfg was loaded.
+	loadedAt time.Time
 
 	writers []client.Writer
 	readers []client.Reader
+
+	// writeSlots bounds the writes in flight, if web.max_concurrent_writes
+	// is set.
+	writeSlots chan struct{}
+
+	readinessLock sync.Mutex
+	lastReadiness *readinessReport
+
+	// srv is the HTTP server, created by Serve or Shutdown.
+	srv *http.Server
 }
 
 // ReloadConfig reloads the config file from cli params.
 func (s *Server) ReloadConfig(logger log.Logger, cfg *config.Config) error {
+	var tlsConfig *tls.Config
+	if cfg.Web.TLS != nil {
+		var err error
+		if tlsConfig, err = newTLSConfig(cfg); err != nil {
+			return err
+		}
+	}
+
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
@@ -217,8 +418,20 @@ func (s *Server) ReloadConfig(logger log.Logger, cfg *config.Config) error {
 	}
 
 	s.cfg = cfg
+	s.loadedAt = time.Now()
+	s.tlsConfig = tlsConfig
+	// No write is in flight while the lock is held.
+	s.writeSlots = nil
+	if n := cfg.Web.MaxConcurrentWrites; n > 0 {
+		s.writeSlots = make(chan struct{}, n)
+	}
 	s.writers, s.readers = buildClients(cfg, logger)
 
+	// The backends may have changed.
+	s.readinessLock.Lock()
+	s.lastReadiness = nil
+	s.readinessLock.Unlock()
+
 	return nil
 }
 
@@ -226,32 +439,120 @@ func (s *Server) ReloadConfig(logger log.Logger, cfg *config.Config) error {
 func (s *Server) Serve(logger log.Logger) error {
 	level.Info(logger).Log("ListenAddress", s.cfg.Web.ListenAddress, "msg", "Listening")
 
+	s.registerRoutes(http.DefaultServeMux, logger)
+
+	var err error
+	if srv := s.httpServer(); srv.TLSConfig != nil {
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// registerRoutes registers the handlers of the server on mux.
+func (s *Server) registerRoutes(mux *http.ServeMux, logger log.Logger) {
 	ihf := func(name string, f http.HandlerFunc) http.HandlerFunc {
 		return prometheus.InstrumentHandlerFunc(name, func(w http.ResponseWriter, r *http.Request) {
 			f(w, r)
 		})
 	}
 
-	http.HandleFunc("/write", ihf("write", func(w http.ResponseWriter, r *http.Request) {
+	write := ihf("write", func(w http.ResponseWriter, r *http.Request) {
 		s.Write(logger, w, r)
-	}))
+	})
+	mux.HandleFunc("/write", write)
+	// Alias for the clients posting to the path of Prometheus' receiver.
+	mux.HandleFunc("/api/v1/write", write)
 
-	http.HandleFunc("/read", ihf("read", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/read", ihf("read", func(w http.ResponseWriter, r *http.Request) {
 		s.Read(logger, w, r)
 	}))
 
-	http.HandleFunc("/", ihf("status", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/-/healthy", ihf("healthy", s.Healthy))
+
+	mux.HandleFunc("/-/ready", ihf("ready", s.Ready))
+
+	mux.HandleFunc("/debug/path", ihf("debug_path", s.DebugPath))
+
+	mux.HandleFunc("/config", ihf("config", s.Config))
+
+	mux.HandleFunc("/api/v1/labels", ihf("labels", s.LabelNames))
+
+	mux.HandleFunc("/api/v1/label/", ihf("label_values", s.LabelValues))
+
+	mux.HandleFunc("/api/v1/series", ihf("series", s.Series))
+
+	mux.HandleFunc("/", ihf("status", func(w http.ResponseWriter, r *http.Request) {
 		s.Status(w, r)
 	}))
+}
+
+// httpServer returns the HTTP server, creating it on the first call.
+func (s *Server) httpServer() *http.Server {
+	s.lock.Lock()
+	defer s.lock.Unlock()
 
-	return http.ListenAndServe(s.cfg.Web.ListenAddress, nil)
+	if s.srv == nil {
+		s.srv = &http.Server{Addr: s.cfg.Web.ListenAddress}
+		if s.cfg.Web.TLS != nil {
+			s.srv.TLSConfig = &tls.Config{GetConfigForClient: s.getConfigForClient}
+		}
+	}
+	return s.srv
 }
 
-// Status generate an html status page.
+// Shutdown stops accepting requests, waits for the ongoing ones, then shuts
+// the clients down so that they flush their pending writes. It gives up when
+// ctx is done, unless draining the requests already took all of it: the
+// writers are flushed anyway, within their own write timeouts.
+func (s *Server) Shutdown(ctx context.Context) error {
+	var errs []string
+	deadline := ctx.Done()
+	if err := s.httpServer().Shutdown(ctx); err != nil {
+		errs = append(errs, fmt.Sprintf("requests not drained: %s", err))
+		// The remaining requests must not write while the writers flush.
+		s.httpServer().Close()
+		deadline = nil
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.lock.Lock()
+		defer s.lock.Unlock()
+
+		for _, v := range s.writers {
+			v.Shutdown()
+		}
+		for _, v := range s.readers {
+			v.Shutdown()
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-deadline:
+		errs = append(errs, fmt.Sprintf("pending writes not flushed: %s", ctx.Err()))
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Status generate an html status page. The clients it dumps hold the
+// credentials of the backends, so it's behind the web auth.
 func (s *Server) Status(w http.ResponseWriter, r *http.Request) {
 	s.lock.RLock()
 	defer s.lock.RUnlock()
 
+	if !s.authorize(w, r) {
+		return
+	}
 	s.status(w, r)
 }
 
@@ -280,7 +581,8 @@ func (s *Server) status(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "graphite-remote-adapter %s<br/>", version.Info())
 	fmt.Fprintf(w, "Build context %s<br/>", version.BuildContext())
 
-	fmt.Fprintf(w, "Flags:<br/><pre>%s</pre>", html.EscapeString(spew.Sdump(s.cfg)))
+	// Secrets are redacted in YAML.
+	fmt.Fprintf(w, "Flags:<br/><pre>%s</pre>", html.EscapeString(s.cfg.String()))
 
 	fmt.Fprintf(w, "Writers:<br/><dl>")
 	for _, v := range s.writers {
@@ -307,55 +609,134 @@ func (s *Server) Write(logger log.Logger, w http.ResponseWriter, r *http.Request
 	s.lock.RLock()
 	defer s.lock.RUnlock()
 
+	if !s.authorize(w, r) {
+		return
+	}
+	// Excess writes are rejected rather than queued, to bound the memory
+	// used. Prometheus retries on 503 but not on most 4xx.
+	if s.writeSlots != nil {
+		select {
+		case s.writeSlots <- struct{}{}:
+			defer func() { <-s.writeSlots }()
+		default:
+			rejectedWrites.Inc()
+			http.Error(w, "too many concurrent writes", http.StatusServiceUnavailable)
+			return
+		}
+	}
+	inFlightWrites.Inc()
+	defer inFlightWrites.Dec()
 	s.write(logger, w, r)
 }
 
 func (s *Server) write(logger log.Logger, w http.ResponseWriter, r *http.Request) {
-	level.Debug(logger).Log("request", r, "msg", "Handling /write request")
-	compressed, err := ioutil.ReadAll(r.Body)
-	if err != nil {
+	level.Debug(logger).Log("url", r.URL, "remote_addr", r.RemoteAddr, "msg", "Handling /write request")
+	compressed := getBodyBuffer()
+	defer putBodyBuffer(compressed)
+	if _, err := compressed.ReadFrom(r.Body); err != nil {
 		level.Warn(logger).Log("err", err, "msg", "Error reading request body")
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	reqBuf, err := snappy.Decode(nil, compressed)
+	writeProto, err := remoteWriteProto(r.Header.Get("Content-Type"))
 	if err != nil {
-		level.Warn(logger).Log("err", err, "msg", "Error decoding request body")
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		level.Warn(logger).Log("err", err, "msg", "Error negotiating remote write protocol")
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
 		return
 	}
 
-	var req prompb.WriteRequest
-	if err := proto.Unmarshal(reqBuf, &req); err != nil {
-		level.Warn(logger).Log("err", err, "msg", "Error unmarshalling protobuf")
+	var samples model.Samples
+	var metadata []client.MetricMetadata
+	var histograms []nativeHistogram
+	if writeProto == remoteWriteV2Proto {
+		samples, metadata, histograms, err = decodeWriteRequestV2(compressed.Bytes())
+	} else {
+		var req *prompb.WriteRequest
+		if req, metadata, histograms, err = decodeWriteRequest(compressed.Bytes()); err == nil {
+			samples = protoToSamples(req)
+			putWriteRequest(req)
+		}
+	}
+	if err != nil {
+		level.Warn(logger).Log("err", err, "msg", "Error decoding request body")
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-
-	samples := protoToSamples(&req)
+	// The series the histograms are converted to aren't samples of the request.
+	writtenSamples := len(samples)
+	convertedHistograms := 0
+	if len(histograms) > 0 {
+		writeCfg := s.cfg.Graphite.Write
+		if writeCfg.NativeHistograms == "drop" {
+			droppedHistograms.Add(float64(len(histograms)))
+		} else {
+			for _, h := range histograms {
+				samples = append(samples, h.samples(writeCfg.NativeHistogramSuffixes)...)
+			}
+			convertedHistograms = len(histograms)
+		}
+	}
+	if len(metadata) > 0 {
+		for _, writer := range s.writers {
+			if mw, ok := writer.(client.MetadataWriter); ok {
+				mw.WriteMetadata(metadata)
+			}
+		}
+	}
 	receivedSamples.Add(float64(len(samples)))
 
+	ctx, span := tracing.StartSpan(tracing.Extract(r), "write")
+	defer span.End()
+	span.SetAttribute("samples", len(samples))
+	r = r.WithContext(ctx)
+
 	var wg sync.WaitGroup
-	for _, w := range s.writers {
+	errs := make([]error, len(s.writers))
+	for i, writer := range s.writers {
 		wg.Add(1)
-		go func(rw client.Writer) {
-			sendSamples(logger, rw, samples, r)
+		go func(i int, rw client.Writer) {
+			errs[i] = sendSamples(logger, rw, samples, r)
 			wg.Done()
-		}(w)
+		}(i, writer)
 	}
 	wg.Wait()
+
+	// Failed writes must be retried by Prometheus, which only does it on
+	// server errors.
+	for _, err := range errs {
+		if err == client.ErrThrottled {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+	}
+	for _, err := range errs {
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Remote write 2.0 clients expect to be told what was written.
+	if writeProto == remoteWriteV2Proto {
+		w.Header().Set("X-Prometheus-Remote-Write-Samples-Written", strconv.Itoa(writtenSamples))
+		w.Header().Set("X-Prometheus-Remote-Write-Histograms-Written", strconv.Itoa(convertedHistograms))
+		w.Header().Set("X-Prometheus-Remote-Write-Exemplars-Written", "0")
+	}
 }
 
 func (s *Server) Read(logger log.Logger, w http.ResponseWriter, r *http.Request) {
 	s.lock.RLock()
 	defer s.lock.RUnlock()
 
+	if !s.authorize(w, r) {
+		return
+	}
 	s.read(logger, w, r)
 }
 
 func (s *Server) read(logger log.Logger, w http.ResponseWriter, r *http.Request) {
-	level.Debug(logger).Log("request", r, "msg", "Handling /read request")
+	level.Debug(logger).Log("url", r.URL, "remote_addr", r.RemoteAddr, "msg", "Handling /read request")
 	compressed, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		level.Warn(logger).Log("err", err, "msg", "Error reading request body")
@@ -377,6 +758,14 @@ func (s *Server) read(logger log.Logger, w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	// Hints are newer than our prompb, decode them on their own.
+	hints, err := client.DecodeReadHints(reqBuf)
+	if err != nil {
+		level.Debug(logger).Log("err", err, "msg", "Error decoding read hints, ignoring them")
+	} else {
+		r = client.WithReadHints(r, hints)
+	}
+
 	// TODO: Support reading from more than one reader and merging the results.
 	if len(s.readers) != 1 {
 		http.Error(w, fmt.Sprintf("expected exactly one reader, found %d readers", len(s.readers)), http.StatusInternalServerError)
@@ -384,11 +773,55 @@ func (s *Server) read(logger log.Logger, w http.ResponseWriter, r *http.Request)
 	}
 	reader := s.readers[0]
 
+	ctx, span := tracing.StartSpan(tracing.Extract(r), "read")
+	defer span.End()
+	span.SetAttribute("queries", len(req.Queries))
+	stats := &client.ReadStats{}
+	r = client.WithReadStats(r.WithContext(ctx), stats)
+
+	readQueries.WithLabelValues(reader.Name()).Add(float64(len(req.Queries)))
+	begin := time.Now()
+
+	// Stream the series when the client supports it, falling back to the
+	// buffered response otherwise.
+	if streamReader, ok := reader.(client.StreamReader); ok && acceptsStreamedChunks(reqBuf) {
+		if _, ok := w.(http.Flusher); ok {
+			started, err := streamRead(w, r, streamReader, &req)
+			readDuration.WithLabelValues(reader.Name()).Observe(time.Since(begin).Seconds())
+			if err != nil {
+				span.SetError(err)
+				readErrors.WithLabelValues(reader.Name()).Inc()
+				level.Warn(logger).Log(
+					"query", req, "query_count", len(req.Queries), "storage", reader.Name(),
+					"err", err, "msg", "Error streaming query results")
+				if s.cfg.Read.IgnoreError == false {
+					if started {
+						// Abort the response so that the client doesn't take
+						// it for complete.
+						panic(http.ErrAbortHandler)
+					}
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+			}
+			if !started {
+				w.Header().Set("Content-Type", streamedReadContentType)
+			}
+			level.Debug(logger).Log(
+				"query_count", len(req.Queries), "storage", reader.Name(), "targets", stats.Targets(),
+				"backend_duration", stats.Backend(), "msg", "Streamed query results")
+			return
+		}
+	}
+
 	var resp *prompb.ReadResponse
 	resp, err = reader.Read(&req, r)
+	readDuration.WithLabelValues(reader.Name()).Observe(time.Since(begin).Seconds())
 	if err != nil {
+		span.SetError(err)
+		readErrors.WithLabelValues(reader.Name()).Inc()
 		level.Warn(logger).Log(
-			"query", req, "storage", reader.Name(),
+			"query", req, "query_count", len(req.Queries), "storage", reader.Name(),
 			"err", err, "msg", "Error executing query")
 		if s.cfg.Read.IgnoreError == false {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -409,6 +842,18 @@ func (s *Server) read(logger log.Logger, w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	points := 0
+	for _, result := range resp.Results {
+		for _, ts := range result.Timeseries {
+			points += len(ts.Samples)
+		}
+	}
+	level.Debug(logger).Log(
+		"query_count", len(req.Queries), "storage", reader.Name(), "targets", stats.Targets(),
+		"points", points, "backend_duration", stats.Backend(), "msg", "Read query results")
+	w.Header().Set(readTargetsHeader, strconv.FormatInt(stats.Targets(), 10))
+	w.Header().Set(readPointsHeader, strconv.Itoa(points))
+	w.Header().Set(readBackendHeader, strconv.FormatFloat(stats.Backend().Seconds(), 'f', -1, 64))
 	w.Header().Set("Content-Type", "application/x-protobuf")
 	w.Header().Set("Content-Encoding", "snappy")
 
@@ -420,7 +865,13 @@ func (s *Server) read(logger log.Logger, w http.ResponseWriter, r *http.Request)
 }
 
 func protoToSamples(req *prompb.WriteRequest) model.Samples {
-	var samples model.Samples
+	n := 0
+	for _, ts := range req.Timeseries {
+		n += len(ts.Samples)
+	}
+	// Allocate all the samples at once.
+	backing := make([]model.Sample, n)
+	samples := make(model.Samples, 0, n)
 	for _, ts := range req.Timeseries {
 		metric := make(model.Metric, len(ts.Labels))
 		for _, l := range ts.Labels {
@@ -428,26 +879,44 @@ func protoToSamples(req *prompb.WriteRequest) model.Samples {
 		}
 
 		for _, s := range ts.Samples {
-			samples = append(samples, &model.Sample{
-				Metric:    metric,
-				Value:     model.SampleValue(s.Value),
-				Timestamp: model.Time(s.Timestamp),
-			})
+			sample := &backing[len(samples)]
+			sample.Metric = metric
+			sample.Value = model.SampleValue(s.Value)
+			sample.Timestamp = model.Time(s.Timestamp)
+			samples = append(samples, sample)
 		}
 	}
 	return samples
 }
 
-func sendSamples(logger log.Logger, w client.Writer, samples model.Samples, r *http.Request) {
+func sendSamples(logger log.Logger, w client.Writer, samples model.Samples, r *http.Request) error {
 	begin := time.Now()
 	err := w.Write(samples, r)
 	duration := time.Since(begin).Seconds()
 	if err != nil {
 		level.Warn(logger).Log(
-			"num_samples", len(samples), "storage", w.Name(),
+			"metric_count", len(samples), "storage", w.Name(),
 			"err", err, "msg", "Error sending samples to remote storage")
 		failedSamples.WithLabelValues(w.Name()).Add(float64(len(samples)))
+		writeErrors.WithLabelValues(w.Name(), errorType(err)).Inc()
 	}
 	sentSamples.WithLabelValues(w.Name()).Add(float64(len(samples)))
 	sentBatchDuration.WithLabelValues(w.Name()).Observe(duration)
+	return err
+}
+
+// errorType classifies write errors to keep the cardinality of their metric
+// bounded.
+func errorType(err error) string {
+	if err == client.ErrThrottled {
+		return "throttled"
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return "timeout"
+	}
+	switch err.(type) {
+	case *net.OpError, *net.DNSError:
+		return "network"
+	}
+	return "other"
 }
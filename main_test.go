@@ -0,0 +1,548 @@
+// Copyright 2018 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/require"
+
+	"github.com/criteo/graphite-remote-adapter/client"
+	"github.com/criteo/graphite-remote-adapter/config"
+	"github.com/criteo/graphite-remote-adapter/tracing"
+)
+
+const reloadTestConfig = `
+graphite:
+  write:
+    carbon_address: %s
+    rules:
+    - match:
+        owner: team-X
+      template: '%s.{{.labels.owner}}'
+      continue: false
+`
+
+// listenCarbon returns the address of a tcp listener sending the received
+// lines to the returned channel.
+func listenCarbon(t *testing.T) (net.Listener, chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	lines := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					lines <- scanner.Text()
+				}
+			}()
+		}
+	}()
+	return l, lines
+}
+
+func writeRequest(t *testing.T) *http.Request {
+	req := &prompb.WriteRequest{
+		Timeseries: []*prompb.TimeSeries{{
+			Labels: []*prompb.Label{
+				{Name: "__name__", Value: "test"},
+				{Name: "owner", Value: "team-X"},
+			},
+			Samples: []*prompb.Sample{{Value: 1, Timestamp: 1000}},
+		}},
+	}
+	data, err := proto.Marshal(req)
+	require.NoError(t, err)
+	r, err := http.NewRequest("POST", "/write", bytes.NewReader(snappy.Encode(nil, data)))
+	require.NoError(t, err)
+	return r
+}
+
+func expectLine(t *testing.T, lines chan string, expected string) {
+	select {
+	case line := <-lines:
+		require.Equal(t, expected, line)
+	case <-time.After(time.Second):
+		t.Fatalf("no line received, expected %q", expected)
+	}
+}
+
+func gaugeValue(t *testing.T, g interface{ Write(*dto.Metric) error }) float64 {
+	var m dto.Metric
+	require.NoError(t, g.Write(&m))
+	return m.GetGauge().GetValue()
+}
+
+func TestReloadSwapsRules(t *testing.T) {
+	l, lines := listenCarbon(t)
+	defer l.Close()
+
+	f, err := ioutil.TempFile("", "config")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	writeConfig := func(content string) {
+		require.NoError(t, ioutil.WriteFile(f.Name(), []byte(content), 0644))
+	}
+
+	logger := log.NewNopLogger()
+	cliCfg := &config.Config{ConfigFile: f.Name()}
+	server := &Server{}
+	defer server.ReloadConfig(logger, &config.Config{})
+
+	writeConfig(fmt.Sprintf(reloadTestConfig, l.Addr(), "old"))
+	_, err = reload(cliCfg, logger, server)
+	require.NoError(t, err)
+	server.Write(logger, httptest.NewRecorder(), writeRequest(t))
+	expectLine(t, lines, "old.team-X 1.000000 1.000000")
+
+	writeConfig(fmt.Sprintf(reloadTestConfig, l.Addr(), "new"))
+	_, err = reload(cliCfg, logger, server)
+	require.NoError(t, err)
+	require.Equal(t, float64(1), gaugeValue(t, configSuccess))
+	require.NotZero(t, gaugeValue(t, configSuccessTime))
+	server.Write(logger, httptest.NewRecorder(), writeRequest(t))
+	expectLine(t, lines, "new.team-X 1.000000 1.000000")
+
+	// An invalid config keeps the current one.
+	writeConfig("graphite:\n  write:\n    unknown_field: true\n")
+	_, err = reload(cliCfg, logger, server)
+	require.Error(t, err)
+	require.Equal(t, float64(0), gaugeValue(t, configSuccess))
+	server.Write(logger, httptest.NewRecorder(), writeRequest(t))
+	expectLine(t, lines, "new.team-X 1.000000 1.000000")
+}
+
+// fakeStorage is a remote storage failing writes with err.
+type fakeStorage struct {
+	err error
+}
+
+func (f *fakeStorage) Write(samples model.Samples, r *http.Request) error { return f.err }
+func (f *fakeStorage) Read(req *prompb.ReadRequest, r *http.Request) (*prompb.ReadResponse, error) {
+	return &prompb.ReadResponse{Results: []*prompb.QueryResult{{}}}, nil
+}
+func (f *fakeStorage) Name() string   { return "fake" }
+func (f *fakeStorage) String() string { return "fake" }
+func (f *fakeStorage) Shutdown()      {}
+
+func counterValue(t *testing.T, c prometheus.Collector) float64 {
+	ch := make(chan prometheus.Metric, 1)
+	c.Collect(ch)
+	var m dto.Metric
+	require.NoError(t, (<-ch).Write(&m))
+	return m.GetCounter().GetValue()
+}
+
+func TestRequestMetrics(t *testing.T) {
+	storage := &fakeStorage{err: &net.OpError{Op: "write", Err: syscall.ECONNRESET}}
+	server := &Server{
+		cfg:     &config.DefaultConfig,
+		writers: []client.Writer{storage},
+		readers: []client.Reader{storage},
+	}
+	logger := log.NewNopLogger()
+
+	received := counterValue(t, receivedSamples)
+	server.Write(logger, httptest.NewRecorder(), writeRequest(t))
+	require.Equal(t, received+1, counterValue(t, receivedSamples))
+	require.Equal(t, float64(1), counterValue(t, writeErrors.WithLabelValues("fake", "network")))
+
+	data, err := proto.Marshal(&prompb.ReadRequest{Queries: []*prompb.Query{{}, {}}})
+	require.NoError(t, err)
+	r, err := http.NewRequest("POST", "/read", bytes.NewReader(snappy.Encode(nil, data)))
+	require.NoError(t, err)
+	server.Read(logger, httptest.NewRecorder(), r)
+	require.Equal(t, float64(2), counterValue(t, readQueries.WithLabelValues("fake")))
+
+	families, err := prometheus.DefaultGatherer.Gather()
+	require.NoError(t, err)
+	names := map[string]bool{}
+	for _, family := range families {
+		names[family.GetName()] = true
+	}
+	for _, name := range []string{
+		"remote_adapter_received_samples_total",
+		"remote_adapter_sent_samples_total",
+		"remote_adapter_failed_samples_total",
+		"remote_adapter_sent_batch_duration_seconds",
+		"remote_adapter_write_errors_total",
+		"remote_adapter_read_queries_total",
+		"remote_adapter_read_duration_seconds",
+		"remote_adapter_graphite_rule_matched_samples_total",
+	} {
+		require.True(t, names[name], "%s isn't registered", name)
+	}
+}
+
+// costlyStorage is a remote storage reading series from two targets.
+type costlyStorage struct {
+	fakeStorage
+}
+
+func (f *costlyStorage) Read(req *prompb.ReadRequest, r *http.Request) (*prompb.ReadResponse, error) {
+	stats := client.ReadStatsFromContext(r.Context())
+	stats.AddTarget(10 * time.Millisecond)
+	stats.AddTarget(20 * time.Millisecond)
+	samples := []*prompb.Sample{{Value: 1, Timestamp: 1000}, {Value: 2, Timestamp: 2000}}
+	return &prompb.ReadResponse{Results: []*prompb.QueryResult{{Timeseries: []*prompb.TimeSeries{
+		{Labels: []*prompb.Label{{Name: "__name__", Value: "up"}}, Samples: samples},
+		{Labels: []*prompb.Label{{Name: "__name__", Value: "test"}}, Samples: samples[:1]},
+	}}}}, nil
+}
+
+func TestReadCostHeaders(t *testing.T) {
+	server := &Server{
+		cfg:     &config.DefaultConfig,
+		readers: []client.Reader{&costlyStorage{}},
+	}
+	data, err := proto.Marshal(&prompb.ReadRequest{Queries: []*prompb.Query{{}}})
+	require.NoError(t, err)
+	r, err := http.NewRequest("POST", "/read", bytes.NewReader(snappy.Encode(nil, data)))
+	require.NoError(t, err)
+	w := httptest.NewRecorder()
+	server.Read(log.NewNopLogger(), w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	targets, err := strconv.Atoi(w.Header().Get(readTargetsHeader))
+	require.NoError(t, err)
+	require.Equal(t, 2, targets)
+	points, err := strconv.Atoi(w.Header().Get(readPointsHeader))
+	require.NoError(t, err)
+	require.Equal(t, 3, points)
+	backend, err := strconv.ParseFloat(w.Header().Get(readBackendHeader), 64)
+	require.NoError(t, err)
+	require.Equal(t, 0.03, backend)
+}
+
+func TestErrorType(t *testing.T) {
+	require.Equal(t, "timeout", errorType(&net.OpError{Op: "write", Err: timeoutError{}}))
+	require.Equal(t, "network", errorType(&net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}))
+	require.Equal(t, "other", errorType(fmt.Errorf("template error")))
+	require.Equal(t, "throttled", errorType(client.ErrThrottled))
+}
+
+func TestThrottledWriteFails(t *testing.T) {
+	server := &Server{
+		cfg:     &config.DefaultConfig,
+		writers: []client.Writer{&fakeStorage{err: client.ErrThrottled}},
+	}
+	w := httptest.NewRecorder()
+	server.Write(log.NewNopLogger(), w, writeRequest(t))
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	// Other errors must be retried too.
+	server.writers = []client.Writer{&fakeStorage{err: fmt.Errorf("connection refused")}}
+	w = httptest.NewRecorder()
+	server.Write(log.NewNopLogger(), w, writeRequest(t))
+	require.Equal(t, http.StatusInternalServerError, w.Code)
+}
+
+// blockingStorage is a remote storage whose writes block until release is
+// closed, signalling on started when they begin.
+type blockingStorage struct {
+	fakeStorage
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingStorage) Write(samples model.Samples, r *http.Request) error {
+	b.started <- struct{}{}
+	<-b.release
+	return nil
+}
+
+func TestMaxConcurrentWrites(t *testing.T) {
+	storage := &blockingStorage{started: make(chan struct{}), release: make(chan struct{})}
+	server := &Server{
+		cfg:        &config.DefaultConfig,
+		writers:    []client.Writer{storage},
+		writeSlots: make(chan struct{}, 2),
+	}
+	logger := log.NewNopLogger()
+
+	var wg sync.WaitGroup
+	codes := make([]int, 2)
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			server.Write(logger, w, writeRequest(t))
+			codes[i] = w.Code
+		}(i)
+		<-storage.started
+	}
+	require.Equal(t, float64(2), gaugeValue(t, inFlightWrites))
+
+	rejected := counterValue(t, rejectedWrites)
+	w := httptest.NewRecorder()
+	server.Write(logger, w, writeRequest(t))
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+	require.Equal(t, rejected+1, counterValue(t, rejectedWrites))
+
+	close(storage.release)
+	wg.Wait()
+	require.Equal(t, []int{http.StatusOK, http.StatusOK}, codes)
+	require.Equal(t, float64(0), gaugeValue(t, inFlightWrites))
+
+	// Slots are given back.
+	go func() { <-storage.started }()
+	w = httptest.NewRecorder()
+	server.Write(logger, w, writeRequest(t))
+	require.Equal(t, http.StatusOK, w.Code)
+}
+
+// recordingStorage is a remote storage recording the samples written.
+type recordingStorage struct {
+	fakeStorage
+	lock    sync.Mutex
+	samples model.Samples
+}
+
+func (s *recordingStorage) Write(samples model.Samples, r *http.Request) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.samples = append(s.samples, samples...)
+	return nil
+}
+
+func TestWriteRoutes(t *testing.T) {
+	storage := &recordingStorage{}
+	server := &Server{
+		cfg:     &config.DefaultConfig,
+		writers: []client.Writer{storage},
+	}
+	mux := http.NewServeMux()
+	server.registerRoutes(mux, log.NewNopLogger())
+
+	for _, path := range []string{"/write", "/api/v1/write"} {
+		storage.samples = nil
+		r := writeRequest(t)
+		r.URL.Path = path
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		require.Equal(t, http.StatusOK, w.Code, path)
+		require.Equal(t, model.Samples{{
+			Metric:    model.Metric{model.MetricNameLabel: "test", "owner": "team-X"},
+			Value:     1,
+			Timestamp: 1000,
+		}}, storage.samples, path)
+	}
+}
+
+func TestWriteV2(t *testing.T) {
+	storage := &recordingStorage{}
+	server := &Server{
+		cfg:     &config.DefaultConfig,
+		writers: []client.Writer{storage},
+	}
+	data, err := proto.Marshal(&writeRequestV2{
+		Symbols:    []string{"", "__name__", "test", "owner", "team-X"},
+		Timeseries: []*timeSeriesV2{{LabelsRefs: []uint32{1, 2, 3, 4}, Samples: []*sampleV2{{Value: 1, Timestamp: 1000}}}},
+	})
+	require.NoError(t, err)
+
+	r, err := http.NewRequest("POST", "/api/v1/write", bytes.NewReader(snappy.Encode(nil, data)))
+	require.NoError(t, err)
+	r.Header.Set("Content-Type", "application/x-protobuf;proto=io.prometheus.write.v2.Request")
+	w := httptest.NewRecorder()
+	server.Write(log.NewNopLogger(), w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "1", w.Header().Get("X-Prometheus-Remote-Write-Samples-Written"))
+	require.Equal(t, model.Samples{{
+		Metric:    model.Metric{model.MetricNameLabel: "test", "owner": "team-X"},
+		Value:     1,
+		Timestamp: 1000,
+	}}, storage.samples)
+
+	r.Header.Set("Content-Type", "application/x-protobuf;proto=io.prometheus.write.v3.Request")
+	w = httptest.NewRecorder()
+	server.Write(log.NewNopLogger(), w, r)
+	require.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestWriteSpans(t *testing.T) {
+	l, lines := listenCarbon(t)
+	defer l.Close()
+
+	f, err := ioutil.TempFile("", "config")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	require.NoError(t, ioutil.WriteFile(f.Name(), []byte(fmt.Sprintf(reloadTestConfig, l.Addr(), "traced")), 0644))
+
+	logger := log.NewNopLogger()
+	server := &Server{}
+	defer server.ReloadConfig(logger, &config.Config{})
+	_, err = reload(&config.Config{ConfigFile: f.Name()}, logger, server)
+	require.NoError(t, err)
+
+	recorder := &tracing.Recorder{}
+	tracing.SetExporter(recorder)
+	defer tracing.SetExporter(nil)
+
+	r := writeRequest(t)
+	r.Header.Set("traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	server.Write(logger, httptest.NewRecorder(), r)
+	expectLine(t, lines, "traced.team-X 1.000000 1.000000")
+
+	spans := map[string]tracing.SpanData{}
+	for _, s := range recorder.Spans() {
+		spans[s.Name] = s
+	}
+	require.Len(t, spans, 4)
+
+	write := spans["write"]
+	require.Equal(t, "0af7651916cd43dd8448eb211c80319c", fmt.Sprintf("%x", write.TraceID))
+	require.Equal(t, "b7ad6b7169203331", fmt.Sprintf("%x", write.ParentSpanID))
+	require.Equal(t, "1", write.Attributes["samples"])
+
+	graphiteWrite := spans["graphite.Write"]
+	require.Equal(t, write.TraceID, graphiteWrite.TraceID)
+	require.Equal(t, write.SpanID, graphiteWrite.ParentSpanID)
+	for _, name := range []string{"graphite.pathsFromMetric", "graphite.send"} {
+		require.Equal(t, write.TraceID, spans[name].TraceID, name)
+		require.Equal(t, graphiteWrite.SpanID, spans[name].ParentSpanID, name)
+		require.Empty(t, spans[name].Error, name)
+	}
+}
+
+type shutdownStorage struct {
+	fakeStorage
+	shutdown bool
+}
+
+func (s *shutdownStorage) Shutdown() { s.shutdown = true }
+
+func TestShutdownFlushesAfterDrainTimeout(t *testing.T) {
+	storage := &shutdownStorage{}
+	server := &Server{cfg: &config.DefaultConfig, writers: []client.Writer{storage}}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go server.httpServer().Serve(l)
+
+	// A request whose headers never end keeps its connection active.
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("POST /write HTTP/1.1\r\n"))
+	require.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err = server.Shutdown(ctx)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "requests not drained")
+	require.True(t, storage.shutdown)
+}
+
+func TestWriteFanoutPolicyStatus(t *testing.T) {
+	l, lines := listenCarbon(t)
+	defer l.Close()
+	down, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	down.Close()
+
+	logger := log.NewNopLogger()
+	server := &Server{}
+	defer server.ReloadConfig(logger, &config.Config{})
+	for policy, code := range map[string]int{
+		"all_must_succeed": http.StatusInternalServerError,
+		"any":              http.StatusOK,
+	} {
+		cfg, err := config.Load(fmt.Sprintf(`
+graphite:
+  write:
+    carbon_address: ['%s', '%s']
+    fanout_policy: %s
+    max_retries: 0
+`, l.Addr(), down.Addr(), policy))
+		require.NoError(t, err)
+		require.NoError(t, server.ReloadConfig(logger, cfg))
+
+		w := httptest.NewRecorder()
+		server.Write(logger, w, writeRequest(t))
+		require.Equal(t, code, w.Code, policy)
+		expectLine(t, lines, "test.owner.team-X 1.000000 1.000000")
+	}
+}
+
+func TestShutdownFlushesBatch(t *testing.T) {
+	l, lines := listenCarbon(t)
+	defer l.Close()
+
+	cfg, err := config.Load(fmt.Sprintf(`
+web:
+  listen_address: 127.0.0.1:0
+graphite:
+  write:
+    carbon_address: %s
+    batch_size: 100
+    flush_interval: 1h
+`, l.Addr()))
+	require.NoError(t, err)
+
+	logger := log.NewNopLogger()
+	server := &Server{}
+	require.NoError(t, server.ReloadConfig(logger, cfg))
+	served := make(chan error)
+	go func() { served <- server.Serve(logger) }()
+
+	w := httptest.NewRecorder()
+	server.Write(logger, w, writeRequest(t))
+	require.Equal(t, http.StatusOK, w.Code)
+	select {
+	case line := <-lines:
+		t.Fatalf("unexpected line %q before shutdown", line)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, server.Shutdown(ctx))
+	expectLine(t, lines, "test.owner.team-X 1.000000 1.000000")
+	require.NoError(t, <-served)
+}
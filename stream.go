@@ -0,0 +1,162 @@
+// Copyright 2018 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"net/http"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/prometheus/prometheus/prompb"
+
+	"github.com/criteo/graphite-remote-adapter/client"
+)
+
+// The streamed remote read protocol is newer than our prompb, its messages
+// are mirrored here.
+
+// responseTypesRequest mirrors prompb.ReadRequest, only keeping the response
+// types accepted by the client.
+type responseTypesRequest struct {
+	AcceptedResponseTypes []int32 `protobuf:"varint,2,rep,packed,name=accepted_response_types,json=acceptedResponseTypes"`
+}
+
+func (m *responseTypesRequest) Reset()         { *m = responseTypesRequest{} }
+func (m *responseTypesRequest) String() string { return proto.CompactTextString(m) }
+func (*responseTypesRequest) ProtoMessage()    {}
+
+// streamedXORChunks is the STREAMED_XOR_CHUNKS read response type.
+const streamedXORChunks = 1
+
+// chunkEncodingXOR is the XOR encoding of prompb.Chunk.
+const chunkEncodingXOR = 1
+
+// streamedReadContentType is the content type of streamed read responses.
+const streamedReadContentType = "application/x-streamed-protobuf; proto=prometheus.ChunkedReadResponse"
+
+// chunk mirrors prompb.Chunk.
+type chunk struct {
+	MinTimeMs int64  `protobuf:"varint,1,opt,name=min_time_ms,json=minTimeMs,proto3"`
+	MaxTimeMs int64  `protobuf:"varint,2,opt,name=max_time_ms,json=maxTimeMs,proto3"`
+	Type      int32  `protobuf:"varint,3,opt,name=type,proto3"`
+	Data      []byte `protobuf:"bytes,4,opt,name=data,proto3"`
+}
+
+func (m *chunk) Reset()         { *m = chunk{} }
+func (m *chunk) String() string { return proto.CompactTextString(m) }
+func (*chunk) ProtoMessage()    {}
+
+// chunkedSeries mirrors prompb.ChunkedSeries.
+type chunkedSeries struct {
+	Labels []*prompb.Label `protobuf:"bytes,1,rep,name=labels"`
+	Chunks []*chunk        `protobuf:"bytes,2,rep,name=chunks"`
+}
+
+func (m *chunkedSeries) Reset()         { *m = chunkedSeries{} }
+func (m *chunkedSeries) String() string { return proto.CompactTextString(m) }
+func (*chunkedSeries) ProtoMessage()    {}
+
+// chunkedReadResponse mirrors prompb.ChunkedReadResponse.
+type chunkedReadResponse struct {
+	ChunkedSeries []*chunkedSeries `protobuf:"bytes,1,rep,name=chunked_series,json=chunkedSeries"`
+	QueryIndex    int64            `protobuf:"varint,2,opt,name=query_index,json=queryIndex,proto3"`
+}
+
+func (m *chunkedReadResponse) Reset()         { *m = chunkedReadResponse{} }
+func (m *chunkedReadResponse) String() string { return proto.CompactTextString(m) }
+func (*chunkedReadResponse) ProtoMessage()    {}
+
+// acceptsStreamedChunks tells whether the uncompressed read request in buf
+// accepts streamed XOR chunks.
+func acceptsStreamedChunks(buf []byte) bool {
+	var req responseTypesRequest
+	if err := proto.Unmarshal(buf, &req); err != nil {
+		return false
+	}
+	for _, t := range req.AcceptedResponseTypes {
+		if t == streamedXORChunks {
+			return true
+		}
+	}
+	return false
+}
+
+// maxSamplesPerChunk is the number of samples of the chunks of the TSDB.
+const maxSamplesPerChunk = 120
+
+// toChunkedSeries encodes the samples of ts in XOR chunks.
+func toChunkedSeries(ts *prompb.TimeSeries) *chunkedSeries {
+	cs := &chunkedSeries{Labels: ts.Labels}
+	for i := 0; i < len(ts.Samples); i += maxSamplesPerChunk {
+		end := i + maxSamplesPerChunk
+		if end > len(ts.Samples) {
+			end = len(ts.Samples)
+		}
+		samples := ts.Samples[i:end]
+		cs.Chunks = append(cs.Chunks, &chunk{
+			MinTimeMs: samples[0].Timestamp,
+			MaxTimeMs: samples[len(samples)-1].Timestamp,
+			Type:      chunkEncodingXOR,
+			Data:      encodeXORChunk(samples),
+		})
+	}
+	return cs
+}
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// writeFrame writes msg to w as a frame of the streamed read protocol: its
+// uvarint length, its big endian CRC32 (Castagnoli) and itself, then flushes
+// it to the client.
+func writeFrame(w http.ResponseWriter, msg []byte) error {
+	var header [binary.MaxVarintLen64 + 4]byte
+	n := binary.PutUvarint(header[:], uint64(len(msg)))
+	binary.BigEndian.PutUint32(header[n:], crc32.Checksum(msg, castagnoliTable))
+	if _, err := w.Write(header[:n+4]); err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	w.(http.Flusher).Flush()
+	return nil
+}
+
+// streamRead sends the series read by reader as streamed XOR chunks, each
+// series in a frame of its own. It returns whether the response started
+// being sent, after which errors can't be reported with a status code.
+func streamRead(w http.ResponseWriter, r *http.Request, reader client.StreamReader, req *prompb.ReadRequest) (bool, error) {
+	started := false
+	err := reader.ReadStream(req, r, func(queryIndex int, series []*prompb.TimeSeries) error {
+		for _, ts := range series {
+			data, err := proto.Marshal(&chunkedReadResponse{
+				ChunkedSeries: []*chunkedSeries{toChunkedSeries(ts)},
+				QueryIndex:    int64(queryIndex),
+			})
+			if err != nil {
+				return err
+			}
+			if !started {
+				w.Header().Set("Content-Type", streamedReadContentType)
+				started = true
+			}
+			if err := writeFrame(w, data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return started, err
+}
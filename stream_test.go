@@ -0,0 +1,225 @@
+// Copyright 2018 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/require"
+
+	"github.com/criteo/graphite-remote-adapter/client"
+	"github.com/criteo/graphite-remote-adapter/config"
+)
+
+// bitReader reads the bits written by a bitWriter.
+type bitReader struct {
+	b   []byte
+	pos uint
+}
+
+func (r *bitReader) readBits(nbits int) uint64 {
+	var u uint64
+	for ; nbits > 0; nbits-- {
+		bit := r.b[r.pos/8] >> (7 - r.pos%8) & 1
+		u = u<<1 | uint64(bit)
+		r.pos++
+	}
+	return u
+}
+
+func (r *bitReader) ReadByte() (byte, error) {
+	return byte(r.readBits(8)), nil
+}
+
+// decodeXORChunk is the reverse of encodeXORChunk.
+func decodeXORChunk(t *testing.T, data []byte) []*prompb.Sample {
+	n := int(binary.BigEndian.Uint16(data))
+	r := &bitReader{b: data[2:]}
+	var samples []*prompb.Sample
+	var ts, tDelta int64
+	var v uint64
+	var leading, trailing int
+	readValue := func() {
+		if r.readBits(1) == 0 {
+			return
+		}
+		if r.readBits(1) == 1 {
+			leading = int(r.readBits(5))
+			sigbits := int(r.readBits(6))
+			if sigbits == 0 {
+				sigbits = 64
+			}
+			trailing = 64 - leading - sigbits
+		}
+		v ^= r.readBits(64-leading-trailing) << uint(trailing)
+	}
+	for i := 0; i < n; i++ {
+		switch i {
+		case 0:
+			var err error
+			ts, err = binary.ReadVarint(r)
+			require.NoError(t, err)
+			v = r.readBits(64)
+		case 1:
+			d, err := binary.ReadUvarint(r)
+			require.NoError(t, err)
+			tDelta = int64(d)
+			ts += tDelta
+			readValue()
+		default:
+			var nbits int
+			switch {
+			case r.readBits(1) == 0:
+			case r.readBits(1) == 0:
+				nbits = 14
+			case r.readBits(1) == 0:
+				nbits = 17
+			case r.readBits(1) == 0:
+				nbits = 20
+			default:
+				nbits = 64
+			}
+			if nbits > 0 {
+				dod := int64(r.readBits(nbits))
+				if nbits < 64 && dod > 1<<uint(nbits-1) {
+					dod -= 1 << uint(nbits)
+				}
+				tDelta += dod
+			}
+			ts += tDelta
+			readValue()
+		}
+		samples = append(samples, &prompb.Sample{Timestamp: ts, Value: math.Float64frombits(v)})
+	}
+	return samples
+}
+
+func TestXORChunkRoundTrip(t *testing.T) {
+	var samples []*prompb.Sample
+	ts := int64(1500000000000)
+	for i, step := range []int64{0, 15000, 15000, 15001, 14000, 30000, 3600000, 15000, 1, 100000000000} {
+		ts += step
+		value := []float64{1, 1, 2.5, -3, 1e300, 0, math.Inf(1), 42, 42.5, 7}[i]
+		samples = append(samples, &prompb.Sample{Timestamp: ts, Value: value})
+	}
+	require.Equal(t, samples, decodeXORChunk(t, encodeXORChunk(samples)))
+}
+
+// streamingStorage is a remote storage streaming its series.
+type streamingStorage struct {
+	fakeStorage
+	series []*prompb.TimeSeries
+}
+
+func (s *streamingStorage) ReadStream(req *prompb.ReadRequest, r *http.Request, send func(int, []*prompb.TimeSeries) error) error {
+	for i := range req.Queries {
+		for _, ts := range s.series {
+			if err := send(i, []*prompb.TimeSeries{ts}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readRequest returns a read request of one query, accepting streamed XOR
+// chunks if streamed.
+func readRequest(t *testing.T, streamed bool) *http.Request {
+	data, err := proto.Marshal(&prompb.ReadRequest{Queries: []*prompb.Query{{}}})
+	require.NoError(t, err)
+	if streamed {
+		// accepted_response_types: [SAMPLES, STREAMED_XOR_CHUNKS]
+		data = append(data, 0x12, 0x02, 0x00, 0x01)
+	}
+	r, err := http.NewRequest("POST", "/read", bytes.NewReader(snappy.Encode(nil, data)))
+	require.NoError(t, err)
+	return r
+}
+
+func TestStreamedRead(t *testing.T) {
+	var samples []*prompb.Sample
+	for i := 0; i < 150; i++ {
+		samples = append(samples, &prompb.Sample{Timestamp: int64(i) * 15000, Value: float64(i)})
+	}
+	storage := &streamingStorage{series: []*prompb.TimeSeries{
+		{Labels: []*prompb.Label{{Name: "__name__", Value: "a"}}, Samples: samples},
+		{Labels: []*prompb.Label{{Name: "__name__", Value: "b"}}, Samples: samples[:1]},
+	}}
+	server := &Server{cfg: &config.DefaultConfig, readers: []client.Reader{storage}}
+
+	w := httptest.NewRecorder()
+	server.Read(log.NewNopLogger(), w, readRequest(t, true))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, streamedReadContentType, w.Header().Get("Content-Type"))
+
+	body := bufio.NewReader(w.Body)
+	for _, expected := range storage.series {
+		size, err := binary.ReadUvarint(body)
+		require.NoError(t, err)
+		var sum uint32
+		require.NoError(t, binary.Read(body, binary.BigEndian, &sum))
+		msg := make([]byte, size)
+		_, err = io.ReadFull(body, msg)
+		require.NoError(t, err)
+		require.Equal(t, crc32.Checksum(msg, castagnoliTable), sum)
+
+		var resp chunkedReadResponse
+		require.NoError(t, proto.Unmarshal(msg, &resp))
+		require.Len(t, resp.ChunkedSeries, 1)
+		require.Equal(t, expected.Labels, resp.ChunkedSeries[0].Labels)
+		var decoded []*prompb.Sample
+		for _, c := range resp.ChunkedSeries[0].Chunks {
+			require.Equal(t, int32(chunkEncodingXOR), c.Type)
+			chunkSamples := decodeXORChunk(t, c.Data)
+			require.Equal(t, chunkSamples[0].Timestamp, c.MinTimeMs)
+			require.Equal(t, chunkSamples[len(chunkSamples)-1].Timestamp, c.MaxTimeMs)
+			decoded = append(decoded, chunkSamples...)
+		}
+		require.Equal(t, expected.Samples, decoded)
+	}
+	_, err := body.ReadByte()
+	require.Equal(t, io.EOF, err)
+}
+
+func TestStreamedReadFallback(t *testing.T) {
+	storage := &streamingStorage{series: []*prompb.TimeSeries{
+		{Labels: []*prompb.Label{{Name: "__name__", Value: "a"}}},
+	}}
+	server := &Server{cfg: &config.DefaultConfig, readers: []client.Reader{storage}}
+
+	// Clients not negotiating streaming get a buffered response.
+	w := httptest.NewRecorder()
+	server.Read(log.NewNopLogger(), w, readRequest(t, false))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "application/x-protobuf", w.Header().Get("Content-Type"))
+	require.Equal(t, "snappy", w.Header().Get("Content-Encoding"))
+
+	// So do readers not supporting it.
+	server.readers = []client.Reader{&fakeStorage{}}
+	w = httptest.NewRecorder()
+	server.Read(log.NewNopLogger(), w, readRequest(t, true))
+	require.Equal(t, "application/x-protobuf", w.Header().Get("Content-Type"))
+}
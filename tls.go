@@ -0,0 +1,66 @@
+// Copyright 2018 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/criteo/graphite-remote-adapter/config"
+)
+
+// newTLSConfig loads the certificates of the web TLS configuration of cfg.
+func newTLSConfig(cfg *config.Config) (*tls.Config, error) {
+	opts := cfg.Web.TLS
+	cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load the web certificate: %s", err)
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if opts.MinVersion != "" {
+		tlsConfig.MinVersion = config.TLSVersions[opts.MinVersion]
+	}
+
+	if opts.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(opts.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load the web client CA: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", opts.ClientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// getConfigForClient returns the TLS configuration of the last loaded
+// config, so that certificates are reloaded along with it.
+func (s *Server) getConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if s.tlsConfig == nil {
+		return nil, fmt.Errorf("tls was disabled by a config reload, restart needed")
+	}
+	return s.tlsConfig, nil
+}
@@ -0,0 +1,161 @@
+// Copyright 2018 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+
+	"github.com/criteo/graphite-remote-adapter/config"
+)
+
+// writeCertificate writes a self-signed certificate for name and its key
+// in dir, and returns them.
+func writeCertificate(t *testing.T, dir, name string, serial int64) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name+".crt"), certPEM, 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name+".key"), keyPEM, 0600))
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	require.NoError(t, err)
+	return cert
+}
+
+// serveTLS serves with the TLS configuration of server, as Serve does.
+func serveTLS(t *testing.T, server *Server) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	tlsListener := tls.NewListener(l, &tls.Config{GetConfigForClient: server.getConfigForClient})
+	go http.Serve(tlsListener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	return tlsListener
+}
+
+func tlsClient(ca tls.Certificate, certs ...tls.Certificate) *http.Client {
+	pool := x509.NewCertPool()
+	leaf, _ := x509.ParseCertificate(ca.Certificate[0])
+	pool.AddCert(leaf)
+	return &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: pool, Certificates: certs},
+	}}
+}
+
+func TestServeTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "web-tls")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cfg, err := config.Load(`
+web:
+  tls:
+    cert_file: ` + filepath.Join(dir, "server.crt") + `
+    key_file: ` + filepath.Join(dir, "server.key") + `
+`)
+	require.NoError(t, err)
+
+	logger := log.NewNopLogger()
+	server := &Server{}
+	// Certificates are loaded with the config.
+	require.Error(t, server.ReloadConfig(logger, cfg))
+
+	first := writeCertificate(t, dir, "server", 1)
+	require.NoError(t, server.ReloadConfig(logger, cfg))
+	l := serveTLS(t, server)
+	defer l.Close()
+
+	resp, err := tlsClient(first).Get("https://" + l.Addr().String())
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// New certificates are served once the config is reloaded.
+	second := writeCertificate(t, dir, "server", 2)
+	_, err = tlsClient(second).Get("https://" + l.Addr().String())
+	require.Error(t, err)
+	require.NoError(t, server.ReloadConfig(logger, cfg))
+	resp, err = tlsClient(second).Get("https://" + l.Addr().String())
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, int64(2), resp.TLS.PeerCertificates[0].SerialNumber.Int64())
+}
+
+func TestServeMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "web-tls")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	serverCert := writeCertificate(t, dir, "server", 1)
+	trusted := writeCertificate(t, dir, "prometheus", 2)
+	untrusted := writeCertificate(t, dir, "intruder", 3)
+
+	cfg, err := config.Load(`
+web:
+  tls:
+    cert_file: ` + filepath.Join(dir, "server.crt") + `
+    key_file: ` + filepath.Join(dir, "server.key") + `
+    client_ca_file: ` + filepath.Join(dir, "prometheus.crt") + `
+    min_version: TLS12
+`)
+	require.NoError(t, err)
+
+	server := &Server{}
+	require.NoError(t, server.ReloadConfig(log.NewNopLogger(), cfg))
+	l := serveTLS(t, server)
+	defer l.Close()
+
+	resp, err := tlsClient(serverCert, trusted).Get("https://" + l.Addr().String())
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	_, err = tlsClient(serverCert, untrusted).Get("https://" + l.Addr().String())
+	require.Error(t, err)
+
+	_, err = tlsClient(serverCert).Get("https://" + l.Addr().String())
+	require.Error(t, err)
+}
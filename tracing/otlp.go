@@ -0,0 +1,235 @@
+// Copyright 2018 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+const (
+	serviceName = "graphite-remote-adapter"
+
+	// Spans are sent by batches of at most otlpBatchSize spans, at least
+	// every otlpFlushInterval.
+	otlpBatchSize     = 512
+	otlpFlushInterval = 5 * time.Second
+	// Spans are dropped once otlpMaxPendingSpans are waiting to be sent,
+	// e.g. while the collector is unreachable.
+	otlpMaxPendingSpans = 4 * otlpBatchSize
+
+	// OTLP status codes.
+	otlpStatusOk    = 1
+	otlpStatusError = 2
+)
+
+// OTLPExporter sends spans to an OpenTelemetry collector with OTLP over HTTP,
+// using the JSON encoding.
+type OTLPExporter struct {
+	endpoint string
+	client   *http.Client
+	logger   log.Logger
+
+	lock    sync.Mutex
+	spans   []SpanData
+	dropped int
+
+	// flush asks the loop to send a full batch.
+	flush chan struct{}
+	quit  chan struct{}
+	done  chan struct{}
+}
+
+// NewOTLPExporter returns an exporter sending spans to endpoint, the URL of
+// the traces endpoint of the collector (e.g. http://localhost:4318/v1/traces).
+func NewOTLPExporter(endpoint string, logger log.Logger) *OTLPExporter {
+	e := &OTLPExporter{
+		endpoint: endpoint,
+		client:   &http.Client{Timeout: otlpFlushInterval},
+		logger:   logger,
+		flush:    make(chan struct{}, 1),
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go e.loop()
+	return e
+}
+
+// ExportSpan implements the Exporter interface. Spans are sent by the loop
+// of the exporter, so that a slow collector never delays the requests.
+func (e *OTLPExporter) ExportSpan(span SpanData) {
+	e.lock.Lock()
+	if len(e.spans) >= otlpMaxPendingSpans {
+		e.dropped++
+		e.lock.Unlock()
+		return
+	}
+	e.spans = append(e.spans, span)
+	full := len(e.spans) >= otlpBatchSize
+	e.lock.Unlock()
+	if full {
+		select {
+		case e.flush <- struct{}{}:
+		default:
+			// A flush is already pending.
+		}
+	}
+}
+
+func (e *OTLPExporter) loop() {
+	defer close(e.done)
+
+	ticker := time.NewTicker(otlpFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			e.Flush()
+		case <-e.flush:
+			e.Flush()
+		case <-e.quit:
+			e.Flush()
+			return
+		}
+	}
+}
+
+// Close sends the remaining spans and stops the exporter.
+func (e *OTLPExporter) Close() {
+	close(e.quit)
+	<-e.done
+}
+
+// Flush sends the pending spans to the collector. Spans failing to be sent
+// are dropped.
+func (e *OTLPExporter) Flush() {
+	e.lock.Lock()
+	spans, dropped := e.spans, e.dropped
+	e.spans, e.dropped = nil, 0
+	e.lock.Unlock()
+	if dropped > 0 {
+		level.Warn(e.logger).Log(
+			"endpoint", e.endpoint, "spans", dropped,
+			"msg", "Too many spans waiting to be exported, dropped them")
+	}
+	if len(spans) == 0 {
+		return
+	}
+
+	if err := e.send(spans); err != nil {
+		level.Warn(e.logger).Log(
+			"endpoint", e.endpoint, "spans", len(spans), "err", err,
+			"msg", "Error exporting spans, dropping them")
+	}
+}
+
+func (e *OTLPExporter) send(spans []SpanData) error {
+	body, err := json.Marshal(otlpRequest(spans))
+	if err != nil {
+		return err
+	}
+	resp, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("server returned HTTP status %s", resp.Status)
+	}
+	return nil
+}
+
+type otlpAttribute struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+func attributes(m map[string]string) []otlpAttribute {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	attrs := make([]otlpAttribute, len(keys))
+	for i, k := range keys {
+		attrs[i].Key = k
+		attrs[i].Value.StringValue = m[k]
+	}
+	return attrs
+}
+
+// otlpRequest builds the ExportTraceServiceRequest holding spans.
+func otlpRequest(spans []SpanData) map[string]interface{} {
+	converted := make([]otlpSpan, len(spans))
+	for i, s := range spans {
+		converted[i] = otlpSpan{
+			TraceID:           hex.EncodeToString(s.TraceID[:]),
+			SpanID:            hex.EncodeToString(s.SpanID[:]),
+			Name:              s.Name,
+			Kind:              1, // SPAN_KIND_INTERNAL
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+			Attributes:        attributes(s.Attributes),
+			Status:            otlpStatus{Code: otlpStatusOk},
+		}
+		if s.ParentSpanID != [8]byte{} {
+			converted[i].ParentSpanID = hex.EncodeToString(s.ParentSpanID[:])
+		}
+		if s.Error != "" {
+			converted[i].Status = otlpStatus{Code: otlpStatusError, Message: s.Error}
+		}
+	}
+
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": attributes(map[string]string{"service.name": serviceName}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": serviceName},
+				"spans": converted,
+			}},
+		}},
+	}
+}
@@ -0,0 +1,36 @@
+// Copyright 2018 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing
+
+import "sync"
+
+// Recorder is an exporter keeping the ended spans in memory, for tests.
+type Recorder struct {
+	lock  sync.Mutex
+	spans []SpanData
+}
+
+// ExportSpan implements the Exporter interface.
+func (r *Recorder) ExportSpan(span SpanData) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.spans = append(r.spans, span)
+}
+
+// Spans returns the spans ended so far, in the order they ended.
+func (r *Recorder) Spans() []SpanData {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]SpanData{}, r.spans...)
+}
@@ -0,0 +1,206 @@
+// Copyright 2018 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tracing is a minimal OpenTelemetry compatible tracer: spans are
+// propagated with the W3C traceparent header and exported with OTLP.
+package tracing
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const traceparentHeader = "traceparent"
+
+// SpanContext identifies a span within a trace.
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+}
+
+// IsValid tells whether sc identifies a span.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// SpanData is an ended span, as given to exporters.
+type SpanData struct {
+	Name         string
+	TraceID      [16]byte
+	SpanID       [8]byte
+	ParentSpanID [8]byte
+	Start        time.Time
+	End          time.Time
+	Attributes   map[string]string
+	Error        string
+}
+
+// Exporter sends ended spans to a tracing backend.
+type Exporter interface {
+	ExportSpan(span SpanData)
+}
+
+var (
+	lock     sync.RWMutex
+	exporter Exporter
+)
+
+// SetExporter sets the exporter of the ended spans. Tracing is disabled
+// while it is nil.
+func SetExporter(e Exporter) {
+	lock.Lock()
+	defer lock.Unlock()
+	exporter = e
+}
+
+func currentExporter() Exporter {
+	lock.RLock()
+	defer lock.RUnlock()
+	return exporter
+}
+
+// Span is an operation being traced. A nil Span, returned when tracing is
+// disabled, can be used and does nothing.
+type Span struct {
+	lock     sync.Mutex
+	data     SpanData
+	exporter Exporter
+}
+
+type spanContextKey struct{}
+
+// StartSpan starts a span named name, child of the span in ctx if any, and
+// returns a context holding it.
+func StartSpan(ctx context.Context, name string) (context.Context, *Span) {
+	e := currentExporter()
+	if e == nil {
+		return ctx, nil
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	s := &Span{
+		data: SpanData{
+			Name:       name,
+			Start:      time.Now(),
+			Attributes: map[string]string{},
+		},
+		exporter: e,
+	}
+	if parent := SpanContextFromContext(ctx); parent.IsValid() {
+		s.data.TraceID = parent.TraceID
+		s.data.ParentSpanID = parent.SpanID
+	} else {
+		rand.Read(s.data.TraceID[:])
+	}
+	rand.Read(s.data.SpanID[:])
+	return ContextWithSpanContext(ctx, s.SpanContext()), s
+}
+
+// SpanContext returns the identifiers of s.
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return SpanContext{TraceID: s.data.TraceID, SpanID: s.data.SpanID}
+}
+
+// SetAttribute annotates s.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.data.Attributes[key] = fmt.Sprint(value)
+}
+
+// SetError marks s as failed if err isn't nil.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.data.Error = err.Error()
+}
+
+// End ends s and exports it.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	s.data.End = time.Now()
+	data := s.data
+	s.lock.Unlock()
+	s.exporter.ExportSpan(data)
+}
+
+// ContextWithSpanContext returns a copy of ctx holding sc.
+func ContextWithSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, spanContextKey{}, sc)
+}
+
+// SpanContextFromContext returns the span context held by ctx, if any.
+func SpanContextFromContext(ctx context.Context) SpanContext {
+	if ctx == nil {
+		return SpanContext{}
+	}
+	sc, _ := ctx.Value(spanContextKey{}).(SpanContext)
+	return sc
+}
+
+// Extract returns the context of r, holding the span context of its
+// traceparent header if it has a valid one.
+func Extract(r *http.Request) context.Context {
+	ctx := context.Context(r.Context())
+	parts := strings.Split(r.Header.Get(traceparentHeader), "-")
+	if len(parts) != 4 || parts[0] != "00" {
+		return ctx
+	}
+	var sc SpanContext
+	traceID, err := hex.DecodeString(parts[1])
+	if err != nil || len(traceID) != len(sc.TraceID) {
+		return ctx
+	}
+	spanID, err := hex.DecodeString(parts[2])
+	if err != nil || len(spanID) != len(sc.SpanID) {
+		return ctx
+	}
+	copy(sc.TraceID[:], traceID)
+	copy(sc.SpanID[:], spanID)
+	if !sc.IsValid() {
+		return ctx
+	}
+	return ContextWithSpanContext(ctx, sc)
+}
+
+// Inject sets the traceparent header of an outgoing request to the span
+// context held by ctx, if any.
+func Inject(ctx context.Context, h http.Header) {
+	sc := SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return
+	}
+	h.Set(traceparentHeader, fmt.Sprintf("00-%s-%s-01",
+		hex.EncodeToString(sc.TraceID[:]), hex.EncodeToString(sc.SpanID[:])))
+}
@@ -0,0 +1,153 @@
+// Copyright 2018 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+const traceparent = "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+
+func TestExtractInject(t *testing.T) {
+	r, err := http.NewRequest("GET", "/", nil)
+	require.NoError(t, err)
+	r.Header.Set("traceparent", traceparent)
+
+	h := http.Header{}
+	Inject(Extract(r), h)
+	require.Equal(t, traceparent, h.Get("traceparent"))
+
+	for _, invalid := range []string{
+		"",
+		"garbage",
+		"01-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+		"00-0af7651916cd43dd-b7ad6b7169203331-01",
+		"00-00000000000000000000000000000000-b7ad6b7169203331-01",
+	} {
+		r.Header.Set("traceparent", invalid)
+		require.False(t, SpanContextFromContext(Extract(r)).IsValid(), invalid)
+		h := http.Header{}
+		Inject(Extract(r), h)
+		require.Empty(t, h.Get("traceparent"), invalid)
+	}
+}
+
+func TestStartSpanDisabled(t *testing.T) {
+	SetExporter(nil)
+	ctx, span := StartSpan(context.Background(), "noop")
+	require.Nil(t, span)
+	require.False(t, SpanContextFromContext(ctx).IsValid())
+
+	// A nil span can be used.
+	span.SetAttribute("key", "value")
+	span.SetError(errors.New("error"))
+	span.End()
+}
+
+func TestStartSpanHierarchy(t *testing.T) {
+	recorder := &Recorder{}
+	SetExporter(recorder)
+	defer SetExporter(nil)
+
+	ctx, parent := StartSpan(context.Background(), "parent")
+	_, child := StartSpan(ctx, "child")
+	child.SetAttribute("answer", 42)
+	child.SetError(errors.New("failed"))
+	child.End()
+	parent.End()
+
+	spans := recorder.Spans()
+	require.Len(t, spans, 2)
+	require.Equal(t, "child", spans[0].Name)
+	require.Equal(t, "parent", spans[1].Name)
+	require.Equal(t, spans[1].TraceID, spans[0].TraceID)
+	require.Equal(t, spans[1].SpanID, spans[0].ParentSpanID)
+	require.Equal(t, [8]byte{}, spans[1].ParentSpanID)
+	require.Equal(t, map[string]string{"answer": "42"}, spans[0].Attributes)
+	require.Equal(t, "failed", spans[0].Error)
+}
+
+func TestOTLPExporter(t *testing.T) {
+	bodies := make(chan []byte, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		bodies <- body
+	}))
+	defer server.Close()
+
+	e := NewOTLPExporter(server.URL, log.NewNopLogger())
+	SetExporter(e)
+	defer SetExporter(nil)
+
+	r, err := http.NewRequest("GET", "/", nil)
+	require.NoError(t, err)
+	r.Header.Set("traceparent", traceparent)
+	_, span := StartSpan(Extract(r), "write")
+	span.SetAttribute("samples", 3)
+	span.End()
+	e.Close()
+
+	var req struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []otlpSpan
+			}
+		}
+	}
+	require.NoError(t, json.Unmarshal(<-bodies, &req))
+	spans := req.ResourceSpans[0].ScopeSpans[0].Spans
+	require.Len(t, spans, 1)
+	require.Equal(t, "write", spans[0].Name)
+	require.Equal(t, "0af7651916cd43dd8448eb211c80319c", spans[0].TraceID)
+	require.Equal(t, "b7ad6b7169203331", spans[0].ParentSpanID)
+	require.Equal(t, "samples", spans[0].Attributes[0].Key)
+	require.Equal(t, "3", spans[0].Attributes[0].Value.StringValue)
+	require.Equal(t, otlpStatusOk, spans[0].Status.Code)
+}
+
+func TestOTLPExporterSlowCollector(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	e := NewOTLPExporter(server.URL, log.NewNopLogger())
+
+	// At most one flush is stuck on the collector, the other spans pile up.
+	start := time.Now()
+	for i := 0; i < 3*otlpMaxPendingSpans; i++ {
+		e.ExportSpan(SpanData{Name: "write"})
+	}
+	require.True(t, time.Since(start) < otlpFlushInterval)
+	e.lock.Lock()
+	pending, dropped := len(e.spans), e.dropped
+	e.lock.Unlock()
+	require.Equal(t, otlpMaxPendingSpans, pending)
+	require.True(t, dropped >= otlpMaxPendingSpans)
+
+	close(release)
+	e.Close()
+}
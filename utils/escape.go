@@ -15,8 +15,8 @@ package utils
 
 import (
 	"bytes"
-	"fmt"
 	"strings"
+	"unicode/utf8"
 )
 
 const (
@@ -78,24 +78,215 @@ const (
 //
 // "日" -> "%E6%97%A5"
 func Escape(tv string) string {
-	length := len(tv)
-	result := bytes.NewBuffer(make([]byte, 0, length))
-	for i := 0; i < length; i++ {
+	i := 0
+	for i < len(tv) && escapeTable[tv[i]] == escapeCopy {
+		i++
+	}
+	if i == len(tv) {
+		return tv
+	}
+
+	result := make([]byte, i, len(tv)+8)
+	copy(result, tv[:i])
+	for ; i < len(tv); i++ {
 		b := tv[i]
+		switch escapeTable[b] {
+		case escapeCopy:
+			result = append(result, b)
+		case escapeBackslash:
+			result = append(result, '\\', b)
+		default:
+			// Like "%%%X", bytes under 0x10 only take one digit.
+			result = append(result, '%')
+			if b >= 0x10 {
+				result = append(result, upperHex[b>>4])
+			}
+			result = append(result, upperHex[b&0xF])
+		}
+	}
+	return string(result)
+}
+
+const upperHex = "0123456789ABCDEF"
+
+// How Escape handles each byte.
+const (
+	escapeCopy = iota
+	escapeBackslash
+	escapePercent
+)
+
+// escapeTable holds how Escape handles each byte, so that escaping is a
+// table lookup per byte.
+var escapeTable = func() (table [256]uint8) {
+	for i := range table {
+		b := byte(i)
 		switch {
 		// . is reserved by graphite, % is used to escape other bytes.
 		case b == '.' || b == '%' || b == '/' || b == '=':
-			fmt.Fprintf(result, "%%%X", b)
+			table[i] = escapePercent
 		// These symbols are ok only if backslash escaped.
 		case strings.IndexByte(symbols, b) != -1:
-			result.WriteString("\\" + string(b))
+			table[i] = escapeBackslash
 		// These are all fine.
 		case strings.IndexByte(printables, b) != -1:
-			result.WriteByte(b)
+			table[i] = escapeCopy
 		// Defaults to percent-encoding.
 		default:
-			fmt.Fprintf(result, "%%%X", b)
+			table[i] = escapePercent
+		}
+	}
+	return table
+}()
+
+// Escaping policies supported by EscapeWithPolicy.
+const (
+	EscapePercent    = "percent"
+	EscapeUnderscore = "underscore"
+	EscapeNone       = "none"
+)
+
+// EscapeWithPolicy escapes tv according to policy:
+//
+// - "percent" (or empty) is the Escape encoding.
+//
+// - "underscore" replaces every rune that Escape would encode with '_'.
+//
+// - "none" leaves tv untouched.
+//
+// If replacement isn't empty, it is used as-is in place of '.' and '/'.
+func EscapeWithPolicy(tv string, policy string, replacement string) string {
+	if replacement == "" {
+		return escapeWithPolicy(tv, policy)
+	}
+
+	result := bytes.NewBuffer(make([]byte, 0, len(tv)))
+	start := 0
+	for i := 0; i < len(tv); i++ {
+		if tv[i] == '.' || tv[i] == '/' {
+			result.WriteString(escapeWithPolicy(tv[start:i], policy))
+			result.WriteString(replacement)
+			start = i + 1
 		}
 	}
+	result.WriteString(escapeWithPolicy(tv[start:], policy))
 	return result.String()
 }
+
+func escapeWithPolicy(tv string, policy string) string {
+	switch policy {
+	case EscapeNone:
+		return tv
+	case EscapeUnderscore:
+		return escapeUnderscore(tv)
+	default:
+		return Escape(tv)
+	}
+}
+
+func escapeUnderscore(tv string) string {
+	i := 0
+	for i < len(tv) && escapeTable[tv[i]] == escapeCopy {
+		i++
+	}
+	if i == len(tv) {
+		return tv
+	}
+
+	result := make([]byte, i, len(tv))
+	copy(result, tv[:i])
+	// Same as Escape, everything that isn't directly copied is replaced,
+	// multi-byte runes by a single '_'.
+	for _, r := range tv[i:] {
+		if r < utf8.RuneSelf && escapeTable[r] == escapeCopy {
+			result = append(result, byte(r))
+		} else {
+			result = append(result, '_')
+		}
+	}
+	return string(result)
+}
+
+// Bytes that carbon reserves in tag names and values, see
+// http://graphite.readthedocs.io/en/latest/tags.html
+const (
+	tagNameReserved  = ";!^="
+	tagValueReserved = ";="
+)
+
+// EscapeTagName substitutes the bytes carbon doesn't accept in tag names:
+// they are percent-encoded with the "percent" policy and replaced by '_'
+// otherwise.
+func EscapeTagName(name string, policy string) string {
+	return escapeReserved(name, tagNameReserved, policy)
+}
+
+// EscapeTagValue is EscapeTagName for tag values, and for the series name
+// that carbon stores as the "name" tag. Values can't start with '~' either.
+func EscapeTagValue(value string, policy string) string {
+	value = escapeReserved(value, tagValueReserved, policy)
+	if strings.HasPrefix(value, "~") {
+		return escapeReserved(value[:1], "~", policy) + value[1:]
+	}
+	return value
+}
+
+func escapeReserved(s string, reserved string, policy string) string {
+	if !strings.ContainsAny(s, reserved) {
+		return s
+	}
+
+	result := make([]byte, 0, len(s)+8)
+	for i := 0; i < len(s); i++ {
+		b := s[i]
+		switch {
+		case strings.IndexByte(reserved, b) == -1:
+			result = append(result, b)
+		case policy == "" || policy == EscapePercent:
+			result = append(result, '%', upperHex[b>>4], upperHex[b&0xF])
+		default:
+			result = append(result, '_')
+		}
+	}
+	return string(result)
+}
+
+// Unescape reverses Escape, and the percent-encoding of EscapeTagName and
+// EscapeTagValue. Since Escape encodes the bytes under 0x10 with a single
+// hexadecimal digit, two digits are always decoded when possible.
+func Unescape(s string) string {
+	if strings.IndexByte(s, '%') == -1 && strings.IndexByte(s, '\\') == -1 {
+		return s
+	}
+
+	result := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		switch b := s[i]; {
+		case b == '\\' && i+1 < len(s):
+			i++
+			result = append(result, s[i])
+		case b == '%' && i+1 < len(s) && unhex(s[i+1]) >= 0:
+			v := unhex(s[i+1])
+			i++
+			if i+1 < len(s) && unhex(s[i+1]) >= 0 {
+				v = v<<4 | unhex(s[i+1])
+				i++
+			}
+			result = append(result, byte(v))
+		default:
+			result = append(result, b)
+		}
+	}
+	return string(result)
+}
+
+// unhex returns the value of the uppercase hexadecimal digit b, or -1.
+func unhex(b byte) int {
+	switch {
+	case '0' <= b && b <= '9':
+		return int(b - '0')
+	case 'A' <= b && b <= 'F':
+		return int(b-'A') + 10
+	}
+	return -1
+}
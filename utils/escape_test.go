@@ -34,3 +34,95 @@ func TestEscape(t *testing.T) {
 		t.Errorf("Expected %s, got %s", expected, actual)
 	}
 }
+
+func TestEscapeWithPolicy(t *testing.T) {
+	value := "é/|_;:%."
+	for _, tc := range []struct {
+		policy, replacement, expected string
+	}{
+		{"", "", "%C3%A9%2F|_;:%25%2E"},
+		{EscapePercent, "", "%C3%A9%2F|_;:%25%2E"},
+		{EscapePercent, "-", "%C3%A9-|_;:%25-"},
+		{EscapeUnderscore, "", "__|_;:__"},
+		{EscapeNone, "", "é/|_;:%."},
+		{EscapeNone, "_", "é_|_;:%_"},
+	} {
+		actual := EscapeWithPolicy(value, tc.policy, tc.replacement)
+		if tc.expected != actual {
+			t.Errorf("%s/%s: expected %s, got %s", tc.policy, tc.replacement, tc.expected, actual)
+		}
+	}
+}
+
+func TestEscapeTag(t *testing.T) {
+	for _, tc := range []struct {
+		policy, name, value string
+	}{
+		{EscapePercent, "a%3Db%21c%5Ed%3Be", "%7Ea~b%3Dc%3Bd"},
+		{EscapeUnderscore, "a_b_c_d_e", "_a~b_c_d"},
+		{EscapeNone, "a_b_c_d_e", "_a~b_c_d"},
+	} {
+		if actual := EscapeTagName("a=b!c^d;e", tc.policy); actual != tc.name {
+			t.Errorf("%s: expected name %s, got %s", tc.policy, tc.name, actual)
+		}
+		if actual := EscapeTagValue("~a~b=c;d", tc.policy); actual != tc.value {
+			t.Errorf("%s: expected value %s, got %s", tc.policy, tc.value, actual)
+		}
+	}
+}
+
+func TestUnescape(t *testing.T) {
+	for _, value := range []string{
+		"foo-bar-42",
+		"http://example.org:8080",
+		"Björn's email: bjoern@soundcloud.com",
+		"abc!ABC:012-3!45ö67~89./(){},=.\"\\",
+		"日",
+		"%",
+		"",
+	} {
+		if actual := Unescape(Escape(value)); actual != value {
+			t.Errorf("%q: escaped as %s, unescaped as %q", value, Escape(value), actual)
+		}
+		escaped := EscapeTagValue(EscapeTagName(Escape(value), EscapePercent), EscapePercent)
+		if actual := Unescape(escaped); actual != value {
+			t.Errorf("%q: escaped as tag %s, unescaped as %q", value, escaped, actual)
+		}
+	}
+}
+
+func TestEscapeUnchanged(t *testing.T) {
+	for value, expected := range map[string]string{
+		"foo-bar-42":              "foo-bar-42",
+		"a b\n\x7f":               "a%20b%A%7F",
+		"Björn's email: b@sc.com": "Bj%C3%B6rn\\'s%20email:%20b@sc%2Ecom",
+		"":                        "",
+	} {
+		if actual := Escape(value); actual != expected {
+			t.Errorf("%q: expected %s, got %s", value, expected, actual)
+		}
+	}
+
+	for value, expected := range map[string]string{
+		"foo-bar-42": "foo-bar-42",
+		"a b\n日\xff": "a_b___",
+	} {
+		if actual := EscapeWithPolicy(value, EscapeUnderscore, ""); actual != expected {
+			t.Errorf("%q: expected %s, got %s", value, expected, actual)
+		}
+	}
+}
+
+func BenchmarkEscape(b *testing.B) {
+	for name, value := range map[string]string{
+		"plain":   "node-exporter-42",
+		"escaped": "http://example.org:8080/Björn",
+	} {
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				Escape(value)
+			}
+		})
+	}
+}
@@ -14,15 +14,21 @@
 package utils
 
 import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
+	"github.com/golang/snappy"
 
 	"golang.org/x/net/context"
 	"golang.org/x/net/context/ctxhttp"
+
+	"github.com/criteo/graphite-remote-adapter/tracing"
 )
 
 // PrepareURL return an url.URL from it's parameters
@@ -44,20 +50,50 @@ func PrepareURL(schemeHost string, path string, params map[string]string) (*url.
 }
 
 // FetchURL return body of a fetched url.URL
-func FetchURL(ctx context.Context, logger log.Logger, u *url.URL) ([]byte, error) {
+func FetchURL(ctx context.Context, client *http.Client, logger log.Logger, u *url.URL) ([]byte, error) {
 	level.Debug(logger).Log("url", u, "context", ctx, "msg", "Fetching URL")
 
-	hresp, err := ctxhttp.Get(ctx, http.DefaultClient, u.String())
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	tracing.Inject(ctx, req.Header)
+	// Render responses are large, ask for them compressed.
+	req.Header.Set("Accept-Encoding", "gzip, snappy")
+
+	hresp, err := ctxhttp.Do(ctx, client, req)
 	if err != nil {
 		return nil, err
 	}
 	defer hresp.Body.Close()
 
 	body, err := ioutil.ReadAll(hresp.Body)
-	level.Debug(logger).Log("len(body)", len(body), "err", err, "msg", "Fetching URL")
+	level.Debug(logger).Log(
+		"len(body)", len(body), "encoding", hresp.Header.Get("Content-Encoding"),
+		"err", err, "msg", "Fetching URL")
 	if err != nil {
 		return nil, err
 	}
 
-	return body, nil
+	return decodeBody(body, hresp.Header.Get("Content-Encoding"))
+}
+
+// decodeBody decompresses a response body according to its Content-Encoding.
+// Snappy bodies use the block format, as in the Prometheus remote protocols.
+func decodeBody(body []byte, encoding string) ([]byte, error) {
+	switch encoding {
+	case "", "identity":
+		return body, nil
+	case "gzip":
+		r, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	case "snappy":
+		return snappy.Decode(nil, body)
+	default:
+		return nil, fmt.Errorf("unsupported content encoding: %s", encoding)
+	}
 }
@@ -22,6 +22,21 @@ func replace(input interface{}, from string, to string) string {
 	return strings.Replace(input.(string), from, to, -1)
 }
 
+// The functions below take their input last, so that they compose with
+// pipes: {{ .labels.owner | lower | replaceAll "-" "_" }}.
+
+func replaceAll(from string, to string, input string) string {
+	return strings.Replace(input, from, to, -1)
+}
+
+func trimPrefix(prefix string, input string) string {
+	return strings.TrimPrefix(input, prefix)
+}
+
+func trimSuffix(suffix string, input string) string {
+	return strings.TrimSuffix(input, suffix)
+}
+
 func split(input interface{}, delimiter string) ([]string, error) {
 	return strings.Split(input.(string), delimiter), nil
 }
@@ -32,7 +47,26 @@ func escape(input interface{}) string {
 
 // TmplFuncMap expose custom go template functions
 var TmplFuncMap = template.FuncMap{
-	"replace": replace,
-	"split":   split,
-	"escape":  escape,
+	"replace":    replace,
+	"replaceAll": replaceAll,
+	"split":      split,
+	"escape":     escape,
+	"lower":      strings.ToLower,
+	"upper":      strings.ToUpper,
+	"trimPrefix": trimPrefix,
+	"trimSuffix": trimSuffix,
+}
+
+// MetricFuncs are the template functions bound to the labels of the metric
+// when executing write templates. They are only declared here, so that
+// templates using them parse.
+var MetricFuncs = template.FuncMap{
+	"labelsJoined": func(sep string, names ...string) string { return "" },
+	"hasLabel":     func(name string) bool { return false },
+}
+
+func init() {
+	for name, f := range MetricFuncs {
+		TmplFuncMap[name] = f
+	}
 }
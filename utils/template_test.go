@@ -0,0 +1,48 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"bytes"
+	"testing"
+	"text/template"
+)
+
+func TestTmplStringFuncs(t *testing.T) {
+	data := map[string]interface{}{
+		"labels": map[string]string{"owner": "Team-X", "job": "prom-node"},
+	}
+	for tmpl, expected := range map[string]string{
+		`{{ .labels.owner | lower | replaceAll "-" "_" }}`:        "team_x",
+		`{{ .labels.owner | upper }}`:                             "TEAM-X",
+		`{{ replace .labels.job "-" "." }}`:                       "prom.node",
+		`{{ replaceAll "-" "." .labels.job }}`:                    "prom.node",
+		`{{ .labels.job | trimPrefix "prom-" }}`:                  "node",
+		`{{ .labels.job | trimSuffix "-node" | escape }}`:         "prom",
+		`{{ .labels.owner | trimPrefix "nope" | lower }}`:         "team-x",
+		`{{ range split .labels.job "-" }}{{ upper . }}{{ end }}`: "PROMNODE",
+	} {
+		parsed, err := template.New("").Funcs(TmplFuncMap).Parse(tmpl)
+		if err != nil {
+			t.Fatalf("%s: %s", tmpl, err)
+		}
+		var out bytes.Buffer
+		if err := parsed.Execute(&out, data); err != nil {
+			t.Fatalf("%s: %s", tmpl, err)
+		}
+		if out.String() != expected {
+			t.Errorf("%s: expected %s, got %s", tmpl, expected, out.String())
+		}
+	}
+}
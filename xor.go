@@ -0,0 +1,139 @@
+// Copyright 2018 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"math/bits"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// bitWriter appends bits to a byte slice, most significant bit first.
+type bitWriter struct {
+	b []byte
+	// free is the number of bits left in the last byte of b.
+	free uint
+}
+
+func (w *bitWriter) writeBit(bit bool) {
+	if w.free == 0 {
+		w.b = append(w.b, 0)
+		w.free = 8
+	}
+	w.free--
+	if bit {
+		w.b[len(w.b)-1] |= 1 << w.free
+	}
+}
+
+// writeBits writes the nbits least significant bits of u.
+func (w *bitWriter) writeBits(u uint64, nbits int) {
+	for nbits > 0 {
+		nbits--
+		w.writeBit(u>>uint(nbits)&1 == 1)
+	}
+}
+
+// writeBytes writes the bytes of b, whatever the alignment.
+func (w *bitWriter) writeBytes(b []byte) {
+	for _, c := range b {
+		w.writeBits(uint64(c), 8)
+	}
+}
+
+// encodeXORChunk encodes samples in a chunk of the Prometheus TSDB XOR
+// encoding: the number of samples, then the timestamps as delta of deltas
+// and the values XORed with the previous ones (Gorilla compression).
+func encodeXORChunk(samples []*prompb.Sample) []byte {
+	w := &bitWriter{b: make([]byte, 2, 2+len(samples)*2)}
+	binary.BigEndian.PutUint16(w.b, uint16(len(samples)))
+
+	var varint [binary.MaxVarintLen64]byte
+	var t, tDelta int64
+	var v float64
+	// leading is 0xff until a value delta was written with its leading and
+	// trailing zeros.
+	var leading, trailing uint8 = 0xff, 0
+
+	writeValue := func(value float64) {
+		delta := math.Float64bits(value) ^ math.Float64bits(v)
+		if delta == 0 {
+			w.writeBit(false)
+			return
+		}
+		w.writeBit(true)
+
+		l := uint8(bits.LeadingZeros64(delta))
+		tr := uint8(bits.TrailingZeros64(delta))
+		// Leading zeros are written on 5 bits.
+		if l >= 32 {
+			l = 31
+		}
+		if leading != 0xff && l >= leading && tr >= trailing {
+			// The significant bits fit in those of the previous delta.
+			w.writeBit(false)
+			w.writeBits(delta>>trailing, 64-int(leading)-int(trailing))
+			return
+		}
+		leading, trailing = l, tr
+		w.writeBit(true)
+		w.writeBits(uint64(l), 5)
+		// 64 significant bits are written as 0.
+		sigbits := 64 - l - tr
+		w.writeBits(uint64(sigbits), 6)
+		w.writeBits(delta>>tr, int(sigbits))
+	}
+
+	for i, s := range samples {
+		switch i {
+		case 0:
+			w.writeBytes(varint[:binary.PutVarint(varint[:], s.Timestamp)])
+			w.writeBits(math.Float64bits(s.Value), 64)
+		case 1:
+			tDelta = s.Timestamp - t
+			w.writeBytes(varint[:binary.PutUvarint(varint[:], uint64(tDelta))])
+			writeValue(s.Value)
+		default:
+			delta := s.Timestamp - t
+			dod := delta - tDelta
+			switch {
+			case dod == 0:
+				w.writeBit(false)
+			case bitRange(dod, 14):
+				w.writeBits(0x02, 2)
+				w.writeBits(uint64(dod), 14)
+			case bitRange(dod, 17):
+				w.writeBits(0x06, 3)
+				w.writeBits(uint64(dod), 17)
+			case bitRange(dod, 20):
+				w.writeBits(0x0e, 4)
+				w.writeBits(uint64(dod), 20)
+			default:
+				w.writeBits(0x0f, 4)
+				w.writeBits(uint64(dod), 64)
+			}
+			tDelta = delta
+			writeValue(s.Value)
+		}
+		t, v = s.Timestamp, s.Value
+	}
+	return w.b
+}
+
+// bitRange tells whether x fits in nbits bits, as encoded by encodeXORChunk.
+func bitRange(x int64, nbits uint) bool {
+	return -((1<<(nbits-1))-1) <= x && x <= 1<<(nbits-1)
+}